@@ -133,9 +133,17 @@ func (g *noOpGauge) Update(v float64) {
 
 }
 
+type noOpHistogram struct {
+}
+
+func (h *noOpHistogram) RecordDuration(v time.Duration) {
+
+}
+
 type noOpScope struct {
-	counter *noOpCounter
-	gauge   *noOpGauge
+	counter   *noOpCounter
+	gauge     *noOpGauge
+	histogram *noOpHistogram
 }
 
 func (s *noOpScope) Counter(name string) Counter {
@@ -146,6 +154,10 @@ func (s *noOpScope) Gauge(name string) Gauge {
 	return s.gauge
 }
 
+func (s *noOpScope) Histogram(name string) Histogram {
+	return s.histogram
+}
+
 func (s *noOpScope) Tagged(tags map[string]string) Scope {
 	return s
 }
@@ -164,8 +176,9 @@ func (s *noOpScope) Start() error {
 
 func newNoOpScope() Scope {
 	return &noOpScope{
-		counter: &noOpCounter{},
-		gauge:   &noOpGauge{},
+		counter:   &noOpCounter{},
+		gauge:     &noOpGauge{},
+		histogram: &noOpHistogram{},
 	}
 }
 
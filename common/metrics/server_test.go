@@ -187,6 +187,7 @@ func TestNoOpScopeMetrics(t *testing.T) {
 	subScope := s.SubScope("test")
 	subScope.Counter("foo").Inc(2)
 	subScope.Gauge("bar").Update(1.33)
+	subScope.Histogram("baz").RecordDuration(time.Second)
 	tagSubScope := subScope.Tagged(map[string]string{"env": "test"})
 	tagSubScope.Counter("foo").Inc(2)
 	tagSubScope.Gauge("bar").Update(1.33)
@@ -6,7 +6,10 @@ SPDX-License-Identifier: Apache-2.0
 
 package metrics
 
-import "io"
+import (
+	"io"
+	"time"
+)
 
 // Counter is the interface for emitting Counter type metrics.
 type Counter interface {
@@ -20,6 +23,12 @@ type Gauge interface {
 	Update(value float64)
 }
 
+// Histogram is the interface for emitting Histogram metrics of durations.
+type Histogram interface {
+	// RecordDuration records the occurrence of a duration.
+	RecordDuration(value time.Duration)
+}
+
 // Scope is a namespace wrapper around a stats Reporter, ensuring that
 // all emitted values have a given prefix or set of tags.
 type Scope interface {
@@ -30,6 +39,9 @@ type Scope interface {
 	// Gauge returns the Gauge object corresponding to the name.
 	Gauge(name string) Gauge
 
+	// Histogram returns the Histogram object corresponding to the name.
+	Histogram(name string) Histogram
+
 	// Tagged returns a new child Scope with the given tags and current tags.
 	Tagged(tags map[string]string) Scope
 
@@ -0,0 +1,77 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package chaincode
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// CC2CCBudget bounds the chaincode-to-chaincode invocations performed
+// while executing a single proposal
+type CC2CCBudget struct {
+	maxDepth      int
+	maxChaincodes int
+
+	sync.Mutex
+	invoked map[string]struct{}
+}
+
+// cc2ccInvocation is the budget of a proposal along with the depth of the
+// chaincode invocation currently executing, the one invoked by the
+// proposal itself having depth 0
+type cc2ccInvocation struct {
+	budget *CC2CCBudget
+	depth  int
+}
+
+// WithCC2CCBudget attaches to the context a budget allowing cc2cc
+// invocations to nest at most maxDepth deep and to reach at most
+// maxChaincodes distinct chaincodes. A non-positive max is no limit.
+func WithCC2CCBudget(ctxt context.Context, maxDepth int, maxChaincodes int) context.Context {
+	budget := &CC2CCBudget{
+		maxDepth:      maxDepth,
+		maxChaincodes: maxChaincodes,
+		invoked:       make(map[string]struct{}),
+	}
+	return context.WithValue(ctxt, CC2CCBudgetKey, &cc2ccInvocation{budget: budget})
+}
+
+func getCC2CCInvocation(context context.Context) *cc2ccInvocation {
+	if invocation, ok := context.Value(CC2CCBudgetKey).(*cc2ccInvocation); ok {
+		return invocation
+	}
+	return nil
+}
+
+// invoke charges the budget with the cc2cc invocation of the chaincode
+// instance from the current invocation, and returns the invocation to
+// attach to the context of the called chaincode
+func (inv *cc2ccInvocation) invoke(calledCC string) (*cc2ccInvocation, error) {
+	if inv == nil {
+		return nil, nil
+	}
+
+	b := inv.budget
+	depth := inv.depth + 1
+	if b.maxDepth > 0 && depth > b.maxDepth {
+		return nil, errors.Errorf("cc2cc invocation of %s exceeds the maximum invocation depth of %d", calledCC, b.maxDepth)
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.invoked[calledCC]; !ok {
+		if b.maxChaincodes > 0 && len(b.invoked) >= b.maxChaincodes {
+			return nil, errors.Errorf("cc2cc invocation of %s exceeds the maximum of %d distinct chaincodes invoked by a proposal", calledCC, b.maxChaincodes)
+		}
+		b.invoked[calledCC] = struct{}{}
+	}
+
+	return &cc2ccInvocation{budget: b, depth: depth}, nil
+}
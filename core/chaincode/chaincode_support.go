@@ -58,6 +58,9 @@ const (
 	//HistoryQueryExecutorKey is used to attach ledger history query executor context
 	HistoryQueryExecutorKey key = "historyqueryexecutorkey"
 
+	//CC2CCBudgetKey is used to attach the cc2cc invocation budget of a proposal
+	CC2CCBudgetKey key = "cc2ccbudgetkey"
+
 	// Mutual TLS auth client key and cert paths in the chaincode container
 	TLSClientKeyPath  string = "/etc/hyperledger/fabric/client.key"
 	TLSClientCertPath string = "/etc/hyperledger/fabric/client.crt"
@@ -126,6 +129,15 @@ func (chaincodeSupport *ChaincodeSupport) chaincodeHasBeenLaunched(chaincode str
 	return chrte, hasbeenlaunched
 }
 
+// IsRunning returns whether the chaincode of the canonical name is running,
+// its handler registered
+func (chaincodeSupport *ChaincodeSupport) IsRunning(canName string) bool {
+	chaincodeSupport.runningChaincodes.RLock()
+	defer chaincodeSupport.runningChaincodes.RUnlock()
+	chrte, ok := chaincodeSupport.chaincodeHasBeenLaunched(canName)
+	return ok && chrte.handler != nil && chrte.handler.registered
+}
+
 //call this under lock
 func (chaincodeSupport *ChaincodeSupport) launchStarted(chaincode string) bool {
 	if _, launchStarted := chaincodeSupport.runningChaincodes.launchStarted[chaincode]; launchStarted {
@@ -821,6 +833,9 @@ func (chaincodeSupport *ChaincodeSupport) Execute(ctxt context.Context, cccid *c
 		//are typically treated as error
 	case <-time.After(timeout):
 		err = errors.New("timeout expired while executing transaction")
+	case <-ctxt.Done():
+		// the caller gave up on the transaction
+		err = errors.Wrap(ctxt.Err(), "transaction execution aborted")
 	}
 
 	//our responsibility to delete transaction context if sendExecuteMessage succeeded
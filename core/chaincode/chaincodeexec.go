@@ -56,7 +56,11 @@ func GetCDS(ctxt context.Context, txid string, signedProp *pb.SignedProposal, pr
 }
 
 // GetChaincodeDefinition returns resourcesconfig.ChaincodeDefinition for the chaincode with the supplied name
+// It gives up once ctxt is done, the execution of lscc included.
 func GetChaincodeDefinition(ctxt context.Context, txid string, signedProp *pb.SignedProposal, prop *pb.Proposal, chainID string, chaincodeID string) (resourcesconfig.ChaincodeDefinition, error) {
+	if err := ctxt.Err(); err != nil {
+		return nil, errors.Wrap(err, "chaincode definition lookup aborted")
+	}
 	version := util.GetSysCCVersion()
 	cccid := ccprovider.NewCCContext(chainID, "lscc", version, txid, true, signedProp, prop)
 	res, _, err := ExecuteChaincode(ctxt, cccid, [][]byte{[]byte("getccdata"), []byte(chainID), []byte(chaincodeID)})
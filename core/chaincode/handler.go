@@ -50,6 +50,9 @@ type transactionContext struct {
 
 	txsimulator          ledger.TxSimulator
 	historyQueryExecutor ledger.HistoryQueryExecutor
+
+	// cc2cc bounds the cc2cc invocations of the transaction, if set
+	cc2cc *cc2ccInvocation
 }
 
 type nextStateInfo struct {
@@ -184,6 +187,7 @@ func (handler *Handler) createTxContext(ctxt context.Context, chainID string, tx
 	handler.txCtxs[txCtxID] = txctx
 	txctx.txsimulator = getTxSimulator(ctxt)
 	txctx.historyQueryExecutor = getHistoryQueryExecutor(ctxt)
+	txctx.cc2cc = getCC2CCInvocation(ctxt)
 
 	return txctx, nil
 }
@@ -1108,6 +1112,13 @@ func (handler *Handler) handleGetHistoryForKey(msg *pb.ChaincodeMessage) {
 		}
 		chaincodeID := handler.getCCRootName()
 
+		// queries processed without a history query executor cannot query
+		// the history of keys
+		if txContext.historyQueryExecutor == nil {
+			errHandler([]byte("history queries are not available to this transaction"), nil, "[%s]No history query executor for GetHistoryForKey. Sending %s", shorttxid(msg.Txid), pb.ChaincodeMessage_ERROR)
+			return
+		}
+
 		historyIter, err := txContext.historyQueryExecutor.GetHistoryForKey(chaincodeID, getHistoryForKey.Key)
 		if err != nil {
 			errHandler([]byte(err.Error()), nil, "Failed to get ledger history iterator. Sending %s", pb.ChaincodeMessage_ERROR)
@@ -1237,6 +1248,12 @@ func (handler *Handler) enterBusyState(e *fsm.Event, state string) {
 				return
 			}
 
+			cc2cc, err := txContext.cc2cc.invoke(calledCcIns.ChaincodeName + "/" + calledCcIns.ChainID)
+			if err != nil {
+				errHandler([]byte(err.Error()), "[%s] C-call-C %s on channel %s rejected: [%s]", shorttxid(msg.Txid), calledCcIns.ChaincodeName, calledCcIns.ChainID, err)
+				return
+			}
+
 			// Set up a new context for the called chaincode if on a different channel
 			// We grab the called channel's ledger simulator to hold the new state
 			ctxt := context.Background()
@@ -1261,6 +1278,9 @@ func (handler *Handler) enterBusyState(e *fsm.Event, state string) {
 			}
 			ctxt = context.WithValue(ctxt, TXSimulatorKey, txsim)
 			ctxt = context.WithValue(ctxt, HistoryQueryExecutorKey, historyQueryExecutor)
+			if cc2cc != nil {
+				ctxt = context.WithValue(ctxt, CC2CCBudgetKey, cc2cc)
+			}
 
 			chaincodeLogger.Debugf("[%s] calling lscc to get chaincode data for %s on channel %s",
 				shorttxid(msg.Txid), calledCcIns.ChaincodeName, calledCcIns.ChainID)
@@ -0,0 +1,101 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hyperledger/fabric/core/peer"
+)
+
+// aclCacheSweepSize is the number of decisions cached beyond which the
+// expired ones are dropped as new ones are cached
+const aclCacheSweepSize = 10000
+
+type aclKey struct {
+	channel string
+	creator string
+}
+
+// aclDecision records that a creator was allowed to propose on a channel,
+// under the channel config of the given sequence
+type aclDecision struct {
+	sequence uint64
+	expires  time.Time
+}
+
+// aclCache keeps the creators the ACL of a channel allowed to propose for
+// ttl, so that a burst of proposals from the same creator evaluates the
+// policy once. Only successful checks are cached, and a decision is only
+// reused under the channel config it was made with: any config update,
+// such as a policy change, invalidates the decisions of the channel.
+type aclCache struct {
+	ttl time.Duration
+
+	sync.Mutex
+	decisions map[aclKey]aclDecision
+}
+
+// newACLCache returns a cache keeping decisions for ttl, or nil if ttl is
+// not positive; a nil cache never hits
+func newACLCache(ttl time.Duration) *aclCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &aclCache{ttl: ttl, decisions: make(map[aclKey]aclDecision)}
+}
+
+// allowed returns whether the creator was allowed to propose on the channel
+// less than ttl ago, under the config of the given sequence
+func (c *aclCache) allowed(channel string, creator []byte, sequence uint64, now time.Time) bool {
+	if c == nil {
+		return false
+	}
+
+	key := aclKey{channel: channel, creator: string(creator)}
+	c.Lock()
+	defer c.Unlock()
+	decision, ok := c.decisions[key]
+	if !ok {
+		return false
+	}
+	if decision.sequence != sequence || !now.Before(decision.expires) {
+		delete(c.decisions, key)
+		return false
+	}
+	return true
+}
+
+// allow records that the creator was allowed to propose on the channel
+// under the config of the given sequence
+func (c *aclCache) allow(channel string, creator []byte, sequence uint64, now time.Time) {
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if len(c.decisions) >= aclCacheSweepSize {
+		for key, decision := range c.decisions {
+			if !now.Before(decision.expires) {
+				delete(c.decisions, key)
+			}
+		}
+	}
+	c.decisions[aclKey{channel: channel, creator: string(creator)}] = aclDecision{sequence: sequence, expires: now.Add(c.ttl)}
+}
+
+// configSequence returns the sequence of the current config of the channel,
+// and false if the channel does not exist
+func configSequence(channel string) (uint64, bool) {
+	config := peer.GetChannelConfig(channel)
+	if config == nil || config.ConfigtxValidator() == nil {
+		return 0, false
+	}
+	return config.ConfigtxValidator().Sequence(), true
+}
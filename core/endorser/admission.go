@@ -0,0 +1,53 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"time"
+
+	syscc "github.com/hyperledger/fabric/core/scc"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// admit admits the signed proposal to an entry point of the Endorser other
+// than ProcessProposal, which admits its proposals itself: the proposal is
+// rejected if the Endorser is stopped, if it is larger than MaxProposalSize
+// or if it exceeds the rate limit of its channel, and it then waits for a
+// slot among the proposals simulated concurrently. The returned function
+// must be called once the proposal is processed.
+func (e *Endorser) admit(ctx context.Context, signedProp *pb.SignedProposal) (func(), error) {
+	processed, err := e.proposalsInFlight.enter()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = e.checkProposalSize(signedProp); err != nil {
+		processed()
+		return nil, err
+	}
+
+	// proposals to system chaincodes are never rate limited
+	chainID, ccName := proposalTarget(signedProp)
+	if !syscc.IsSysCC(ccName) {
+		if retryAfter := e.rates.take(chainID, time.Now()); retryAfter > 0 {
+			processed()
+			return nil, errors.Errorf("proposal rate limit of channel %s exceeded, retry after %s", chainID, retryAfter)
+		}
+	}
+
+	release, err := e.proposals.acquire(ctx, ccName)
+	if err != nil {
+		processed()
+		return nil, err
+	}
+	return func() {
+		release()
+		processed()
+	}, nil
+}
@@ -0,0 +1,197 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"sync"
+
+	"github.com/hyperledger/fabric/core/ledger"
+	"github.com/hyperledger/fabric/protos/ledger/rwset"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	putils "github.com/hyperledger/fabric/protos/utils"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// BatchResult is the outcome of the simulation of a proposal of a batch
+type BatchResult struct {
+	// Response is the response of the chaincode
+	Response *pb.Response
+	// SimulationResults are the public simulation results
+	SimulationResults []byte
+	// Err is the error the simulation failed with, if any
+	Err error
+}
+
+// SimulateBatch simulates the signed proposals without endorsing them and
+// returns their results in the order of the proposals. Every proposal is
+// simulated on a simulator of its own, so that up to BatchParallelism of
+// them are simulated concurrently; the failure of one does not affect the
+// others.
+func (e *Endorser) SimulateBatch(ctx context.Context, signedProps []*pb.SignedProposal) []*BatchResult {
+	parallelism := e.config.BatchParallelism
+	if parallelism <= 0 {
+		parallelism = 1
+	}
+
+	results := make([]*BatchResult, len(signedProps))
+	slots := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for i, signedProp := range signedProps {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, signedProp *pb.SignedProposal) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			res, simResult, _, err := e.simulateWithoutEndorsement(ctx, signedProp)
+			results[i] = &BatchResult{Response: res, SimulationResults: simResult, Err: err}
+		}(i, signedProp)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// errBatchQueryWrite is returned to the chaincode of a read-only proposal
+// of a batch that attempts to write
+var errBatchQueryWrite = errors.New("read-only proposal of a batch attempted to write")
+
+// batchQuerySimulator is the TxSimulator a read-only proposal of a batch is
+// simulated on. The proposal cannot write, and its simulation results are
+// empty: it is the answer to a query, not a transaction. Every proposal has
+// a simulator of its own, released once it is processed, so that the batch
+// never holds the ledger while a block is being committed.
+type batchQuerySimulator struct {
+	ledger.TxSimulator
+}
+
+// SetState refuses to write
+func (s *batchQuerySimulator) SetState(namespace string, key string, value []byte) error {
+	return errBatchQueryWrite
+}
+
+// DeleteState refuses to write
+func (s *batchQuerySimulator) DeleteState(namespace string, key string) error {
+	return errBatchQueryWrite
+}
+
+// SetStateMultipleKeys refuses to write
+func (s *batchQuerySimulator) SetStateMultipleKeys(namespace string, kvs map[string][]byte) error {
+	return errBatchQueryWrite
+}
+
+// ExecuteUpdate refuses to write
+func (s *batchQuerySimulator) ExecuteUpdate(query string) error {
+	return errBatchQueryWrite
+}
+
+// SetPrivateData refuses to write
+func (s *batchQuerySimulator) SetPrivateData(namespace, collection, key string, value []byte) error {
+	return errBatchQueryWrite
+}
+
+// SetPrivateDataMultipleKeys refuses to write
+func (s *batchQuerySimulator) SetPrivateDataMultipleKeys(namespace, collection string, kvs map[string][]byte) error {
+	return errBatchQueryWrite
+}
+
+// DeletePrivateData refuses to write
+func (s *batchQuerySimulator) DeletePrivateData(namespace, collection, key string) error {
+	return errBatchQueryWrite
+}
+
+// GetTxSimulationResults returns empty results
+func (s *batchQuerySimulator) GetTxSimulationResults() (*ledger.TxSimulationResults, error) {
+	return &ledger.TxSimulationResults{
+		PubSimulationResults: &rwset.TxReadWriteSet{DataModel: rwset.TxReadWriteSet_KV},
+	}, nil
+}
+
+// readOnlyChannel returns the channel of the signed proposal if it invokes a
+// function configured as read-only, and whether it does
+func (e *Endorser) readOnlyChannel(signedProp *pb.SignedProposal) (string, bool) {
+	chainID, ccName := proposalTarget(signedProp)
+	if chainID == "" || ccName == "" {
+		return "", false
+	}
+	prop, err := putils.GetProposal(signedProp.GetProposalBytes())
+	if err != nil {
+		return "", false
+	}
+	cis, err := putils.GetChaincodeInvocationSpec(prop)
+	if err != nil {
+		return "", false
+	}
+	return chainID, e.isReadOnly(ccName, cis.GetChaincodeSpec().GetInput().GetArgs())
+}
+
+// isReadOnlyProposal returns whether the signed proposal invokes a function
+// configured as read-only
+func (e *Endorser) isReadOnlyProposal(signedProp *pb.SignedProposal) bool {
+	_, readOnly := e.readOnlyChannel(signedProp)
+	return readOnly
+}
+
+// ProcessProposals processes the signed proposals of a batch in order and
+// returns their responses in the same order. The response of each proposal
+// is independent of the others: a proposal that fails gets the failure
+// response ProcessProposal would have returned, and the others are still
+// processed.
+//
+// The proposals invoking functions configured as ReadOnlyFunctions are not
+// allowed to write, an attempt fails the proposal, and their responses
+// carry empty simulation results: they are answers to queries, not
+// transactions to submit for ordering. Every proposal, read-only or not, is
+// simulated on a simulator of its own against the committed state, exactly
+// as by ProcessProposal: the proposals of a batch do not share a snapshot
+// of the ledger, a block committed while the batch is processed is seen by
+// the proposals after it. Nor does a proposal see the writes of the
+// proposals before it in the batch; proposals of a batch that write the
+// keys others read conflict, and all but the first of them to be committed
+// are invalidated.
+//
+// An error is only returned for the batch as a whole, when the Endorser is
+// stopped or the context is done before all its proposals were processed.
+func (e *Endorser) ProcessProposals(ctx context.Context, signedProps []*pb.SignedProposal) ([]*pb.ProposalResponse, error) {
+	// every proposal is admitted by ProcessProposal; the batch only keeps
+	// Stop waiting until it is processed
+	processed, err := e.proposalsInFlight.enter()
+	if err != nil {
+		return nil, err
+	}
+	defer processed()
+
+	querying := *e
+	querying.newTxSimulator = func(ledgername string, txid string) (ledger.TxSimulator, error) {
+		txsim, err := e.getTxSimulator(ledgername, txid)
+		if err != nil {
+			return nil, err
+		}
+		return &batchQuerySimulator{TxSimulator: txsim}, nil
+	}
+
+	responses := make([]*pb.ProposalResponse, len(signedProps))
+	for i, signedProp := range signedProps {
+		if err := ctx.Err(); err != nil {
+			return nil, errors.Wrapf(err, "batch abandoned after %d of %d proposals", i, len(signedProps))
+		}
+
+		processor := e
+		if _, ok := e.readOnlyChannel(signedProp); ok {
+			processor = &querying
+		}
+
+		resp, err := processor.ProcessProposal(ctx, signedProp)
+		if resp == nil && err != nil {
+			resp = failureResponse(categorize(err), err)
+		}
+		responses[i] = resp
+	}
+	return responses, nil
+}
@@ -0,0 +1,170 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+
+	"github.com/hyperledger/fabric/core/ledger"
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/rwsetutil"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	putils "github.com/hyperledger/fabric/protos/utils"
+	"github.com/pkg/errors"
+)
+
+// errStaleSimulation is returned by simulateProposal when the cached
+// simulation it replayed is stale. The proposal is to be simulated again on
+// a new simulator, once the one the replay read from is released.
+var errStaleSimulation = errors.New("cached simulation is stale")
+
+// endorsementCache keeps the outcome of the simulations of read-only
+// proposals, so that a proposal with the same input is endorsed without
+// running the chaincode again as long as none of the keys it read has been
+// updated since. A cached simulation is replayed by reading the same keys
+// again, which records their current version in the simulation results:
+// the cached results are used only if they are identical. Only the
+// simulation is cached: the endorsement covers the proposal itself, so it
+// is always signed anew.
+type endorsementCache struct {
+	size int
+
+	sync.Mutex
+	entries map[string]*cachedSimulation
+	// order is the keys of the entries, oldest first
+	order []string
+}
+
+// cachedSimulation is the outcome of the simulation of a read-only proposal,
+// along with the keys it read
+type cachedSimulation struct {
+	res       *pb.Response
+	simResult []byte
+	reads     []cachedRead
+}
+
+type cachedRead struct {
+	namespace string
+	key       string
+}
+
+// newEndorsementCache returns a cache of size entries, or nil if size is not
+// positive
+func newEndorsementCache(size int) *endorsementCache {
+	if size <= 0 {
+		return nil
+	}
+	return &endorsementCache{
+		size:    size,
+		entries: make(map[string]*cachedSimulation),
+	}
+}
+
+// endorsementCacheKey identifies the proposals invoking the same version of
+// a chaincode with the same input, transient data included, on behalf of the
+// same creator: the response of the chaincode may depend on any of them
+func endorsementCacheKey(chainID string, ccName string, version string, prop *pb.Proposal) (string, error) {
+	hdr, err := putils.GetHeader(prop.Header)
+	if err != nil {
+		return "", err
+	}
+	shdr, err := putils.GetSignatureHeader(hdr.SignatureHeader)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%d:", len(shdr.Creator))
+	h.Write(shdr.Creator)
+	h.Write(prop.Payload)
+	return fmt.Sprintf("%s/%s:%s/%x", chainID, ccName, version, h.Sum(nil)), nil
+}
+
+// store caches the outcome of a simulation, unless its results do more than
+// reading individual public keys: writes, range queries and private data
+// cannot be checked for staleness by reading the keys again
+func (c *endorsementCache) store(key string, res *pb.Response, simResult []byte) {
+	if c == nil {
+		return
+	}
+
+	txRWSet := &rwsetutil.TxRwSet{}
+	if err := txRWSet.FromProtoBytes(simResult); err != nil {
+		endorserLogger.Debugf("not caching the simulation of %s: %s", key, err)
+		return
+	}
+	entry := &cachedSimulation{res: res, simResult: simResult}
+	for _, nsRWSet := range txRWSet.NsRwSets {
+		kvRWSet := nsRWSet.KvRwSet
+		if len(nsRWSet.CollHashedRwSets) > 0 || kvRWSet == nil || len(kvRWSet.Writes) > 0 || len(kvRWSet.RangeQueriesInfo) > 0 {
+			return
+		}
+		for _, read := range kvRWSet.Reads {
+			entry.reads = append(entry.reads, cachedRead{namespace: nsRWSet.NameSpace, key: read.Key})
+		}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.entries[key]; !ok {
+		if len(c.order) == c.size {
+			delete(c.entries, c.order[0])
+			c.order = c.order[1:]
+		}
+		c.order = append(c.order, key)
+	}
+	c.entries[key] = entry
+}
+
+// get returns the cached simulation of the proposal identified by key, or
+// nil if there is none
+func (c *endorsementCache) get(key string) *cachedSimulation {
+	if c == nil {
+		return nil
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	return c.entries[key]
+}
+
+// replay reads the keys read by the cached simulation with txsim, leaving it
+// with the results of the simulation if none of the keys has been updated
+// since, and returns the cached response of the chaincode
+func (s *cachedSimulation) replay(txsim ledger.TxSimulator) (*pb.Response, error) {
+	for _, read := range s.reads {
+		if _, err := txsim.GetState(read.namespace, read.key); err != nil {
+			return nil, errors.WithMessage(err, "failed to replay cached simulation")
+		}
+	}
+	return s.res, nil
+}
+
+// isStale returns whether the results of replaying the cached simulation
+// differ from the cached ones, which is the case as soon as the version of
+// one of the keys read has advanced
+func (s *cachedSimulation) isStale(simResult []byte) bool {
+	return !bytes.Equal(simResult, s.simResult)
+}
+
+// evict removes the entry of key, unless it has been replaced in the meantime
+func (c *endorsementCache) evict(key string, entry *cachedSimulation) {
+	c.Lock()
+	defer c.Unlock()
+	if c.entries[key] != entry {
+		return
+	}
+	delete(c.entries, key)
+	for i, k := range c.order {
+		if k == key {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+}
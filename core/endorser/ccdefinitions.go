@@ -0,0 +1,109 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/common/resourcesconfig"
+	"github.com/hyperledger/fabric/core/common/ccprovider"
+	"golang.org/x/net/context"
+)
+
+// definitionContextKey is the context key of the chaincode definition resolved
+// for the proposal being processed
+const definitionContextKey contextKey = "definition"
+
+// ChaincodeDefinitionFrom returns the definition of the chaincode invoked
+// by the proposal being processed, as resolved from lscc before the
+// chaincode is executed, so that the hooks receiving the context of the
+// execution can act on the version or the policies of the chaincode. It
+// returns nil for system chaincodes, which have no definition.
+func ChaincodeDefinitionFrom(ctx context.Context) resourcesconfig.ChaincodeDefinition {
+	cd, _ := ctx.Value(definitionContextKey).(resourcesconfig.ChaincodeDefinition)
+	return cd
+}
+
+// withChaincodeDefinition returns the context carrying the chaincode
+// definition, or ctx itself if there is none
+func withChaincodeDefinition(ctx context.Context, cd resourcesconfig.ChaincodeDefinition) context.Context {
+	if cd == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, definitionContextKey, cd)
+}
+
+type definitionKey struct {
+	channel   string
+	chaincode string
+}
+
+// cachedDefinition is a chaincode definition resolved by lscc, along with
+// the lscc state it was resolved from
+type cachedDefinition struct {
+	state      []byte
+	definition *ccprovider.ChaincodeData
+}
+
+// definitionCache keeps the chaincode definitions resolved by lscc so that
+// proposals are simulated without invoking lscc as long as the definition of
+// their chaincode is unchanged. A definition is only used when the lscc
+// state of the chaincode is identical to the one it was resolved from: the
+// state is read on every proposal anyway, as the read set of the proposal
+// must record the version of the definition it was simulated against.
+type definitionCache struct {
+	sync.RWMutex
+	definitions map[definitionKey]*cachedDefinition
+}
+
+func newDefinitionCache() *definitionCache {
+	return &definitionCache{definitions: make(map[definitionKey]*cachedDefinition)}
+}
+
+// get returns a copy of the definition of the chaincode resolved from the
+// lscc state, or nil if it has not been resolved yet
+func (c *definitionCache) get(chainID string, ccName string, state []byte) resourcesconfig.ChaincodeDefinition {
+	if c == nil {
+		return nil
+	}
+
+	c.RLock()
+	cached, ok := c.definitions[definitionKey{channel: chainID, chaincode: ccName}]
+	c.RUnlock()
+	if !ok || !bytes.Equal(cached.state, state) {
+		return nil
+	}
+	return proto.Clone(cached.definition).(*ccprovider.ChaincodeData)
+}
+
+// put caches the definition of the chaincode resolved from the lscc state
+func (c *definitionCache) put(chainID string, ccName string, state []byte, definition resourcesconfig.ChaincodeDefinition) {
+	cd, ok := definition.(*ccprovider.ChaincodeData)
+	if c == nil || !ok || state == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.definitions[definitionKey{channel: chainID, chaincode: ccName}] = &cachedDefinition{
+		state:      state,
+		definition: proto.Clone(cd).(*ccprovider.ChaincodeData),
+	}
+}
+
+// invalidate drops the definition of a chaincode being deployed or upgraded
+func (c *definitionCache) invalidate(chainID string, ccName string) {
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	delete(c.definitions, definitionKey{channel: chainID, chaincode: ccName})
+}
@@ -0,0 +1,148 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hyperledger/fabric/core/common/ccprovider"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/pkg/errors"
+)
+
+// defaultCircuitBreakerCooldown is how long an open circuit rejects the
+// proposals to its chaincode when no cooldown is configured
+const defaultCircuitBreakerCooldown = 30 * time.Second
+
+// errCircuitOpen is returned for the proposals to a chaincode whose circuit
+// is open
+var errCircuitOpen = errors.New("chaincode circuit is open")
+
+// circuit tracks the failures of the executions of a chaincode
+type circuit struct {
+	// failures is the number of consecutive failures, the first of which
+	// happened at firstFailure
+	failures     int
+	firstFailure time.Time
+	// openUntil is when the circuit lets a trial execution through, or the
+	// zero time if the circuit is closed
+	openUntil time.Time
+	// trial tells whether the trial execution is in progress
+	trial bool
+}
+
+// circuitBreaker stops executing a chaincode for a cooldown period once it
+// failed too many times in a row, so that proposals to a chaincode whose
+// container is gone fail right away rather than after the execute timeout.
+// Once the cooldown is over, a single trial execution is let through: the
+// circuit is closed again if it succeeds, and opened for another cooldown
+// otherwise.
+type circuitBreaker struct {
+	maxFailures int
+	window      time.Duration
+	cooldown    time.Duration
+
+	sync.Mutex
+	circuits map[string]*circuit
+}
+
+// newCircuitBreaker returns a breaker opening the circuit of a chaincode
+// after maxFailures consecutive failures within the window, or nil (never
+// open) if maxFailures is not positive. A zero window counts the failures
+// however far apart they are.
+func newCircuitBreaker(maxFailures int, window time.Duration, cooldown time.Duration) *circuitBreaker {
+	if maxFailures <= 0 {
+		return nil
+	}
+	if cooldown <= 0 {
+		cooldown = defaultCircuitBreakerCooldown
+	}
+	return &circuitBreaker{
+		maxFailures: maxFailures,
+		window:      window,
+		cooldown:    cooldown,
+		circuits:    make(map[string]*circuit),
+	}
+}
+
+// allow returns an error if the chaincode with the given canonical name
+// must not be executed at the given time. Otherwise, the returned function
+// must be called once the execution is over, with whether it succeeded and
+// when it ended.
+func (b *circuitBreaker) allow(canName string, now time.Time) (func(succeeded bool, now time.Time), error) {
+	if b == nil {
+		return func(bool, time.Time) {}, nil
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	c, ok := b.circuits[canName]
+	if !ok {
+		c = &circuit{}
+		b.circuits[canName] = c
+	}
+	trial := false
+	if !c.openUntil.IsZero() {
+		if c.trial || now.Before(c.openUntil) {
+			return nil, errors.WithMessage(errCircuitOpen, "rejecting proposal to "+canName+" after repeated failures")
+		}
+		c.trial = true
+		trial = true
+	}
+
+	return func(succeeded bool, now time.Time) {
+		b.record(canName, c, trial, succeeded, now)
+	}, nil
+}
+
+// record records the outcome of an execution allowed through the circuit
+func (b *circuitBreaker) record(canName string, c *circuit, trial bool, succeeded bool, now time.Time) {
+	b.Lock()
+	defer b.Unlock()
+	if trial {
+		c.trial = false
+	}
+	if succeeded {
+		if trial || c.openUntil.IsZero() {
+			c.failures = 0
+			c.openUntil = time.Time{}
+		}
+		return
+	}
+
+	if trial {
+		c.openUntil = now.Add(b.cooldown)
+		return
+	}
+	if c.failures == 0 || (b.window > 0 && now.Sub(c.firstFailure) > b.window) {
+		c.failures = 0
+		c.firstFailure = now
+	}
+	c.failures++
+	if c.failures >= b.maxFailures && c.openUntil.IsZero() {
+		endorserLogger.Warningf("chaincode %s failed %d times in a row, rejecting its proposals for %s", canName, c.failures, b.cooldown)
+		c.openUntil = now.Add(b.cooldown)
+	}
+}
+
+// allowExecution checks the circuit of the chaincode of the context before
+// it is executed. System chaincodes run in process and are never broken.
+func (e *Endorser) allowExecution(cccid *ccprovider.CCContext) (func(succeeded bool, now time.Time), error) {
+	if cccid.Syscc {
+		return func(bool, time.Time) {}, nil
+	}
+	return e.breaker.allow(cccid.GetCanonicalName(), time.Now())
+}
+
+// circuitOpenResponse is returned to the client when the circuit of the
+// chaincode of its proposal is open; the proposal can be retried once the
+// cooldown is over.
+func circuitOpenResponse(err error) *pb.Response {
+	endorserLogger.Warningf("%s", err)
+	return &pb.Response{Status: 503, Message: err.Error()}
+}
@@ -0,0 +1,138 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/protos/ledger/rwset"
+	"github.com/hyperledger/fabric/protos/ledger/rwset/kvrwset"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// CollectionSigner is an identity endorsing the writes to a private data
+// collection; msp.SigningIdentity satisfies it
+type CollectionSigner interface {
+	// Serialize returns the serialized identity of the signer
+	Serialize() ([]byte, error)
+
+	// Sign signs the message
+	Sign(msg []byte) ([]byte, error)
+}
+
+// CollectionEndorsementMessage returns the message signed by the endorser of
+// the writes of a proposal response to a collection, ie
+// payload + namespace + collection + endorser
+func CollectionEndorsementMessage(payload []byte, namespace string, collection string, endorser []byte) []byte {
+	msg := make([]byte, 0, len(payload)+len(namespace)+len(collection)+len(endorser))
+	msg = append(msg, payload...)
+	msg = append(msg, namespace...)
+	msg = append(msg, collection...)
+	return append(msg, endorser...)
+}
+
+// endorseCollections adds to the proposal response the endorsement of every
+// collection written by the simulation results for which a signer is
+// configured
+func (e *Endorser) endorseCollections(pResp *pb.ProposalResponse, simRes []byte) error {
+	if len(e.config.CollectionSigners) == 0 || len(simRes) == 0 {
+		return nil
+	}
+
+	txRWSet := &rwset.TxReadWriteSet{}
+	if err := proto.Unmarshal(simRes, txRWSet); err != nil {
+		return errors.Wrap(err, "failed to unmarshal simulation results")
+	}
+
+	for _, nsRWSet := range txRWSet.NsRwset {
+		signers := e.config.CollectionSigners[nsRWSet.Namespace]
+		for _, collRWSet := range nsRWSet.CollectionHashedRwset {
+			signer, ok := signers[collRWSet.CollectionName]
+			if !ok {
+				continue
+			}
+
+			hashedRWSet := &kvrwset.HashedRWSet{}
+			if err := proto.Unmarshal(collRWSet.HashedRwset, hashedRWSet); err != nil {
+				return errors.Wrapf(err, "failed to unmarshal the hashed rwset of collection %s", collRWSet.CollectionName)
+			}
+			if len(hashedRWSet.HashedWrites) == 0 {
+				continue
+			}
+
+			endorsement, err := endorseCollection(signer, pResp.Payload, nsRWSet.Namespace, collRWSet.CollectionName)
+			if err != nil {
+				return errors.WithMessage(err, fmt.Sprintf("failed to endorse collection %s/%s", nsRWSet.Namespace, collRWSet.CollectionName))
+			}
+			pResp.CollectionEndorsements = append(pResp.CollectionEndorsements, &pb.CollectionEndorsement{
+				Namespace:   nsRWSet.Namespace,
+				Collection:  collRWSet.CollectionName,
+				Endorsement: endorsement,
+			})
+		}
+	}
+	return nil
+}
+
+func endorseCollection(signer CollectionSigner, payload []byte, namespace string, collection string) (*pb.Endorsement, error) {
+	endorser, err := signer.Serialize()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to serialize the signing identity")
+	}
+
+	signature, err := signer.Sign(CollectionEndorsementMessage(payload, namespace, collection, endorser))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to sign the proposal response")
+	}
+
+	return &pb.Endorsement{Endorser: endorser, Signature: signature}, nil
+}
+
+// PvtDataDistributionError is the failure of a proposal whose chaincode
+// executed successfully, but whose private data could not be distributed to
+// the other peers. The proposal can be submitted again.
+type PvtDataDistributionError struct {
+	ChannelID string
+	TxID      string
+	Err       error
+}
+
+func (e *PvtDataDistributionError) Error() string {
+	return fmt.Sprintf("failed to distribute the private data of transaction %s on channel %s: %s", e.TxID, e.ChannelID, e.Err)
+}
+
+// pvtDataDistributionFailedResponse is returned to the client when the
+// private data of its proposal could not be distributed
+func pvtDataDistributionFailedResponse(err error) *pb.ProposalResponse {
+	return &pb.ProposalResponse{Response: &pb.Response{Status: 503, Message: categorizedMessage(distributionError, err.Error())}}
+}
+
+// distribute distributes the private data written by a proposal, returning
+// the endpoints of the peers which acknowledged it if the distributor
+// reports them. Transient failures are retried as configured, the others
+// are reported as a PvtDataDistributionError.
+func (e *Endorser) distribute(ctx context.Context, chainID string, txid string, pvtData *rwset.TxPvtReadWriteSet) ([]string, error) {
+	var recipients []string
+	var err error
+	for attempt := 1; ; attempt++ {
+		if e.config.AckingPrivateDataDistributor != nil {
+			recipients, err = e.config.AckingPrivateDataDistributor(chainID, txid, pvtData)
+		} else {
+			err = e.distributePrivateData(chainID, txid, pvtData)
+		}
+		if err == nil || !e.retryDistribution(ctx, attempt, err) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, &PvtDataDistributionError{ChannelID: chainID, TxID: txid, Err: err}
+	}
+	return recipients, nil
+}
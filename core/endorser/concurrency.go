@@ -0,0 +1,70 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	syscc "github.com/hyperledger/fabric/core/scc"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"golang.org/x/sync/semaphore"
+)
+
+// proposalLimiter bounds the number of proposals simulated at the same time,
+// separately for the proposals to system chaincodes and the proposals to
+// application chaincodes, so that a spike of one kind cannot starve the
+// other
+type proposalLimiter struct {
+	system      *semaphore.Weighted
+	application *semaphore.Weighted
+}
+
+// newProposalLimiter returns a limiter allowing maxSystem concurrent system
+// chaincode proposals and maxApplication concurrent application chaincode
+// proposals, a non-positive max being no limit, or nil if neither is
+// limited
+func newProposalLimiter(maxSystem int, maxApplication int) *proposalLimiter {
+	if maxSystem <= 0 && maxApplication <= 0 {
+		return nil
+	}
+	l := &proposalLimiter{}
+	if maxSystem > 0 {
+		l.system = semaphore.NewWeighted(int64(maxSystem))
+	}
+	if maxApplication > 0 {
+		l.application = semaphore.NewWeighted(int64(maxApplication))
+	}
+	return l
+}
+
+// acquire waits for a slot to simulate a proposal to the chaincode until
+// ctx is done. The returned function gives the slot back.
+func (l *proposalLimiter) acquire(ctx context.Context, ccName string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	kind, sem := "application", l.application
+	if syscc.IsSysCC(ccName) {
+		kind, sem = "system", l.system
+	}
+	if sem == nil {
+		return func() {}, nil
+	}
+
+	if err := sem.Acquire(ctx, 1); err != nil {
+		return nil, errors.WithMessage(err, "too many concurrent "+kind+" chaincode proposals")
+	}
+	return func() { sem.Release(1) }, nil
+}
+
+// proposalsSaturatedResponse is returned to the client when its proposal
+// gave up waiting for a simulation slot; the proposal can be retried later.
+func proposalsSaturatedResponse(err error) *pb.ProposalResponse {
+	endorserLogger.Warningf("%s", err)
+	return &pb.ProposalResponse{Response: &pb.Response{Status: 503, Message: err.Error()}}
+}
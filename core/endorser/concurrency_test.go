@@ -0,0 +1,83 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/rwset"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestProposalLimiterSeparatesSystemAndApplication(t *testing.T) {
+	assert.Nil(t, newProposalLimiter(0, 0))
+
+	limiter := newProposalLimiter(1, 2)
+	acquireWithin := func(ccName string) (func(), error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		return limiter.acquire(ctx, ccName)
+	}
+
+	releaseSystem, err := acquireWithin("lscc")
+	assert.NoError(t, err)
+	releaseApp, err := acquireWithin("mycc")
+	assert.NoError(t, err)
+	_, err = acquireWithin("othercc")
+	assert.NoError(t, err)
+
+	// both kinds are saturated, independently of each other
+	_, err = acquireWithin("qscc")
+	assert.EqualError(t, err, "too many concurrent system chaincode proposals: context deadline exceeded")
+	_, err = acquireWithin("mycc")
+	assert.EqualError(t, err, "too many concurrent application chaincode proposals: context deadline exceeded")
+
+	releaseSystem()
+	_, err = acquireWithin("qscc")
+	assert.NoError(t, err)
+	releaseApp()
+	_, err = acquireWithin("mycc")
+	assert.NoError(t, err)
+
+	// an unlimited kind never waits
+	limiter = newProposalLimiter(1, 0)
+	for i := 0; i < 3; i++ {
+		_, err = limiter.acquire(context.Background(), "mycc")
+		assert.NoError(t, err)
+	}
+}
+
+func TestProposalsSaturated(t *testing.T) {
+	chainID := util.GetTestChainID()
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{MaxConcurrentApplicationProposals: 1}).(*Endorser)
+
+	release, err := e.proposals.acquire(context.Background(), testCCName)
+	assert.NoError(t, err)
+
+	_, signedProp, err := getTestCCProposal(chainID, "get", "saturatedkey")
+	assert.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	resp, err := e.ProcessProposal(ctx, signedProp)
+	assert.Error(t, err)
+	assert.Equal(t, int32(503), resp.Response.Status)
+
+	// the proposal goes through once the slot is given back
+	release()
+	resp, err = e.ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(shim.OK), resp.Response.Status)
+
+	// and gives it back in turn
+	release, err = e.proposals.acquire(context.Background(), testCCName)
+	assert.NoError(t, err)
+	release()
+}
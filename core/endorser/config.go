@@ -0,0 +1,313 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"time"
+
+	"github.com/hyperledger/fabric/common/metrics"
+	"github.com/hyperledger/fabric/core/handlers/library"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Config holds the optional settings of an Endorser. The zero value
+// preserves the default endorsement behavior.
+type Config struct {
+	// CorrelationIDs, when set, tags every failed proposal with a
+	// generated correlation ID that is returned to the client and
+	// logged alongside the failure, so that the two can be tied together.
+	CorrelationIDs bool
+
+	// MaxConcurrentLaunches bounds the number of chaincode containers
+	// the endorser launches at the same time. Zero means no limit.
+	MaxConcurrentLaunches int
+	// LaunchTimeout is how long a launch waits for a free slot before the
+	// proposal is rejected with a retryable 503. Zero means it waits
+	// until a slot frees up or the proposal is done.
+	LaunchTimeout time.Duration
+
+	// MaxConcurrentSystemProposals and MaxConcurrentApplicationProposals
+	// bound the number of proposals to system chaincodes and to
+	// application chaincodes simulated at the same time. A proposal
+	// waits for a free slot until its context is done, and is then
+	// rejected with a retryable 503. Zero means no limit.
+	MaxConcurrentSystemProposals      int
+	MaxConcurrentApplicationProposals int
+
+	// ProposalRateLimits maps channels to the rate limits of their
+	// proposals; DefaultProposalRateLimit applies to the channels not
+	// listed. Every channel has a bucket of its own. A proposal exceeding
+	// the limit is rejected with a 429 telling when to retry. Proposals to
+	// system chaincodes are never limited.
+	ProposalRateLimits       map[string]RateLimit
+	DefaultProposalRateLimit RateLimit
+
+	// MaxProposalSize bounds the bytes of a signed proposal, its signature
+	// included. Larger proposals are rejected before they are parsed.
+	// Zero means no limit.
+	MaxProposalSize int
+
+	// UpgradeObserved, when set, is called every time the endorser
+	// executes a chaincode upgrade. It is called during simulation, before
+	// the upgrade transaction is ordered and committed.
+	UpgradeObserved func(UpgradeEvent)
+
+	// TransientRetries is the number of times the simulation of a proposal
+	// is retried when it fails with a transient error. Zero disables the
+	// retries.
+	TransientRetries int
+	// TransientRetryBackoff is the delay before the first retry; it doubles
+	// with every subsequent one. Retries stop once the next one could not
+	// start before the deadline of the proposal.
+	TransientRetryBackoff time.Duration
+
+	// PvtDataDistributionRetries is the number of times the distribution
+	// of the private data of a proposal is retried when it fails with a
+	// transient error. Zero disables the retries.
+	PvtDataDistributionRetries int
+	// PvtDataDistributionRetryBackoff is the delay before the first retry
+	// of the distribution; it doubles with every subsequent one, within
+	// the deadline of the proposal like the simulation retries.
+	PvtDataDistributionRetryBackoff time.Duration
+
+	// ReadOnlyFunctions maps the names of chaincodes to their functions
+	// that are read-only queries; the chaincode events those functions
+	// emit are dropped from the proposal response. A chaincode mapped to
+	// no function is read-only altogether.
+	ReadOnlyFunctions map[string][]string
+
+	// LightweightQueries, when set, simulates the proposals invoking the
+	// ReadOnlyFunctions on a query executor, which does not track their
+	// reads, and endorses empty simulation results. The writes of such a
+	// function are refused, and fail the proposal.
+	LightweightQueries bool
+
+	// CollectionSigners maps the names of chaincodes to the signers of
+	// their private data collections. When a proposal writes to one of
+	// these collections, its response also carries an endorsement of the
+	// collection by the configured signer.
+	CollectionSigners map[string]map[string]CollectionSigner
+
+	// CheckDeterminism, when set, simulates every proposal twice on the
+	// same tx simulator and compares the responses, events and the keys
+	// read and written by both runs, logging a warning on mismatch. This
+	// doubles the cost of simulation and is meant for canary peers.
+	CheckDeterminism bool
+	// FailNonDeterministic additionally fails the proposals for which the
+	// determinism check finds a mismatch
+	FailNonDeterministic bool
+
+	// DeadLetterSink, when set, receives the proposals that failed because
+	// of an internal error, along with the failure. Writes happen in the
+	// background and never delay the response; chaincode errors, and
+	// proposals rejected as malformed or not allowed, are not captured.
+	DeadLetterSink DeadLetterSink
+
+	// MaxCC2CCDepth bounds how deep chaincode-to-chaincode invocations
+	// may nest within a proposal. Zero means no limit.
+	MaxCC2CCDepth int
+	// MaxCC2CCChaincodes bounds the number of distinct chaincodes a
+	// proposal may invoke through chaincode-to-chaincode invocations. Zero
+	// means no limit.
+	MaxCC2CCChaincodes int
+
+	// EpochKeys, when set, resolves the identity endorsing the proposals
+	// of the current epoch: the endorsement of the ESCC is replaced by one
+	// signed by that identity, and the response records the epoch.
+	EpochKeys EpochKeyProvider
+
+	// Tenants maps channels, then the names of their chaincodes, to the
+	// tenants owning them; the empty chaincode name maps every chaincode
+	// of the channel not listed. The tenant of a proposal prefixes the log
+	// lines about it and tags its metrics.
+	Tenants map[string]map[string]string
+
+	// Metrics, when set, is the scope the proposal metrics are reported
+	// to, tagged with the channel, chaincode and tenant of the proposal:
+	// the proposals received, succeeded and failed, the failures caused
+	// by the chaincode, and the durations of ProcessProposal and of the
+	// invocation of the chaincode
+	Metrics metrics.Scope
+
+	// DeprecatedVersions maps the names of chaincodes to their deprecated
+	// versions. Proposals invoking a deprecated version still succeed,
+	// with a warning in their response, and are counted in the
+	// deprecated_invocations metric.
+	DeprecatedVersions map[string][]string
+
+	// BatchParallelism bounds the number of proposals of a batch simulated
+	// concurrently by SimulateBatch. Zero simulates them one at a time.
+	BatchParallelism int
+
+	// EndorsementDelays maps the names of chaincodes to the delay applied
+	// before endorsing their proposals. Chaincodes not listed are endorsed
+	// right away.
+	EndorsementDelays map[string]EndorsementDelay
+
+	// AckingPrivateDataDistributor, when set, distributes the private data
+	// in place of the distributor of the Endorser. The endpoints of the
+	// peers which acknowledged the private data of a proposal are returned
+	// in its response.
+	AckingPrivateDataDistributor AckingPrivateDataDistributor
+
+	// EndorsementCacheSize is the number of simulations of read-only
+	// proposals kept to endorse the proposals with the same arguments
+	// without invoking the chaincode, for as long as the keys they read
+	// are not updated. Zero disables the cache.
+	EndorsementCacheSize int
+
+	// ResponseCacheSize is the number of responses to the proposals
+	// endorsed successfully kept by txid, so that a client retrying the
+	// same signed proposal, e.g. after a timeout, gets the same response
+	// back without the proposal being simulated again. The responses are
+	// kept for ResponseCacheTTL, 30s if zero, and no longer served once
+	// the transaction is committed. Zero disables the cache.
+	ResponseCacheSize int
+	ResponseCacheTTL  time.Duration
+
+	// TxIDFilterSize, when positive, keeps a bloom filter of the txids of
+	// the proposals recently received on every channel, so that the
+	// response cache is only searched for the txids it may have seen. The
+	// filter holds TxIDFilterSize txids per generation and keeps the
+	// current and the previous generations. The ledger is searched for
+	// duplicates of every txid regardless, the filter knowing nothing of
+	// the txids endorsed by other peers or received before a restart.
+	TxIDFilterSize int
+	// TxIDFilterRotation is how often the generations of the txid filter
+	// are rotated. Zero rotates them only when the current one is full.
+	TxIDFilterRotation time.Duration
+
+	// TxIDValidator, when set, enforces additional policies on the txids
+	// of the proposals, e.g. a prefix. It is called with the channel, the
+	// txid and the creator of every proposal once the built-in checks of
+	// the txid passed, the channel being empty for chainless proposals. An
+	// error fails the proposal as invalid.
+	TxIDValidator func(channelID string, txid string, creator []byte) error
+
+	// PartialResultsOnError, when set, keeps the chaincode event emitted
+	// by a chaincode that then failed, so that the failure response of the
+	// proposal carries it along with the public simulation results of the
+	// chaincode up to the failure. The private data it wrote is never
+	// part of the response.
+	PartialResultsOnError bool
+
+	// ACLCacheTTL, when positive, is how long the creators allowed to
+	// propose on a channel by its ACL are allowed again without evaluating
+	// the policy. The decisions are dropped as soon as the config of the
+	// channel is updated.
+	ACLCacheTTL time.Duration
+
+	// ChaincodeEventObserved, when set, is called with the chaincode events
+	// emitted while simulating proposals, whether or not the proposals are
+	// endorsed afterwards. It is called from a goroutine of its own; the
+	// events emitted while it is too far behind are dropped.
+	ChaincodeEventObserved func(channel string, txID string, event *pb.ChaincodeEvent)
+
+	// SlowSigningThreshold, when positive, is how long the ESCC may take
+	// to sign the endorsement of a proposal before a warning naming the
+	// chaincode is logged. The signing time is also reported in the
+	// signing_duration metric, separately from chaincode_duration.
+	SlowSigningThreshold time.Duration
+
+	// EndorsedFailureThreshold, when above 400, has the ESCC sign the
+	// failures of chaincodes whose status is below it, so that clients get
+	// a signed attestation that the chaincode failed rather than an
+	// unsigned error. The failure is endorsed with empty simulation
+	// results and returned without an error, its status telling it apart
+	// from a success. Zero keeps the default behavior of never endorsing
+	// failures.
+	//
+	// Endorsing failures has security implications: a signed failure is
+	// a valid endorsement of the proposal, which anyone holding it can
+	// submit for ordering and present as proof that the chaincode failed,
+	// whether the failure is deterministic or caused by the peer itself
+	// (e.g. a timeout or a resource exhausted). The threshold should only
+	// cover the statuses chaincodes return on purpose.
+	EndorsedFailureThreshold int32
+
+	// ExternallyInvokableSysCCs maps the names of system chaincodes to
+	// whether proposals may invoke them, overriding the default of the
+	// system chaincode; the system chaincodes not listed keep their
+	// default, and names which are not system chaincodes are ignored. The
+	// committing peers still invalidate the transactions invoking the
+	// system chaincodes which cannot be invoked by default, so allowing
+	// one is only useful for proposals which are not submitted, such as
+	// queries, or for system chaincodes added to the peer.
+	ExternallyInvokableSysCCs map[string]bool
+
+	// Tracer, when set, reports a span for every proposal, child of the
+	// span of the trace context the client put in the transient map of
+	// the proposal, if any, with child spans for the validation, the
+	// simulation, the invocation of the chaincode and the endorsement.
+	// The span of the proposal records its txid, channel and chaincode
+	// and the status of the response.
+	Tracer Tracer
+
+	// UnchangedSinceSimulations, when set, allows SimulateUnchangedSince to
+	// simulate stored proposals again on the current state, checking that
+	// their reads were not updated since a past block height. It is a
+	// debugging aid: the simulations run the chaincode like any proposal.
+	UnchangedSinceSimulations bool
+
+	// EndorsementMetadata, when set, records in the endorsement metadata of
+	// every endorsed proposal response the MSP ID of the endorser, the
+	// endpoint of the peer and the time of the endorsement, so that clients
+	// need not dig into the payload. The metadata is not signed and not
+	// part of the payload, so it does not change the transaction validated
+	// by the VSCC.
+	EndorsementMetadata bool
+
+	// EndorsementPolicyCheck, when set, flags the endorsement metadata of
+	// the endorsed proposal responses whose endorser satisfies none of the
+	// principals of the endorsement policy of the chaincode, so that SDKs
+	// can stop collecting endorsements that do not count towards it. The
+	// proposals are processed and endorsed all the same.
+	EndorsementPolicyCheck bool
+
+	// CircuitBreakerFailures, when positive, is the number of consecutive
+	// executions of a chaincode that may fail, e.g. because its container
+	// is gone, before the proposals to it are rejected right away with a
+	// retryable 503 rather than waiting for the execute timeout. The
+	// failures only count if they happen within CircuitBreakerWindow, zero
+	// counting them however far apart they are. Once CircuitBreakerCooldown
+	// is over, 30s if zero, a single trial proposal is let through: its
+	// success lets the proposals through again, its failure starts another
+	// cooldown. Every version of a chaincode has a circuit of its own;
+	// system chaincodes and error responses of chaincodes are not counted.
+	CircuitBreakerFailures int
+	CircuitBreakerWindow   time.Duration
+	CircuitBreakerCooldown time.Duration
+
+	// RejectProposalsDuringUpgrade, when set, rejects the proposals to a
+	// chaincode with a retryable 503 while the endorser simulates its
+	// upgrade, rather than simulating them against the version being
+	// replaced, whose responses would fail validation once the upgrade is
+	// committed. System chaincodes are exempt.
+	RejectProposalsDuringUpgrade bool
+
+	// TxSimulatorFactory, when set, provides the tx simulators of the
+	// proposals in place of the ledgers of the channels, e.g. to simulate
+	// them on mocks or sharded simulators. HistoryQueryExecutorFactory
+	// does the same for the history query executors. The ledger of the
+	// channel is still needed to check the txids of the proposals for
+	// duplicates.
+	TxSimulatorFactory          TxSimulatorFactory
+	HistoryQueryExecutorFactory HistoryQueryExecutorFactory
+
+	// Handlers configures the handlers of the registry, resolved once
+	// when the Endorser is created. Only the first configuration the
+	// registry is initialized with takes effect.
+	Handlers library.Config
+}
+
+// UpgradeEvent describes a chaincode upgrade executed by the endorser
+type UpgradeEvent struct {
+	ChannelID     string
+	ChaincodeName string
+	OldVersion    string
+	NewVersion    string
+}
@@ -0,0 +1,92 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/pkg/errors"
+)
+
+// deadLetterQueueSize is the number of dead letters waiting to be written
+// to the sink beyond which new ones are dropped
+const deadLetterQueueSize = 100
+
+// DeadLetter is a proposal which failed to be endorsed because of an
+// internal error, kept for later analysis and replay
+type DeadLetter struct {
+	// SignedProposal is the marshalled SignedProposal
+	SignedProposal []byte
+	// Reason is the error the proposal failed with
+	Reason string
+	// Timestamp is the time the proposal failed
+	Timestamp time.Time
+}
+
+// DeadLetterSink stores dead letters
+type DeadLetterSink interface {
+	Write(*DeadLetter) error
+}
+
+// deadLetters hands dead letters over to the sink from a goroutine of its
+// own, so that a slow sink never delays a proposal response
+type deadLetters struct {
+	sink  DeadLetterSink
+	queue chan *DeadLetter
+}
+
+// newDeadLetters returns the dead letter queue of the sink, or nil if there
+// is no sink
+func newDeadLetters(sink DeadLetterSink) *deadLetters {
+	if sink == nil {
+		return nil
+	}
+	d := &deadLetters{
+		sink:  sink,
+		queue: make(chan *DeadLetter, deadLetterQueueSize),
+	}
+	go d.writeLoop()
+	return d
+}
+
+func (d *deadLetters) writeLoop() {
+	for letter := range d.queue {
+		if err := d.sink.Write(letter); err != nil {
+			endorserLogger.Warningf("failed to write dead letter: %s", err)
+		}
+	}
+}
+
+// capture queues the proposal which failed with err, answered with pResp,
+// if the failure is an internal error of the peer: the failures of the
+// chaincode, and the proposals rejected as malformed or not allowed, are an
+// answer rather than an incident
+func (d *deadLetters) capture(signedProp *pb.SignedProposal, pResp *pb.ProposalResponse, err error) {
+	if d == nil {
+		return
+	}
+	if _, ok := errors.Cause(err).(*chaincodeError); ok {
+		return
+	}
+	if failureCategory(pResp, err) != internalError {
+		return
+	}
+
+	propBytes, merr := proto.Marshal(signedProp)
+	if merr != nil {
+		endorserLogger.Warningf("failed to marshal dead letter: %s", merr)
+		return
+	}
+
+	select {
+	case d.queue <- &DeadLetter{SignedProposal: propBytes, Reason: err.Error(), Timestamp: time.Now()}:
+	default:
+		endorserLogger.Warningf("dead letter queue is full, dropping proposal which failed with: %s", err)
+	}
+}
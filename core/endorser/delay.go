@@ -0,0 +1,55 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// EndorsementDelay is the delay applied before endorsing the proposals of
+// a chaincode, so that synchronized bursts of clients are spread over time
+type EndorsementDelay struct {
+	// Min is the minimum delay
+	Min time.Duration
+	// Jitter is the bound of the random delay added to Min
+	Jitter time.Duration
+}
+
+// duration returns the delay to apply to a proposal, picked uniformly in
+// [Min, Min+Jitter)
+func (d EndorsementDelay) duration() time.Duration {
+	if d.Jitter <= 0 {
+		return d.Min
+	}
+	return d.Min + time.Duration(rand.Int63n(int64(d.Jitter)))
+}
+
+// delayEndorsement waits for the endorsement delay of the chaincode, or
+// returns an error if ctx is done first
+func (e *Endorser) delayEndorsement(ctx context.Context, ccName string) error {
+	delay, ok := e.config.EndorsementDelays[ccName]
+	if !ok {
+		return nil
+	}
+	d := delay.duration()
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrapf(ctx.Err(), "proposal for chaincode %s given up while delaying its endorsement", ccName)
+	}
+}
@@ -0,0 +1,48 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric/common/resourcesconfig"
+	"github.com/hyperledger/fabric/common/util"
+	"golang.org/x/net/context"
+)
+
+// isDeprecated returns true if the version of the chaincode is configured
+// as deprecated
+func (e *Endorser) isDeprecated(ccName string, version string) bool {
+	for _, deprecated := range e.config.DeprecatedVersions[ccName] {
+		if deprecated == version {
+			return true
+		}
+	}
+	return false
+}
+
+// recordDeprecatedInvocation logs and counts the invocation of a deprecated
+// version of a chaincode
+func (e *Endorser) recordDeprecatedInvocation(ctx context.Context, ccName string, version string) {
+	proposalLoggerFrom(ctx).Warningf("%s", deprecationWarning(ccName, version))
+	if scope := proposalMetricsFrom(ctx); scope != nil {
+		scope.Tagged(map[string]string{"version": version}).Counter("deprecated_invocations").Inc(1)
+	}
+}
+
+func deprecationWarning(ccName string, version string) string {
+	return fmt.Sprintf("version %s of chaincode %s is deprecated", version, ccName)
+}
+
+// ccVersion returns the version of the chaincode definition, the one of
+// the system chaincodes if there is none
+func ccVersion(cd resourcesconfig.ChaincodeDefinition) string {
+	if cd == nil {
+		return util.GetSysCCVersion()
+	}
+	return cd.CCVersion()
+}
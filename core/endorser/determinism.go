@@ -0,0 +1,184 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+
+	"github.com/hyperledger/fabric/core/ledger"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// recordingSimulator is a TxSimulator recording the keys read and written
+// by a chaincode, so that two simulations of the same proposal can be
+// compared. Reads always go to the underlying simulator; writes only do if
+// forwardWrites is set, so that a re-simulation does not alter the results
+// of the first one. Range queries and rich queries are not recorded.
+type recordingSimulator struct {
+	ledger.TxSimulator
+	forwardWrites bool
+	reads         map[string][]byte
+	writes        map[string][]byte
+}
+
+func newRecordingSimulator(txsim ledger.TxSimulator, forwardWrites bool) *recordingSimulator {
+	return &recordingSimulator{
+		TxSimulator:   txsim,
+		forwardWrites: forwardWrites,
+		reads:         make(map[string][]byte),
+		writes:        make(map[string][]byte),
+	}
+}
+
+func recordedKey(namespace, collection, key string) string {
+	return namespace + "\x00" + collection + "\x00" + key
+}
+
+func (s *recordingSimulator) GetState(namespace string, key string) ([]byte, error) {
+	value, err := s.TxSimulator.GetState(namespace, key)
+	if err == nil {
+		s.reads[recordedKey(namespace, "", key)] = value
+	}
+	return value, err
+}
+
+func (s *recordingSimulator) GetStateMultipleKeys(namespace string, keys []string) ([][]byte, error) {
+	values, err := s.TxSimulator.GetStateMultipleKeys(namespace, keys)
+	if err == nil {
+		for i, key := range keys {
+			s.reads[recordedKey(namespace, "", key)] = values[i]
+		}
+	}
+	return values, err
+}
+
+func (s *recordingSimulator) GetPrivateData(namespace, collection, key string) ([]byte, error) {
+	value, err := s.TxSimulator.GetPrivateData(namespace, collection, key)
+	if err == nil {
+		s.reads[recordedKey(namespace, collection, key)] = value
+	}
+	return value, err
+}
+
+func (s *recordingSimulator) GetPrivateDataMultipleKeys(namespace, collection string, keys []string) ([][]byte, error) {
+	values, err := s.TxSimulator.GetPrivateDataMultipleKeys(namespace, collection, keys)
+	if err == nil {
+		for i, key := range keys {
+			s.reads[recordedKey(namespace, collection, key)] = values[i]
+		}
+	}
+	return values, err
+}
+
+func (s *recordingSimulator) SetState(namespace string, key string, value []byte) error {
+	if s.forwardWrites {
+		if err := s.TxSimulator.SetState(namespace, key, value); err != nil {
+			return err
+		}
+	}
+	s.writes[recordedKey(namespace, "", key)] = value
+	return nil
+}
+
+func (s *recordingSimulator) DeleteState(namespace string, key string) error {
+	return s.SetState(namespace, key, nil)
+}
+
+func (s *recordingSimulator) SetStateMultipleKeys(namespace string, kvs map[string][]byte) error {
+	for key, value := range kvs {
+		if err := s.SetState(namespace, key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *recordingSimulator) SetPrivateData(namespace, collection, key string, value []byte) error {
+	if s.forwardWrites {
+		if err := s.TxSimulator.SetPrivateData(namespace, collection, key, value); err != nil {
+			return err
+		}
+	}
+	s.writes[recordedKey(namespace, collection, key)] = value
+	return nil
+}
+
+func (s *recordingSimulator) DeletePrivateData(namespace, collection, key string) error {
+	return s.SetPrivateData(namespace, collection, key, nil)
+}
+
+func (s *recordingSimulator) SetPrivateDataMultipleKeys(namespace, collection string, kvs map[string][]byte) error {
+	for key, value := range kvs {
+		if err := s.SetPrivateData(namespace, collection, key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// simulationRun is the outcome of one simulation of a proposal
+type simulationRun struct {
+	res     *pb.Response
+	ccevent *pb.ChaincodeEvent
+	txsim   *recordingSimulator
+}
+
+// mismatch describes the first difference found between two simulations of
+// the same proposal, or returns the empty string if there is none
+func (r *simulationRun) mismatch(other *simulationRun) string {
+	switch {
+	case r.res.Status != other.res.Status || r.res.Message != other.res.Message:
+		return fmt.Sprintf("response status differs (%d %q vs %d %q)", r.res.Status, r.res.Message, other.res.Status, other.res.Message)
+	case !bytes.Equal(r.res.Payload, other.res.Payload):
+		return "response payload differs"
+	case !reflect.DeepEqual(r.ccevent, other.ccevent):
+		return "chaincode event differs"
+	case !reflect.DeepEqual(r.txsim.reads, other.txsim.reads):
+		return "read set differs"
+	case !reflect.DeepEqual(r.txsim.writes, other.txsim.writes):
+		return "write set differs"
+	}
+	return ""
+}
+
+// callChaincodeChecked calls the chaincode like callChaincode does, and when
+// the determinism check is enabled, re-simulates the proposal on the same
+// simulator to compare the outcomes of both runs. A mismatch is logged, and
+// also fails the proposal if FailNonDeterministic is set.
+func (e *Endorser) callChaincodeChecked(ctxt context.Context, chainID string, version string, txid string, signedProp *pb.SignedProposal, prop *pb.Proposal, cis *pb.ChaincodeInvocationSpec, cid *pb.ChaincodeID, txsim ledger.TxSimulator) (*pb.Response, *pb.ChaincodeEvent, error) {
+	// lscc deploys and upgrades launch the chaincode as a side effect, they
+	// must not be run twice
+	if !e.config.CheckDeterminism || txsim == nil || cid.Name == "lscc" {
+		return e.callChaincode(ctxt, chainID, version, txid, signedProp, prop, cis, cid, txsim)
+	}
+
+	first := &simulationRun{txsim: newRecordingSimulator(txsim, true)}
+	var err error
+	first.res, first.ccevent, err = e.callChaincode(ctxt, chainID, version, txid, signedProp, prop, cis, cid, first.txsim)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	second := &simulationRun{txsim: newRecordingSimulator(txsim, false)}
+	second.res, second.ccevent, err = e.callChaincode(ctxt, chainID, version, txid, signedProp, prop, cis, cid, second.txsim)
+	if err != nil {
+		return nil, nil, errors.WithMessage(err, fmt.Sprintf("failed to re-simulate transaction %s for the determinism check", txid))
+	}
+
+	if mismatch := first.mismatch(second); mismatch != "" {
+		endorserLogger.Warningf("chaincode %s is not deterministic on transaction %s: %s", cid.Name, txid, mismatch)
+		if e.config.FailNonDeterministic {
+			return nil, nil, errors.Errorf("chaincode %s is not deterministic: %s", cid.Name, mismatch)
+		}
+	}
+
+	return first.res, first.ccevent, nil
+}
@@ -0,0 +1,214 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric/common/cauthdsl"
+	"github.com/hyperledger/fabric/core/common/ccprovider"
+	"github.com/hyperledger/fabric/core/common/validation"
+	"github.com/hyperledger/fabric/core/peer"
+	syscc "github.com/hyperledger/fabric/core/scc"
+	mspmgmt "github.com/hyperledger/fabric/msp/mgmt"
+	"github.com/hyperledger/fabric/protos/common"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	putils "github.com/hyperledger/fabric/protos/utils"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// DeployDryRun is the outcome of the dry run of a deploy or an upgrade
+type DeployDryRun struct {
+	ChaincodeName string
+	Version       string
+	// Upgrade tells whether the proposal upgrades an instantiated
+	// chaincode rather than deploying a new one
+	Upgrade bool
+	// Err is the reason the deploy would fail, or nil if it would succeed
+	Err error
+}
+
+// WouldSucceed returns whether the deploy would succeed
+func (r *DeployDryRun) WouldSucceed() bool {
+	return r.Err == nil
+}
+
+// DryRunDeploy checks whether the lscc deploy or upgrade of the signed
+// proposal would succeed, without executing it: the chaincode must be
+// installed, instantiated on the channel for an upgrade, to another
+// version, and not for a deploy, and the proposal must satisfy the
+// instantiation policies. Nothing is written and the chaincode is not
+// launched, so failures of its Init are not detected. An error is returned
+// if the proposal is not a deploy or an upgrade at all.
+func (e *Endorser) DryRunDeploy(ctx context.Context, signedProp *pb.SignedProposal) (*DeployDryRun, error) {
+	processed, err := e.admit(ctx, signedProp)
+	if err != nil {
+		return nil, err
+	}
+	defer processed()
+
+	prop, hdr, hdrExt, err := validation.ValidateProposalMessage(signedProp)
+	if err != nil {
+		return nil, err
+	}
+
+	chdr, err := putils.UnmarshalChannelHeader(hdr.ChannelHeader)
+	if err != nil {
+		return nil, err
+	}
+	chainID := chdr.ChannelId
+	if chainID == "" {
+		return nil, errors.New("dry run of a deploy requires a channel")
+	}
+
+	cid := hdrExt.ChaincodeId
+	if cid.Name != "lscc" {
+		return nil, errors.Errorf("dry run of a deploy requires a proposal to lscc, not to %s", cid.Name)
+	}
+	cis, err := putils.GetChaincodeInvocationSpec(prop)
+	if err != nil {
+		return nil, err
+	}
+	if err = validateInvocationSpec(cid, cis); err != nil {
+		return nil, err
+	}
+	args := cis.ChaincodeSpec.Input.Args
+	op := string(args[0])
+	if op != "deploy" && op != "upgrade" {
+		return nil, errors.Errorf("dry run of a deploy requires a deploy or upgrade proposal, not %s", op)
+	}
+	if len(args) < 3 {
+		return nil, errors.Errorf("too few arguments passed. expected %d", 3)
+	}
+	cds, err := putils.GetChaincodeDeploymentSpec(args[2])
+	if err != nil {
+		return nil, err
+	}
+	if cds.ChaincodeSpec == nil || cds.ChaincodeSpec.ChaincodeId == nil {
+		return nil, errors.New("the deployment spec does not identify the chaincode")
+	}
+
+	result := &DeployDryRun{
+		ChaincodeName: cds.ChaincodeSpec.ChaincodeId.Name,
+		Version:       cds.ChaincodeSpec.ChaincodeId.Version,
+		Upgrade:       op == "upgrade",
+	}
+	result.Err = e.checkDeploy(ctx, chainID, chdr.TxId, signedProp, prop, cid, cis, result)
+	return result, nil
+}
+
+// checkDeploy returns the reason the deploy of the dry run would fail, or
+// nil if it would succeed
+func (e *Endorser) checkDeploy(ctx context.Context, chainID string, txid string, signedProp *pb.SignedProposal, prop *pb.Proposal, cid *pb.ChaincodeID, cis *pb.ChaincodeInvocationSpec, result *DeployDryRun) error {
+	name, version := result.ChaincodeName, result.Version
+	if syscc.IsSysCC(name) {
+		return errors.Errorf("attempting to deploy a system chaincode %s/%s", name, chainID)
+	}
+	if err := e.validateChaincodeType(cid, cis); err != nil {
+		return err
+	}
+
+	txsim, err := e.getTxSimulator(chainID, txid)
+	if err != nil {
+		return err
+	}
+	defer txsim.Done()
+
+	state, err := txsim.GetState("lscc", name)
+	if err != nil {
+		return err
+	}
+	if !result.Upgrade && state != nil {
+		return errors.Errorf("chaincode %s is already instantiated on channel %s", name, chainID)
+	}
+	if result.Upgrade {
+		if state == nil {
+			return errors.Errorf("chaincode %s is not instantiated on channel %s, it cannot be upgraded", name, chainID)
+		}
+		cdLedger, err := e.getCDSFromLSCC(ctx, chainID, txid, signedProp, prop, name, txsim)
+		if err != nil {
+			return err
+		}
+		if cdLedger.CCVersion() == version {
+			return errors.Errorf("chaincode %s is already at version %s on channel %s", name, version, chainID)
+		}
+		// the policy of the instantiated version governs its upgrade
+		cd, ok := cdLedger.(*ccprovider.ChaincodeData)
+		if !ok || cd.InstantiationPolicy == nil {
+			return errors.Errorf("chaincode %s has no instantiation policy on channel %s", name, chainID)
+		}
+		if err = evaluateInstantiationPolicy(chainID, signedProp, cd.InstantiationPolicy); err != nil {
+			return err
+		}
+	}
+
+	ccpack, err := ccprovider.GetChaincodeFromFS(name, version)
+	if err != nil {
+		return errors.WithMessage(err, "chaincode "+name+":"+version+" is not installed")
+	}
+	policy, err := instantiationPolicy(chainID, ccpack)
+	if err != nil {
+		return err
+	}
+	// the definition written by the deploy must pass the check invocations
+	// of the chaincode go through
+	cd := ccpack.GetChaincodeData()
+	cd.InstantiationPolicy = policy
+	if err = ccprovider.CheckInsantiationPolicy(name, version, cd); err != nil {
+		return err
+	}
+	return evaluateInstantiationPolicy(chainID, signedProp, policy)
+}
+
+// instantiationPolicy returns the instantiation policy lscc applies to the
+// package on the channel: the one of a signed package, or else the policy
+// allowing any admin of the channel
+func instantiationPolicy(chainID string, ccpack ccprovider.CCPackage) ([]byte, error) {
+	if sccpack, ok := ccpack.(*ccprovider.SignedCDSPackage); ok {
+		policy := sccpack.GetInstantiationPolicy()
+		if policy == nil {
+			return nil, errors.New("instantiation policy cannot be null for a SignedCCDeploymentSpec")
+		}
+		return policy, nil
+	}
+	return putils.Marshal(cauthdsl.SignedByAnyAdmin(peer.GetMSPIDs(chainID)))
+}
+
+// evaluateInstantiationPolicy evaluates the instantiation policy against
+// the creator of the signed proposal, like lscc does
+func evaluateInstantiationPolicy(chainID string, signedProp *pb.SignedProposal, policy []byte) error {
+	mgr := mspmgmt.GetManagerForChain(chainID)
+	if mgr == nil {
+		return errors.Errorf("MSP manager for channel %s not found", chainID)
+	}
+	instPol, _, err := cauthdsl.NewPolicyProvider(mgr).NewPolicy(policy)
+	if err != nil {
+		return err
+	}
+	prop, err := putils.GetProposal(signedProp.ProposalBytes)
+	if err != nil {
+		return err
+	}
+	hdr, err := putils.GetHeader(prop.Header)
+	if err != nil {
+		return err
+	}
+	shdr, err := putils.GetSignatureHeader(hdr.SignatureHeader)
+	if err != nil {
+		return err
+	}
+	sd := []*common.SignedData{{
+		Data:      signedProp.ProposalBytes,
+		Identity:  shdr.Creator,
+		Signature: signedProp.Signature,
+	}}
+	if err = instPol.Evaluate(sd); err != nil {
+		return errors.WithMessage(err, fmt.Sprintf("instantiation policy %s violated by %s", describePolicy(policy), describeCreator(signedProp)))
+	}
+	return nil
+}
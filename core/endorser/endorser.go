@@ -8,9 +8,12 @@ package endorser
 
 import (
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/hyperledger/fabric/common/flogging"
+	"github.com/hyperledger/fabric/common/metrics"
 	"github.com/hyperledger/fabric/common/resourcesconfig"
 	"github.com/hyperledger/fabric/common/util"
 	"github.com/hyperledger/fabric/core/aclmgmt"
@@ -19,6 +22,7 @@ import (
 	"github.com/hyperledger/fabric/core/common/ccprovider"
 	"github.com/hyperledger/fabric/core/common/validation"
 	"github.com/hyperledger/fabric/core/handlers/decoration"
+	"github.com/hyperledger/fabric/core/handlers/endorsement"
 	"github.com/hyperledger/fabric/core/handlers/library"
 	"github.com/hyperledger/fabric/core/ledger"
 	"github.com/hyperledger/fabric/core/peer"
@@ -33,14 +37,96 @@ import (
 )
 
 // >>>>> begin errors section >>>>>
+// errorCategory classifies the failures of proposals, so that clients can
+// tell the ones worth retrying apart
+type errorCategory string
+
+const (
+	// validationError means the proposal is malformed or not allowed;
+	// retrying it as is fails the same way
+	validationError errorCategory = "validation"
+	// chaincodeFailure means the chaincode returned an error response
+	chaincodeFailure errorCategory = "chaincode"
+	// timeoutError means the proposal ran out of time; it can be retried
+	timeoutError errorCategory = "timeout"
+	// cancelledError means the client cancelled the proposal before it
+	// was processed
+	cancelledError errorCategory = "cancelled"
+	// endorsementError means the simulation results could not be endorsed
+	endorsementError errorCategory = "endorsement"
+	// distributionError means the chaincode succeeded but the private
+	// data of the proposal could not be distributed; it can be retried
+	distributionError errorCategory = "distribution"
+	// rateLimitedError means the proposal exceeded the rate limit of its
+	// channel; it can be retried after the delay of the message
+	rateLimitedError errorCategory = "ratelimited"
+	// stoppedError means the endorser was stopped; the proposal can be
+	// retried on another peer
+	stoppedError errorCategory = "stopped"
+	// internalError means the peer failed to process the proposal
+	internalError errorCategory = "internal"
+)
+
+// categorize returns the category of err, raised while processing a proposal
+// by the peer rather than by the chaincode
+func categorize(err error) errorCategory {
+	if errors.Cause(err) == context.DeadlineExceeded || strings.Contains(err.Error(), "timeout expired") {
+		return timeoutError
+	}
+	if errors.Cause(err) == context.Canceled {
+		return cancelledError
+	}
+	if _, ok := errors.Cause(err).(*PvtDataDistributionError); ok {
+		return distributionError
+	}
+	if _, ok := errors.Cause(err).(*invocationSpecError); ok {
+		return validationError
+	}
+	return internalError
+}
+
+// categorizedMessage prefixes the message of a failure with its category,
+// which clients can parse
+func categorizedMessage(category errorCategory, msg string) string {
+	return fmt.Sprintf("[%s] %s", category, msg)
+}
+
+// failureResponse returns the response to a proposal which failed with err
+func failureResponse(category errorCategory, err error) *pb.ProposalResponse {
+	return &pb.ProposalResponse{Response: &pb.Response{Status: 500, Message: categorizedMessage(category, err.Error())}}
+}
+
 //chaincodeError is a fabric error signifying error from chaincode
 type chaincodeError struct {
-	status int32
-	msg    string
+	status   int32
+	msg      string
+	category errorCategory
 }
 
 func (ce chaincodeError) Error() string {
-	return fmt.Sprintf("chaincode error (status: %d, message: %s)", ce.status, ce.msg)
+	msg := fmt.Sprintf("chaincode error (status: %d, message: %s)", ce.status, ce.msg)
+	if ce.category != "" {
+		msg += fmt.Sprintf(" (category: %s)", ce.category)
+	}
+	return msg
+}
+
+// correlateFailure tags a failed proposal with a freshly generated
+// correlation ID, both in the response returned to the client and in the
+// error log line, so support can tie the two together
+func correlateFailure(logger proposalLogger, pResp *pb.ProposalResponse, err error) (*pb.ProposalResponse, error) {
+	correlationID := util.GenerateUUID()
+	logger.Errorf("[correlation id: %s] failed to process proposal: %s", correlationID, err)
+
+	if pResp == nil {
+		pResp = &pb.ProposalResponse{}
+	}
+	if pResp.Response == nil {
+		pResp.Response = &pb.Response{Status: 500, Message: err.Error()}
+	}
+	pResp.Response.Message = fmt.Sprintf("%s (correlation id: %s)", pResp.Response.Message, correlationID)
+
+	return pResp, errors.WithMessage(err, fmt.Sprintf("correlation id: %s", correlationID))
 }
 
 // <<<<< end errors section <<<<<<
@@ -52,23 +138,95 @@ var endorserLogger = flogging.MustGetLogger("endorser")
 
 type privateDataDistributor func(channel string, txID string, privateData *rwset.TxPvtReadWriteSet) error
 
+// AckingPrivateDataDistributor distributes private data like the
+// distributor of an Endorser, and returns the endpoints of the peers which
+// acknowledged it
+type AckingPrivateDataDistributor func(channel string, txID string, privateData *rwset.TxPvtReadWriteSet) ([]string, error)
+
+// TxSimulatorFactory returns the tx simulator a proposal of the channel is
+// simulated with
+type TxSimulatorFactory func(channelID string, txid string) (ledger.TxSimulator, error)
+
+// HistoryQueryExecutorFactory returns the executor of the history queries
+// of the chaincodes a proposal of the channel invokes
+type HistoryQueryExecutorFactory func(channelID string) (ledger.HistoryQueryExecutor, error)
+
 // Endorser provides the Endorser service ProcessProposal
 type Endorser struct {
 	distributePrivateData privateDataDistributor
+	config                Config
+	launches              *launchLimiter
+	deadLetters           *deadLetters
+	endorsementCache      *endorsementCache
+	responses             *responseCache
+	definitions           *definitionCache
+	proposals             *proposalLimiter
+	txIDs                 *txIDFilter
+	acls                  *aclCache
+	rates                 *rateLimiter
+	breaker               *circuitBreaker
+	upgrades              *upgradeGuard
+	proposalsInFlight     *proposalTracker
+	events                *chaincodeEvents
+	// decorators decorate the input of every chaincode invocation
+	decorators []decoration.Decorator
+	// selectors select the ESCC endorsing every proposal
+	selectors []endorsement.Selector
+	// newTxSimulator, when set, replaces the ledger of the channel as the
+	// source of tx simulators
+	newTxSimulator func(ledgername string, txid string) (ledger.TxSimulator, error)
+	// newHistoryQueryExecutor, when set, replaces the ledger of the channel
+	// as the source of history query executors
+	newHistoryQueryExecutor func(ledgername string) (ledger.HistoryQueryExecutor, error)
 }
 
 // NewEndorserServer creates and returns a new Endorser server instance.
-func NewEndorserServer(privDist privateDataDistributor) pb.EndorserServer {
+func NewEndorserServer(privDist privateDataDistributor, config Config) pb.EndorserServer {
 	e := &Endorser{
 		distributePrivateData: privDist,
+		config:                config,
+		launches:              newLaunchLimiter(config.MaxConcurrentLaunches, config.LaunchTimeout),
+		deadLetters:           newDeadLetters(config.DeadLetterSink),
+		endorsementCache:      newEndorsementCache(config.EndorsementCacheSize),
+		responses:             newResponseCache(config.ResponseCacheSize, config.ResponseCacheTTL),
+		definitions:           newDefinitionCache(),
+		proposals:             newProposalLimiter(config.MaxConcurrentSystemProposals, config.MaxConcurrentApplicationProposals),
+		txIDs:                 newTxIDFilter(config.TxIDFilterSize, config.TxIDFilterRotation),
+		acls:                  newACLCache(config.ACLCacheTTL),
+		rates:                 newRateLimiter(config.ProposalRateLimits, config.DefaultProposalRateLimit),
+		breaker:               newCircuitBreaker(config.CircuitBreakerFailures, config.CircuitBreakerWindow, config.CircuitBreakerCooldown),
+		upgrades:              newUpgradeGuard(config.RejectProposalsDuringUpgrade),
+		proposalsInFlight:     &proposalTracker{},
+		events:                newChaincodeEvents(config.ChaincodeEventObserved),
+		decorators:            library.InitRegistry(config.Handlers).Lookup(library.Decoration).([]decoration.Decorator),
+		selectors:             library.InitRegistry(config.Handlers).Lookup(library.Endorsement).([]endorsement.Selector),
 	}
+	e.newTxSimulator = config.TxSimulatorFactory
+	e.newHistoryQueryExecutor = config.HistoryQueryExecutorFactory
 	return e
 }
 
 // checkACL checks that the supplied proposal complies
-// with the writers policy of the chain
+// with the writers policy of the chain. The creators it allowed are cached
+// when configured; the signature of the creator over the proposal has been
+// verified already, the policy is all the ACL checks.
 func (e *Endorser) checkACL(signedProp *pb.SignedProposal, chdr *common.ChannelHeader, shdr *common.SignatureHeader, hdrext *pb.ChaincodeHeaderExtension) error {
-	return aclmgmt.GetACLProvider().CheckACL(aclmgmt.PROPOSE, chdr.ChannelId, signedProp)
+	var sequence uint64
+	cacheable := e.acls != nil && shdr != nil
+	if cacheable {
+		sequence, cacheable = configSequence(chdr.ChannelId)
+	}
+	if cacheable && e.acls.allowed(chdr.ChannelId, shdr.Creator, sequence, time.Now()) {
+		return nil
+	}
+
+	if err := aclmgmt.GetACLProvider().CheckACL(aclmgmt.PROPOSE, chdr.ChannelId, signedProp); err != nil {
+		return err
+	}
+	if cacheable {
+		e.acls.allow(chdr.ChannelId, shdr.Creator, sequence, time.Now())
+	}
+	return nil
 }
 
 //TODO - check for escc and vscc
@@ -76,26 +234,64 @@ func (*Endorser) checkEsccAndVscc(prop *pb.Proposal) error {
 	return nil
 }
 
-func (*Endorser) getTxSimulator(ledgername string, txid string) (ledger.TxSimulator, error) {
+// channelNotFoundError is returned for the proposals to a channel the peer
+// has not joined
+type channelNotFoundError struct {
+	channelID string
+}
+
+func (e *channelNotFoundError) Error() string {
+	return "channel does not exist: " + e.channelID
+}
+
+// getLedger returns the ledger of the channel. It is looked up once per
+// proposal and reused, so that a channel removed while the proposal is
+// processed fails it the same way wherever the ledger is needed.
+func getLedger(ledgername string) (ledger.PeerLedger, error) {
 	lgr := peer.GetLedger(ledgername)
 	if lgr == nil {
-		return nil, errors.Errorf("channel does not exist: %s", ledgername)
+		return nil, &channelNotFoundError{channelID: ledgername}
+	}
+	return lgr, nil
+}
+
+func (e *Endorser) getTxSimulator(ledgername string, txid string) (ledger.TxSimulator, error) {
+	if e.newTxSimulator != nil {
+		return e.newTxSimulator(ledgername, txid)
+	}
+	lgr, err := getLedger(ledgername)
+	if err != nil {
+		return nil, err
 	}
 	return lgr.NewTxSimulator(txid)
 }
 
-func (*Endorser) getHistoryQueryExecutor(ledgername string) (ledger.HistoryQueryExecutor, error) {
-	lgr := peer.GetLedger(ledgername)
-	if lgr == nil {
-		return nil, errors.Errorf("channel does not exist: %s", ledgername)
+// newTxSimulatorOn returns a tx simulator on the ledger of the channel,
+// already looked up
+func (e *Endorser) newTxSimulatorOn(lgr ledger.PeerLedger, ledgername string, txid string) (ledger.TxSimulator, error) {
+	if e.newTxSimulator != nil {
+		return e.newTxSimulator(ledgername, txid)
+	}
+	return lgr.NewTxSimulator(txid)
+}
+
+// newHistoryQueryExecutorOn returns a history query executor on the ledger
+// of the channel, already looked up
+func (e *Endorser) newHistoryQueryExecutorOn(lgr ledger.PeerLedger, ledgername string) (ledger.HistoryQueryExecutor, error) {
+	if e.newHistoryQueryExecutor != nil {
+		return e.newHistoryQueryExecutor(ledgername)
 	}
 	return lgr.NewHistoryQueryExecutor()
 }
 
 //call specified chaincode (system or user)
 func (e *Endorser) callChaincode(ctxt context.Context, chainID string, version string, txid string, signedProp *pb.SignedProposal, prop *pb.Proposal, cis *pb.ChaincodeInvocationSpec, cid *pb.ChaincodeID, txsim ledger.TxSimulator) (*pb.Response, *pb.ChaincodeEvent, error) {
-	endorserLogger.Debugf("Entry - txid: %s channel id: %s version: %s", txid, chainID, version)
-	defer endorserLogger.Debugf("Exit")
+	logger := proposalLoggerFrom(ctxt)
+	logger.Debugf("Entry - txid: %s channel id: %s version: %s", txid, chainID, version)
+	defer logger.Debugf("Exit")
+	ctxt, span := e.startSpan(ctxt, "callChaincode")
+	span.SetAttribute("chaincode", cid.Name)
+	defer span.End()
 	var err error
 	var res *pb.Response
 	var ccevent *pb.ChaincodeEvent
@@ -104,28 +300,49 @@ func (e *Endorser) callChaincode(ctxt context.Context, chainID string, version s
 		ctxt = context.WithValue(ctxt, chaincode.TXSimulatorKey, txsim)
 	}
 
+	if e.config.MaxCC2CCDepth > 0 || e.config.MaxCC2CCChaincodes > 0 {
+		ctxt = chaincode.WithCC2CCBudget(ctxt, e.config.MaxCC2CCDepth, e.config.MaxCC2CCChaincodes)
+	}
+
 	//is this a system chaincode
 	scc := syscc.IsSysCC(cid.Name)
 
 	cccid := ccprovider.NewCCContext(chainID, cid.Name, version, txid, scc, signedProp, prop)
 
 	// decorate the chaincode input
-	decorators := library.InitRegistry(library.Config{}).Lookup(library.Decoration).([]decoration.Decorator)
 	cis.ChaincodeSpec.Input.Decorations = make(map[string][]byte)
-	cis.ChaincodeSpec.Input = decoration.Apply(prop, cis.ChaincodeSpec.Input, decorators...)
+	cis.ChaincodeSpec.Input = decoration.Apply(prop, cis.ChaincodeSpec.Input, e.decorators...)
 	cccid.ProposalDecorations = cis.ChaincodeSpec.Input.Decorations
 
+	var launched func()
+	if launched, err = e.acquireLaunch(ctxt, cccid); err != nil {
+		return launchQueueSaturatedResponse(err), nil, nil
+	}
+	var executed func(bool, time.Time)
+	if executed, err = e.allowExecution(cccid); err != nil {
+		launched()
+		return circuitOpenResponse(err), nil, nil
+	}
 	res, ccevent, err = chaincode.ExecuteChaincode(ctxt, cccid, cis.ChaincodeSpec.Input.Args)
+	launched()
+	// the proposals cancelled by their clients say nothing of the chaincode
+	executed(err == nil || categorize(err) == cancelledError, time.Now())
 
 	if err != nil {
 		return nil, nil, err
 	}
+	res = normalizeStatus(logger, cid.Name, res)
 
 	//per doc anything < 400 can be sent as TX.
 	//fabric errors will always be >= 400 (ie, unambiguous errors )
 	//"lscc" will respond with status 200 or 500 (ie, unambiguous OK or ERROR)
 	if res.Status >= shim.ERRORTHRESHOLD {
-		return res, nil, nil
+		// the event emitted before the chaincode failed is only kept for
+		// the failure response to carry it
+		if !e.config.PartialResultsOnError {
+			ccevent = nil
+		}
+		return res, ccevent, nil
 	}
 
 	//----- BEGIN -  SECTION THAT MAY NEED TO BE DONE IN LSCC ------
@@ -137,32 +354,158 @@ func (e *Endorser) callChaincode(ctxt context.Context, chainID string, version s
 	//NOTE that if there's an error all simulation, including the chaincode
 	//table changes in lscc will be thrown away
 	if cid.Name == "lscc" && len(cis.ChaincodeSpec.Input.Args) >= 3 && (string(cis.ChaincodeSpec.Input.Args[0]) == "deploy" || string(cis.ChaincodeSpec.Input.Args[0]) == "upgrade") {
-		var cds *pb.ChaincodeDeploymentSpec
-		cds, err = putils.GetChaincodeDeploymentSpec(cis.ChaincodeSpec.Input.Args[2])
-		if err != nil {
-			return nil, nil, err
+		if resp, err := e.handleLSCCDeploy(ctxt, chainID, txid, signedProp, prop, cis, txsim); resp != nil || err != nil {
+			return resp, nil, err
 		}
+	}
+	//----- END -------
 
-		//this should not be a system chaincode
-		if syscc.IsSysCC(cds.ChaincodeSpec.ChaincodeId.Name) {
-			return nil, nil, errors.Errorf("attempting to deploy a system chaincode %s/%s", cds.ChaincodeSpec.ChaincodeId.Name, chainID)
-		}
+	return res, ccevent, err
+}
 
-		cccid = ccprovider.NewCCContext(chainID, cds.ChaincodeSpec.ChaincodeId.Name, cds.ChaincodeSpec.ChaincodeId.Version, txid, false, signedProp, prop)
+// handleLSCCDeploy does the deploy or upgrade of the chaincode requested by
+// the lscc invocation cis once lscc succeeded, launching the chaincode with
+// the same TxSimulator. It returns a response to return in place of the one
+// of lscc when the launch is to be retried, or the error of the deploy.
+func (e *Endorser) handleLSCCDeploy(ctxt context.Context, chainID string, txid string, signedProp *pb.SignedProposal, prop *pb.Proposal, cis *pb.ChaincodeInvocationSpec, txsim ledger.TxSimulator) (*pb.Response, error) {
+	cds, err := putils.GetChaincodeDeploymentSpec(cis.ChaincodeSpec.Input.Args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	//this should not be a system chaincode
+	if syscc.IsSysCC(cds.ChaincodeSpec.ChaincodeId.Name) {
+		return nil, errors.Errorf("attempting to deploy a system chaincode %s/%s", cds.ChaincodeSpec.ChaincodeId.Name, chainID)
+	}
+
+	cccid := ccprovider.NewCCContext(chainID, cds.ChaincodeSpec.ChaincodeId.Name, cds.ChaincodeSpec.ChaincodeId.Version, txid, false, signedProp, prop)
 
-		_, _, err = chaincode.Execute(ctxt, cccid, cds)
+	// the proposals to the chaincode are rejected while the new version
+	// is launched, whether the upgrade succeeds or not
+	if string(cis.ChaincodeSpec.Input.Args[0]) == "upgrade" {
+		defer e.upgrades.begin(chainID, cds.ChaincodeSpec.ChaincodeId.Name)()
+	}
+
+	launched, err := e.acquireLaunch(ctxt, cccid)
+	if err != nil {
+		return launchQueueSaturatedResponse(err), nil
+	}
+	_, _, err = chaincode.Execute(ctxt, cccid, cds)
+	launched()
+	if err != nil {
+		return nil, err
+	}
+
+	e.definitions.invalidate(chainID, cds.ChaincodeSpec.ChaincodeId.Name)
+	if string(cis.ChaincodeSpec.Input.Args[0]) == "upgrade" {
+		e.observeUpgrade(chainID, cds.ChaincodeSpec.ChaincodeId, txsim)
+	}
+
+	return nil, nil
+}
+
+// observeUpgrade notifies the UpgradeObserved callback, if any, of the
+// upgrade of the chaincode to ccid.Version. The old version is the one of
+// the committed chaincode definition, which the upgrade simulated by lscc
+// in txsim does not affect.
+func (e *Endorser) observeUpgrade(chainID string, ccid *pb.ChaincodeID, txsim ledger.TxSimulator) {
+	if e.config.UpgradeObserved == nil {
+		return
+	}
+
+	event := UpgradeEvent{
+		ChannelID:     chainID,
+		ChaincodeName: ccid.Name,
+		NewVersion:    ccid.Version,
+	}
+	if txsim != nil {
+		cdbytes, err := txsim.GetState("lscc", ccid.Name)
 		if err != nil {
-			return nil, nil, err
+			endorserLogger.Warningf("failed to look up the version of chaincode %s being upgraded: %s", ccid.Name, err)
+		} else if cdbytes != nil {
+			cd := &ccprovider.ChaincodeData{}
+			if err = proto.Unmarshal(cdbytes, cd); err != nil {
+				endorserLogger.Warningf("failed to unmarshal the definition of chaincode %s being upgraded: %s", ccid.Name, err)
+			} else {
+				event.OldVersion = cd.Version
+			}
 		}
 	}
-	//----- END -------
 
-	return res, ccevent, err
+	e.config.UpgradeObserved(event)
+}
+
+// isReadOnly returns whether the invocation of the chaincode with the given
+// arguments is configured as a read-only query
+func (e *Endorser) isReadOnly(ccName string, args [][]byte) bool {
+	functions, ok := e.config.ReadOnlyFunctions[ccName]
+	if !ok {
+		return false
+	}
+	if len(functions) == 0 {
+		return true
+	}
+	if len(args) == 0 {
+		return false
+	}
+	for _, function := range functions {
+		if function == string(args[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+// lsccOperations are the operations lscc can be invoked with
+var lsccOperations = map[string]struct{}{
+	"install":                {},
+	"deploy":                 {},
+	"upgrade":                {},
+	"getid":                  {},
+	"getdepspec":             {},
+	"getccdata":              {},
+	"getchaincodes":          {},
+	"getinstalledchaincodes": {},
+}
+
+// invocationSpecError means the invocation spec of a proposal cannot be
+// handed to the chaincode
+type invocationSpecError struct {
+	msg string
+}
+
+func (e *invocationSpecError) Error() string {
+	return e.msg
 }
 
-//TO BE REMOVED WHEN JAVA CC IS ENABLED
-//disableJavaCCInst if trying to install, instantiate or upgrade Java CC
-func (e *Endorser) disableJavaCCInst(cid *pb.ChaincodeID, cis *pb.ChaincodeInvocationSpec) error {
+// validateInvocationSpec checks that the invocation spec of a proposal to
+// the chaincode carries an input with at least the function to invoke and,
+// for lscc, that the function is one of its operations, so that clients get
+// an actionable error instead of the failure of the chaincode
+func validateInvocationSpec(cid *pb.ChaincodeID, cis *pb.ChaincodeInvocationSpec) error {
+	if cis.ChaincodeSpec == nil {
+		return &invocationSpecError{msg: fmt.Sprintf("invocation of chaincode %s has no chaincode spec", cid.Name)}
+	}
+	if cis.ChaincodeSpec.Input == nil {
+		return &invocationSpecError{msg: fmt.Sprintf("invocation of chaincode %s has no input", cid.Name)}
+	}
+	if len(cis.ChaincodeSpec.Input.Args) == 0 {
+		return &invocationSpecError{msg: fmt.Sprintf("invocation of chaincode %s has no arguments, expected at least the function to invoke", cid.Name)}
+	}
+	if cid.Name != "lscc" {
+		return nil
+	}
+	op := string(cis.ChaincodeSpec.Input.Args[0])
+	if _, ok := lsccOperations[op]; !ok {
+		return &invocationSpecError{msg: fmt.Sprintf("unknown lscc operation %q", op)}
+	}
+	return nil
+}
+
+//validateChaincodeType if trying to install, instantiate or upgrade a chaincode,
+//checks that its type is supported and matches the type of the installed package.
+//Java chaincode is supported unless Java support is disabled, see javaEnabled
+func (e *Endorser) validateChaincodeType(cid *pb.ChaincodeID, cis *pb.ChaincodeInvocationSpec) error {
 	//if not lscc we don't care
 	if cid.Name != "lscc" {
 		return nil
@@ -179,7 +522,8 @@ func (e *Endorser) disableJavaCCInst(cid *pb.ChaincodeID, cis *pb.ChaincodeInvoc
 	}
 
 	var argNo int
-	switch string(cis.ChaincodeSpec.Input.Args[0]) {
+	op := string(cis.ChaincodeSpec.Input.Args[0])
+	switch op {
 	case "install":
 		argNo = 1
 	case "deploy", "upgrade":
@@ -200,41 +544,68 @@ func (e *Endorser) disableJavaCCInst(cid *pb.ChaincodeID, cis *pb.ChaincodeInvoc
 	}
 
 	cds := ccpack.GetDepSpec()
+	if cds.ChaincodeSpec == nil || cds.ChaincodeSpec.ChaincodeId == nil {
+		//leave it to lscc to reject an incomplete spec
+		return nil
+	}
 
-	if javaEnabled() {
-		endorserLogger.Debug("java chaincode enabled")
-	} else {
-		endorserLogger.Debug("java chaincode disabled")
-		//finally, if JAVA not enabled error out
-		if cds.ChaincodeSpec.Type == pb.ChaincodeSpec_JAVA {
+	if cds.ChaincodeSpec.Type == pb.ChaincodeSpec_JAVA {
+		if !javaEnabled() {
 			return errors.New("Java chaincode is work-in-progress and disabled")
 		}
+		endorserLogger.Debug("java chaincode enabled")
+	}
+
+	//the package of an install is the one being installed, there is
+	//nothing to compare it with
+	if op == "install" {
+		return nil
+	}
+
+	//the chaincode not being installed is reported by lscc
+	name, version := cds.ChaincodeSpec.ChaincodeId.Name, cds.ChaincodeSpec.ChaincodeId.Version
+	installed, err := ccprovider.GetChaincodeFromFS(name, version)
+	if err != nil {
+		return nil
+	}
+
+	installedSpec := installed.GetDepSpec().GetChaincodeSpec()
+	if installedSpec != nil && installedSpec.Type != cds.ChaincodeSpec.Type {
+		return errors.Errorf("chaincode %s:%s is installed as a %s chaincode but the proposal declares it as %s", name, version, installedSpec.Type, cds.ChaincodeSpec.Type)
 	}
 
-	//not a java install, instantiate or upgrade op
 	return nil
 }
 
 //simulate the proposal by calling the chaincode
-func (e *Endorser) simulateProposal(ctx context.Context, chainID string, txid string, signedProp *pb.SignedProposal, prop *pb.Proposal, cid *pb.ChaincodeID, txsim ledger.TxSimulator) (resourcesconfig.ChaincodeDefinition, *pb.Response, []byte, *pb.ChaincodeEvent, error) {
-	endorserLogger.Debugf("Entry - txid: %s channel id: %s", txid, chainID)
-	defer endorserLogger.Debugf("Exit")
+func (e *Endorser) simulateProposal(ctx context.Context, chainID string, txid string, signedProp *pb.SignedProposal, prop *pb.Proposal, cid *pb.ChaincodeID, txsim ledger.TxSimulator) (resourcesconfig.ChaincodeDefinition, *pb.Response, []byte, *pb.ChaincodeEvent, []string, error) {
+	logger := proposalLoggerFrom(ctx)
+	logger.Debugf("Entry - txid: %s channel id: %s", txid, chainID)
+	defer logger.Debugf("Exit")
+	ctx, span := e.startSpan(ctx, "simulateProposal")
+	defer span.End()
+	if err := ctx.Err(); err != nil {
+		return nil, nil, nil, nil, nil, errors.Wrap(err, "proposal abandoned before simulation")
+	}
 	//we do expect the payload to be a ChaincodeInvocationSpec
 	//if we are supporting other payloads in future, this be glaringly point
 	//as something that should change
 	cis, err := putils.GetChaincodeInvocationSpec(prop)
 	if err != nil {
-		return nil, nil, nil, nil, err
+		return nil, nil, nil, nil, nil, err
+	}
+	if err = validateInvocationSpec(cid, cis); err != nil {
+		return nil, nil, nil, nil, nil, err
 	}
 
-	//disable Java install,instantiate,upgrade for now
-	if err = e.disableJavaCCInst(cid, cis); err != nil {
-		return nil, nil, nil, nil, err
+	//reject Java install,instantiate,upgrade if Java is disabled
+	if err = e.validateChaincodeType(cid, cis); err != nil {
+		return nil, nil, nil, nil, nil, err
 	}
 
 	//---1. check ESCC and VSCC for the chaincode
 	if err = e.checkEsccAndVscc(prop); err != nil {
-		return nil, nil, nil, nil, err
+		return nil, nil, nil, nil, nil, err
 	}
 
 	var cdLedger resourcesconfig.ChaincodeDefinition
@@ -243,79 +614,186 @@ func (e *Endorser) simulateProposal(ctx context.Context, chainID string, txid st
 	if !syscc.IsSysCC(cid.Name) {
 		cdLedger, err = e.getCDSFromLSCC(ctx, chainID, txid, signedProp, prop, cid.Name, txsim)
 		if err != nil {
-			return nil, nil, nil, nil, errors.WithMessage(err, fmt.Sprintf("make sure the chaincode %s has been successfully instantiated and try again", cid.Name))
+			return nil, nil, nil, nil, nil, errors.WithMessage(err, fmt.Sprintf("make sure the chaincode %s has been successfully instantiated and try again", cid.Name))
 		}
 		version = cdLedger.CCVersion()
 
 		err = ccprovider.CheckInsantiationPolicy(cid.Name, version, cdLedger.(*ccprovider.ChaincodeData))
 		if err != nil {
-			return nil, nil, nil, nil, err
+			return nil, nil, nil, nil, nil, instantiationPolicyError(err, cid.Name, version, cdLedger.(*ccprovider.ChaincodeData), signedProp)
 		}
 	} else {
 		version = util.GetSysCCVersion()
 	}
 
+	if e.isDeprecated(cid.Name, version) {
+		e.recordDeprecatedInvocation(ctx, cid.Name, version)
+	}
+	ctx = withChaincodeDefinition(ctx, cdLedger)
+
 	//---3. execute the proposal and get simulation results
 	var simResult *ledger.TxSimulationResults
 	var pubSimResBytes []byte
 	var res *pb.Response
 	var ccevent *pb.ChaincodeEvent
-	res, ccevent, err = e.callChaincode(ctx, chainID, version, txid, signedProp, prop, cis, cid, txsim)
+	var recipients []string
+	var cacheKey string
+	var cached *cachedSimulation
+	if txsim != nil && e.endorsementCache != nil {
+		if cacheKey, err = endorsementCacheKey(chainID, cid.Name, version, prop); err != nil {
+			return nil, nil, nil, nil, nil, err
+		}
+		cached = e.endorsementCache.get(cacheKey)
+	}
+	if cached != nil {
+		logger.Debugf("replaying cached simulation of chaincode %s on transaction %s", cid.Name, txid)
+		res, err = cached.replay(txsim)
+	} else {
+		scope := proposalMetricsFrom(ctx)
+		var start time.Time
+		if scope != nil {
+			start = time.Now()
+		}
+		res, ccevent, err = e.callChaincodeChecked(ctx, chainID, version, txid, signedProp, prop, cis, cid, txsim)
+		if scope != nil {
+			scope.Histogram("chaincode_duration").RecordDuration(time.Since(start))
+		}
+	}
 	if err != nil {
-		endorserLogger.Errorf("failed to invoke chaincode %s on transaction %s, error: %+v", cid, txid, err)
-		return nil, nil, nil, nil, err
+		logger.Errorf("failed to invoke chaincode %s on transaction %s, error: %+v", cid, txid, err)
+		return nil, nil, nil, nil, nil, err
+	}
+
+	e.events.emitted(chainID, txid, ccevent)
+	if ccevent != nil && e.isReadOnly(cid.Name, cis.ChaincodeSpec.Input.Args) {
+		logger.Debugf("dropping event %s emitted by read-only chaincode %s on transaction %s", ccevent.EventName, cid.Name, txid)
+		ccevent = nil
 	}
 
 	if txsim != nil {
 		if simResult, err = txsim.GetTxSimulationResults(); err != nil {
-			return nil, nil, nil, nil, err
+			return nil, nil, nil, nil, nil, err
+		}
+		if pubSimResBytes, err = simResult.GetPubSimulationBytes(); err != nil {
+			return nil, nil, nil, nil, nil, err
+		}
+
+		// a stale simulation is dropped before its private data, if any,
+		// reaches other peers
+		if cached != nil && cached.isStale(pubSimResBytes) {
+			logger.Debugf("cached simulation of chaincode %s is stale, transaction %s is to be simulated again", cid.Name, txid)
+			e.endorsementCache.evict(cacheKey, cached)
+			return nil, nil, nil, nil, nil, errStaleSimulation
 		}
 
 		if simResult.PvtSimulationResults != nil {
-			if err := e.distributePrivateData(chainID, txid, simResult.PvtSimulationResults); err != nil {
-				return nil, nil, nil, nil, err
+			if recipients, err = e.distribute(ctx, chainID, txid, simResult.PvtSimulationResults); err != nil {
+				return nil, nil, nil, nil, nil, err
 			}
 		}
-		if pubSimResBytes, err = simResult.GetPubSimulationBytes(); err != nil {
-			return nil, nil, nil, nil, err
+		if cached == nil && cacheKey != "" && ccevent == nil && res.Status < shim.ERRORTHRESHOLD {
+			e.endorsementCache.store(cacheKey, res, pubSimResBytes)
 		}
 	}
-	return cdLedger, res, pubSimResBytes, ccevent, nil
+	return cdLedger, res, pubSimResBytes, ccevent, recipients, nil
 }
 
 func (e *Endorser) getCDSFromLSCC(ctx context.Context, chainID string, txid string, signedProp *pb.SignedProposal, prop *pb.Proposal, chaincodeID string, txsim ledger.TxSimulator) (resourcesconfig.ChaincodeDefinition, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Wrap(err, "chaincode definition lookup aborted")
+	}
+
+	// the derived context keeps the deadline of the proposal along with
+	// the tx simulator
 	ctxt := ctx
+	var state []byte
 	if txsim != nil {
 		ctxt = context.WithValue(ctx, chaincode.TXSimulatorKey, txsim)
+
+		var err error
+		if state, err = getStateWithin(ctx, txsim, "lscc", chaincodeID); err != nil {
+			return nil, err
+		}
+		if cd := e.definitions.get(chainID, chaincodeID, state); cd != nil {
+			return cd, nil
+		}
+	}
+
+	cd, err := chaincode.GetChaincodeDefinition(ctxt, txid, signedProp, prop, chainID, chaincodeID)
+	if err != nil {
+		return nil, err
+	}
+	e.definitions.put(chainID, chaincodeID, state, cd)
+	return cd, nil
+}
+
+// getStateWithin reads the key from the tx simulator, giving up once the
+// context is done; the read itself cannot be interrupted, and its result is
+// dropped when it completes too late
+func getStateWithin(ctx context.Context, txsim ledger.TxSimulator, namespace string, key string) ([]byte, error) {
+	if ctx.Done() == nil {
+		return txsim.GetState(namespace, key)
 	}
 
-	return chaincode.GetChaincodeDefinition(ctxt, txid, signedProp, prop, chainID, chaincodeID)
+	type stateRead struct {
+		value []byte
+		err   error
+	}
+	read := make(chan stateRead, 1)
+	go func() {
+		value, err := txsim.GetState(namespace, key)
+		read <- stateRead{value, err}
+	}()
+	select {
+	case r := <-read:
+		return r.value, r.err
+	case <-ctx.Done():
+		return nil, errors.Wrapf(ctx.Err(), "reading %s/%s aborted", namespace, key)
+	}
+}
+
+// resolveESCC returns the name of the ESCC endorsing a proposal to the
+// chaincode: the ESCC selected by the endorsement handlers if any, otherwise
+// the ESCC of its definition, or escc for the system chaincodes, which have
+// no definition
+func (e *Endorser) resolveESCC(chainID string, ccid *pb.ChaincodeID, cd resourcesconfig.ChaincodeDefinition) (string, error) {
+	escc := "escc"
+	if cd != nil {
+		// LSCC always fills this field
+		escc = cd.Endorsement()
+	}
+
+	escc = endorsement.Select(chainID, ccid.Name, escc, e.selectors...)
+	if escc == "" {
+		return "", errors.Errorf("no ESCC specified in the definition of chaincode %s on channel %s", ccid.Name, chainID)
+	}
+	return escc, nil
 }
 
 //endorse the proposal by calling the ESCC
 func (e *Endorser) endorseProposal(ctx context.Context, chainID string, txid string, signedProp *pb.SignedProposal, proposal *pb.Proposal, response *pb.Response, simRes []byte, event *pb.ChaincodeEvent, visibility []byte, ccid *pb.ChaincodeID, txsim ledger.TxSimulator, cd resourcesconfig.ChaincodeDefinition) (*pb.ProposalResponse, error) {
-	endorserLogger.Debugf("Entry - txid: %s channel id: %s chaincode id: %s", txid, chainID, ccid)
-	defer endorserLogger.Debugf("Exit")
+	logger := proposalLoggerFrom(ctx)
+	logger.Debugf("Entry - txid: %s channel id: %s chaincode id: %s", txid, chainID, ccid)
+	defer logger.Debugf("Exit")
+	ctx, span := e.startSpan(ctx, "endorseProposal")
+	defer span.End()
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Wrap(err, "proposal abandoned before endorsement")
+	}
 
 	isSysCC := cd == nil
 	// 1) extract the name of the escc that is requested to endorse this chaincode
-	var escc string
-	//ie, not "lscc" or system chaincodes
-	if isSysCC {
-		// FIXME: getCDSFromLSCC seems to fail for lscc - not sure this is expected?
-		// TODO: who should endorse a call to LSCC?
-		escc = "escc"
-	} else {
-		escc = cd.Endorsement()
-		if escc == "" { // this should never happen, LSCC always fills this field
-			panic("No ESCC specified in ChaincodeData")
-		}
+	escc, err := e.resolveESCC(chainID, ccid, cd)
+	if err != nil {
+		return nil, err
 	}
 
-	endorserLogger.Debugf("info: escc for chaincode id %s is %s", ccid, escc)
+	logger.Debugf("info: escc for chaincode id %s is %s", ccid, escc)
+	if !syscc.IsSysCCAvailable(escc) {
+		return nil, errors.Errorf("endorsement plugin %s not available for chaincode %s", escc, ccid.Name)
+	}
 
 	// marshalling event bytes
-	var err error
 	var eventBytes []byte
 	if event != nil {
 		eventBytes, err = putils.GetBytesChaincodeEvent(event)
@@ -353,10 +831,16 @@ func (e *Endorser) endorseProposal(ctx context.Context, chainID string, txid str
 	// args[5] - binary blob of simulation results
 	// args[6] - serialized events
 	// args[7] - payloadVisibility
+	// args[8] - status the endorsed responses are below, only passed with a failure to endorse
 	args := [][]byte{[]byte(""), proposal.Header, proposal.Payload, ccidBytes, resBytes, simRes, eventBytes, visibility}
+	if e.endorsesFailure(response.Status) {
+		args = append(args, e.failureThresholdArg())
+	}
 	version := util.GetSysCCVersion()
 	ecccis := &pb.ChaincodeInvocationSpec{ChaincodeSpec: &pb.ChaincodeSpec{Type: pb.ChaincodeSpec_GOLANG, ChaincodeId: &pb.ChaincodeID{Name: escc}, Input: &pb.ChaincodeInput{Args: args}}}
+	signingStart := time.Now()
 	res, _, err := e.callChaincode(ctx, chainID, version, txid, signedProp, proposal, ecccis, &pb.ChaincodeID{Name: escc}, txsim)
+	e.signingObserved(ctx, ccid.Name, escc, txid, time.Since(signingStart))
 	if err != nil {
 		return nil, err
 	}
@@ -381,56 +865,149 @@ func (e *Endorser) endorseProposal(ctx context.Context, chainID string, txid str
 		return nil, err
 	}
 
+	if err = e.endorseWithEpochKey(pResp); err != nil {
+		return nil, err
+	}
+
+	if err = e.endorseCollections(pResp, simRes); err != nil {
+		return nil, err
+	}
+
 	return pResp, nil
 }
 
 // ProcessProposal process the Proposal
 func (e *Endorser) ProcessProposal(ctx context.Context, signedProp *pb.SignedProposal) (*pb.ProposalResponse, error) {
-	endorserLogger.Debugf("Entry")
-	defer endorserLogger.Debugf("Exit")
+	processed, err := e.proposalsInFlight.enter()
+	if err != nil {
+		pResp := stoppedResponse(err)
+		return pResp, statusError(ctx, pResp, err)
+	}
+	defer processed()
+
+	// oversized proposals are rejected before anything is unmarshalled
+	if err = e.checkProposalSize(signedProp); err != nil {
+		endorserLogger.Warningf("%s", err)
+		pResp := failureResponse(validationError, err)
+		return pResp, statusError(ctx, pResp, err)
+	}
+
+	var scope metrics.Scope
+	if len(e.config.Tenants) > 0 || e.config.Metrics != nil {
+		chainID, ccName := proposalTarget(signedProp)
+		tenant := e.resolveTenant(chainID, ccName)
+		if tenant != "" {
+			ctx = context.WithValue(ctx, tenantKey, tenant)
+		}
+		scope = e.proposalMetrics(chainID, ccName, tenant)
+	}
+	var start time.Time
+	if scope != nil {
+		ctx = context.WithValue(ctx, metricsKey, scope)
+		scope.Counter("proposals_received").Inc(1)
+		start = time.Now()
+	}
+
+	ctx, span := e.startProposalSpan(ctx, signedProp)
+	pResp, err := e.processProposal(ctx, signedProp)
+	if err != nil && e.config.CorrelationIDs {
+		pResp, err = correlateFailure(proposalLoggerFrom(ctx), pResp, err)
+	}
+	if err != nil {
+		e.deadLetters.capture(signedProp, pResp, err)
+	}
+
+	if scope != nil {
+		scope.Histogram("proposal_duration").RecordDuration(time.Since(start))
+		if err != nil {
+			scope.Counter("proposals_failed").Inc(1)
+			// failures of the chaincode itself, as opposed to the
+			// failures of the peer
+			if _, ok := errors.Cause(err).(*chaincodeError); ok {
+				scope.Counter("proposals_chaincode_failed").Inc(1)
+			}
+		} else {
+			scope.Counter("proposals_succeeded").Inc(1)
+		}
+	}
+	endProposalSpan(span, pResp, err)
+	return pResp, statusError(ctx, pResp, err)
+}
+
+func (e *Endorser) processProposal(ctx context.Context, signedProp *pb.SignedProposal) (*pb.ProposalResponse, error) {
+	logger := proposalLoggerFrom(ctx)
+	logger.Debugf("Entry")
+	defer logger.Debugf("Exit")
 	// at first, we check whether the message is valid
+	_, span := e.startSpan(ctx, "validateProposal")
 	prop, hdr, hdrExt, err := validation.ValidateProposalMessage(signedProp)
+	span.End()
 	if err != nil {
-		return &pb.ProposalResponse{Response: &pb.Response{Status: 500, Message: err.Error()}}, err
+		return failureResponse(validationError, err), err
 	}
 
 	chdr, err := putils.UnmarshalChannelHeader(hdr.ChannelHeader)
 	if err != nil {
-		return &pb.ProposalResponse{Response: &pb.Response{Status: 500, Message: err.Error()}}, err
+		return failureResponse(validationError, err), err
 	}
 
 	shdr, err := putils.GetSignatureHeader(hdr.SignatureHeader)
 	if err != nil {
-		return &pb.ProposalResponse{Response: &pb.Response{Status: 500, Message: err.Error()}}, err
+		return failureResponse(validationError, err), err
 	}
 
 	// block invocations to security-sensitive system chaincodes
-	if syscc.IsSysCCAndNotInvokableExternal(hdrExt.ChaincodeId.Name) {
-		endorserLogger.Errorf("Error: an attempt was made by %#v to invoke system chaincode %s",
+	if e.isSysCCAndNotInvokableExternal(hdrExt.ChaincodeId.Name) {
+		logger.Errorf("Error: an attempt was made by %#v to invoke system chaincode %s",
 			shdr.Creator, hdrExt.ChaincodeId.Name)
 		err = errors.Errorf("chaincode %s cannot be invoked through a proposal", hdrExt.ChaincodeId.Name)
-		return &pb.ProposalResponse{Response: &pb.Response{Status: 500, Message: err.Error()}}, err
+		return failureResponse(validationError, err), err
 	}
 
 	chainID := chdr.ChannelId
 
+	// proposals to system chaincodes, chainless ones included, are never
+	// rate limited, nor rejected during upgrades
+	if !syscc.IsSysCC(hdrExt.ChaincodeId.Name) {
+		if retryAfter := e.rates.take(chainID, time.Now()); retryAfter > 0 {
+			err = errors.Errorf("proposal rate limit of channel %s exceeded, retry after %s", chainID, retryAfter)
+			return rateLimitedResponse(err), err
+		}
+		if err = e.upgrades.check(chainID, hdrExt.ChaincodeId.Name); err != nil {
+			return chaincodeUpgradingResponse(err), err
+		}
+	}
+
 	// Check for uniqueness of prop.TxID with ledger
 	// Notice that ValidateProposalMessage has already verified
 	// that TxID is computed properly
 	txid := chdr.TxId
 	if txid == "" {
 		err = errors.New("invalid txID. It must be different from the empty string")
-		return &pb.ProposalResponse{Response: &pb.Response{Status: 500, Message: err.Error()}}, err
+		return failureResponse(validationError, err), err
 	}
-	endorserLogger.Debugf("processing txid: %s", txid)
+	logger.Debugf("processing txid: %s", txid)
+	// queries are never committed, so their txids need not be unique
+	queryOnly := isQueryOnly(ctx)
+	// the ledger is looked up once, and serves the whole proposal
+	var lgr ledger.PeerLedger
+	// whether the txid may have been received before
+	var received bool
 	if chainID != "" {
 		// here we handle uniqueness check and ACLs for proposals targeting a chain
-		lgr := peer.GetLedger(chainID)
-		if lgr == nil {
-			return nil, errors.Errorf("failed to look up the ledger for channel %s", chainID)
+		if lgr, err = getLedger(chainID); err != nil {
+			return failureResponse(internalError, err), err
 		}
-		if _, err := lgr.GetTransactionByID(txid); err == nil {
-			return nil, errors.Errorf("duplicate transaction found [%s]. Creator [%x]", txid, shdr.Creator)
+		// the ledger is searched for every txid, whether the filter has
+		// seen it or not: the filter forgets txids, and never sees the
+		// ones endorsed by other peers
+		if !queryOnly {
+			received = e.txIDs.seen(chainID, txid)
+			if _, err := lgr.GetTransactionByID(txid); err == nil {
+				e.responses.evict(chainID, txid)
+				err = errors.Errorf("duplicate transaction found [%s]. Creator [%x]", txid, shdr.Creator)
+				return failureResponse(validationError, err), err
+			}
 		}
 
 		// check ACL only for application chaincodes; ACLs
@@ -438,7 +1015,7 @@ func (e *Endorser) ProcessProposal(ctx context.Context, signedProp *pb.SignedPro
 		if !syscc.IsSysCC(hdrExt.ChaincodeId.Name) {
 			// check that the proposal complies with the channel's writers
 			if err = e.checkACL(signedProp, chdr, shdr, hdrExt); err != nil {
-				return &pb.ProposalResponse{Response: &pb.Response{Status: 500, Message: err.Error()}}, err
+				return failureResponse(validationError, err), err
 			}
 		}
 	} else {
@@ -448,24 +1025,43 @@ func (e *Endorser) ProcessProposal(ctx context.Context, signedProp *pb.SignedPro
 		// MSP of the peer instead by the call to ValidateProposalMessage above
 	}
 
+	if e.config.TxIDValidator != nil {
+		if err = e.config.TxIDValidator(chainID, txid, shdr.Creator); err != nil {
+			err = errors.WithMessage(err, fmt.Sprintf("txid %s rejected", txid))
+			return failureResponse(validationError, err), err
+		}
+	}
+
+	// a client retrying a proposal not committed yet gets the response it
+	// may have missed; a txid the filter has not seen has none
+	if chainID != "" && !queryOnly && received {
+		if pResp := e.responses.get(chainID, txid, signedProp, time.Now()); pResp != nil {
+			logger.Debugf("returning the cached response to txid: %s", txid)
+			return pResp, nil
+		}
+	}
+
 	// obtaining once the tx simulator for this proposal. This will be nil
 	// for chainless proposals
 	// Also obtain a history query executor for history queries, since tx simulator does not cover history
 	var txsim ledger.TxSimulator
 	var historyQueryExecutor ledger.HistoryQueryExecutor
 	if chainID != "" {
-		if txsim, err = e.getTxSimulator(chainID, txid); err != nil {
-			return &pb.ProposalResponse{Response: &pb.Response{Status: 500, Message: err.Error()}}, err
-		}
-		if historyQueryExecutor, err = e.getHistoryQueryExecutor(chainID); err != nil {
-			return &pb.ProposalResponse{Response: &pb.Response{Status: 500, Message: err.Error()}}, err
+		if !queryOnly {
+			if historyQueryExecutor, err = e.newHistoryQueryExecutorOn(lgr, chainID); err != nil {
+				return failureResponse(internalError, err), err
+			}
+			// Add the historyQueryExecutor to context
+			// TODO shouldn't we also add txsim to context here as well? Rather than passing txsim parameter
+			// around separately, since eventually it gets added to context anyways
+			ctx = context.WithValue(ctx, chaincode.HistoryQueryExecutorKey, historyQueryExecutor)
 		}
-		// Add the historyQueryExecutor to context
-		// TODO shouldn't we also add txsim to context here as well? Rather than passing txsim parameter
-		// around separately, since eventually it gets added to context anyways
-		ctx = context.WithValue(ctx, chaincode.HistoryQueryExecutorKey, historyQueryExecutor)
 
-		defer txsim.Done()
+		defer func() {
+			if txsim != nil {
+				txsim.Done()
+			}
+		}()
 	}
 	//this could be a request to a chainless SysCC
 
@@ -474,14 +1070,82 @@ func (e *Endorser) ProcessProposal(ctx context.Context, signedProp *pb.SignedPro
 	//       we're trying to emulate a submitting peer. On the other hand, we need
 	//       to validate the supplied action before endorsing it
 
-	//1 -- simulate
-	cd, res, simulationResult, ccevent, err := e.simulateProposal(ctx, chainID, txid, signedProp, prop, hdrExt.ChaincodeId, txsim)
+	//1 -- simulate, with a fresh tx simulator for every attempt
+	release, err := e.proposals.acquire(ctx, hdrExt.ChaincodeId.Name)
 	if err != nil {
-		return &pb.ProposalResponse{Response: &pb.Response{Status: 500, Message: err.Error()}}, err
+		return proposalsSaturatedResponse(err), err
+	}
+	var cd resourcesconfig.ChaincodeDefinition
+	var res *pb.Response
+	var simulationResult []byte
+	var ccevent *pb.ChaincodeEvent
+	var pvtDataRecipients []string
+	// queries are simulated on a query executor rather than a simulator;
+	// a read-only function or a query submitted through ProcessQuery that
+	// writes after all fails
+	lightweight := chainID != "" && (queryOnly || (e.config.LightweightQueries && e.isReadOnlyProposal(signedProp)))
+	for attempt := 1; ; attempt++ {
+		var query *querySimulator
+		if chainID != "" {
+			if lightweight {
+				if query, err = newQuerySimulator(lgr); err == nil {
+					txsim = query
+				}
+			} else {
+				txsim, err = e.newTxSimulatorOn(lgr, chainID, txid)
+			}
+			if err != nil {
+				if e.retryTransient(ctx, attempt, err) {
+					continue
+				}
+				release()
+				return failureResponse(internalError, err), err
+			}
+		}
+
+		cd, res, simulationResult, ccevent, pvtDataRecipients, err = e.simulateProposal(ctx, chainID, txid, signedProp, prop, hdrExt.ChaincodeId, txsim)
+		if err == errStaleSimulation {
+			// the stale simulator is released before another one is
+			// opened, which could otherwise wait behind a commit waiting
+			// for it
+			txsim.Done()
+			txsim = nil
+			continue
+		}
+		if query != nil && query.attemptedWrite() {
+			// the write was refused, whatever the chaincode made of the
+			// refusal: the proposal is not a query after all. It is not
+			// simulated again under the same txid, the chaincode possibly
+			// still unwinding the first execution.
+			if queryOnly {
+				err = errors.Errorf("query to chaincode %s attempted to write", hdrExt.ChaincodeId.Name)
+			} else {
+				err = errors.Errorf("read-only function of chaincode %s attempted to write", hdrExt.ChaincodeId.Name)
+			}
+			break
+		}
+		if err == nil || !e.retryTransient(ctx, attempt, err) {
+			break
+		}
+		if txsim != nil {
+			txsim.Done()
+			txsim = nil
+		}
+	}
+	release()
+	if err != nil {
+		if categorize(err) == distributionError {
+			return pvtDataDistributionFailedResponse(err), err
+		}
+		return failureResponse(categorize(err), err), err
 	}
 	if res != nil {
-		if res.Status >= shim.ERROR {
-			endorserLogger.Errorf("simulateProposal() resulted in chaincode response status %d for txid: %s", res.Status, txid)
+		// failures, between ERRORTHRESHOLD and ERROR included, are never
+		// endorsed unless configured to be: the response is an error
+		// either way, the ESCC would sign it for nothing. Chainless
+		// proposals are not endorsed, their failures included.
+		if res.Status >= shim.ERRORTHRESHOLD && (chainID == "" || !e.endorsesFailure(res.Status)) {
+			logger.Errorf("simulateProposal() resulted in chaincode response status %d for txid: %s", res.Status, txid)
 			var cceventBytes []byte
 			if ccevent != nil {
 				cceventBytes, err = putils.GetBytesChaincodeEvent(ccevent)
@@ -491,10 +1155,12 @@ func (e *Endorser) ProcessProposal(ctx context.Context, signedProp *pb.SignedPro
 			}
 			pResp, err := putils.CreateProposalResponseFailure(prop.Header, prop.Payload, res, simulationResult, cceventBytes, hdrExt.ChaincodeId, hdrExt.PayloadVisibility)
 			if err != nil {
-				return &pb.ProposalResponse{Response: &pb.Response{Status: 500, Message: err.Error()}}, err
+				return failureResponse(internalError, err), err
 			}
 
-			return pResp, &chaincodeError{res.Status, res.Message}
+			cerr := &chaincodeError{status: res.Status, msg: res.Message, category: chaincodeFailure}
+			pResp.Response.Message = categorizedMessage(chaincodeFailure, res.Message)
+			return pResp, cerr
 		}
 	}
 
@@ -506,14 +1172,34 @@ func (e *Endorser) ProcessProposal(ctx context.Context, signedProp *pb.SignedPro
 	if chainID == "" {
 		pResp = &pb.ProposalResponse{Response: res}
 	} else {
+		if err = e.delayEndorsement(ctx, hdrExt.ChaincodeId.Name); err != nil {
+			return failureResponse(categorize(err), err), err
+		}
+		if e.endorsesFailure(res.Status) {
+			if simulationResult, err = failureSimulationResults(); err != nil {
+				return failureResponse(internalError, err), err
+			}
+		}
 		pResp, err = e.endorseProposal(ctx, chainID, txid, signedProp, prop, res, simulationResult, ccevent, hdrExt.PayloadVisibility, hdrExt.ChaincodeId, txsim, cd)
 		if err != nil {
-			return &pb.ProposalResponse{Response: &pb.Response{Status: 500, Message: err.Error()}}, err
+			return failureResponse(endorsementError, err), err
 		}
 		if pResp != nil {
+			e.describeEndorsement(pResp)
+			e.flagOutsideEndorsementPolicy(chainID, pResp, cd)
+			if e.endorsesFailure(res.Status) && pResp.Endorsement != nil {
+				// the ESCC reports the signing itself as a success, the
+				// failure being in the signed payload
+				logger.Warningf("Endorsed chaincode response status %d for txid: %s", res.Status, txid)
+				pResp.Response = &pb.Response{Status: res.Status, Message: categorizedMessage(chaincodeFailure, res.Message), Payload: res.Payload}
+				return pResp, nil
+			}
+			// a failure the ESCC refused to endorse
 			if res.Status >= shim.ERRORTHRESHOLD {
-				endorserLogger.Debugf("endorseProposal() resulted in chaincode error for txid: %s", txid)
-				return pResp, &chaincodeError{res.Status, res.Message}
+				logger.Debugf("endorseProposal() resulted in chaincode error for txid: %s", txid)
+				cerr := &chaincodeError{status: res.Status, msg: res.Message, category: chaincodeFailure}
+				pResp.Response.Message = categorizedMessage(chaincodeFailure, res.Message)
+				return pResp, cerr
 			}
 		}
 	}
@@ -522,7 +1208,15 @@ func (e *Endorser) ProcessProposal(ctx context.Context, signedProp *pb.SignedPro
 	// contains the "return value" from the
 	// chaincode invocation
 	pResp.Response.Payload = res.Payload
+	pResp.PrivateDataRecipients = pvtDataRecipients
+
+	if version := ccVersion(cd); e.isDeprecated(hdrExt.ChaincodeId.Name, version) {
+		pResp.Warnings = append(pResp.Warnings, deprecationWarning(hdrExt.ChaincodeId.Name, version))
+	}
 
+	if chainID != "" && !queryOnly {
+		e.responses.store(chainID, txid, signedProp, pResp, time.Now())
+	}
 	return pResp, nil
 }
 
@@ -535,9 +1229,9 @@ func (e *Endorser) commitTxSimulation(proposal *pb.Proposal, chainID string, sig
 		return err
 	}
 
-	lgr := peer.GetLedger(chainID)
-	if lgr == nil {
-		return errors.Errorf("failed to look up the ledger for channel %s", chainID)
+	lgr, err := getLedger(chainID)
+	if err != nil {
+		return err
 	}
 
 	txBytes, err := proto.Marshal(tx)
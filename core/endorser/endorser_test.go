@@ -7,16 +7,25 @@ SPDX-License-Identifier: Apache-2.0
 package endorser
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
-	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -25,17 +34,28 @@ import (
 	"github.com/golang/protobuf/proto"
 	"github.com/hyperledger/fabric/bccsp"
 	"github.com/hyperledger/fabric/bccsp/factory"
+	"github.com/hyperledger/fabric/common/cauthdsl"
+	"github.com/hyperledger/fabric/common/flogging"
+	"github.com/hyperledger/fabric/common/metrics"
+	mockconfigtx "github.com/hyperledger/fabric/common/mocks/configtx"
 	mockpolicies "github.com/hyperledger/fabric/common/mocks/policies"
-	//"github.com/hyperledger/fabric/common/flogging"
 	"github.com/hyperledger/fabric/common/policies"
+	"github.com/hyperledger/fabric/common/resourcesconfig"
 	"github.com/hyperledger/fabric/common/util"
 	"github.com/hyperledger/fabric/core/aclmgmt"
 	"github.com/hyperledger/fabric/core/aclmgmt/mocks"
 	"github.com/hyperledger/fabric/core/chaincode"
 	"github.com/hyperledger/fabric/core/chaincode/accesscontrol"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
 	"github.com/hyperledger/fabric/core/common/ccprovider"
 	"github.com/hyperledger/fabric/core/config"
 	"github.com/hyperledger/fabric/core/container"
+	"github.com/hyperledger/fabric/core/container/inproccontroller"
+	"github.com/hyperledger/fabric/core/handlers/decoration"
+	"github.com/hyperledger/fabric/core/handlers/endorsement"
+	"github.com/hyperledger/fabric/core/handlers/library"
+	"github.com/hyperledger/fabric/core/ledger"
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/rwsetutil"
 	"github.com/hyperledger/fabric/core/peer"
 	syscc "github.com/hyperledger/fabric/core/scc"
 	"github.com/hyperledger/fabric/core/testutil"
@@ -45,16 +65,231 @@ import (
 	"github.com/hyperledger/fabric/protos/common"
 	pb "github.com/hyperledger/fabric/protos/peer"
 	pbutils "github.com/hyperledger/fabric/protos/utils"
+	"github.com/pkg/errors"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 )
 
 var endorserServer pb.EndorserServer
 var signer msp.SigningIdentity
 
+// testCCName is the name of an in-process application chaincode, so that
+// tests can exercise endorsement without a container
+const testCCName = "endorsertestcc"
+
+// testCCVersion is the version the test chaincodes are defined with
+const testCCVersion = "1.0"
+
+// testCCNames are the names under which the test chaincode is deployed, so
+// that tests can chain invocations across distinct chaincodes
+var testCCNames = []string{testCCName, testCCName + "2", testCCName + "3"}
+
+// testCC is the chaincode deployed as testCCNames
+type testCC struct{}
+
+// testCCInvocations counts the invocations of the nondeterministic function
+var testCCInvocations int64
+
+// testCCGets counts the invocations of the get function
+var testCCGets int64
+
+// testCCSleeping counts the invocations of the sleep function in progress,
+// testCCMaxSleeping is the highest it got to
+var testCCSleeping, testCCMaxSleeping int64
+
+func (*testCC) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	return shim.Success(nil)
+}
+
+func (*testCC) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	f, args := stub.GetFunctionAndParameters()
+	switch f {
+	case "put":
+		if len(args) != 2 {
+			return shim.Error("put expects a key and a value")
+		}
+		if err := stub.PutState(args[0], []byte(args[1])); err != nil {
+			return shim.Error(err.Error())
+		}
+		return shim.Success(nil)
+	case "get":
+		if len(args) != 1 {
+			return shim.Error("get expects a key")
+		}
+		atomic.AddInt64(&testCCGets, 1)
+		val, err := stub.GetState(args[0])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		return shim.Success(val)
+	case "nondeterministic":
+		// every invocation writes and returns a different value
+		value := []byte(fmt.Sprintf("%d", atomic.AddInt64(&testCCInvocations, 1)))
+		if err := stub.PutState("nondeterministic", value); err != nil {
+			return shim.Error(err.Error())
+		}
+		return shim.Success(value)
+	case "call":
+		if len(args) < 1 {
+			return shim.Error("call expects a chaincode name and the arguments to invoke it with")
+		}
+		res := stub.InvokeChaincode(args[0], util.ToChaincodeArgs(args[1:]...), "")
+		if res.Status != shim.OK {
+			// errors raised by the peer come in the payload
+			if res.Message == "" {
+				return shim.Error(string(res.Payload))
+			}
+			return shim.Error(res.Message)
+		}
+		return res
+	case "sleep":
+		if len(args) != 1 {
+			return shim.Error("sleep expects a value to return")
+		}
+		sleeping := atomic.AddInt64(&testCCSleeping, 1)
+		for {
+			max := atomic.LoadInt64(&testCCMaxSleeping)
+			if sleeping <= max || atomic.CompareAndSwapInt64(&testCCMaxSleeping, max, sleeping) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt64(&testCCSleeping, -1)
+		return shim.Success([]byte(args[0]))
+	case "emit":
+		if len(args) != 1 {
+			return shim.Error("emit expects an event name")
+		}
+		if err := stub.SetEvent(args[0], []byte(args[0])); err != nil {
+			return shim.Error(err.Error())
+		}
+		return shim.Success(nil)
+	case "fail":
+		// writes a key and emits an event before failing
+		if len(args) != 1 {
+			return shim.Error("fail expects a key")
+		}
+		if err := stub.PutState(args[0], []byte(args[0])); err != nil {
+			return shim.Error(err.Error())
+		}
+		if err := stub.SetEvent(args[0], []byte(args[0])); err != nil {
+			return shim.Error(err.Error())
+		}
+		return shim.Error("failed on purpose")
+	case "respond":
+		// responds with the given status, compliant or not
+		if len(args) != 1 {
+			return shim.Error("respond expects a status")
+		}
+		status, err := strconv.Atoi(args[0])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		return pb.Response{Status: int32(status), Message: "status " + args[0]}
+	default:
+		return shim.Error(fmt.Sprintf("unknown function %s", f))
+	}
+}
+
+// testCCPath is the path the test chaincode of the given name is
+// registered under with the in-process controller
+func testCCPath(name string) string {
+	return "github.com/hyperledger/fabric/core/endorser/" + name
+}
+
+// testCCDeploymentSpec is the deployment spec of the test chaincode of the
+// given name, installed on the file system and run in process
+func testCCDeploymentSpec(name string) *pb.ChaincodeDeploymentSpec {
+	return &pb.ChaincodeDeploymentSpec{
+		ChaincodeSpec: &pb.ChaincodeSpec{
+			Type:        pb.ChaincodeSpec_GOLANG,
+			ChaincodeId: &pb.ChaincodeID{Name: name, Path: testCCPath(name), Version: testCCVersion},
+			Input:       &pb.ChaincodeInput{Args: util.ToChaincodeArgs("init")},
+		},
+		ExecEnv: pb.ChaincodeDeploymentSpec_SYSTEM,
+	}
+}
+
+// launchTestCCs installs the test chaincodes and launches them in process
+// as application chaincodes, which need no container; they are invoked
+// once their definitions are committed by defineTestCCs
+func launchTestCCs(chainID string) error {
+	lgr := peer.GetLedger(chainID)
+	for _, name := range testCCNames {
+		if err := inproccontroller.Register(testCCPath(name), &testCC{}); err != nil {
+			return err
+		}
+		cds := testCCDeploymentSpec(name)
+		if err := ccprovider.PutChaincodeIntoFS(cds); err != nil {
+			return err
+		}
+
+		txid := util.GenerateUUID()
+		ctxt, txsim, err := ccprovider.GetChaincodeProvider().GetContext(lgr, txid)
+		if err != nil {
+			return err
+		}
+		cccid := ccprovider.NewCCContext(chainID, name, testCCVersion, txid, false, nil, nil)
+		_, _, err = chaincode.Execute(ctxt, cccid, cds)
+		txsim.Done()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// defineTestCCs commits the definitions of the test chaincodes to lscc, as
+// instantiating them would
+func defineTestCCs(chainID string) error {
+	lgr := peer.GetLedger(chainID)
+	txsim, err := lgr.NewTxSimulator(util.GenerateUUID())
+	if err != nil {
+		return err
+	}
+	defer txsim.Done()
+	for _, name := range testCCNames {
+		cd := &ccprovider.ChaincodeData{Name: name, Version: testCCVersion, Escc: "escc", Vscc: "vscc"}
+		if err = txsim.SetState("lscc", name, pbutils.MarshalOrPanic(cd)); err != nil {
+			return err
+		}
+	}
+	simRes, err := txsim.GetTxSimulationResults()
+	if err != nil {
+		return err
+	}
+	pubSimRes, err := simRes.GetPubSimulationBytes()
+	if err != nil {
+		return err
+	}
+
+	prop, _, err := getChaincodeProposal(chainID, "lscc", "deploy")
+	if err != nil {
+		return err
+	}
+	pResp, err := pbutils.CreateProposalResponse(prop.Header, prop.Payload, &pb.Response{Status: shim.OK}, pubSimRes, nil, &pb.ChaincodeID{Name: "lscc"}, nil, signer)
+	if err != nil {
+		return err
+	}
+	info, err := lgr.GetBlockchainInfo()
+	if err != nil {
+		return err
+	}
+	return endorserServer.(*Endorser).commitTxSimulation(prop, chainID, signer, pResp, info.Height)
+}
+
+// allowAllACLs lets the mock ACL provider grant every access, as the tests
+// expect unless they set expectations of their own
+func allowAllACLs() {
+	mockAclProvider.Reset()
+	mockAclProvider.On("CheckACL", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+}
+
 type testEnvironment struct {
 	tempDir  string
 	listener net.Listener
@@ -112,6 +347,11 @@ func initPeer(chainID string) (*testEnvironment, error) {
 
 	syscc.DeploySysCCs(chainID)
 
+	if err = launchTestCCs(chainID); err != nil {
+		closeListenerAndSleep(lis)
+		return nil, err
+	}
+
 	go grpcServer.Serve(lis)
 
 	return &testEnvironment{tempDir: tempDir, listener: lis}, nil
@@ -252,6 +492,7 @@ func deployOrUpgrade(endorserServer pb.EndorserServer, chainID string, spec *pb.
 		return nil, nil, err
 	}
 
+	defer allowAllACLs()
 	mockAclProvider.Reset()
 	mockAclProvider.On("CheckACL", aclmgmt.LSCC_GETCCDATA, chainID, signedProp).Return(nil)
 	mockAclProvider.On("CheckACL", aclmgmt.PROPOSE, chainID, signedProp).Return(nil)
@@ -286,6 +527,7 @@ func invoke(chainID string, spec *pb.ChaincodeSpec) (*pb.Proposal, *pb.ProposalR
 		return nil, nil, "", nil, err
 	}
 
+	defer allowAllACLs()
 	mockAclProvider.Reset()
 	mockAclProvider.On("CheckACL", aclmgmt.LSCC_GETCCDATA, chainID, signedProp).Return(nil)
 	mockAclProvider.On("CheckACL", aclmgmt.PROPOSE, chainID, signedProp).Return(nil)
@@ -317,6 +559,7 @@ func invokeWithOverride(txid string, chainID string, spec *pb.ChaincodeSpec, non
 		return nil, err
 	}
 
+	defer allowAllACLs()
 	mockAclProvider.Reset()
 	mockAclProvider.On("CheckACL", aclmgmt.LSCC_GETCCDATA, chainID, signedProp).Return(nil)
 	mockAclProvider.On("CheckACL", aclmgmt.PROPOSE, chainID, signedProp).Return(nil)
@@ -328,6 +571,52 @@ func invokeWithOverride(txid string, chainID string, spec *pb.ChaincodeSpec, non
 	return resp, err
 }
 
+// getTestCCProposal returns a signed proposal invoking the test chaincode
+func getTestCCProposal(chainID string, args ...string) (*pb.Proposal, *pb.SignedProposal, error) {
+	return getChaincodeProposal(chainID, testCCName, args...)
+}
+
+// getChaincodeProposal returns a signed proposal invoking the chaincode
+// with the given arguments
+func getChaincodeProposal(chainID string, ccName string, args ...string) (*pb.Proposal, *pb.SignedProposal, error) {
+	creator, err := signer.Serialize()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	spec := &pb.ChaincodeSpec{Type: pb.ChaincodeSpec_GOLANG, ChaincodeId: &pb.ChaincodeID{Name: ccName}, Input: &pb.ChaincodeInput{Args: util.ToChaincodeArgs(args...)}}
+	prop, _, err := getInvokeProposal(&pb.ChaincodeInvocationSpec{ChaincodeSpec: spec}, chainID, creator)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	signedProp, err := getSignedProposal(prop, signer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return prop, signedProp, nil
+}
+
+// invokeTestCC endorses an invocation of the test chaincode and commits
+// the resulting transaction on top of the ledger
+func invokeTestCC(chainID string, args ...string) (*pb.ProposalResponse, error) {
+	prop, signedProp, err := getTestCCProposal(chainID, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := endorserServer.ProcessProposal(context.Background(), signedProp)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := peer.GetLedger(chainID).GetBlockchainInfo()
+	if err != nil {
+		return nil, err
+	}
+	return resp, endorserServer.(*Endorser).commitTxSimulation(prop, chainID, signer, resp, info.Height)
+}
+
 func deleteChaincodeOnDisk(chaincodeID string) {
 	os.RemoveAll(filepath.Join(config.GetPath("peer.fileSystemPath"), "chaincodes", chaincodeID))
 }
@@ -374,6 +663,35 @@ func TestJavaDeploy(t *testing.T) {
 	chaincode.GetChain().Stop(context.Background(), cccid, &pb.ChaincodeDeploymentSpec{ChaincodeSpec: spec})
 }
 
+func TestJavaChaincodeType(t *testing.T) {
+	e := &Endorser{}
+	lsccCID := &pb.ChaincodeID{Name: "lscc", Version: util.GetSysCCVersion()}
+	lsccSpec := func(args ...[]byte) *pb.ChaincodeInvocationSpec {
+		return &pb.ChaincodeInvocationSpec{ChaincodeSpec: &pb.ChaincodeSpec{Type: pb.ChaincodeSpec_GOLANG, ChaincodeId: lsccCID, Input: &pb.ChaincodeInput{Args: args}}}
+	}
+
+	spec := &pb.ChaincodeSpec{Type: pb.ChaincodeSpec_JAVA, ChaincodeId: &pb.ChaincodeID{Name: "javacc", Path: "path/to/cc", Version: "0"}}
+	cds := pbutils.MarshalOrPanic(&pb.ChaincodeDeploymentSpec{ChaincodeSpec: spec, CodePackage: []byte("some code")})
+	for _, args := range [][][]byte{
+		{[]byte("install"), cds},
+		{[]byte("deploy"), []byte(util.GetTestChainID()), cds},
+		{[]byte("upgrade"), []byte(util.GetTestChainID()), cds},
+	} {
+		err := e.validateChaincodeType(lsccCID, lsccSpec(args...))
+		if javaEnabled() {
+			assert.NoError(t, err, "%s of Java chaincode should be allowed", args[0])
+		} else {
+			assert.EqualError(t, err, "Java chaincode is work-in-progress and disabled", "%s of Java chaincode should be rejected", args[0])
+		}
+	}
+
+	// the deployment spec is looked up after the command
+	err := e.validateChaincodeType(lsccCID, lsccSpec([]byte("install")))
+	assert.EqualError(t, err, "too few arguments passed. expected 1")
+	err = e.validateChaincodeType(lsccCID, lsccSpec([]byte("deploy"), []byte(util.GetTestChainID())))
+	assert.EqualError(t, err, "too few arguments passed. expected 2")
+}
+
 func TestJavaCheckWithDifferentPackageTypes(t *testing.T) {
 	//try SignedChaincodeDeploymentSpec with go chaincode (type 1)
 	spec := &pb.ChaincodeSpec{Type: 1, ChaincodeId: &pb.ChaincodeID{Name: "gocc", Path: "path/to/cc", Version: "0"}, Input: &pb.ChaincodeInput{Args: [][]byte{[]byte("someargs")}}}
@@ -386,17 +704,138 @@ func TestJavaCheckWithDifferentPackageTypes(t *testing.T) {
 	lsccSpec := &pb.ChaincodeInvocationSpec{ChaincodeSpec: &pb.ChaincodeSpec{Type: pb.ChaincodeSpec_GOLANG, ChaincodeId: lsccCID, Input: &pb.ChaincodeInput{Args: [][]byte{[]byte("install"), b}}}}
 
 	e := &Endorser{}
-	err := e.disableJavaCCInst(lsccCID, lsccSpec)
+	err := e.validateChaincodeType(lsccCID, lsccSpec)
 	assert.Nil(t, err)
 
 	//now try plain ChaincodeDeploymentSpec...should succeed (go chaincode)
 	b = pbutils.MarshalOrPanic(cds)
 
 	lsccSpec = &pb.ChaincodeInvocationSpec{ChaincodeSpec: &pb.ChaincodeSpec{Type: pb.ChaincodeSpec_GOLANG, ChaincodeId: lsccCID, Input: &pb.ChaincodeInput{Args: [][]byte{[]byte("install"), b}}}}
-	err = e.disableJavaCCInst(lsccCID, lsccSpec)
+	err = e.validateChaincodeType(lsccCID, lsccSpec)
 	assert.Nil(t, err)
 }
 
+func TestValidateChaincodeType(t *testing.T) {
+	chainID := util.GetTestChainID()
+	ccID := &pb.ChaincodeID{Name: "typecc", Path: "path/to/cc", Version: "0"}
+	installed := &pb.ChaincodeDeploymentSpec{ChaincodeSpec: &pb.ChaincodeSpec{Type: pb.ChaincodeSpec_GOLANG, ChaincodeId: ccID}, CodePackage: []byte("some code")}
+	assert.NoError(t, ccprovider.PutChaincodeIntoFS(installed))
+	defer deleteChaincodeOnDisk("typecc.0")
+
+	lsccCID := &pb.ChaincodeID{Name: "lscc", Version: util.GetSysCCVersion()}
+	e := &Endorser{}
+	for _, op := range []string{"deploy", "upgrade"} {
+		for _, ccType := range []pb.ChaincodeSpec_Type{pb.ChaincodeSpec_GOLANG, pb.ChaincodeSpec_NODE} {
+			cds := &pb.ChaincodeDeploymentSpec{ChaincodeSpec: &pb.ChaincodeSpec{Type: ccType, ChaincodeId: ccID, Input: &pb.ChaincodeInput{Args: [][]byte{[]byte("init")}}}}
+			lsccSpec := &pb.ChaincodeInvocationSpec{ChaincodeSpec: &pb.ChaincodeSpec{Type: pb.ChaincodeSpec_GOLANG, ChaincodeId: lsccCID, Input: &pb.ChaincodeInput{Args: [][]byte{[]byte(op), []byte(chainID), pbutils.MarshalOrPanic(cds)}}}}
+
+			err := e.validateChaincodeType(lsccCID, lsccSpec)
+			if ccType == pb.ChaincodeSpec_GOLANG {
+				assert.NoError(t, err, "%s of a chaincode of the installed type", op)
+			} else {
+				assert.EqualError(t, err, "chaincode typecc:0 is installed as a GOLANG chaincode but the proposal declares it as NODE", "%s of a chaincode of another type", op)
+			}
+		}
+	}
+
+	// a chaincode which is not installed is left to lscc to reject
+	cds := &pb.ChaincodeDeploymentSpec{ChaincodeSpec: &pb.ChaincodeSpec{Type: pb.ChaincodeSpec_NODE, ChaincodeId: &pb.ChaincodeID{Name: "typecc", Version: "1"}}}
+	lsccSpec := &pb.ChaincodeInvocationSpec{ChaincodeSpec: &pb.ChaincodeSpec{Type: pb.ChaincodeSpec_GOLANG, ChaincodeId: lsccCID, Input: &pb.ChaincodeInput{Args: [][]byte{[]byte("deploy"), []byte(chainID), pbutils.MarshalOrPanic(cds)}}}}
+	assert.NoError(t, e.validateChaincodeType(lsccCID, lsccSpec))
+}
+
+func TestDryRunDeploy(t *testing.T) {
+	chainID := util.GetTestChainID()
+	creator, err := signer.Serialize()
+	assert.NoError(t, err)
+	dryRun := func(op string, name string, version string) (*DeployDryRun, error) {
+		cds := &pb.ChaincodeDeploymentSpec{ChaincodeSpec: &pb.ChaincodeSpec{Type: pb.ChaincodeSpec_GOLANG, ChaincodeId: &pb.ChaincodeID{Name: name, Path: "path/to/cc", Version: version}}}
+		lsccSpec := &pb.ChaincodeInvocationSpec{ChaincodeSpec: &pb.ChaincodeSpec{Type: pb.ChaincodeSpec_GOLANG, ChaincodeId: &pb.ChaincodeID{Name: "lscc", Version: util.GetSysCCVersion()}, Input: &pb.ChaincodeInput{Args: [][]byte{[]byte(op), []byte(chainID), pbutils.MarshalOrPanic(cds)}}}}
+		prop, _, err := getInvokeProposal(lsccSpec, chainID, creator)
+		assert.NoError(t, err)
+		signedProp, err := getSignedProposal(prop, signer)
+		assert.NoError(t, err)
+		return endorserServer.(*Endorser).DryRunDeploy(context.Background(), signedProp)
+	}
+
+	// only deploys and upgrades can be dry run
+	_, signedProp, err := getTestCCProposal(chainID, "get", "key")
+	assert.NoError(t, err)
+	_, err = endorserServer.(*Endorser).DryRunDeploy(context.Background(), signedProp)
+	assert.EqualError(t, err, "dry run of a deploy requires a proposal to lscc, not to "+testCCName)
+	_, err = dryRun("getchaincodes", "dryruncc", "0")
+	assert.EqualError(t, err, "dry run of a deploy requires a deploy or upgrade proposal, not getchaincodes")
+
+	result, err := dryRun("deploy", testCCName, "0")
+	assert.NoError(t, err)
+	assert.False(t, result.WouldSucceed(), "system chaincodes cannot be deployed")
+
+	result, err = dryRun("deploy", "dryruncc", "0")
+	assert.NoError(t, err)
+	assert.False(t, result.WouldSucceed())
+	assert.Contains(t, result.Err.Error(), "chaincode dryruncc:0 is not installed")
+
+	installed := &pb.ChaincodeDeploymentSpec{ChaincodeSpec: &pb.ChaincodeSpec{Type: pb.ChaincodeSpec_GOLANG, ChaincodeId: &pb.ChaincodeID{Name: "dryruncc", Path: "path/to/cc", Version: "0"}}, CodePackage: []byte("some code")}
+	assert.NoError(t, ccprovider.PutChaincodeIntoFS(installed))
+	defer deleteChaincodeOnDisk("dryruncc.0")
+
+	result, err = dryRun("deploy", "dryruncc", "0")
+	assert.NoError(t, err)
+	assert.Equal(t, &DeployDryRun{ChaincodeName: "dryruncc", Version: "0"}, result)
+	assert.True(t, result.WouldSucceed())
+
+	// the dry run did not instantiate the chaincode
+	result, err = dryRun("upgrade", "dryruncc", "0")
+	assert.NoError(t, err)
+	assert.True(t, result.Upgrade)
+	assert.EqualError(t, result.Err, "chaincode dryruncc is not instantiated on channel "+chainID+", it cannot be upgraded")
+}
+
+func TestInstantiationPolicyError(t *testing.T) {
+	policy := pbutils.MarshalOrPanic(cauthdsl.SignedByAnyAdmin([]string{"Org1MSP", "Org2MSP"}))
+	assert.Equal(t, "OutOf(1, 'Org1MSP.admin', 'Org2MSP.admin')", describePolicy(policy))
+	assert.Equal(t, "no policy", describePolicy(nil))
+	assert.Equal(t, "an unreadable policy", describePolicy([]byte("garbage")))
+
+	_, signedProp, err := getTestCCProposal(util.GetTestChainID(), "get", "key")
+	assert.NoError(t, err)
+	cdLedger := &ccprovider.ChaincodeData{Name: "policycc", Version: "0", InstantiationPolicy: policy}
+	err = instantiationPolicyError(errors.New("Instantiation policy mismatch for cc policycc/0"), "policycc", "0", cdLedger, signedProp)
+	assert.Contains(t, err.Error(), "instantiation policy check failed for chaincode policycc:0")
+	assert.Contains(t, err.Error(), "the channel definition expects OutOf(1, 'Org1MSP.admin', 'Org2MSP.admin')")
+	assert.Contains(t, err.Error(), "the installed package expects unknown")
+	assert.Contains(t, err.Error(), "the proposal was created by "+signer.GetMSPIdentifier()+" member")
+	assert.Contains(t, err.Error(), "Instantiation policy mismatch for cc policycc/0")
+}
+
+func TestValidateInvocationSpec(t *testing.T) {
+	ccID := &pb.ChaincodeID{Name: testCCName}
+	lsccCID := &pb.ChaincodeID{Name: "lscc", Version: util.GetSysCCVersion()}
+	spec := func(cid *pb.ChaincodeID, args ...string) *pb.ChaincodeInvocationSpec {
+		return &pb.ChaincodeInvocationSpec{ChaincodeSpec: &pb.ChaincodeSpec{ChaincodeId: cid, Input: &pb.ChaincodeInput{Args: util.ToChaincodeArgs(args...)}}}
+	}
+
+	assert.NoError(t, validateInvocationSpec(ccID, spec(ccID, "get", "key")))
+	assert.NoError(t, validateInvocationSpec(lsccCID, spec(lsccCID, "getchaincodes")))
+
+	err := validateInvocationSpec(ccID, &pb.ChaincodeInvocationSpec{})
+	assert.EqualError(t, err, "invocation of chaincode "+testCCName+" has no chaincode spec")
+	err = validateInvocationSpec(ccID, &pb.ChaincodeInvocationSpec{ChaincodeSpec: &pb.ChaincodeSpec{ChaincodeId: ccID}})
+	assert.EqualError(t, err, "invocation of chaincode "+testCCName+" has no input")
+	err = validateInvocationSpec(ccID, spec(ccID))
+	assert.EqualError(t, err, "invocation of chaincode "+testCCName+" has no arguments, expected at least the function to invoke")
+	err = validateInvocationSpec(lsccCID, spec(lsccCID, "instantiate"))
+	assert.EqualError(t, err, `unknown lscc operation "instantiate"`)
+	assert.Equal(t, validationError, categorize(err))
+
+	// the client is told what is wrong with its proposal
+	_, signedProp, err := getTestCCProposal(util.GetTestChainID())
+	assert.NoError(t, err)
+	resp, err := endorserServer.ProcessProposal(context.Background(), signedProp)
+	assert.Error(t, err)
+	assert.Equal(t, "[validation] invocation of chaincode "+testCCName+" has no arguments, expected at least the function to invoke", resp.Response.Message)
+}
+
 //TestRedeploy - deploy two times, second time should fail but example02 should remain deployed
 func TestRedeploy(t *testing.T) {
 	chainID := util.GetTestChainID()
@@ -518,7 +957,7 @@ func TestDeployAndInvoke(t *testing.T) {
 		t.Logf("expecting fabric to report error from chaincode failure")
 		chaincode.GetChain().Stop(ctxt, cccid, &pb.ChaincodeDeploymentSpec{ChaincodeSpec: &pb.ChaincodeSpec{ChaincodeId: chaincodeID}})
 		return
-	} else if _, ok := err.(*chaincodeError); !ok {
+	} else if grpc.Code(err) != codes.Unknown || !strings.Contains(err.Error(), "chaincode error") {
 		t.Fail()
 		t.Logf("expecting chaincode error but found %v", err)
 		chaincode.GetChain().Stop(ctxt, cccid, &pb.ChaincodeDeploymentSpec{ChaincodeSpec: &pb.ChaincodeSpec{ChaincodeId: chaincodeID}})
@@ -666,6 +1105,7 @@ func TestHeaderExtensionNoChaincodeID(t *testing.T) {
 	invocation := &pb.ChaincodeInvocationSpec{ChaincodeSpec: spec}
 	prop, _, _ := pbutils.CreateChaincodeProposalWithTxIDNonceAndTransient(txID, common.HeaderType_ENDORSER_TRANSACTION, util.GetTestChainID(), invocation, []byte{1, 2, 3}, creator, nil)
 	signedProp, _ := getSignedProposal(prop, signer)
+	defer allowAllACLs()
 	mockAclProvider.Reset()
 	mockAclProvider.On("CheckACL", aclmgmt.PROPOSE, util.GetTestChainID(), signedProp).Return(nil)
 	_, err = endorserServer.ProcessProposal(context.Background(), signedProp)
@@ -673,134 +1113,1143 @@ func TestHeaderExtensionNoChaincodeID(t *testing.T) {
 	assert.Contains(t, err.Error(), "ChaincodeHeaderExtension.ChaincodeId is nil")
 }
 
-//rest of the code tests good ACL. Lets now test bad ACL
-func TestResourceBasedACL(t *testing.T) {
+func TestCorrelationIDOnFailure(t *testing.T) {
+	logOutput := &bytes.Buffer{}
+	flogging.InitBackend(flogging.SetFormat("%{message}"), logOutput)
+	defer flogging.InitBackend(flogging.SetFormat(""), os.Stderr)
+
+	e := NewEndorserServer(func(channel string, txID string, privateData *rwset.TxPvtReadWriteSet) error {
+		return nil
+	}, Config{CorrelationIDs: true})
+
 	creator, _ := signer.Serialize()
-	nonce := []byte{1, 2, 3}
-	digest, err := factory.GetDefault().Hash(append(nonce, creator...), &bccsp.SHA256Opts{})
-	txID := hex.EncodeToString(digest)
-	spec := &pb.ChaincodeSpec{Type: 1, ChaincodeId: &pb.ChaincodeID{Path: "/path/to/mycc", Name: "mycc", Version: "0"}, Input: &pb.ChaincodeInput{Args: util.ToChaincodeArgs()}}
-	invocation := &pb.ChaincodeInvocationSpec{ChaincodeSpec: spec}
-	prop, _, _ := pbutils.CreateChaincodeProposalWithTxIDNonceAndTransient(txID, common.HeaderType_ENDORSER_TRANSACTION, util.GetTestChainID(), invocation, []byte{1, 2, 3}, creator, nil)
+	spec := &pb.ChaincodeSpec{Type: 1, ChaincodeId: nil, Input: &pb.ChaincodeInput{Args: util.ToChaincodeArgs()}}
+	prop, _, _ := getInvokeProposal(&pb.ChaincodeInvocationSpec{ChaincodeSpec: spec}, util.GetTestChainID(), creator)
 	signedProp, _ := getSignedProposal(prop, signer)
 
-	//return Bad ACL
-	mockAclProvider.Reset()
-	mockAclProvider.On("CheckACL", aclmgmt.PROPOSE, util.GetTestChainID(), signedProp).Return(errors.New("Bad ACL"))
-	_, err = endorserServer.ProcessProposal(context.Background(), signedProp)
+	resp, err := e.ProcessProposal(context.Background(), signedProp)
 	assert.Error(t, err)
-	assert.Contains(t, err.Error(), "Bad ACL")
+	assert.Equal(t, int32(500), resp.Response.Status)
+
+	match := regexp.MustCompile(`correlation id: ([0-9a-f-]+)`).FindStringSubmatch(resp.Response.Message)
+	if assert.Len(t, match, 2, "response message should carry a correlation id") {
+		assert.Contains(t, err.Error(), match[0])
+		assert.Contains(t, logOutput.String(), fmt.Sprintf("[%s] failed to process proposal", match[0]))
+	}
 }
 
-// TestAdminACLFail deploys tried to deploy a chaincode;
-// however we inject a special policy for admins to simulate
-// the scenario in which the creator of this proposal is not among
-// the admins for the chain
-func TestAdminACLFail(t *testing.T) {
-	//skip pending FAB-2457 fix
-	t.Skip()
+func TestSimulateWithOverlay(t *testing.T) {
 	chainID := util.GetTestChainID()
 
-	// here we inject a reject policy for admins
-	// to simulate the scenario in which the invoker
-	// is not authorized to issue this proposal
-	rejectpolicy := &mockpolicies.Policy{
-		Err: errors.New("The creator of this proposal does not fulfil the writers policy of this chain"),
-	}
-	pm := peer.GetPolicyManager(chainID)
-	pm.(*mockpolicies.Manager).PolicyMap = map[string]policies.Policy{policies.ChannelApplicationAdmins: rejectpolicy}
+	_, err := invokeTestCC(chainID, "put", "overlaykey", "committed")
+	assert.NoError(t, err)
 
-	var ctxt = context.Background()
+	_, signedProp, err := getTestCCProposal(chainID, "get", "overlaykey")
+	assert.NoError(t, err)
+	e := endorserServer.(*Endorser)
 
-	url := "github.com/hyperledger/fabric/examples/chaincode/go/chaincode_example01"
-	chaincodeID := &pb.ChaincodeID{Path: url, Name: "ex01-fail1", Version: "0"}
+	res, err := e.SimulateWithOverlay(context.Background(), signedProp, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "committed", string(res.Payload))
 
-	defer deleteChaincodeOnDisk("ex01-fail1.0")
+	overlay := StateOverlay{testCCName: {"overlaykey": []byte("what-if")}}
+	res, err = e.SimulateWithOverlay(context.Background(), signedProp, overlay)
+	assert.NoError(t, err)
+	assert.Equal(t, "what-if", string(res.Payload))
 
-	f := "init"
-	argsDeploy := util.ToChaincodeArgs(f, "a", "100", "b", "200")
-	spec := &pb.ChaincodeSpec{Type: 1, ChaincodeId: chaincodeID, Input: &pb.ChaincodeInput{Args: argsDeploy}}
+	// the overlay is not committed
+	_, signedProp, err = getTestCCProposal(chainID, "get", "overlaykey")
+	assert.NoError(t, err)
+	resp, err := endorserServer.ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+	assert.Equal(t, "committed", string(resp.Response.Payload))
+}
 
-	cccid := ccprovider.NewCCContext(chainID, "ex01-fail1", "0", "", false, nil, nil)
+func TestExplain(t *testing.T) {
+	chainID := util.GetTestChainID()
+	e := endorserServer.(*Endorser)
+
+	_, signedProp, err := getTestCCProposal(chainID, "put", "explainkey", "explained")
+	assert.NoError(t, err)
+	explanation, err := e.Explain(context.Background(), signedProp)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(shim.OK), explanation.Response.Status)
+	assert.Empty(t, explanation.EventName)
+	assert.NotZero(t, explanation.ResultsSize)
+	// the definition of the chaincode is read from lscc
+	if assert.Len(t, explanation.Namespaces, 2) {
+		ns := explanation.Namespaces[0]
+		assert.Equal(t, testCCName, ns.Namespace)
+		assert.Empty(t, ns.Reads)
+		assert.Equal(t, []string{"explainkey"}, ns.Writes)
+		assert.Empty(t, ns.Deletes)
+		assert.Empty(t, ns.Collections)
+		assert.Equal(t, "lscc", explanation.Namespaces[1].Namespace)
+		assert.Equal(t, []string{testCCName}, explanation.Namespaces[1].Reads)
+	}
 
-	_, _, err := deploy(endorserServer, chainID, spec, nil)
-	if err == nil {
-		t.Fail()
-		t.Logf("Deploying chaincode should have failed!")
-		chaincode.GetChain().Stop(ctxt, cccid, &pb.ChaincodeDeploymentSpec{ChaincodeSpec: &pb.ChaincodeSpec{ChaincodeId: chaincodeID}})
-		return
+	// the footprint of a committed get is its read set
+	_, signedProp, err = getTestCCProposal(chainID, "get", "explainkey")
+	assert.NoError(t, err)
+	explanation, err = e.Explain(context.Background(), signedProp)
+	assert.NoError(t, err)
+	assert.Empty(t, explanation.Response.Payload, "the explained put should not have been committed")
+	if assert.Len(t, explanation.Namespaces, 2) {
+		assert.Equal(t, []string{"explainkey"}, explanation.Namespaces[0].Reads)
+		assert.Empty(t, explanation.Namespaces[0].Writes)
 	}
 
-	t.Logf("TestATestAdminACLFailCLFail passed")
+	_, signedProp, err = getTestCCProposal(chainID, "emit", "explainevent")
+	assert.NoError(t, err)
+	explanation, err = e.Explain(context.Background(), signedProp)
+	assert.NoError(t, err)
+	assert.Equal(t, "explainevent", explanation.EventName)
+	assert.NotZero(t, explanation.EventSize)
+}
 
-	chaincode.GetChain().Stop(ctxt, cccid, &pb.ChaincodeDeploymentSpec{ChaincodeSpec: &pb.ChaincodeSpec{ChaincodeId: chaincodeID}})
+func TestExplainCollections(t *testing.T) {
+	builder := rwsetutil.NewRWSetBuilder()
+	builder.AddToReadSet("ns", "key1", nil)
+	builder.AddToWriteSet("ns", "key2", nil)
+	assert.NoError(t, builder.AddToPvtAndHashedWriteSet("ns", "coll", "pvtkey1", []byte("value")))
+	assert.NoError(t, builder.AddToPvtAndHashedWriteSet("ns", "coll", "pvtkey2", []byte("value")))
+	simResults, err := builder.GetTxSimulationResults()
+	assert.NoError(t, err)
+	simResBytes, err := simResults.GetPubSimulationBytes()
+	assert.NoError(t, err)
+
+	explanation, err := explain(&pb.Response{Status: shim.OK}, simResBytes, nil)
+	assert.NoError(t, err)
+	if assert.Len(t, explanation.Namespaces, 1) {
+		ns := explanation.Namespaces[0]
+		assert.Equal(t, []string{"key1"}, ns.Reads)
+		assert.Equal(t, []string{"key2"}, ns.Writes)
+		assert.Equal(t, []string{"key2"}, ns.Deletes)
+		assert.Equal(t, []*CollectionFootprint{{Collection: "coll", Writes: 2}}, ns.Collections)
+	}
 }
 
-// TestInvokeSccFail makes sure that invoking a system chaincode fails
-func TestInvokeSccFail(t *testing.T) {
+func TestEndorsementPluginNotAvailable(t *testing.T) {
 	chainID := util.GetTestChainID()
+	e := endorserServer.(*Endorser)
+
+	prop, signedProp, err := getTestCCProposal(chainID, "put", "escckey", "value")
+	assert.NoError(t, err)
+	hdr, err := pbutils.GetHeader(prop.Header)
+	assert.NoError(t, err)
+	chdr, err := pbutils.UnmarshalChannelHeader(hdr.ChannelHeader)
+	assert.NoError(t, err)
+
+	cd := &ccprovider.ChaincodeData{Name: "mycc", Version: "1.0", Escc: "noescc", Vscc: "vscc"}
+	_, err = e.endorseProposal(context.Background(), chainID, chdr.TxId, signedProp, prop, &pb.Response{Status: shim.OK}, nil, nil, nil, &pb.ChaincodeID{Name: "mycc"}, nil, cd)
+	assert.EqualError(t, err, "endorsement plugin noescc not available for chaincode mycc")
+}
 
-	chaincodeID := &pb.ChaincodeID{Name: "escc"}
-	args := util.ToChaincodeArgs("someFunc", "someArg")
-	spec := &pb.ChaincodeSpec{Type: 1, ChaincodeId: chaincodeID, Input: &pb.ChaincodeInput{Args: args}}
-	_, _, _, _, err := invoke(chainID, spec)
-	if err == nil {
-		t.Logf("Invoking escc should have failed!")
-		t.Fail()
-		return
-	}
+// fakeMetrics records the values of the counters and histograms reported
+// through the scopes it returns, by metric name and tags
+type fakeMetrics struct {
+	sync.Mutex
+	counters   map[string]int64
+	histograms map[string][]time.Duration
 }
 
-func newTempDir() string {
-	tempDir, err := ioutil.TempDir("", "fabric-")
-	if err != nil {
-		panic(err)
+func newFakeMetrics() *fakeMetrics {
+	return &fakeMetrics{counters: make(map[string]int64), histograms: make(map[string][]time.Duration)}
+}
+
+func (m *fakeMetrics) scope() *fakeScope {
+	return &fakeScope{metrics: m, tags: map[string]string{}}
+}
+
+// counter returns the value of the counter with the given name and tags
+func (m *fakeMetrics) counter(name string, tags map[string]string) int64 {
+	m.Lock()
+	defer m.Unlock()
+	return m.counters[metricKey(name, tags)]
+}
+
+// histogram returns the durations recorded by the histogram with the given
+// name and tags
+func (m *fakeMetrics) histogram(name string, tags map[string]string) []time.Duration {
+	m.Lock()
+	defer m.Unlock()
+	return m.histograms[metricKey(name, tags)]
+}
+
+func metricKey(name string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
 	}
-	return tempDir
+	sort.Strings(keys)
+	for _, k := range keys {
+		name += fmt.Sprintf(",%s=%s", k, tags[k])
+	}
+	return name
 }
 
-var mockAclProvider *mocks.MockACLProvider
+type fakeScope struct {
+	metrics *fakeMetrics
+	prefix  string
+	tags    map[string]string
+}
 
-func TestMain(m *testing.M) {
-	mockAclProvider = &mocks.MockACLProvider{}
-	mockAclProvider.Reset()
+type fakeCounter func(int64)
 
-	aclmgmt.RegisterACLProvider(mockAclProvider)
+func (c fakeCounter) Inc(v int64) { c(v) }
 
-	setupTestConfig()
+type fakeGauge func(float64)
 
-	chainID := util.GetTestChainID()
-	tev, err := initPeer(chainID)
-	if err != nil {
-		os.Exit(-1)
-		fmt.Printf("Could not initialize tests")
-		finitPeer(tev)
-		return
-	}
+func (g fakeGauge) Update(v float64) { g(v) }
 
-	endorserServer = NewEndorserServer(func(channel string, txID string, privateData *rwset.TxPvtReadWriteSet) error {
-		return nil
+type fakeHistogram func(time.Duration)
+
+func (h fakeHistogram) RecordDuration(v time.Duration) { h(v) }
+
+func (s *fakeScope) Counter(name string) metrics.Counter {
+	key := metricKey(s.prefix+name, s.tags)
+	return fakeCounter(func(v int64) {
+		s.metrics.Lock()
+		defer s.metrics.Unlock()
+		s.metrics.counters[key] += v
 	})
+}
 
-	// setup the MSP manager so that we can sign/verify
-	err = msptesttools.LoadMSPSetupForTesting()
-	if err != nil {
-		fmt.Printf("Could not initialize msp/signer, err %s", err)
-		finitPeer(tev)
-		os.Exit(-1)
-		return
+func (s *fakeScope) Gauge(name string) metrics.Gauge {
+	return fakeGauge(func(float64) {})
+}
+
+func (s *fakeScope) Histogram(name string) metrics.Histogram {
+	key := metricKey(s.prefix+name, s.tags)
+	return fakeHistogram(func(v time.Duration) {
+		s.metrics.Lock()
+		defer s.metrics.Unlock()
+		s.metrics.histograms[key] = append(s.metrics.histograms[key], v)
+	})
+}
+
+func (s *fakeScope) Tagged(tags map[string]string) metrics.Scope {
+	merged := make(map[string]string)
+	for k, v := range s.tags {
+		merged[k] = v
 	}
-	signer, err = mspmgmt.GetLocalMSP().GetDefaultSigningIdentity()
-	if err != nil {
-		fmt.Printf("Could not initialize msp/signer")
-		finitPeer(tev)
-		os.Exit(-1)
-		return
+	for k, v := range tags {
+		merged[k] = v
 	}
+	return &fakeScope{metrics: s.metrics, prefix: s.prefix, tags: merged}
+}
 
-	retVal := m.Run()
+func (s *fakeScope) SubScope(name string) metrics.Scope {
+	return &fakeScope{metrics: s.metrics, prefix: s.prefix + name + ".", tags: s.tags}
+}
 
-	finitPeer(tev)
+func (s *fakeScope) Start() error { return nil }
+
+func (s *fakeScope) Close() error { return nil }
+
+func TestTenantTags(t *testing.T) {
+	logOutput := &bytes.Buffer{}
+	flogging.InitBackend(flogging.SetFormat("%{message}"), logOutput)
+	defer flogging.InitBackend(flogging.SetFormat(""), os.Stderr)
+	defer flogging.SetModuleLevel("endorser", flogging.GetModuleLevel("endorser"))
+	flogging.SetModuleLevel("endorser", "debug")
+
+	chainID := util.GetTestChainID()
+	fm := newFakeMetrics()
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{
+		Tenants: map[string]map[string]string{chainID: {testCCName: "tenantA", "": "tenantB"}},
+		Metrics: fm.scope(),
+	})
+
+	for _, ccName := range []string{testCCName, testCCName + "2"} {
+		_, signedProp, err := getChaincodeProposal(chainID, ccName, "put", "tenantkey", "value")
+		assert.NoError(t, err)
+		_, err = e.ProcessProposal(context.Background(), signedProp)
+		assert.NoError(t, err)
+	}
+
+	for ccName, tenant := range map[string]string{testCCName: "tenantA", testCCName + "2": "tenantB"} {
+		tags := map[string]string{"channel": chainID, "chaincode": ccName, "tenant": tenant}
+		assert.Equal(t, int64(1), fm.counter("proposals_received", tags), "proposals of %s should be tagged with %s", ccName, tenant)
+		assert.Equal(t, int64(1), fm.counter("proposals_succeeded", tags))
+		assert.Zero(t, fm.counter("proposals_failed", tags))
+		assert.Contains(t, logOutput.String(), fmt.Sprintf("[tenant: %s] Entry", tenant))
+	}
+}
+
+func TestDeprecatedVersion(t *testing.T) {
+	chainID := util.GetTestChainID()
+	version := testCCVersion
+	fm := newFakeMetrics()
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{
+		Metrics:            fm.scope(),
+		DeprecatedVersions: map[string][]string{testCCName: {"0.9", version}},
+	})
+	tags := map[string]string{"channel": chainID, "chaincode": testCCName, "version": version}
+
+	_, signedProp, err := getTestCCProposal(chainID, "put", "deprecatedkey", "value")
+	assert.NoError(t, err)
+	resp, err := e.ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(shim.OK), resp.Response.Status)
+	assert.Equal(t, []string{fmt.Sprintf("version %s of chaincode %s is deprecated", version, testCCName)}, resp.Warnings)
+	assert.Equal(t, int64(1), fm.counter("deprecated_invocations", tags))
+
+	// other chaincodes are not affected
+	_, signedProp, err = getChaincodeProposal(chainID, testCCName+"2", "put", "deprecatedkey", "value")
+	assert.NoError(t, err)
+	resp, err = e.ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+	assert.Empty(t, resp.Warnings)
+	tags["chaincode"] = testCCName + "2"
+	assert.Zero(t, fm.counter("deprecated_invocations", tags))
+}
+
+func TestSimulateBatch(t *testing.T) {
+	chainID := util.GetTestChainID()
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{BatchParallelism: 3}).(*Endorser)
+
+	var signedProps []*pb.SignedProposal
+	for i := 0; i < 8; i++ {
+		args := []string{"sleep", fmt.Sprintf("%d", i)}
+		if i == 4 {
+			args = []string{"unknown"}
+		}
+		_, signedProp, err := getTestCCProposal(chainID, args...)
+		assert.NoError(t, err)
+		signedProps = append(signedProps, signedProp)
+	}
+
+	atomic.StoreInt64(&testCCMaxSleeping, 0)
+	results := e.SimulateBatch(context.Background(), signedProps)
+	if assert.Len(t, results, len(signedProps)) {
+		for i, result := range results {
+			assert.NoError(t, result.Err)
+			if i == 4 {
+				// a failing proposal does not affect the others
+				assert.Equal(t, int32(shim.ERROR), result.Response.Status)
+				continue
+			}
+			assert.Equal(t, int32(shim.OK), result.Response.Status)
+			assert.Equal(t, fmt.Sprintf("%d", i), string(result.Response.Payload), "results should come back in the order of the proposals")
+		}
+	}
+
+	maxSleeping := atomic.LoadInt64(&testCCMaxSleeping)
+	assert.True(t, maxSleeping <= 3, "at most 3 proposals should be simulated concurrently, %d were", maxSleeping)
+	assert.True(t, maxSleeping > 1, "proposals should be simulated concurrently")
+}
+
+func TestProcessProposals(t *testing.T) {
+	chainID := util.GetTestChainID()
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{
+		ReadOnlyFunctions: map[string][]string{testCCName: {"get"}},
+	}).(*Endorser)
+	var simulators int64
+	var open int32
+	e.newTxSimulator = func(ledgername string, txid string) (ledger.TxSimulator, error) {
+		atomic.AddInt64(&simulators, 1)
+		// a simulator still open would hold off the commit of blocks
+		assert.Zero(t, atomic.AddInt32(&open, 1)-1, "the simulator of the previous proposal should have been released")
+		txsim, err := peer.GetLedger(ledgername).NewTxSimulator(txid)
+		return &doneCountingSimulator{TxSimulator: txsim, done: &open}, err
+	}
+
+	var signedProps []*pb.SignedProposal
+	for _, args := range [][]string{{"get", "batchkey"}, {"get", "otherkey"}, {"put", "batchkey", "value"}, {"unknown"}, {"get", "batchkey"}} {
+		_, signedProp, err := getTestCCProposal(chainID, args...)
+		assert.NoError(t, err)
+		signedProps = append(signedProps, signedProp)
+	}
+
+	resps, err := e.ProcessProposals(context.Background(), signedProps)
+	assert.NoError(t, err)
+	if assert.Len(t, resps, len(signedProps)) {
+		for _, i := range []int{0, 1, 2, 4} {
+			assert.Equal(t, int32(shim.OK), resps[i].Response.Status, "proposal %d should succeed", i)
+		}
+		// a failing proposal does not affect the others
+		assert.Equal(t, int32(500), resps[3].Response.Status)
+	}
+	// every proposal has a simulator of its own, the queries included
+	assert.Equal(t, int64(len(signedProps)), atomic.LoadInt64(&simulators))
+
+	// read-only proposals of a batch cannot write
+	e = NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{
+		ReadOnlyFunctions: map[string][]string{testCCName: {"get", "put"}},
+	}).(*Endorser)
+	_, signedProp, err := getTestCCProposal(chainID, "put", "batchkey", "value")
+	assert.NoError(t, err)
+	resps, err = e.ProcessProposals(context.Background(), []*pb.SignedProposal{signedProp})
+	assert.NoError(t, err)
+	if assert.Len(t, resps, 1) {
+		assert.Equal(t, int32(500), resps[0].Response.Status)
+	}
+
+	// a batch abandoned by the client fails as a whole
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = e.ProcessProposals(ctx, signedProps)
+	assert.Error(t, err)
+}
+
+func TestProposalRateLimit(t *testing.T) {
+	l := newRateLimiter(map[string]RateLimit{"busy": {Rate: 10, Burst: 2}, "free": {}}, RateLimit{Rate: 1})
+	now := time.Now()
+	assert.Zero(t, l.take("busy", now))
+	assert.Zero(t, l.take("busy", now))
+	retryAfter := l.take("busy", now)
+	assert.Equal(t, 100*time.Millisecond, retryAfter)
+	// the load on one channel does not throttle the others
+	assert.Zero(t, l.take("other", now))
+	assert.NotZero(t, l.take("other", now), "the default limit should apply to the channels not listed")
+	for i := 0; i < 10; i++ {
+		assert.Zero(t, l.take("free", now))
+	}
+	// the bucket refills at the rate of the channel
+	assert.Zero(t, l.take("busy", now.Add(retryAfter)))
+	assert.NotZero(t, l.take("busy", now.Add(retryAfter)))
+
+	assert.Nil(t, newRateLimiter(map[string]RateLimit{"free": {}}, RateLimit{}))
+
+	chainID := util.GetTestChainID()
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{
+		ProposalRateLimits: map[string]RateLimit{chainID: {Rate: 0.001, Burst: 1}},
+	})
+	_, signedProp, err := getTestCCProposal(chainID, "get", "ratelimited")
+	assert.NoError(t, err)
+	resp, err := e.ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(shim.OK), resp.Response.Status)
+
+	_, signedProp, err = getTestCCProposal(chainID, "get", "ratelimited")
+	assert.NoError(t, err)
+	resp, err = e.ProcessProposal(context.Background(), signedProp)
+	assert.Error(t, err)
+	assert.Equal(t, int32(429), resp.Response.Status)
+	assert.Contains(t, resp.Response.Message, "[ratelimited]")
+	assert.Contains(t, resp.Response.Message, "retry after")
+	_, _, err = e.(*Endorser).SimulateProposal(context.Background(), signedProp)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "retry after")
+
+	// while the proposals to system chaincodes are not rate limited
+	_, signedProp, err = getChaincodeProposal(chainID, "lscc", "getchaincodes")
+	assert.NoError(t, err)
+	resp, err = e.ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(shim.OK), resp.Response.Status)
+}
+
+func TestEndorsementDelay(t *testing.T) {
+	delay := EndorsementDelay{Min: 20 * time.Millisecond, Jitter: 10 * time.Millisecond}
+	e := &Endorser{config: Config{EndorsementDelays: map[string]EndorsementDelay{"delayedcc": delay}}}
+
+	for i := 0; i < 5; i++ {
+		start := time.Now()
+		assert.NoError(t, e.delayEndorsement(context.Background(), "delayedcc"))
+		elapsed := time.Since(start)
+		assert.True(t, elapsed >= delay.Min, "the endorsement should be delayed by at least %s, it was by %s", delay.Min, elapsed)
+		// leave some room for the scheduler
+		assert.True(t, elapsed < delay.Min+delay.Jitter+50*time.Millisecond, "the endorsement should not be delayed beyond the jitter, it was by %s", elapsed)
+
+		d := delay.duration()
+		assert.True(t, d >= delay.Min && d < delay.Min+delay.Jitter, "delay %s out of bounds", d)
+	}
+
+	// other chaincodes are not delayed
+	start := time.Now()
+	assert.NoError(t, e.delayEndorsement(context.Background(), "othercc"))
+	assert.True(t, time.Since(start) < delay.Min)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Error(t, e.delayEndorsement(ctx, "delayedcc"))
+}
+
+// pvtDataSimulator is a TxSimulator whose simulation results carry the
+// given private data, for the test chaincode cannot write any
+type pvtDataSimulator struct {
+	ledger.TxSimulator
+	pvtData *rwset.TxPvtReadWriteSet
+}
+
+func (s *pvtDataSimulator) GetTxSimulationResults() (*ledger.TxSimulationResults, error) {
+	res, err := s.TxSimulator.GetTxSimulationResults()
+	if err == nil {
+		res.PvtSimulationResults = s.pvtData
+	}
+	return res, err
+}
+
+func TestPrivateDataRecipients(t *testing.T) {
+	chainID := util.GetTestChainID()
+	pvtData := &rwset.TxPvtReadWriteSet{DataModel: rwset.TxReadWriteSet_KV}
+	peers := []string{"peer1.org1:7051", "peer0.org2:7051"}
+
+	var distributed *rwset.TxPvtReadWriteSet
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error {
+		t.Fatal("the acking distributor should be used")
+		return nil
+	}, Config{
+		AckingPrivateDataDistributor: func(channel string, txID string, privateData *rwset.TxPvtReadWriteSet) ([]string, error) {
+			distributed = privateData
+			return peers, nil
+		},
+	}).(*Endorser)
+	e.newTxSimulator = func(ledgername string, txid string) (ledger.TxSimulator, error) {
+		txsim, err := peer.GetLedger(ledgername).NewTxSimulator(txid)
+		return &pvtDataSimulator{TxSimulator: txsim, pvtData: pvtData}, err
+	}
+
+	_, signedProp, err := getTestCCProposal(chainID, "put", "pvtdatakey", "value")
+	assert.NoError(t, err)
+	resp, err := e.ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+	assert.True(t, distributed == pvtData, "the private data should have been distributed")
+	assert.Equal(t, peers, resp.PrivateDataRecipients)
+
+	// no private data, no recipients
+	e.newTxSimulator = nil
+	_, signedProp, err = getTestCCProposal(chainID, "put", "pvtdatakey", "value")
+	assert.NoError(t, err)
+	resp, err = e.ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+	assert.Empty(t, resp.PrivateDataRecipients)
+}
+
+func TestPrivateDataDistributionFailure(t *testing.T) {
+	chainID := util.GetTestChainID()
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error {
+		return errors.New("no peer reachable")
+	}, Config{}).(*Endorser)
+	e.newTxSimulator = func(ledgername string, txid string) (ledger.TxSimulator, error) {
+		txsim, err := peer.GetLedger(ledgername).NewTxSimulator(txid)
+		return &pvtDataSimulator{TxSimulator: txsim, pvtData: &rwset.TxPvtReadWriteSet{DataModel: rwset.TxReadWriteSet_KV}}, err
+	}
+
+	_, signedProp, err := getTestCCProposal(chainID, "put", "pvtdatakey", "value")
+	assert.NoError(t, err)
+	resp, err := e.ProcessProposal(context.Background(), signedProp)
+	assert.Equal(t, codes.Unavailable, grpc.Code(err))
+	assert.Contains(t, err.Error(), "no peer reachable")
+	assert.Equal(t, int32(503), resp.Response.Status)
+	assert.True(t, strings.HasPrefix(resp.Response.Message, "[distribution] "), "unexpected message %s", resp.Response.Message)
+}
+
+func TestPrivateDataDistributionRetries(t *testing.T) {
+	chainID := util.GetTestChainID()
+	var attempts int
+	newEndorser := func(distErr error) *Endorser {
+		attempts = 0
+		e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error {
+			attempts++
+			if attempts == 1 {
+				return distErr
+			}
+			return nil
+		}, Config{PvtDataDistributionRetries: 2, PvtDataDistributionRetryBackoff: time.Millisecond}).(*Endorser)
+		e.newTxSimulator = func(ledgername string, txid string) (ledger.TxSimulator, error) {
+			txsim, err := peer.GetLedger(ledgername).NewTxSimulator(txid)
+			return &pvtDataSimulator{TxSimulator: txsim, pvtData: &rwset.TxPvtReadWriteSet{DataModel: rwset.TxReadWriteSet_KV}}, err
+		}
+		return e
+	}
+
+	// the first attempt hits a transient error, the second one succeeds
+	_, signedProp, err := getTestCCProposal(chainID, "put", "pvtdatakey", "value")
+	assert.NoError(t, err)
+	_, err = newEndorser(simulatorBusyError{}).ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+
+	// other errors are not retried
+	_, signedProp, err = getTestCCProposal(chainID, "put", "pvtdatakey", "value")
+	assert.NoError(t, err)
+	_, err = newEndorser(errors.New("failed to marshal private data")).ProcessProposal(context.Background(), signedProp)
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+
+	// and neither are transient errors once the deadline is too close
+	_, signedProp, err = getTestCCProposal(chainID, "put", "pvtdatakey", "value")
+	assert.NoError(t, err)
+	e := newEndorser(simulatorBusyError{})
+	e.config.PvtDataDistributionRetryBackoff = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = e.ProcessProposal(ctx, signedProp)
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestReady(t *testing.T) {
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{}).(*Endorser)
+	assert.NoError(t, e.Ready(util.GetTestChainID()))
+	assert.EqualError(t, e.Ready("nosuchchannel"), "channel does not exist: nosuchchannel")
+
+	e.newTxSimulator = func(string, string) (ledger.TxSimulator, error) {
+		return nil, simulatorBusyError{}
+	}
+	assert.EqualError(t, e.Ready(util.GetTestChainID()), "failed to create a tx simulator: simulator busy")
+}
+
+// getResponseEvent returns the chaincode event carried by the proposal
+// response, or nil if there is none
+func getResponseEvent(t *testing.T, resp *pb.ProposalResponse) *pb.ChaincodeEvent {
+	prp, err := pbutils.GetProposalResponsePayload(resp.Payload)
+	assert.NoError(t, err)
+	action, err := pbutils.GetChaincodeAction(prp.Extension)
+	assert.NoError(t, err)
+	if len(action.Events) == 0 {
+		return nil
+	}
+	event, err := pbutils.GetChaincodeEvents(action.Events)
+	assert.NoError(t, err)
+	return event
+}
+
+func TestReadOnlyEventStripping(t *testing.T) {
+	chainID := util.GetTestChainID()
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{
+		ReadOnlyFunctions: map[string][]string{testCCName: {"get", "emit"}},
+	})
+
+	// without the flag the event makes it to the response
+	_, signedProp, err := getTestCCProposal(chainID, "emit", "queried")
+	assert.NoError(t, err)
+	resp, err := endorserServer.ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+	if event := getResponseEvent(t, resp); assert.NotNil(t, event) {
+		assert.Equal(t, "queried", event.EventName)
+	}
+
+	// with emit marked read-only, it is dropped
+	_, signedProp, err = getTestCCProposal(chainID, "emit", "queried")
+	assert.NoError(t, err)
+	resp, err = e.ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+	assert.Nil(t, getResponseEvent(t, resp))
+
+	e = NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{
+		ReadOnlyFunctions: map[string][]string{testCCName: {"get"}},
+	})
+	_, signedProp, err = getTestCCProposal(chainID, "emit", "queried")
+	assert.NoError(t, err)
+	resp, err = e.ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+	assert.NotNil(t, getResponseEvent(t, resp), "the event of a function not marked read-only should be kept")
+}
+
+func TestPartialResultsOnError(t *testing.T) {
+	chainID := util.GetTestChainID()
+	pvtData := &rwset.TxPvtReadWriteSet{
+		DataModel: rwset.TxReadWriteSet_KV,
+		NsPvtRwset: []*rwset.NsPvtReadWriteSet{{
+			Namespace:          testCCName,
+			CollectionPvtRwset: []*rwset.CollectionPvtReadWriteSet{{CollectionName: "coll", Rwset: []byte("privatevalue")}},
+		}},
+	}
+
+	// without the flag the event is lost
+	_, signedProp, err := getTestCCProposal(chainID, "fail", "partialkey")
+	assert.NoError(t, err)
+	resp, err := endorserServer.ProcessProposal(context.Background(), signedProp)
+	assert.Error(t, err)
+	assert.Nil(t, getResponseEvent(t, resp))
+
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{
+		PartialResultsOnError: true,
+	}).(*Endorser)
+	e.newTxSimulator = func(ledgername string, txid string) (ledger.TxSimulator, error) {
+		txsim, err := peer.GetLedger(ledgername).NewTxSimulator(txid)
+		return &pvtDataSimulator{TxSimulator: txsim, pvtData: pvtData}, err
+	}
+	_, signedProp, err = getTestCCProposal(chainID, "fail", "partialkey")
+	assert.NoError(t, err)
+	resp, err = e.ProcessProposal(context.Background(), signedProp)
+	assert.Error(t, err)
+	if event := getResponseEvent(t, resp); assert.NotNil(t, event) {
+		assert.Equal(t, "partialkey", event.EventName)
+	}
+
+	prp, err := pbutils.GetProposalResponsePayload(resp.Payload)
+	assert.NoError(t, err)
+	action, err := pbutils.GetChaincodeAction(prp.Extension)
+	assert.NoError(t, err)
+	results := &rwsetutil.TxRwSet{}
+	assert.NoError(t, results.FromProtoBytes(action.Results))
+	var written []string
+	for _, nsRwSet := range results.NsRwSets {
+		for _, write := range nsRwSet.KvRwSet.Writes {
+			written = append(written, write.Key)
+		}
+	}
+	assert.Contains(t, written, "partialkey")
+	assert.False(t, bytes.Contains(resp.Payload, []byte("privatevalue")), "the private data should not be in the response")
+}
+
+// ecdsaSigner is a signer whose identity is its public key
+type ecdsaSigner struct {
+	key *ecdsa.PrivateKey
+}
+
+func newECDSASigner(t *testing.T) *ecdsaSigner {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	return &ecdsaSigner{key: key}
+}
+
+func (s *ecdsaSigner) Serialize() ([]byte, error) {
+	return elliptic.Marshal(s.key.Curve, s.key.X, s.key.Y), nil
+}
+
+func (s *ecdsaSigner) Sign(msg []byte) ([]byte, error) {
+	digest := sha256.Sum256(msg)
+	return ecdsa.SignASN1(rand.Reader, s.key, digest[:])
+}
+
+func (s *ecdsaSigner) verify(msg []byte, signature []byte) bool {
+	digest := sha256.Sum256(msg)
+	return ecdsa.VerifyASN1(&s.key.PublicKey, digest[:], signature)
+}
+
+// epochKeys is an EpochKeyProvider whose current epoch is set by the test
+type epochKeys struct {
+	current string
+	signers map[string]*ecdsaSigner
+}
+
+func (k *epochKeys) SigningIdentity(time.Time) (string, EpochSigner, error) {
+	return k.current, k.signers[k.current], nil
+}
+
+func TestEpochKeyEndorsement(t *testing.T) {
+	chainID := util.GetTestChainID()
+	keys := &epochKeys{signers: map[string]*ecdsaSigner{
+		"epoch1": newECDSASigner(t),
+		"epoch2": newECDSASigner(t),
+	}}
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{EpochKeys: keys})
+
+	endorsements := make(map[string]*pb.Endorsement)
+	for _, epoch := range []string{"epoch1", "epoch2"} {
+		keys.current = epoch
+		_, signedProp, err := getTestCCProposal(chainID, "put", "epochkey", epoch)
+		assert.NoError(t, err)
+		resp, err := e.ProcessProposal(context.Background(), signedProp)
+		assert.NoError(t, err)
+		assert.Equal(t, epoch, resp.EndorsementEpoch)
+
+		signer := keys.signers[epoch]
+		endorser, _ := signer.Serialize()
+		assert.Equal(t, endorser, resp.Endorsement.Endorser)
+		assert.True(t, signer.verify(append(resp.Payload, endorser...), resp.Endorsement.Signature), "the endorsement of %s should be signed by its key", epoch)
+		endorsements[epoch] = resp.Endorsement
+	}
+	assert.NotEqual(t, endorsements["epoch1"].Endorser, endorsements["epoch2"].Endorser)
+}
+
+func TestCollectionEndorsements(t *testing.T) {
+	signers := map[string]*ecdsaSigner{
+		"collA": newECDSASigner(t),
+		"collB": newECDSASigner(t),
+		"collC": newECDSASigner(t),
+	}
+	e := &Endorser{config: Config{
+		CollectionSigners: map[string]map[string]CollectionSigner{
+			"mycc": {"collA": signers["collA"], "collB": signers["collB"], "collC": signers["collC"]},
+		},
+	}}
+
+	// a transaction writing to collA and collB, and only reading collC
+	builder := rwsetutil.NewRWSetBuilder()
+	assert.NoError(t, builder.AddToPvtAndHashedWriteSet("mycc", "collA", "key", []byte("a")))
+	assert.NoError(t, builder.AddToPvtAndHashedWriteSet("mycc", "collB", "key", []byte("b")))
+	assert.NoError(t, builder.AddToHashedReadSet("mycc", "collC", "key", nil))
+	simResult, err := builder.GetTxSimulationResults()
+	assert.NoError(t, err)
+	simRes, err := simResult.GetPubSimulationBytes()
+	assert.NoError(t, err)
+
+	pResp := &pb.ProposalResponse{Payload: []byte("proposal response payload")}
+	assert.NoError(t, e.endorseCollections(pResp, simRes))
+	if !assert.Len(t, pResp.CollectionEndorsements, 2) {
+		return
+	}
+
+	for i, coll := range []string{"collA", "collB"} {
+		ce := pResp.CollectionEndorsements[i]
+		assert.Equal(t, "mycc", ce.Namespace)
+		assert.Equal(t, coll, ce.Collection)
+
+		identity, _ := signers[coll].Serialize()
+		assert.Equal(t, identity, ce.Endorsement.Endorser)
+		msg := CollectionEndorsementMessage(pResp.Payload, ce.Namespace, ce.Collection, ce.Endorsement.Endorser)
+		assert.True(t, signers[coll].verify(msg, ce.Endorsement.Signature), "endorsement of %s should be valid", coll)
+		for other, signer := range signers {
+			if other != coll {
+				assert.False(t, signer.verify(msg, ce.Endorsement.Signature), "%s should not have endorsed %s", other, coll)
+			}
+		}
+	}
+
+	// without signers, the response is left as is
+	pResp = &pb.ProposalResponse{Payload: []byte("proposal response payload")}
+	assert.NoError(t, (&Endorser{}).endorseCollections(pResp, simRes))
+	assert.Empty(t, pResp.CollectionEndorsements)
+}
+
+func TestDeterminismCheck(t *testing.T) {
+	chainID := util.GetTestChainID()
+	newEndorser := func(fail bool) pb.EndorserServer {
+		return NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{
+			CheckDeterminism:     true,
+			FailNonDeterministic: fail,
+		})
+	}
+
+	logOutput := &bytes.Buffer{}
+	flogging.InitBackend(flogging.SetFormat("%{message}"), logOutput)
+	defer flogging.InitBackend(flogging.SetFormat(""), os.Stderr)
+
+	// a deterministic invocation goes through unflagged
+	_, signedProp, err := getTestCCProposal(chainID, "put", "determinismkey", "value")
+	assert.NoError(t, err)
+	_, err = newEndorser(true).ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+	assert.NotContains(t, logOutput.String(), "is not deterministic")
+
+	// a non-deterministic one is flagged, and endorsed with the results of
+	// the first run
+	_, signedProp, err = getTestCCProposal(chainID, "nondeterministic")
+	assert.NoError(t, err)
+	before := atomic.LoadInt64(&testCCInvocations)
+	resp, err := newEndorser(false).ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), atomic.LoadInt64(&testCCInvocations)-before, "the chaincode should have run twice")
+	assert.Equal(t, fmt.Sprintf("%d", before+1), string(resp.Response.Payload))
+	assert.Contains(t, logOutput.String(), fmt.Sprintf("chaincode %s is not deterministic", testCCName))
+
+	// or rejected altogether
+	_, signedProp, err = getTestCCProposal(chainID, "nondeterministic")
+	assert.NoError(t, err)
+	_, err = newEndorser(true).ProcessProposal(context.Background(), signedProp)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "response payload differs")
+	}
+}
+
+// chanDeadLetterSink is a DeadLetterSink handing dead letters over to a
+// channel
+type chanDeadLetterSink chan *DeadLetter
+
+func (s chanDeadLetterSink) Write(letter *DeadLetter) error {
+	s <- letter
+	return nil
+}
+
+func TestDeadLetters(t *testing.T) {
+	chainID := util.GetTestChainID()
+	sink := make(chanDeadLetterSink, 1)
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{DeadLetterSink: sink}).(*Endorser)
+
+	// a chaincode error is not captured
+	_, signedProp, err := getTestCCProposal(chainID, "nosuchfunction")
+	assert.NoError(t, err)
+	_, err = e.ProcessProposal(context.Background(), signedProp)
+	assert.Error(t, err)
+
+	// neither is a malformed proposal
+	_, err = e.ProcessProposal(context.Background(), &pb.SignedProposal{ProposalBytes: []byte("garbage")})
+	assert.Error(t, err)
+
+	// nor a proposal denied by the ACLs
+	_, signedProp, err = getTestCCProposal(chainID, "get", "deadletterkey")
+	assert.NoError(t, err)
+	mockAclProvider.Reset()
+	mockAclProvider.On("CheckACL", mock.Anything, mock.Anything, mock.Anything).Return(errors.New("access denied"))
+	_, err = e.ProcessProposal(context.Background(), signedProp)
+	allowAllACLs()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "access denied")
+
+	// an internal error is
+	e.newTxSimulator = func(string, string) (ledger.TxSimulator, error) {
+		return nil, errors.New("ledger unavailable")
+	}
+	_, signedProp, err = getTestCCProposal(chainID, "get", "deadletterkey")
+	assert.NoError(t, err)
+	_, err = e.ProcessProposal(context.Background(), signedProp)
+	assert.Error(t, err)
+
+	select {
+	case letter := <-sink:
+		assert.Equal(t, "ledger unavailable", letter.Reason)
+		captured := &pb.SignedProposal{}
+		assert.NoError(t, proto.Unmarshal(letter.SignedProposal, captured))
+		assert.True(t, proto.Equal(signedProp, captured))
+	case <-time.After(time.Second):
+		t.Fatal("the proposal which failed with an internal error should have been captured")
+	}
+
+	select {
+	case letter := <-sink:
+		t.Fatalf("unexpected dead letter: %s", letter.Reason)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestCC2CCBudget(t *testing.T) {
+	chainID := util.GetTestChainID()
+
+	// the test chaincode calls the second one, which calls the third one
+	args := []string{"call", testCCNames[1], "call", testCCNames[2], "nondeterministic"}
+	process := func(config Config) (*pb.ProposalResponse, error) {
+		_, signedProp, err := getTestCCProposal(chainID, args...)
+		assert.NoError(t, err)
+		e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, config)
+		return e.ProcessProposal(context.Background(), signedProp)
+	}
+
+	resp, err := process(Config{MaxCC2CCDepth: 2, MaxCC2CCChaincodes: 2})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, resp.Response.Payload, "the third chaincode should have been invoked")
+
+	_, err = process(Config{MaxCC2CCChaincodes: 1})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), fmt.Sprintf("cc2cc invocation of %s/%s exceeds the maximum of 1 distinct chaincodes invoked by a proposal", testCCNames[2], chainID))
+
+	_, err = process(Config{MaxCC2CCDepth: 1})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "exceeds the maximum invocation depth of 1")
+}
+
+type simulatorBusyError struct{}
+
+func (simulatorBusyError) Error() string   { return "simulator busy" }
+func (simulatorBusyError) Transient() bool { return true }
+
+func TestRetryTransientSimulationFailure(t *testing.T) {
+	chainID := util.GetTestChainID()
+
+	_, err := invokeTestCC(chainID, "put", "retrykey", "retryvalue")
+	assert.NoError(t, err)
+
+	var attempts int
+	newEndorser := func(simErr error) *Endorser {
+		attempts = 0
+		return &Endorser{
+			distributePrivateData: func(string, string, *rwset.TxPvtReadWriteSet) error { return nil },
+			config:                Config{TransientRetries: 2, TransientRetryBackoff: time.Millisecond},
+			newTxSimulator: func(ledgername string, txid string) (ledger.TxSimulator, error) {
+				attempts++
+				if attempts == 1 {
+					return nil, simErr
+				}
+				return peer.GetLedger(ledgername).NewTxSimulator(txid)
+			},
+		}
+	}
+
+	// the first attempt hits a transient error, the second one succeeds
+	_, signedProp, err := getTestCCProposal(chainID, "get", "retrykey")
+	assert.NoError(t, err)
+	resp, err := newEndorser(simulatorBusyError{}).ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+	assert.Equal(t, "retryvalue", string(resp.Response.Payload))
+	assert.Equal(t, 2, attempts)
+
+	// other errors are not retried
+	_, signedProp, err = getTestCCProposal(chainID, "get", "retrykey")
+	assert.NoError(t, err)
+	_, err = newEndorser(errors.New("ledger corrupted")).ProcessProposal(context.Background(), signedProp)
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+
+	// and neither are transient errors once the deadline is too close
+	_, signedProp, err = getTestCCProposal(chainID, "get", "retrykey")
+	assert.NoError(t, err)
+	e := newEndorser(simulatorBusyError{})
+	e.config.TransientRetryBackoff = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = e.ProcessProposal(ctx, signedProp)
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+// lsccStateSimulator is a TxSimulator serving the chaincode definitions
+// committed in the lscc namespace
+type lsccStateSimulator struct {
+	ledger.TxSimulator
+	definitions map[string]*ccprovider.ChaincodeData
+}
+
+func (s *lsccStateSimulator) GetState(namespace string, key string) ([]byte, error) {
+	if namespace != "lscc" || s.definitions[key] == nil {
+		return nil, nil
+	}
+	return proto.Marshal(s.definitions[key])
+}
+
+func TestUpgradeObserved(t *testing.T) {
+	var events []UpgradeEvent
+	e := &Endorser{config: Config{UpgradeObserved: func(event UpgradeEvent) {
+		events = append(events, event)
+	}}}
+	txsim := &lsccStateSimulator{definitions: map[string]*ccprovider.ChaincodeData{
+		"upgradecc": {Name: "upgradecc", Version: "1.0"},
+	}}
+
+	e.observeUpgrade("testchainid", &pb.ChaincodeID{Name: "upgradecc", Version: "2.0"}, txsim)
+	e.observeUpgrade("testchainid", &pb.ChaincodeID{Name: "unknowncc", Version: "1.0"}, txsim)
+
+	assert.Equal(t, []UpgradeEvent{
+		{ChannelID: "testchainid", ChaincodeName: "upgradecc", OldVersion: "1.0", NewVersion: "2.0"},
+		{ChannelID: "testchainid", ChaincodeName: "unknowncc", NewVersion: "1.0"},
+	}, events)
+
+	// without a callback, nothing is looked up
+	e = &Endorser{}
+	e.observeUpgrade("testchainid", &pb.ChaincodeID{Name: "upgradecc", Version: "2.0"}, nil)
+}
+
+//rest of the code tests good ACL. Lets now test bad ACL
+func TestResourceBasedACL(t *testing.T) {
+	creator, _ := signer.Serialize()
+	nonce := []byte{1, 2, 3}
+	digest, err := factory.GetDefault().Hash(append(nonce, creator...), &bccsp.SHA256Opts{})
+	txID := hex.EncodeToString(digest)
+	spec := &pb.ChaincodeSpec{Type: 1, ChaincodeId: &pb.ChaincodeID{Path: "/path/to/mycc", Name: "mycc", Version: "0"}, Input: &pb.ChaincodeInput{Args: util.ToChaincodeArgs()}}
+	invocation := &pb.ChaincodeInvocationSpec{ChaincodeSpec: spec}
+	prop, _, _ := pbutils.CreateChaincodeProposalWithTxIDNonceAndTransient(txID, common.HeaderType_ENDORSER_TRANSACTION, util.GetTestChainID(), invocation, []byte{1, 2, 3}, creator, nil)
+	signedProp, _ := getSignedProposal(prop, signer)
+
+	//return Bad ACL
+	defer allowAllACLs()
+	mockAclProvider.Reset()
+	mockAclProvider.On("CheckACL", aclmgmt.PROPOSE, util.GetTestChainID(), signedProp).Return(errors.New("Bad ACL"))
+	_, err = endorserServer.ProcessProposal(context.Background(), signedProp)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Bad ACL")
+}
+
+// TestAdminACLFail deploys tried to deploy a chaincode;
+// however we inject a special policy for admins to simulate
+// the scenario in which the creator of this proposal is not among
+// the admins for the chain
+func TestAdminACLFail(t *testing.T) {
+	//skip pending FAB-2457 fix
+	t.Skip()
+	chainID := util.GetTestChainID()
+
+	// here we inject a reject policy for admins
+	// to simulate the scenario in which the invoker
+	// is not authorized to issue this proposal
+	rejectpolicy := &mockpolicies.Policy{
+		Err: errors.New("The creator of this proposal does not fulfil the writers policy of this chain"),
+	}
+	pm := peer.GetPolicyManager(chainID)
+	pm.(*mockpolicies.Manager).PolicyMap = map[string]policies.Policy{policies.ChannelApplicationAdmins: rejectpolicy}
+
+	var ctxt = context.Background()
+
+	url := "github.com/hyperledger/fabric/examples/chaincode/go/chaincode_example01"
+	chaincodeID := &pb.ChaincodeID{Path: url, Name: "ex01-fail1", Version: "0"}
+
+	defer deleteChaincodeOnDisk("ex01-fail1.0")
+
+	f := "init"
+	argsDeploy := util.ToChaincodeArgs(f, "a", "100", "b", "200")
+	spec := &pb.ChaincodeSpec{Type: 1, ChaincodeId: chaincodeID, Input: &pb.ChaincodeInput{Args: argsDeploy}}
+
+	cccid := ccprovider.NewCCContext(chainID, "ex01-fail1", "0", "", false, nil, nil)
+
+	_, _, err := deploy(endorserServer, chainID, spec, nil)
+	if err == nil {
+		t.Fail()
+		t.Logf("Deploying chaincode should have failed!")
+		chaincode.GetChain().Stop(ctxt, cccid, &pb.ChaincodeDeploymentSpec{ChaincodeSpec: &pb.ChaincodeSpec{ChaincodeId: chaincodeID}})
+		return
+	}
+
+	t.Logf("TestATestAdminACLFailCLFail passed")
+
+	chaincode.GetChain().Stop(ctxt, cccid, &pb.ChaincodeDeploymentSpec{ChaincodeSpec: &pb.ChaincodeSpec{ChaincodeId: chaincodeID}})
+}
+
+// TestInvokeSccFail makes sure that invoking a system chaincode fails
+func TestInvokeSccFail(t *testing.T) {
+	chainID := util.GetTestChainID()
+
+	chaincodeID := &pb.ChaincodeID{Name: "escc"}
+	args := util.ToChaincodeArgs("someFunc", "someArg")
+	spec := &pb.ChaincodeSpec{Type: 1, ChaincodeId: chaincodeID, Input: &pb.ChaincodeInput{Args: args}}
+	_, _, _, _, err := invoke(chainID, spec)
+	if err == nil {
+		t.Logf("Invoking escc should have failed!")
+		t.Fail()
+		return
+	}
+}
+
+func newTempDir() string {
+	tempDir, err := ioutil.TempDir("", "fabric-")
+	if err != nil {
+		panic(err)
+	}
+	return tempDir
+}
+
+var mockAclProvider *mocks.MockACLProvider
+
+func TestMain(m *testing.M) {
+	mockAclProvider = &mocks.MockACLProvider{}
+	allowAllACLs()
+
+	aclmgmt.RegisterACLProvider(mockAclProvider)
+
+	setupTestConfig()
+
+	chainID := util.GetTestChainID()
+	tev, err := initPeer(chainID)
+	if err != nil {
+		os.Exit(-1)
+		fmt.Printf("Could not initialize tests")
+		finitPeer(tev)
+		return
+	}
+
+	endorserServer = NewEndorserServer(func(channel string, txID string, privateData *rwset.TxPvtReadWriteSet) error {
+		return nil
+	}, Config{})
+
+	// setup the MSP manager so that we can sign/verify
+	err = msptesttools.LoadMSPSetupForTesting()
+	if err != nil {
+		fmt.Printf("Could not initialize msp/signer, err %s", err)
+		finitPeer(tev)
+		os.Exit(-1)
+		return
+	}
+	signer, err = mspmgmt.GetLocalMSP().GetDefaultSigningIdentity()
+	if err != nil {
+		fmt.Printf("Could not initialize msp/signer")
+		finitPeer(tev)
+		os.Exit(-1)
+		return
+	}
+
+	if err = defineTestCCs(chainID); err != nil {
+		fmt.Printf("Could not define the test chaincodes, err %s", err)
+		finitPeer(tev)
+		os.Exit(-1)
+		return
+	}
+
+	retVal := m.Run()
+
+	finitPeer(tev)
 
 	os.Exit(retVal)
 }
@@ -839,3 +2288,1245 @@ func setupTestConfig() {
 		panic(fmt.Errorf("Could not initialize BCCSP Factories [%s]", err))
 	}
 }
+
+func TestEndorsementCache(t *testing.T) {
+	chainID := util.GetTestChainID()
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{EndorsementCacheSize: 10})
+	var open int32
+	e.(*Endorser).newTxSimulator = func(ledgername string, txid string) (ledger.TxSimulator, error) {
+		// a simulator still open would hold off the commit of blocks
+		assert.Zero(t, atomic.AddInt32(&open, 1)-1, "the stale simulator should have been released")
+		txsim, err := peer.GetLedger(ledgername).NewTxSimulator(txid)
+		return &doneCountingSimulator{TxSimulator: txsim, done: &open}, err
+	}
+
+	_, err := invokeTestCC(chainID, "put", "cachedkey", "v1")
+	assert.NoError(t, err)
+
+	get := func() *pb.ProposalResponse {
+		_, signedProp, err := getTestCCProposal(chainID, "get", "cachedkey")
+		assert.NoError(t, err)
+		resp, err := e.ProcessProposal(context.Background(), signedProp)
+		assert.NoError(t, err)
+		assert.Equal(t, int32(shim.OK), resp.Response.Status)
+		return resp
+	}
+
+	before := atomic.LoadInt64(&testCCGets)
+	resp := get()
+	assert.Equal(t, []byte("v1"), resp.Response.Payload)
+	assert.Equal(t, before+1, atomic.LoadInt64(&testCCGets))
+
+	// the state is unchanged, the cached simulation is used and endorsed
+	cachedResp := get()
+	assert.Equal(t, []byte("v1"), cachedResp.Response.Payload)
+	assert.Equal(t, before+1, atomic.LoadInt64(&testCCGets), "the chaincode should not be invoked on a cache hit")
+	assert.NotNil(t, cachedResp.Endorsement)
+	assert.NotEqual(t, resp.Endorsement.Signature, cachedResp.Endorsement.Signature)
+
+	// updating the key invalidates the cached simulation
+	_, err = invokeTestCC(chainID, "put", "cachedkey", "v2")
+	assert.NoError(t, err)
+	resp = get()
+	assert.Equal(t, []byte("v2"), resp.Response.Payload)
+	assert.Equal(t, before+2, atomic.LoadInt64(&testCCGets), "the chaincode should be invoked on a cache miss")
+
+	// updating another key does not
+	_, err = invokeTestCC(chainID, "put", "otherkey", "v1")
+	assert.NoError(t, err)
+	resp = get()
+	assert.Equal(t, []byte("v2"), resp.Response.Payload)
+	assert.Equal(t, before+2, atomic.LoadInt64(&testCCGets))
+}
+
+func TestSimulateProposal(t *testing.T) {
+	chainID := util.GetTestChainID()
+	e := endorserServer.(*Endorser)
+
+	_, err := invokeTestCC(chainID, "put", "simulatedkey", "v1")
+	assert.NoError(t, err)
+
+	prop, signedProp, err := getTestCCProposal(chainID, "put", "simulatedkey", "v2")
+	assert.NoError(t, err)
+	res, simResult, err := e.SimulateProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(shim.OK), res.Status)
+	txRWSet := &rwsetutil.TxRwSet{}
+	assert.NoError(t, txRWSet.FromProtoBytes(simResult))
+	// along with the read of the chaincode definition from lscc
+	if assert.Len(t, txRWSet.NsRwSets, 2) && assert.Len(t, txRWSet.NsRwSets[0].KvRwSet.Writes, 1) {
+		assert.Equal(t, []byte("v2"), txRWSet.NsRwSets[0].KvRwSet.Writes[0].Value)
+	}
+
+	// nothing was endorsed, let alone committed
+	_, signedGet, err := getTestCCProposal(chainID, "get", "simulatedkey")
+	assert.NoError(t, err)
+	res, _, err = e.SimulateProposal(context.Background(), signedGet)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v1"), res.Payload)
+
+	// the transaction of a committed proposal cannot be simulated again
+	resp, err := e.ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+	info, err := peer.GetLedger(chainID).GetBlockchainInfo()
+	assert.NoError(t, err)
+	assert.NoError(t, e.commitTxSimulation(prop, chainID, signer, resp, info.Height))
+	_, _, err = e.SimulateProposal(context.Background(), signedProp)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "duplicate transaction found")
+}
+
+func TestProcessQuery(t *testing.T) {
+	chainID := util.GetTestChainID()
+	e := endorserServer.(*Endorser)
+
+	_, err := invokeTestCC(chainID, "put", "querykey", "v1")
+	assert.NoError(t, err)
+
+	// a committed proposal cannot be processed again
+	prop, signedProp, err := getTestCCProposal(chainID, "get", "querykey")
+	assert.NoError(t, err)
+	resp, err := e.ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+	info, err := peer.GetLedger(chainID).GetBlockchainInfo()
+	assert.NoError(t, err)
+	assert.NoError(t, e.commitTxSimulation(prop, chainID, signer, resp, info.Height))
+	_, err = e.ProcessProposal(context.Background(), signedProp)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "duplicate transaction found")
+
+	// but it can be queried again
+	for i := 0; i < 2; i++ {
+		resp, err = e.ProcessQuery(context.Background(), signedProp)
+		assert.NoError(t, err)
+		assert.Equal(t, int32(shim.OK), resp.Response.Status)
+		assert.Equal(t, []byte("v1"), resp.Response.Payload)
+	}
+
+	// a query attempting to write fails
+	_, signedPut, err := getTestCCProposal(chainID, "put", "querykey", "v2")
+	assert.NoError(t, err)
+	_, err = e.ProcessQuery(context.Background(), signedPut)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "attempted to write")
+}
+
+// simulatedKeys returns the number of keys read and written by the
+// simulation the proposal response endorses
+func simulatedKeys(t *testing.T, resp *pb.ProposalResponse) (int, int) {
+	prp, err := pbutils.GetProposalResponsePayload(resp.Payload)
+	assert.NoError(t, err)
+	action, err := pbutils.GetChaincodeAction(prp.Extension)
+	assert.NoError(t, err)
+	results := &rwsetutil.TxRwSet{}
+	assert.NoError(t, results.FromProtoBytes(action.Results))
+	reads, writes := 0, 0
+	for _, nsRwSet := range results.NsRwSets {
+		reads += len(nsRwSet.KvRwSet.Reads)
+		writes += len(nsRwSet.KvRwSet.Writes)
+	}
+	return reads, writes
+}
+
+func TestLightweightQueries(t *testing.T) {
+	chainID := util.GetTestChainID()
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{
+		ReadOnlyFunctions:  map[string][]string{testCCName: {"get", "put"}},
+		LightweightQueries: true,
+	})
+
+	_, err := invokeTestCC(chainID, "put", "lightkey", "v1")
+	assert.NoError(t, err)
+
+	// the reads of a query are not tracked
+	_, signedProp, err := getTestCCProposal(chainID, "get", "lightkey")
+	assert.NoError(t, err)
+	resp, err := e.ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v1"), resp.Response.Payload)
+	reads, writes := simulatedKeys(t, resp)
+	assert.Zero(t, reads)
+	assert.Zero(t, writes)
+
+	// a read-only function writing after all fails rather than being
+	// endorsed without its write
+	_, signedProp, err = getTestCCProposal(chainID, "put", "lightkey", "v2")
+	assert.NoError(t, err)
+	resp, err = e.ProcessProposal(context.Background(), signedProp)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "read-only function of chaincode "+testCCName+" attempted to write")
+	assert.NotEqual(t, int32(shim.OK), resp.Response.Status)
+	assert.Nil(t, resp.Endorsement)
+}
+
+func TestMaxProposalSize(t *testing.T) {
+	chainID := util.GetTestChainID()
+	_, signedProp, err := getTestCCProposal(chainID, "get", "key")
+	assert.NoError(t, err)
+	size := len(signedProp.ProposalBytes) + len(signedProp.Signature)
+
+	// a proposal within the limit goes through
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{MaxProposalSize: size})
+	resp, err := e.ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(200), resp.Response.Status)
+
+	// a larger one is rejected before it is parsed
+	e = NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{MaxProposalSize: size - 1})
+	resp, err = e.ProcessProposal(context.Background(), signedProp)
+	assert.Equal(t, codes.InvalidArgument, grpc.Code(err))
+	assert.Equal(t, fmt.Sprintf("proposal of %d bytes exceeds the maximum proposal size of %d bytes", size, size-1), grpc.ErrorDesc(err))
+	assert.Equal(t, int32(500), resp.Response.Status)
+	assert.Contains(t, resp.Response.Message, "exceeds the maximum proposal size")
+
+	resp, err = e.ProcessProposal(context.Background(), &pb.SignedProposal{ProposalBytes: make([]byte, size)})
+	assert.Error(t, err)
+	assert.Contains(t, resp.Response.Message, "exceeds the maximum proposal size")
+
+	// the limit applies to the proposals simulated without endorsement too
+	_, _, err = e.(*Endorser).SimulateProposal(context.Background(), signedProp)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "exceeds the maximum proposal size")
+}
+
+func TestProposalMetrics(t *testing.T) {
+	chainID := util.GetTestChainID()
+	fm := newFakeMetrics()
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{Metrics: fm.scope()})
+	tags := map[string]string{"channel": chainID, "chaincode": testCCName}
+
+	_, signedProp, err := getTestCCProposal(chainID, "sleep", "metrics")
+	assert.NoError(t, err)
+	_, err = e.ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+
+	// the chaincode fails on unknown functions
+	_, signedProp, err = getTestCCProposal(chainID, "unknown")
+	assert.NoError(t, err)
+	_, err = e.ProcessProposal(context.Background(), signedProp)
+	assert.Error(t, err)
+
+	assert.Equal(t, int64(2), fm.counter("proposals_received", tags))
+	assert.Equal(t, int64(1), fm.counter("proposals_succeeded", tags))
+	assert.Equal(t, int64(1), fm.counter("proposals_failed", tags))
+	assert.Equal(t, int64(1), fm.counter("proposals_chaincode_failed", tags))
+
+	proposalDurations := fm.histogram("proposal_duration", tags)
+	chaincodeDurations := fm.histogram("chaincode_duration", tags)
+	if assert.Len(t, proposalDurations, 2) && assert.Len(t, chaincodeDurations, 2) {
+		// the sleep function sleeps 20ms
+		assert.True(t, chaincodeDurations[0] >= 20*time.Millisecond)
+		assert.True(t, proposalDurations[0] >= chaincodeDurations[0])
+	}
+
+	// a proposal failing before reaching the chaincode is not a chaincode failure
+	_, signedProp, err = getTestCCProposal("nosuchchannel", "sleep", "metrics")
+	assert.NoError(t, err)
+	_, err = e.ProcessProposal(context.Background(), signedProp)
+	assert.Error(t, err)
+	tags["channel"] = "nosuchchannel"
+	assert.Equal(t, int64(1), fm.counter("proposals_failed", tags))
+	assert.Zero(t, fm.counter("proposals_chaincode_failed", tags))
+}
+
+func TestSigningMetrics(t *testing.T) {
+	chainID := util.GetTestChainID()
+	fm := newFakeMetrics()
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{Metrics: fm.scope(), SlowSigningThreshold: time.Nanosecond})
+	tags := map[string]string{"channel": chainID, "chaincode": testCCName}
+
+	_, signedProp, err := getTestCCProposal(chainID, "sleep", "metrics")
+	assert.NoError(t, err)
+	_, err = e.ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+
+	// the signing is measured apart from the simulation
+	signingDurations := fm.histogram("signing_duration", tags)
+	chaincodeDurations := fm.histogram("chaincode_duration", tags)
+	if assert.Len(t, signingDurations, 1) && assert.Len(t, chaincodeDurations, 1) {
+		assert.True(t, signingDurations[0] > 0)
+		assert.True(t, signingDurations[0] < chaincodeDurations[0])
+	}
+
+	// and is not measured for proposals failing before the endorsement
+	_, signedProp, err = getTestCCProposal(chainID, "unknown")
+	assert.NoError(t, err)
+	_, err = e.ProcessProposal(context.Background(), signedProp)
+	assert.Error(t, err)
+	assert.Len(t, fm.histogram("signing_duration", tags), 1)
+}
+
+// lsccSimulator is a TxSimulator serving the lscc state from definitions,
+// counting the reads of it
+type lsccSimulator struct {
+	ledger.TxSimulator
+	definitions map[string][]byte
+	reads       *int
+}
+
+func (s *lsccSimulator) GetState(namespace string, key string) ([]byte, error) {
+	if namespace != "lscc" {
+		return s.TxSimulator.GetState(namespace, key)
+	}
+	*s.reads++
+	return s.definitions[key], nil
+}
+
+func TestChaincodeDefinitionCache(t *testing.T) {
+	chainID := util.GetTestChainID()
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{}).(*Endorser)
+	definitions := map[string][]byte{}
+	setVersion := func(version string) {
+		definitions["defcc"] = pbutils.MarshalOrPanic(&ccprovider.ChaincodeData{Name: "defcc", Version: version, Escc: "escc", Vscc: "vscc"})
+	}
+
+	prop, signedProp, err := getTestCCProposal(chainID, "get", "key")
+	assert.NoError(t, err)
+	mockAclProvider.On("CheckACL", aclmgmt.LSCC_GETCCDATA, chainID, signedProp).Return(nil)
+	getDefinition := func() (resourcesconfig.ChaincodeDefinition, int) {
+		txsim, err := peer.GetLedger(chainID).NewTxSimulator(util.GenerateUUID())
+		assert.NoError(t, err)
+		defer txsim.Done()
+		reads := 0
+		cd, err := e.getCDSFromLSCC(context.Background(), chainID, util.GenerateUUID(), signedProp, prop, "defcc", &lsccSimulator{TxSimulator: txsim, definitions: definitions, reads: &reads})
+		assert.NoError(t, err)
+		return cd, reads
+	}
+
+	// lscc resolves the definition the first time, reading its state too
+	setVersion("1")
+	cd, reads := getDefinition()
+	assert.Equal(t, "1", cd.CCVersion())
+	assert.Equal(t, 2, reads)
+
+	// then the cached definition is used as long as the state is unchanged
+	cd, reads = getDefinition()
+	assert.Equal(t, "1", cd.CCVersion())
+	assert.Equal(t, 1, reads)
+
+	// an upgraded definition is resolved again
+	setVersion("2")
+	cd, reads = getDefinition()
+	assert.Equal(t, "2", cd.CCVersion())
+	assert.Equal(t, 2, reads)
+	cd, reads = getDefinition()
+	assert.Equal(t, "2", cd.CCVersion())
+	assert.Equal(t, 1, reads)
+
+	// and so is the definition of a chaincode being deployed or upgraded
+	e.definitions.invalidate(chainID, "defcc")
+	_, reads = getDefinition()
+	assert.Equal(t, 2, reads)
+}
+
+// blockingSimulator is a TxSimulator whose reads of the lscc state block
+// until release is closed, and then find nothing
+type blockingSimulator struct {
+	ledger.TxSimulator
+	release chan struct{}
+}
+
+func (s *blockingSimulator) GetState(namespace string, key string) ([]byte, error) {
+	if namespace != "lscc" {
+		return s.TxSimulator.GetState(namespace, key)
+	}
+	<-s.release
+	return nil, nil
+}
+
+func TestChaincodeDefinitionDeadline(t *testing.T) {
+	chainID := util.GetTestChainID()
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{}).(*Endorser)
+	prop, signedProp, err := getTestCCProposal(chainID, "get", "key")
+	assert.NoError(t, err)
+	txsim, err := peer.GetLedger(chainID).NewTxSimulator(util.GenerateUUID())
+	assert.NoError(t, err)
+	defer txsim.Done()
+
+	// a slow state read does not outlive the deadline of the proposal
+	release := make(chan struct{})
+	defer close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = e.getCDSFromLSCC(ctx, chainID, util.GenerateUUID(), signedProp, prop, "defcc", &blockingSimulator{TxSimulator: txsim, release: release})
+	assert.Error(t, err)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+	assert.Equal(t, timeoutError, categorize(err))
+	assert.True(t, time.Since(start) < time.Second)
+
+	// and an expired deadline fails the lookup right away
+	_, err = e.getCDSFromLSCC(ctx, chainID, util.GenerateUUID(), signedProp, prop, "defcc", txsim)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+}
+
+func TestErrorCategories(t *testing.T) {
+	chainID := util.GetTestChainID()
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{
+		EndorsementDelays: map[string]EndorsementDelay{testCCName + "2": {Min: time.Second}},
+	})
+
+	resp, err := e.ProcessProposal(context.Background(), &pb.SignedProposal{ProposalBytes: []byte("garbage")})
+	assert.Error(t, err)
+	assert.True(t, strings.HasPrefix(resp.Response.Message, "[validation] "), "unexpected message %s", resp.Response.Message)
+
+	_, signedProp, err := getTestCCProposal(chainID, "unknown")
+	assert.NoError(t, err)
+	resp, err = e.ProcessProposal(context.Background(), signedProp)
+	assert.Equal(t, "chaincode error (status: 500, message: unknown function unknown) (category: chaincode)", grpc.ErrorDesc(err))
+	assert.Equal(t, "[chaincode] unknown function unknown", resp.Response.Message)
+
+	_, signedProp, err = getChaincodeProposal(chainID, testCCName+"2", "get", "key")
+	assert.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	resp, err = e.ProcessProposal(ctx, signedProp)
+	assert.Error(t, err)
+	assert.True(t, strings.HasPrefix(resp.Response.Message, "[timeout] "), "unexpected message %s", resp.Response.Message)
+}
+
+func TestCancelledProposal(t *testing.T) {
+	chainID := util.GetTestChainID()
+	var simulators int32
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{}).(*Endorser)
+	e.newTxSimulator = func(ledgername string, txid string) (ledger.TxSimulator, error) {
+		atomic.AddInt32(&simulators, 1)
+		txsim, err := peer.GetLedger(ledgername).NewTxSimulator(txid)
+		return &doneCountingSimulator{TxSimulator: txsim, done: &simulators}, err
+	}
+
+	_, signedProp, err := getTestCCProposal(chainID, "get", "key")
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	resp, err := e.ProcessProposal(ctx, signedProp)
+	assert.Equal(t, codes.Canceled, grpc.Code(err))
+	assert.True(t, strings.HasPrefix(resp.Response.Message, "[cancelled] "), "unexpected message %s", resp.Response.Message)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&simulators), "the tx simulator should have been released")
+}
+
+// doneCountingSimulator decrements done when it is released
+type doneCountingSimulator struct {
+	ledger.TxSimulator
+	done *int32
+}
+
+func (s *doneCountingSimulator) Done() {
+	atomic.AddInt32(s.done, -1)
+	s.TxSimulator.Done()
+}
+
+func TestResolveESCC(t *testing.T) {
+	chainID := util.GetTestChainID()
+	e := &Endorser{}
+
+	escc, err := e.resolveESCC(chainID, &pb.ChaincodeID{Name: "lscc"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "escc", escc)
+
+	escc, err = e.resolveESCC(chainID, &pb.ChaincodeID{Name: "mycc"}, &ccprovider.ChaincodeData{Name: "mycc", Escc: "myescc"})
+	assert.NoError(t, err)
+	assert.Equal(t, "myescc", escc)
+
+	_, err = e.resolveESCC(chainID, &pb.ChaincodeID{Name: "mycc"}, &ccprovider.ChaincodeData{Name: "mycc"})
+	assert.EqualError(t, err, "no ESCC specified in the definition of chaincode mycc on channel "+chainID)
+
+	// the selectors of the endorser take precedence over the definition
+	e.selectors = []endorsement.Selector{escc2Selector{}}
+	escc, err = e.resolveESCC(chainID, &pb.ChaincodeID{Name: "mycc"}, &ccprovider.ChaincodeData{Name: "mycc", Escc: "myescc"})
+	assert.NoError(t, err)
+	assert.Equal(t, "escc2", escc)
+}
+
+// escc2Selector selects escc2 for every proposal
+type escc2Selector struct{}
+
+func (escc2Selector) SelectEndorsement(chainID string, ccName string, escc string) string {
+	return "escc2"
+}
+
+func TestHandlersResolvedOnce(t *testing.T) {
+	e := NewEndorserServer(nil, Config{}).(*Endorser)
+	assert.Equal(t, library.InitRegistry(library.Config{}).Lookup(library.Decoration).([]decoration.Decorator), e.decorators)
+	assert.Equal(t, library.InitRegistry(library.Config{}).Lookup(library.Endorsement).([]endorsement.Selector), e.selectors)
+}
+
+func TestTxIDFilter(t *testing.T) {
+	var disabled *txIDFilter
+	assert.Nil(t, newTxIDFilter(0, time.Minute))
+	assert.True(t, disabled.seen("ch", "tx"))
+
+	f := newTxIDFilter(100, 0)
+	for i := 0; i < 100; i++ {
+		f.seen("ch1", fmt.Sprintf("tx%d", i))
+	}
+	for i := 0; i < 100; i++ {
+		assert.True(t, f.seen("ch1", fmt.Sprintf("tx%d", i)), "tx%d should have been seen", i)
+	}
+	// the channels are filtered separately
+	assert.False(t, f.seen("ch2", "tx0"))
+
+	// a full generation becomes the previous one, and is forgotten when
+	// the next one is full in turn
+	for i := 100; i < 199; i++ {
+		f.seen("ch1", fmt.Sprintf("tx%d", i))
+	}
+	assert.True(t, f.seen("ch1", "tx0"))
+	assert.True(t, f.seen("ch1", "tx198"))
+	for i := 200; i < 400; i++ {
+		f.seen("ch1", fmt.Sprintf("tx%d", i))
+	}
+	seen := 0
+	for i := 0; i < 100; i++ {
+		if f.seen("ch1", fmt.Sprintf("tx%d", i)) {
+			seen++
+		}
+	}
+	assert.True(t, seen < 10, "%d forgotten txids were seen", seen)
+
+	// the generations are rotated once the interval elapsed
+	f = newTxIDFilter(100, time.Minute)
+	assert.False(t, f.seen("ch", "tx"))
+	f.channels["ch"].rotated = time.Now().Add(-time.Minute)
+	assert.True(t, f.seen("ch", "tx"))
+	assert.Equal(t, 0, f.channels["ch"].current.count)
+	assert.Equal(t, 1, f.channels["ch"].previous.count)
+}
+
+func TestTxIDFilterDuplicates(t *testing.T) {
+	chainID := util.GetTestChainID()
+	prop, signedProp, err := getTestCCProposal(chainID, "put", "filteredkey", "v1")
+	assert.NoError(t, err)
+	resp, err := endorserServer.ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+	info, err := peer.GetLedger(chainID).GetBlockchainInfo()
+	assert.NoError(t, err)
+	assert.NoError(t, endorserServer.(*Endorser).commitTxSimulation(prop, chainID, signer, resp, info.Height))
+
+	// a transaction committed through another endorser, which the filter
+	// has never seen, is still a duplicate
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{TxIDFilterSize: 100})
+	_, err = e.ProcessProposal(context.Background(), signedProp)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "duplicate transaction found")
+}
+
+func TestACLCache(t *testing.T) {
+	chainID := util.GetTestChainID()
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{ACLCacheTTL: time.Minute}).(*Endorser)
+	checkACL := func() error {
+		prop, signedProp, err := getTestCCProposal(chainID, "get", "key")
+		assert.NoError(t, err)
+		hdr, err := pbutils.GetHeader(prop.Header)
+		assert.NoError(t, err)
+		chdr, err := pbutils.UnmarshalChannelHeader(hdr.ChannelHeader)
+		assert.NoError(t, err)
+		shdr, err := pbutils.GetSignatureHeader(hdr.SignatureHeader)
+		assert.NoError(t, err)
+		return e.checkACL(signedProp, chdr, shdr, nil)
+	}
+	defer allowAllACLs()
+
+	mockAclProvider.Reset()
+	mockAclProvider.On("CheckACL", aclmgmt.PROPOSE, chainID, mock.Anything).Return(nil)
+	assert.NoError(t, checkACL())
+
+	// the policy now rejects the creator, who was allowed a moment ago
+	mockAclProvider.Reset()
+	mockAclProvider.On("CheckACL", aclmgmt.PROPOSE, chainID, mock.Anything).Return(errors.New("not a writer"))
+	assert.NoError(t, checkACL())
+
+	// until the config of the channel is updated
+	validator := peer.GetChannelConfig(chainID).ConfigtxValidator().(*mockconfigtx.Validator)
+	validator.SequenceVal++
+	defer func() { validator.SequenceVal-- }()
+	assert.EqualError(t, checkACL(), "not a writer")
+
+	// the decisions expire
+	now := time.Now()
+	e.acls.allow(chainID, []byte("creator"), validator.SequenceVal, now)
+	assert.True(t, e.acls.allowed(chainID, []byte("creator"), validator.SequenceVal, now.Add(time.Second)))
+	assert.False(t, e.acls.allowed(chainID, []byte("creator"), validator.SequenceVal, now.Add(time.Minute)))
+	assert.False(t, e.acls.allowed(chainID, []byte("creator"), validator.SequenceVal, now))
+}
+
+func TestChaincodeEventObserved(t *testing.T) {
+	chainID := util.GetTestChainID()
+	type observed struct {
+		channel string
+		txID    string
+		event   *pb.ChaincodeEvent
+	}
+	events := make(chan observed, 1)
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{
+		ReadOnlyFunctions: map[string][]string{testCCName: {"emit"}},
+		ChaincodeEventObserved: func(channel string, txID string, event *pb.ChaincodeEvent) {
+			events <- observed{channel: channel, txID: txID, event: event}
+		},
+	})
+
+	// the event is observed even though it is dropped from the response
+	prop, signedProp, err := getTestCCProposal(chainID, "emit", "observed")
+	assert.NoError(t, err)
+	resp, err := e.ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+	assert.Nil(t, getResponseEvent(t, resp))
+
+	hdr, err := pbutils.GetHeader(prop.Header)
+	assert.NoError(t, err)
+	chdr, err := pbutils.UnmarshalChannelHeader(hdr.ChannelHeader)
+	assert.NoError(t, err)
+	select {
+	case o := <-events:
+		assert.Equal(t, chainID, o.channel)
+		assert.Equal(t, chdr.TxId, o.txID)
+		assert.Equal(t, "observed", o.event.EventName)
+	case <-time.After(time.Second):
+		t.Fatal("the chaincode event should have been observed")
+	}
+
+	// a slow observer does not hold back the proposals
+	e.(*Endorser).events.queue = make(chan *observedEvent)
+	_, signedProp, err = getTestCCProposal(chainID, "emit", "dropped")
+	assert.NoError(t, err)
+	_, err = e.ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+}
+
+func TestEndorsedFailures(t *testing.T) {
+	chainID := util.GetTestChainID()
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{
+		EndorsedFailureThreshold: shim.ERROR + 1,
+	})
+
+	_, signedProp, err := getTestCCProposal(chainID, "fail", "endorsedkey")
+	assert.NoError(t, err)
+	resp, err := e.ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(shim.ERROR), resp.Response.Status)
+	assert.Contains(t, resp.Response.Message, "failed on purpose")
+	assert.NotNil(t, resp.Endorsement)
+
+	// the failure is signed, without the writes of the chaincode
+	prp, err := pbutils.GetProposalResponsePayload(resp.Payload)
+	assert.NoError(t, err)
+	action, err := pbutils.GetChaincodeAction(prp.Extension)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(shim.ERROR), action.Response.Status)
+	results := &rwsetutil.TxRwSet{}
+	assert.NoError(t, results.FromProtoBytes(action.Results))
+	assert.Empty(t, results.NsRwSets)
+
+	// failures at or above the threshold are not endorsed
+	e = NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{
+		EndorsedFailureThreshold: shim.ERROR,
+	})
+	_, signedProp, err = getTestCCProposal(chainID, "fail", "endorsedkey")
+	assert.NoError(t, err)
+	resp, err = e.ProcessProposal(context.Background(), signedProp)
+	assert.Error(t, err)
+	assert.Nil(t, resp.Endorsement)
+
+	// and successes are endorsed as usual
+	_, signedProp, err = getTestCCProposal(chainID, "put", "endorsedkey", "value")
+	assert.NoError(t, err)
+	resp, err = e.ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(shim.OK), resp.Response.Status)
+}
+
+func TestStatusCodes(t *testing.T) {
+	chainID := util.GetTestChainID()
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{
+		ProposalRateLimits: map[string]RateLimit{chainID: {Rate: 0.001, Burst: 1}},
+	})
+
+	_, err := e.ProcessProposal(context.Background(), &pb.SignedProposal{ProposalBytes: []byte("garbage")})
+	assert.Equal(t, codes.InvalidArgument, grpc.Code(err))
+
+	_, err = getLedger("nosuchchannel")
+	err = statusError(context.Background(), failureResponse(internalError, err), err)
+	assert.Equal(t, codes.NotFound, grpc.Code(err))
+	assert.Equal(t, "channel does not exist: nosuchchannel", grpc.ErrorDesc(err))
+
+	_, signedProp, err := getTestCCProposal(chainID, "unknown")
+	assert.NoError(t, err)
+	resp, err := e.ProcessProposal(context.Background(), signedProp)
+	assert.Equal(t, codes.Unknown, grpc.Code(err))
+	// the status of the response is left as is
+	assert.Equal(t, int32(500), resp.Response.Status)
+
+	// the proposals to application chaincodes are rate limited, the burst
+	// being spent by the one above
+	_, signedProp, err = getTestCCProposal(chainID, "get", "key")
+	assert.NoError(t, err)
+	resp, err = e.ProcessProposal(context.Background(), signedProp)
+	assert.Equal(t, codes.ResourceExhausted, grpc.Code(err))
+	assert.Equal(t, int32(429), resp.Response.Status)
+
+	assert.Nil(t, statusError(context.Background(), nil, nil))
+}
+
+func TestInvalidResponseStatus(t *testing.T) {
+	chainID := util.GetTestChainID()
+	for _, status := range []string{"0", "-1", "600", "2147483647"} {
+		_, signedProp, err := getTestCCProposal(chainID, "respond", status)
+		assert.NoError(t, err)
+		resp, err := endorserServer.ProcessProposal(context.Background(), signedProp)
+		assert.Error(t, err, "status %s should fail the proposal", status)
+		assert.Equal(t, int32(shim.ERROR), resp.Response.Status)
+		assert.Contains(t, resp.Response.Message, "chaincode responded with invalid status "+status+": status "+status)
+	}
+
+	// the statuses in range are kept
+	_, signedProp, err := getTestCCProposal(chainID, "respond", "201")
+	assert.NoError(t, err)
+	_, err = endorserServer.ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+}
+
+func TestTxIDValidator(t *testing.T) {
+	chainID := util.GetTestChainID()
+	var validated []string
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{
+		TxIDValidator: func(channelID string, txid string, creator []byte) error {
+			assert.Equal(t, chainID, channelID)
+			assert.NotEmpty(t, creator)
+			validated = append(validated, txid)
+			if len(validated) > 1 {
+				return errors.New("deny-listed")
+			}
+			return nil
+		},
+	})
+
+	_, signedProp, err := getTestCCProposal(chainID, "get", "key")
+	assert.NoError(t, err)
+	_, err = e.ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+
+	prop, signedProp, err := getTestCCProposal(chainID, "get", "key")
+	assert.NoError(t, err)
+	resp, err := e.ProcessProposal(context.Background(), signedProp)
+	assert.Error(t, err)
+	assert.Equal(t, int32(500), resp.Response.Status)
+	hdr, err := pbutils.GetHeader(prop.Header)
+	assert.NoError(t, err)
+	chdr, err := pbutils.UnmarshalChannelHeader(hdr.ChannelHeader)
+	assert.NoError(t, err)
+	assert.Equal(t, "[validation] txid "+chdr.TxId+" rejected: deny-listed", resp.Response.Message)
+	assert.Len(t, validated, 2)
+}
+
+func TestChaincodeDefinitionFrom(t *testing.T) {
+	ctx := context.Background()
+	assert.Nil(t, ChaincodeDefinitionFrom(ctx))
+	// system chaincodes have no definition
+	assert.Equal(t, ctx, withChaincodeDefinition(ctx, nil))
+
+	cd := &ccprovider.ChaincodeData{Name: "mycc", Version: "1.0"}
+	ctx = withChaincodeDefinition(ctx, cd)
+	assert.Equal(t, cd, ChaincodeDefinitionFrom(ctx))
+	assert.Equal(t, "1.0", ChaincodeDefinitionFrom(ctx).CCVersion())
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker(2, time.Minute, 10*time.Second)
+	now := time.Now()
+	fail := func(canName string, at time.Time) {
+		executed, err := b.allow(canName, at)
+		assert.NoError(t, err)
+		executed(false, at)
+	}
+
+	// failures too far apart do not open the circuit
+	fail("mycc:1.0", now)
+	fail("mycc:1.0", now.Add(2*time.Minute))
+	executed, err := b.allow("mycc:1.0", now.Add(2*time.Minute))
+	assert.NoError(t, err)
+	executed(true, now.Add(2*time.Minute))
+
+	// consecutive ones do, for the chaincode only
+	fail("mycc:1.0", now)
+	fail("mycc:1.0", now.Add(time.Second))
+	_, err = b.allow("mycc:1.0", now.Add(5*time.Second))
+	assert.Equal(t, errCircuitOpen, errors.Cause(err))
+	_, err = b.allow("othercc:1.0", now.Add(5*time.Second))
+	assert.NoError(t, err)
+
+	// after the cooldown, a single trial goes through; its failure starts
+	// another cooldown
+	trialEnd := now.Add(12 * time.Second)
+	executed, err = b.allow("mycc:1.0", now.Add(11*time.Second))
+	assert.NoError(t, err)
+	_, err = b.allow("mycc:1.0", now.Add(11*time.Second))
+	assert.Error(t, err, "only one trial should go through")
+	executed(false, trialEnd)
+	_, err = b.allow("mycc:1.0", trialEnd.Add(time.Second))
+	assert.Error(t, err)
+
+	// its success closes the circuit
+	executed, err = b.allow("mycc:1.0", trialEnd.Add(10*time.Second))
+	assert.NoError(t, err)
+	executed(true, trialEnd.Add(10*time.Second))
+	_, err = b.allow("mycc:1.0", trialEnd.Add(10*time.Second))
+	assert.NoError(t, err)
+
+	assert.Nil(t, newCircuitBreaker(0, 0, 0))
+	_, err = newCircuitBreaker(0, 0, 0).allow("mycc:1.0", now)
+	assert.NoError(t, err)
+}
+
+func TestEndorsementMetadata(t *testing.T) {
+	chainID := util.GetTestChainID()
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{
+		EndorsementMetadata: true,
+	})
+	_, signedProp, err := getTestCCProposal(chainID, "put", "metadatakey", "value")
+	assert.NoError(t, err)
+	before := time.Now().Unix()
+	resp, err := e.ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+	assert.NotNil(t, resp.EndorsementMetadata)
+	mspID, err := mspmgmt.GetLocalMSP().GetIdentifier()
+	assert.NoError(t, err)
+	assert.Equal(t, mspID, resp.EndorsementMetadata.EndorserMspid)
+	assert.True(t, resp.EndorsementMetadata.EndorsedAt.Seconds >= before)
+
+	e = NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{})
+	_, signedProp, err = getTestCCProposal(chainID, "put", "metadatakey", "value")
+	assert.NoError(t, err)
+	resp, err = e.ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+	assert.Nil(t, resp.EndorsementMetadata)
+}
+
+func TestSimulateUnchangedSince(t *testing.T) {
+	chainID := util.GetTestChainID()
+	_, err := invokeTestCC(chainID, "put", "unchangedkey", "v1")
+	assert.NoError(t, err)
+	info, err := peer.GetLedger(chainID).GetBlockchainInfo()
+	assert.NoError(t, err)
+
+	_, signedProp, err := getTestCCProposal(chainID, "get", "unchangedkey")
+	assert.NoError(t, err)
+	_, _, err = endorserServer.(*Endorser).SimulateUnchangedSince(context.Background(), signedProp, info.Height)
+	assert.EqualError(t, err, "simulations checking the reads unchanged since a block height are disabled")
+
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{
+		UnchangedSinceSimulations: true,
+	}).(*Endorser)
+	res, simResult, err := e.SimulateUnchangedSince(context.Background(), signedProp, info.Height)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v1"), res.Payload)
+	txRWSet := &rwsetutil.TxRwSet{}
+	assert.NoError(t, txRWSet.FromProtoBytes(simResult))
+	assert.NotEmpty(t, txRWSet.NsRwSets)
+
+	// the key was written in the last block, at the previous height: the
+	// simulation is rejected rather than run on the state of the past
+	_, _, err = e.SimulateUnchangedSince(context.Background(), signedProp, info.Height-1)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "key unchangedkey of namespace")
+	_, _, err = e.SimulateUnchangedSince(context.Background(), signedProp, info.Height+1)
+	assert.Error(t, err)
+}
+
+type traceSpanKey struct{}
+
+// recordedSpan is a span started by the recording tracer
+type recordedSpan struct {
+	name       string
+	parent     string
+	attributes map[string]string
+	status     int32
+	ended      bool
+}
+
+func (s *recordedSpan) SetAttribute(key string, value string) { s.attributes[key] = value }
+
+func (s *recordedSpan) SetStatus(status int32, message string) { s.status = status }
+
+func (s *recordedSpan) End() { s.ended = true }
+
+// recordingTracer records the spans it starts, the remote span being the
+// traceparent of the transient map
+type recordingTracer struct {
+	sync.Mutex
+	spans []*recordedSpan
+}
+
+func (t *recordingTracer) Extract(ctx context.Context, transientMap map[string][]byte) context.Context {
+	if parent, ok := transientMap["traceparent"]; ok {
+		return context.WithValue(ctx, traceSpanKey{}, &recordedSpan{name: string(parent)})
+	}
+	return ctx
+}
+
+func (t *recordingTracer) StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	span := &recordedSpan{name: name, attributes: map[string]string{}}
+	if parent, ok := ctx.Value(traceSpanKey{}).(*recordedSpan); ok {
+		span.parent = parent.name
+	}
+	t.Lock()
+	t.spans = append(t.spans, span)
+	t.Unlock()
+	return context.WithValue(ctx, traceSpanKey{}, span), span
+}
+
+func TestTracing(t *testing.T) {
+	chainID := util.GetTestChainID()
+	tracer := &recordingTracer{}
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{
+		Tracer: tracer,
+	})
+
+	creator, err := signer.Serialize()
+	assert.NoError(t, err)
+	spec := &pb.ChaincodeSpec{Type: pb.ChaincodeSpec_GOLANG, ChaincodeId: &pb.ChaincodeID{Name: testCCName}, Input: &pb.ChaincodeInput{Args: util.ToChaincodeArgs("put", "tracedkey", "value")}}
+	prop, txid, err := pbutils.CreateChaincodeProposalWithTransient(common.HeaderType_ENDORSER_TRANSACTION, chainID, &pb.ChaincodeInvocationSpec{ChaincodeSpec: spec}, creator, map[string][]byte{"traceparent": []byte("client")})
+	assert.NoError(t, err)
+	signedProp, err := getSignedProposal(prop, signer)
+	assert.NoError(t, err)
+	_, err = e.ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+
+	parents := map[string]string{}
+	for _, span := range tracer.spans {
+		assert.True(t, span.ended, "span %s not ended", span.name)
+		if _, ok := parents[span.name]; !ok {
+			parents[span.name] = span.parent
+		}
+	}
+	assert.Equal(t, map[string]string{
+		"ProcessProposal":  "client",
+		"validateProposal": "ProcessProposal",
+		"simulateProposal": "ProcessProposal",
+		// the ESCC is then called within endorseProposal
+		"callChaincode":   "simulateProposal",
+		"endorseProposal": "ProcessProposal",
+	}, parents)
+	root := tracer.spans[0]
+	assert.Equal(t, map[string]string{"txid": txid, "channel": chainID, "chaincode": testCCName}, root.attributes)
+	assert.Equal(t, int32(shim.OK), root.status)
+}
+
+func TestFailuresNotEndorsed(t *testing.T) {
+	chainID := util.GetTestChainID()
+	endorsed := func(e pb.EndorserServer, tracer *recordingTracer, status string) (*pb.ProposalResponse, bool, error) {
+		tracer.spans = nil
+		_, signedProp, err := getTestCCProposal(chainID, "respond", status)
+		assert.NoError(t, err)
+		resp, err := e.ProcessProposal(context.Background(), signedProp)
+		for _, span := range tracer.spans {
+			if span.name == "endorseProposal" {
+				return resp, true, err
+			}
+		}
+		return resp, false, err
+	}
+
+	tracer := &recordingTracer{}
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{
+		Tracer: tracer,
+	})
+	// neither the failures above ERRORTHRESHOLD nor those above ERROR are
+	// handed to the ESCC
+	for _, status := range []string{"400", "404", "499", "500", "503"} {
+		resp, escc, err := endorsed(e, tracer, status)
+		assert.Error(t, err)
+		assert.False(t, escc, "status %s should not be endorsed", status)
+		assert.Nil(t, resp.Endorsement)
+		assert.Contains(t, resp.Response.Message, "[chaincode] status "+status)
+	}
+	resp, escc, err := endorsed(e, tracer, "399")
+	assert.NoError(t, err)
+	assert.True(t, escc)
+	assert.NotNil(t, resp.Endorsement)
+
+	// unless they are configured to be endorsed
+	tracer = &recordingTracer{}
+	e = NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{
+		Tracer:                   tracer,
+		EndorsedFailureThreshold: shim.ERROR,
+	})
+	resp, escc, err = endorsed(e, tracer, "404")
+	assert.NoError(t, err)
+	assert.True(t, escc)
+	assert.Equal(t, int32(404), resp.Response.Status)
+	assert.NotNil(t, resp.Endorsement)
+	_, escc, err = endorsed(e, tracer, "500")
+	assert.Error(t, err)
+	assert.False(t, escc)
+}
+
+func TestExternallyInvokableSysCCs(t *testing.T) {
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{
+		ExternallyInvokableSysCCs: map[string]bool{"vscc": true, "qscc": false, testCCName: false},
+	}).(*Endorser)
+	assert.False(t, e.isSysCCAndNotInvokableExternal("vscc"))
+	assert.True(t, e.isSysCCAndNotInvokableExternal("qscc"))
+	// the system chaincodes not listed keep their default
+	assert.True(t, e.isSysCCAndNotInvokableExternal("escc"))
+	assert.False(t, e.isSysCCAndNotInvokableExternal("cscc"))
+	// and application chaincodes are never blocked
+	assert.False(t, e.isSysCCAndNotInvokableExternal(testCCName))
+	_, signedProp, err := getTestCCProposal(util.GetTestChainID(), "get", "key")
+	assert.NoError(t, err)
+	resp, err := e.ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(shim.OK), resp.Response.Status)
+
+	// without overrides, the defaults apply
+	e = NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{}).(*Endorser)
+	assert.True(t, e.isSysCCAndNotInvokableExternal("vscc"))
+	assert.False(t, e.isSysCCAndNotInvokableExternal("qscc"))
+
+	e = NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{
+		ExternallyInvokableSysCCs: map[string]bool{"qscc": false},
+	}).(*Endorser)
+	_, signedProp, err = getChaincodeProposal(util.GetTestChainID(), "qscc", "GetChainInfo", util.GetTestChainID())
+	assert.NoError(t, err)
+	resp, err = e.ProcessProposal(context.Background(), signedProp)
+	assert.Error(t, err)
+	assert.Equal(t, "[validation] chaincode qscc cannot be invoked through a proposal", resp.Response.Message)
+}
+
+func TestRejectProposalsDuringUpgrade(t *testing.T) {
+	chainID := util.GetTestChainID()
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{
+		RejectProposalsDuringUpgrade: true,
+	}).(*Endorser)
+
+	done := e.upgrades.begin(chainID, testCCName)
+	// a concurrent upgrade of the same chaincode
+	otherDone := e.upgrades.begin(chainID, testCCName)
+	_, signedProp, err := getTestCCProposal(chainID, "get", "a")
+	assert.NoError(t, err)
+	resp, err := e.ProcessProposal(context.Background(), signedProp)
+	assert.Error(t, err)
+	assert.Equal(t, int32(503), resp.Response.Status)
+	assert.Contains(t, resp.Response.Message, errChaincodeUpgrading.Error())
+	// the chaincode is only rejected on the channel it is upgraded on
+	assert.NoError(t, e.upgrades.check("otherchannel", testCCName))
+
+	// system chaincodes are exempt
+	defer e.upgrades.begin(chainID, "lscc")()
+	_, signedProp, err = getChaincodeProposal(chainID, "lscc", "getchaincodes")
+	assert.NoError(t, err)
+	resp, err = e.ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(200), resp.Response.Status)
+
+	done()
+	assert.Error(t, e.upgrades.check(chainID, testCCName))
+	otherDone()
+	_, signedProp, err = getTestCCProposal(chainID, "get", "a")
+	assert.NoError(t, err)
+	resp, err = e.ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(200), resp.Response.Status)
+
+	// without the option, proposals are never rejected
+	assert.Nil(t, newUpgradeGuard(false))
+	newUpgradeGuard(false).begin(chainID, testCCName)()
+	assert.NoError(t, newUpgradeGuard(false).check(chainID, testCCName))
+}
+
+func TestStop(t *testing.T) {
+	chainID := util.GetTestChainID()
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{UnchangedSinceSimulations: true}).(*Endorser)
+
+	// a proposal being processed
+	processed, err := e.proposalsInFlight.enter()
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = e.Stop(ctx)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+
+	// the Endorser stays stopped
+	_, signedProp, err := getTestCCProposal(chainID, "get", "a")
+	assert.NoError(t, err)
+	resp, err := e.ProcessProposal(context.Background(), signedProp)
+	assert.Equal(t, codes.Unavailable, grpc.Code(err))
+	assert.Equal(t, int32(503), resp.Response.Status)
+	assert.Equal(t, "[stopped] endorser is stopped", resp.Response.Message)
+
+	// and so do the other entry points
+	resp, err = e.ProcessQuery(context.Background(), signedProp)
+	assert.Equal(t, codes.Unavailable, grpc.Code(err))
+	assert.Equal(t, int32(503), resp.Response.Status)
+	_, err = e.ProcessProposals(context.Background(), []*pb.SignedProposal{signedProp})
+	assert.Equal(t, errStopped, err)
+	_, _, err = e.SimulateProposal(context.Background(), signedProp)
+	assert.Equal(t, errStopped, err)
+	_, err = e.Explain(context.Background(), signedProp)
+	assert.Equal(t, errStopped, err)
+	results := e.SimulateBatch(context.Background(), []*pb.SignedProposal{signedProp})
+	assert.Equal(t, errStopped, results[0].Err)
+	_, err = e.SimulateWithOverlay(context.Background(), signedProp, StateOverlay{})
+	assert.Equal(t, errStopped, err)
+	_, _, err = e.SimulateUnchangedSince(context.Background(), signedProp, 1)
+	assert.Equal(t, errStopped, err)
+	_, err = e.DryRunDeploy(context.Background(), signedProp)
+	assert.Equal(t, errStopped, err)
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- e.Stop(context.Background())
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("Stop should wait for the proposal being processed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	processed()
+	assert.NoError(t, <-stopped)
+}
+
+func TestResponseCache(t *testing.T) {
+	chainID := util.GetTestChainID()
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{
+		ResponseCacheSize: 2,
+	}).(*Endorser)
+
+	// a retry gets the very same endorsement back, while a new endorsement
+	// would have a new signature
+	prop, signedProp, err := getTestCCProposal(chainID, "put", "retriedkey", "value")
+	assert.NoError(t, err)
+	resp, err := e.ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+	retried, err := e.ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+	assert.True(t, proto.Equal(resp, retried))
+
+	// but not once the transaction is committed
+	info, err := peer.GetLedger(chainID).GetBlockchainInfo()
+	assert.NoError(t, err)
+	assert.NoError(t, e.commitTxSimulation(prop, chainID, signer, resp, info.Height))
+	_, err = e.ProcessProposal(context.Background(), signedProp)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "duplicate transaction found")
+	assert.Empty(t, e.responses.entries)
+
+	// failures are not cached
+	_, signedProp, err = getTestCCProposal(chainID, "fail")
+	assert.NoError(t, err)
+	_, err = e.ProcessProposal(context.Background(), signedProp)
+	assert.Error(t, err)
+	assert.Empty(t, e.responses.entries)
+
+	// only the same signed proposal is served, within the TTL and the size
+	c := newResponseCache(2, time.Minute)
+	now := time.Now()
+	c.store(chainID, "tx1", signedProp, resp, now)
+	assert.True(t, proto.Equal(resp, c.get(chainID, "tx1", signedProp, now.Add(time.Second))))
+	assert.Nil(t, c.get(chainID, "tx1", signedProp, now.Add(2*time.Minute)))
+	assert.Nil(t, c.get(chainID, "tx1", &pb.SignedProposal{ProposalBytes: []byte("other")}, now))
+	assert.Nil(t, c.get("otherchannel", "tx1", signedProp, now))
+	c.store(chainID, "tx2", signedProp, resp, now)
+	c.store(chainID, "tx3", signedProp, resp, now)
+	assert.Nil(t, c.get(chainID, "tx1", signedProp, now))
+	assert.NotNil(t, c.get(chainID, "tx3", signedProp, now))
+
+	assert.Nil(t, newResponseCache(0, 0))
+	assert.Nil(t, newResponseCache(0, 0).get(chainID, "tx1", signedProp, now))
+}
+
+func TestEndorsementPolicyCheck(t *testing.T) {
+	chainID := util.GetTestChainID()
+	mspID, err := mspmgmt.GetLocalMSP().GetIdentifier()
+	assert.NoError(t, err)
+	endorser, err := signer.Serialize()
+	assert.NoError(t, err)
+	definition := func(policy *common.SignaturePolicyEnvelope) *ccprovider.ChaincodeData {
+		return &ccprovider.ChaincodeData{Name: "policycc", Version: "1.0", Vscc: "vscc", Policy: pbutils.MarshalOrPanic(policy)}
+	}
+
+	assert.False(t, outsideEndorsementPolicy(chainID, endorser, definition(cauthdsl.SignedByMspMember(mspID))))
+	assert.False(t, outsideEndorsementPolicy(chainID, endorser, definition(cauthdsl.SignedByAnyMember([]string{"OtherMSP", mspID}))))
+	assert.True(t, outsideEndorsementPolicy(chainID, endorser, definition(cauthdsl.SignedByAnyMember([]string{"OtherMSP"}))))
+	// policies which are not signature policies cannot tell
+	assert.False(t, outsideEndorsementPolicy(chainID, endorser, &ccprovider.ChaincodeData{Policy: pbutils.MarshalOrPanic(&pb.VSCCArgs{EndorsementPolicyRef: "/Channel/Application/Endorsement"})}))
+	assert.False(t, outsideEndorsementPolicy(chainID, []byte("garbage"), definition(cauthdsl.SignedByAnyMember([]string{"OtherMSP"}))))
+
+	// the flag is set in the metadata, created if need be
+	e := &Endorser{config: Config{EndorsementPolicyCheck: true}}
+	pResp := &pb.ProposalResponse{Response: &pb.Response{Status: 200}, Endorsement: &pb.Endorsement{Endorser: endorser}}
+	e.flagOutsideEndorsementPolicy(chainID, pResp, definition(cauthdsl.SignedByMspMember(mspID)))
+	assert.Nil(t, pResp.EndorsementMetadata)
+	e.flagOutsideEndorsementPolicy(chainID, pResp, definition(cauthdsl.SignedByMspMember("OtherMSP")))
+	assert.True(t, pResp.EndorsementMetadata.OutsideEndorsementPolicy)
+	assert.Equal(t, int32(200), pResp.Response.Status)
+
+	// but only when the check is enabled
+	pResp.EndorsementMetadata = nil
+	(&Endorser{}).flagOutsideEndorsementPolicy(chainID, pResp, definition(cauthdsl.SignedByMspMember("OtherMSP")))
+	assert.Nil(t, pResp.EndorsementMetadata)
+}
+
+func TestSimulatorFactories(t *testing.T) {
+	chainID := util.GetTestChainID()
+	var simulated, historyQueried []string
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{
+		TxSimulatorFactory: func(channelID string, txid string) (ledger.TxSimulator, error) {
+			simulated = append(simulated, channelID+"/"+txid)
+			return peer.GetLedger(channelID).NewTxSimulator(txid)
+		},
+		HistoryQueryExecutorFactory: func(channelID string) (ledger.HistoryQueryExecutor, error) {
+			historyQueried = append(historyQueried, channelID)
+			return peer.GetLedger(channelID).NewHistoryQueryExecutor()
+		},
+	})
+
+	prop, signedProp, err := getTestCCProposal(chainID, "get", "a")
+	assert.NoError(t, err)
+	resp, err := e.ProcessProposal(context.Background(), signedProp)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(200), resp.Response.Status)
+	hdr, err := pbutils.GetHeader(prop.Header)
+	assert.NoError(t, err)
+	chdr, err := pbutils.UnmarshalChannelHeader(hdr.ChannelHeader)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{chainID + "/" + chdr.TxId}, simulated)
+	assert.Equal(t, []string{chainID}, historyQueried)
+
+	// the errors of the factories fail the proposals
+	e = NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{
+		TxSimulatorFactory: func(string, string) (ledger.TxSimulator, error) {
+			return nil, errors.New("no simulator")
+		},
+	})
+	_, signedProp, err = getTestCCProposal(chainID, "get", "a")
+	assert.NoError(t, err)
+	_, err = e.ProcessProposal(context.Background(), signedProp)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "no simulator")
+}
+
+func TestHandleLSCCDeploy(t *testing.T) {
+	e := NewEndorserServer(func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }, Config{}).(*Endorser)
+	chainID := util.GetTestChainID()
+	lsccInvocation := func(op string, cdsBytes []byte) *pb.ChaincodeInvocationSpec {
+		return &pb.ChaincodeInvocationSpec{ChaincodeSpec: &pb.ChaincodeSpec{
+			ChaincodeId: &pb.ChaincodeID{Name: "lscc"},
+			Input:       &pb.ChaincodeInput{Args: [][]byte{[]byte(op), []byte(chainID), cdsBytes}},
+		}}
+	}
+
+	// the deployment spec must be valid
+	resp, err := e.handleLSCCDeploy(context.Background(), chainID, "txid", nil, nil, lsccInvocation("deploy", []byte("garbage")), nil)
+	assert.Nil(t, resp)
+	assert.Error(t, err)
+
+	// and must not deploy a system chaincode
+	cds := pbutils.MarshalOrPanic(&pb.ChaincodeDeploymentSpec{ChaincodeSpec: &pb.ChaincodeSpec{
+		Type:        pb.ChaincodeSpec_GOLANG,
+		ChaincodeId: &pb.ChaincodeID{Name: "lscc", Version: "0"},
+	}})
+	resp, err = e.handleLSCCDeploy(context.Background(), chainID, "txid", nil, nil, lsccInvocation("upgrade", cds), nil)
+	assert.Nil(t, resp)
+	assert.EqualError(t, err, "attempting to deploy a system chaincode lscc/"+chainID)
+}
@@ -0,0 +1,61 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"time"
+
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/pkg/errors"
+)
+
+// EpochSigner is the identity endorsing the proposals of an epoch;
+// msp.SigningIdentity satisfies it
+type EpochSigner interface {
+	// Serialize returns the serialized identity of the signer
+	Serialize() ([]byte, error)
+
+	// Sign signs the message
+	Sign(msg []byte) ([]byte, error)
+}
+
+// EpochKeyProvider resolves the endorsing identity of rotating keys
+type EpochKeyProvider interface {
+	// SigningIdentity returns the identifier of the epoch t belongs to,
+	// along with the identity endorsing the proposals of that epoch
+	SigningIdentity(t time.Time) (string, EpochSigner, error)
+}
+
+// endorseWithEpochKey replaces the endorsement of the proposal response by
+// one from the identity of the current epoch, signing the same message as
+// the ESCC does, ie payload + endorser
+func (e *Endorser) endorseWithEpochKey(pResp *pb.ProposalResponse) error {
+	if e.config.EpochKeys == nil {
+		return nil
+	}
+
+	epoch, signer, err := e.config.EpochKeys.SigningIdentity(time.Now())
+	if err != nil {
+		return errors.WithMessage(err, "failed to resolve the signing identity of the current epoch")
+	}
+
+	endorser, err := signer.Serialize()
+	if err != nil {
+		return errors.Wrapf(err, "failed to serialize the signing identity of epoch %s", epoch)
+	}
+
+	msg := make([]byte, 0, len(pResp.Payload)+len(endorser))
+	msg = append(msg, pResp.Payload...)
+	signature, err := signer.Sign(append(msg, endorser...))
+	if err != nil {
+		return errors.Wrapf(err, "failed to sign the proposal response with the key of epoch %s", epoch)
+	}
+
+	pResp.Endorsement = &pb.Endorsement{Endorser: endorser, Signature: signature}
+	pResp.EndorsementEpoch = epoch
+	return nil
+}
@@ -0,0 +1,63 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// chaincodeEventQueueSize is the number of chaincode events waiting to be
+// observed beyond which new ones are dropped
+const chaincodeEventQueueSize = 100
+
+type observedEvent struct {
+	channel string
+	txID    string
+	event   *pb.ChaincodeEvent
+}
+
+// chaincodeEvents hands the chaincode events emitted during simulation over
+// to the observer from a goroutine of its own, so that a slow observer never
+// delays a proposal
+type chaincodeEvents struct {
+	observer func(channel string, txID string, event *pb.ChaincodeEvent)
+	queue    chan *observedEvent
+}
+
+// newChaincodeEvents returns the event queue of the observer, or nil if
+// there is no observer
+func newChaincodeEvents(observer func(channel string, txID string, event *pb.ChaincodeEvent)) *chaincodeEvents {
+	if observer == nil {
+		return nil
+	}
+	c := &chaincodeEvents{
+		observer: observer,
+		queue:    make(chan *observedEvent, chaincodeEventQueueSize),
+	}
+	go c.observeLoop()
+	return c
+}
+
+func (c *chaincodeEvents) observeLoop() {
+	for e := range c.queue {
+		c.observer(e.channel, e.txID, e.event)
+	}
+}
+
+// emitted queues the event emitted by the chaincode simulating the
+// transaction, dropping it if the observer is too far behind
+func (c *chaincodeEvents) emitted(channel string, txID string, event *pb.ChaincodeEvent) {
+	if c == nil || event == nil {
+		return
+	}
+
+	select {
+	case c.queue <- &observedEvent{channel: channel, txID: txID, event: event}:
+	default:
+		endorserLogger.Warningf("chaincode event queue is full, dropping event %s of transaction %s", event.EventName, txID)
+	}
+}
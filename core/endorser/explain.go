@@ -0,0 +1,101 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/rwsetutil"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Explanation describes what a proposal would do if it were endorsed and
+// committed
+type Explanation struct {
+	// Response is the response of the chaincode
+	Response *pb.Response
+	// Namespaces are the namespaces touched by the simulation, in the
+	// order of the simulation results
+	Namespaces []*NamespaceFootprint
+	// EventName is the name of the chaincode event emitted, if any
+	EventName string
+	// ResultsSize is the size in bytes of the public simulation results
+	ResultsSize int
+	// EventSize is the size in bytes of the chaincode event
+	EventSize int
+}
+
+// NamespaceFootprint lists the keys of a namespace read and written by a
+// simulation
+type NamespaceFootprint struct {
+	Namespace string
+	Reads     []string
+	// Writes are the keys written, deleted keys included
+	Writes []string
+	// Deletes are the keys deleted
+	Deletes     []string
+	Collections []*CollectionFootprint
+}
+
+// CollectionFootprint counts the keys of a private data collection read and
+// written by a simulation; the keys themselves are only known by their hash
+type CollectionFootprint struct {
+	Collection string
+	Reads      int
+	Writes     int
+}
+
+// Explain simulates the chaincode invoked by the signed proposal and
+// describes the simulation results. Nothing is endorsed and the private data
+// written by the simulation is not distributed.
+func (e *Endorser) Explain(ctx context.Context, signedProp *pb.SignedProposal) (*Explanation, error) {
+	res, simResult, ccevent, err := e.simulateWithoutEndorsement(ctx, signedProp)
+	if err != nil {
+		return nil, err
+	}
+
+	return explain(res, simResult, ccevent)
+}
+
+func explain(res *pb.Response, simResult []byte, ccevent *pb.ChaincodeEvent) (*Explanation, error) {
+	explanation := &Explanation{Response: res, ResultsSize: len(simResult)}
+	if ccevent != nil {
+		explanation.EventName = ccevent.EventName
+		explanation.EventSize = proto.Size(ccevent)
+	}
+
+	txRWSet := &rwsetutil.TxRwSet{}
+	if err := txRWSet.FromProtoBytes(simResult); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal simulation results")
+	}
+
+	for _, nsRWSet := range txRWSet.NsRwSets {
+		ns := &NamespaceFootprint{Namespace: nsRWSet.NameSpace}
+		if kvRWSet := nsRWSet.KvRwSet; kvRWSet != nil {
+			for _, read := range kvRWSet.Reads {
+				ns.Reads = append(ns.Reads, read.Key)
+			}
+			for _, write := range kvRWSet.Writes {
+				ns.Writes = append(ns.Writes, write.Key)
+				if write.IsDelete {
+					ns.Deletes = append(ns.Deletes, write.Key)
+				}
+			}
+		}
+		for _, collRWSet := range nsRWSet.CollHashedRwSets {
+			coll := &CollectionFootprint{Collection: collRWSet.CollectionName}
+			if hashedRWSet := collRWSet.HashedRwSet; hashedRWSet != nil {
+				coll.Reads = len(hashedRWSet.HashedReads)
+				coll.Writes = len(hashedRWSet.HashedWrites)
+			}
+			ns.Collections = append(ns.Collections, coll)
+		}
+		explanation.Namespaces = append(explanation.Namespaces, ns)
+	}
+	return explanation, nil
+}
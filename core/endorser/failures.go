@@ -0,0 +1,36 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/rwset"
+	putils "github.com/hyperledger/fabric/protos/utils"
+)
+
+// endorsesFailure returns whether the chaincode response of the given
+// status is a failure the ESCC is asked to sign
+func (e *Endorser) endorsesFailure(status int32) bool {
+	return status >= shim.ERRORTHRESHOLD && status < e.config.EndorsedFailureThreshold
+}
+
+// failureThresholdArg is the optional argument of the ESCC raising the
+// status of the responses it signs to the configured threshold. It is only
+// passed along with a failure to endorse, so that the ESCCs which do not
+// expect it still endorse the successes.
+func (e *Endorser) failureThresholdArg() []byte {
+	return []byte(strconv.Itoa(int(e.config.EndorsedFailureThreshold)))
+}
+
+// failureSimulationResults are the simulation results endorsed along with
+// a failure: they are empty, so that the transaction of an endorsed failure
+// has no effect on the state even if it is submitted for ordering
+func failureSimulationResults() ([]byte, error) {
+	return putils.Marshal(&rwset.TxReadWriteSet{DataModel: rwset.TxReadWriteSet_KV})
+}
@@ -0,0 +1,78 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"strings"
+
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// categoryCodes maps the categories of the failures of proposals to the
+// gRPC status codes returned to the clients
+var categoryCodes = map[errorCategory]codes.Code{
+	validationError:   codes.InvalidArgument,
+	chaincodeFailure:  codes.Unknown,
+	timeoutError:      codes.DeadlineExceeded,
+	cancelledError:    codes.Canceled,
+	endorsementError:  codes.Internal,
+	distributionError: codes.Unavailable,
+	rateLimitedError:  codes.ResourceExhausted,
+	stoppedError:      codes.Unavailable,
+	internalError:     codes.Internal,
+}
+
+// statusError converts the error a proposal failed with into a gRPC status
+// error, so that clients can handle it by its code. The code follows the
+// category of the failure, as carried by the message of the response; the
+// status of the response itself is left as is.
+func statusError(ctx context.Context, pResp *pb.ProposalResponse, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	if _, ok := errors.Cause(err).(*channelNotFoundError); ok {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	code, ok := categoryCodes[responseCategory(pResp)]
+	if !ok {
+		code = categoryCodes[categorize(err)]
+	}
+	if code == codes.Internal && ctx.Err() == context.DeadlineExceeded {
+		code = codes.DeadlineExceeded
+	}
+	return status.Error(code, err.Error())
+}
+
+// failureCategory returns the category of the failure of a proposal: the
+// one its response carries, or else the one of err
+func failureCategory(pResp *pb.ProposalResponse, err error) errorCategory {
+	if category := responseCategory(pResp); category != "" {
+		return category
+	}
+	return categorize(err)
+}
+
+// responseCategory returns the category the message of the response is
+// prefixed with by categorizedMessage, or an empty one
+func responseCategory(pResp *pb.ProposalResponse) errorCategory {
+	msg := pResp.GetResponse().GetMessage()
+	if !strings.HasPrefix(msg, "[") {
+		return ""
+	}
+	end := strings.Index(msg, "] ")
+	if end < 0 {
+		return ""
+	}
+	return errorCategory(msg[1:end])
+}
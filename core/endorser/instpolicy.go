@@ -0,0 +1,112 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/core/common/ccprovider"
+	"github.com/hyperledger/fabric/protos/common"
+	mspprotos "github.com/hyperledger/fabric/protos/msp"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	putils "github.com/hyperledger/fabric/protos/utils"
+	"github.com/pkg/errors"
+)
+
+// instantiationPolicyError wraps the failure of the instantiation policy
+// check of the chaincode with the policy of its definition on the channel,
+// the policy of the package installed on the peer and the creator of the
+// proposal, so that operators can tell which does not match
+func instantiationPolicyError(err error, name string, version string, cdLedger *ccprovider.ChaincodeData, signedProp *pb.SignedProposal) error {
+	installed := "unknown"
+	if ccdata, ferr := ccprovider.GetChaincodeData(name, version); ferr == nil {
+		installed = describePolicy(ccdata.InstantiationPolicy)
+	}
+	return errors.WithMessage(err, fmt.Sprintf("instantiation policy check failed for chaincode %s:%s: the channel definition expects %s, the installed package expects %s, the proposal was created by %s",
+		name, version, describePolicy(cdLedger.InstantiationPolicy), installed, describeCreator(signedProp)))
+}
+
+// describePolicy renders a marshaled signature policy in the syntax of the
+// policy language, e.g. OutOf(1, 'Org1MSP.admin', 'Org2MSP.admin')
+func describePolicy(policy []byte) string {
+	if policy == nil {
+		return "no policy"
+	}
+	env := &common.SignaturePolicyEnvelope{}
+	if err := proto.Unmarshal(policy, env); err != nil || env.Rule == nil {
+		return "an unreadable policy"
+	}
+	return describeRule(env.Rule, env.Identities)
+}
+
+func describeRule(rule *common.SignaturePolicy, identities []*mspprotos.MSPPrincipal) string {
+	if nOutOf := rule.GetNOutOf(); nOutOf != nil {
+		rules := make([]string, len(nOutOf.Rules))
+		for i, r := range nOutOf.Rules {
+			rules[i] = describeRule(r, identities)
+		}
+		return fmt.Sprintf("OutOf(%d, %s)", nOutOf.N, strings.Join(rules, ", "))
+	}
+	signedBy := rule.GetSignedBy()
+	if signedBy < 0 || int(signedBy) >= len(identities) {
+		return "'unknown principal'"
+	}
+	return "'" + describePrincipal(identities[signedBy]) + "'"
+}
+
+func describePrincipal(principal *mspprotos.MSPPrincipal) string {
+	switch principal.PrincipalClassification {
+	case mspprotos.MSPPrincipal_ROLE:
+		role := &mspprotos.MSPRole{}
+		if err := proto.Unmarshal(principal.Principal, role); err == nil {
+			return role.MspIdentifier + "." + strings.ToLower(role.Role.String())
+		}
+	case mspprotos.MSPPrincipal_ORGANIZATION_UNIT:
+		ou := &mspprotos.OrganizationUnit{}
+		if err := proto.Unmarshal(principal.Principal, ou); err == nil {
+			return ou.MspIdentifier + ".ou:" + ou.OrganizationalUnitIdentifier
+		}
+	case mspprotos.MSPPrincipal_IDENTITY:
+		return describeIdentity(principal.Principal)
+	}
+	return "unknown principal"
+}
+
+// describeIdentity renders a serialized identity as its MSP and, if it holds
+// a certificate, the subject of the certificate
+func describeIdentity(identity []byte) string {
+	sid := &mspprotos.SerializedIdentity{}
+	if err := proto.Unmarshal(identity, sid); err != nil {
+		return "an unreadable identity"
+	}
+	if block, _ := pem.Decode(sid.IdBytes); block != nil {
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			return sid.Mspid + " member " + cert.Subject.CommonName
+		}
+	}
+	return sid.Mspid + " member"
+}
+
+func describeCreator(signedProp *pb.SignedProposal) string {
+	prop, err := putils.GetProposal(signedProp.ProposalBytes)
+	if err != nil {
+		return "an unknown creator"
+	}
+	hdr, err := putils.GetHeader(prop.Header)
+	if err != nil {
+		return "an unknown creator"
+	}
+	shdr, err := putils.GetSignatureHeader(hdr.SignatureHeader)
+	if err != nil {
+		return "an unknown creator"
+	}
+	return describeIdentity(shdr.Creator)
+}
@@ -8,6 +8,9 @@ SPDX-License-Identifier: Apache-2.0
 
 package endorser
 
+// javaEnabled returns whether Java chaincode can be installed, instantiated
+// and upgraded. It is in experimental builds, which the Makefile produces
+// unless EXPERIMENTAL is set to false.
 func javaEnabled() bool {
 	return true
 }
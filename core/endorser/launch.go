@@ -0,0 +1,96 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode"
+	"github.com/hyperledger/fabric/core/common/ccprovider"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// errLaunchQueueSaturated is returned when no launch slot frees up within
+// the launch timeout
+var errLaunchQueueSaturated = errors.New("chaincode launch queue is saturated")
+
+// launchLimiter bounds the number of chaincode launches that can be in
+// progress at the same time. The executions of a chaincode already running
+// skip the queue; a chaincode whose container terminated, or executed in
+// another version, waits for a slot again, as its execution launches it.
+type launchLimiter struct {
+	slots   chan struct{}
+	timeout time.Duration
+	// running returns whether the chaincode of the canonical name is
+	// running
+	running func(canName string) bool
+}
+
+// newLaunchLimiter returns a limiter allowing maxLaunches concurrent
+// launches, or nil (no limit) if maxLaunches is not positive
+func newLaunchLimiter(maxLaunches int, timeout time.Duration) *launchLimiter {
+	if maxLaunches <= 0 {
+		return nil
+	}
+	return &launchLimiter{
+		slots:   make(chan struct{}, maxLaunches),
+		timeout: timeout,
+		running: isChaincodeRunning,
+	}
+}
+
+// isChaincodeRunning returns whether the chaincode support runs the
+// chaincode of the canonical name
+func isChaincodeRunning(canName string) bool {
+	chaincodeSupport := chaincode.GetChain()
+	return chaincodeSupport != nil && chaincodeSupport.IsRunning(canName)
+}
+
+// acquire waits for a launch slot for the chaincode with the given
+// canonical name, unless it is running already, until the launch timeout
+// expires or ctx is done. The returned function must be called once the
+// execution is over to give the slot back.
+func (l *launchLimiter) acquire(ctx context.Context, canName string) (func(), error) {
+	if l == nil || l.running(canName) {
+		return func() {}, nil
+	}
+
+	var timeout <-chan time.Time
+	if l.timeout > 0 {
+		timer := time.NewTimer(l.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+	case <-timeout:
+		return nil, errors.WithMessage(errLaunchQueueSaturated, "timed out waiting to launch "+canName)
+	case <-ctx.Done():
+		return nil, errors.Wrap(ctx.Err(), "gave up waiting to launch "+canName)
+	}
+
+	return func() { <-l.slots }, nil
+}
+
+// acquireLaunch takes a launch slot for the chaincode of the context before
+// it is executed. System chaincodes run in process and are never launched.
+func (e *Endorser) acquireLaunch(ctx context.Context, cccid *ccprovider.CCContext) (func(), error) {
+	if cccid.Syscc {
+		return func() {}, nil
+	}
+	return e.launches.acquire(ctx, cccid.GetCanonicalName())
+}
+
+// launchQueueSaturatedResponse is returned to the client when its proposal
+// gave up waiting for a launch slot; the proposal can be retried later.
+func launchQueueSaturatedResponse(err error) *pb.Response {
+	endorserLogger.Warningf("%s", err)
+	return &pb.Response{Status: 503, Message: err.Error()}
+}
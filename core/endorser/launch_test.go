@@ -0,0 +1,153 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/common/ccprovider"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// runningChaincodes fakes the chaincodes the chaincode support runs, by
+// canonical name
+type runningChaincodes struct {
+	sync.Mutex
+	names map[string]bool
+}
+
+func (r *runningChaincodes) set(canName string, running bool) {
+	r.Lock()
+	defer r.Unlock()
+	r.names[canName] = running
+}
+
+func (r *runningChaincodes) running(canName string) bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.names[canName]
+}
+
+func TestLaunchLimiterCapsConcurrentLaunches(t *testing.T) {
+	const launchCap = 3
+	limiter := newLaunchLimiter(launchCap, 5*time.Second)
+	limiter.running = func(string) bool { return false }
+
+	var inFlight, maxInFlight int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			launched, err := limiter.acquire(context.Background(), fmt.Sprintf("cc%d:1.0", i))
+			if !assert.NoError(t, err) {
+				return
+			}
+			n := atomic.AddInt32(&inFlight, 1)
+			for {
+				max := atomic.LoadInt32(&maxInFlight)
+				if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&inFlight, -1)
+			launched()
+		}(i)
+	}
+	wg.Wait()
+
+	assert.True(t, maxInFlight <= launchCap, "at most %d launches should run at once, got %d", launchCap, maxInFlight)
+}
+
+func TestLaunchLimiterSaturated(t *testing.T) {
+	limiter := newLaunchLimiter(1, 50*time.Millisecond)
+	chaincodes := &runningChaincodes{names: map[string]bool{}}
+	limiter.running = chaincodes.running
+	ctx := context.Background()
+
+	launched, err := limiter.acquire(ctx, "cc1:1.0")
+	assert.NoError(t, err)
+
+	// the only slot is taken, a second first-touch chaincode times out
+	_, err = limiter.acquire(ctx, "cc2:1.0")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), errLaunchQueueSaturated.Error())
+
+	chaincodes.set("cc1:1.0", true)
+	launched()
+
+	// cc1 is now running, so it no longer needs a slot
+	hold, err := limiter.acquire(ctx, "cc2:1.0")
+	assert.NoError(t, err)
+	_, err = limiter.acquire(ctx, "cc1:1.0")
+	assert.NoError(t, err)
+
+	// while another version of it does
+	_, err = limiter.acquire(ctx, "cc1:1.1")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), errLaunchQueueSaturated.Error())
+
+	// and so does cc1 once its container terminated
+	chaincodes.set("cc1:1.0", false)
+	_, err = limiter.acquire(ctx, "cc1:1.0")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), errLaunchQueueSaturated.Error())
+	hold()
+}
+
+func TestLaunchLimiterWithoutTimeout(t *testing.T) {
+	limiter := newLaunchLimiter(1, 0)
+	limiter.running = func(string) bool { return false }
+
+	launched, err := limiter.acquire(context.Background(), "cc1:1.0")
+	assert.NoError(t, err)
+	defer launched()
+
+	// without a launch timeout, a launch waits until its proposal is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = limiter.acquire(ctx, "cc2:1.0")
+	assert.Error(t, err)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+}
+
+func TestAcquireLaunchUnlimited(t *testing.T) {
+	e := &Endorser{launches: newLaunchLimiter(0, 0)}
+	assert.Nil(t, e.launches)
+
+	for i := 0; i < 10; i++ {
+		cccid := ccprovider.NewCCContext("testchainid", fmt.Sprintf("cc%d", i), "1.0", "txid", false, nil, nil)
+		_, err := e.acquireLaunch(context.Background(), cccid)
+		assert.NoError(t, err)
+	}
+}
+
+func TestLaunchQueueSaturatedResponse(t *testing.T) {
+	e := &Endorser{launches: newLaunchLimiter(1, 10*time.Millisecond)}
+	e.launches.running = func(string) bool { return false }
+	ctx := context.Background()
+
+	cccid := ccprovider.NewCCContext("testchainid", "cc1", "1.0", "txid", false, nil, nil)
+	_, err := e.acquireLaunch(ctx, cccid)
+	assert.NoError(t, err)
+
+	// system chaincodes never wait for a slot
+	_, err = e.acquireLaunch(ctx, ccprovider.NewCCContext("testchainid", "lscc", "1.1.0", "txid", true, nil, nil))
+	assert.NoError(t, err)
+
+	_, err = e.acquireLaunch(ctx, ccprovider.NewCCContext("testchainid", "cc2", "1.0", "txid", false, nil, nil))
+	assert.Error(t, err)
+	res := launchQueueSaturatedResponse(err)
+	assert.Equal(t, int32(503), res.Status)
+}
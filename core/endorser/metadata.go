@@ -0,0 +1,36 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/core/peer"
+	mspprotos "github.com/hyperledger/fabric/protos/msp"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// describeEndorsement sets the endorsement metadata of the endorsed
+// proposal response: the MSP of the identity which signed it, the endpoint
+// of the peer and the time of the endorsement. The metadata is outside of
+// the payload and the endorsement, so the transaction the response ends up
+// in is the same with or without it.
+func (e *Endorser) describeEndorsement(pResp *pb.ProposalResponse) {
+	if !e.config.EndorsementMetadata || pResp.Endorsement == nil {
+		return
+	}
+
+	metadata := &pb.EndorsementMetadata{EndorsedAt: util.CreateUtcTimestamp()}
+	sid := &mspprotos.SerializedIdentity{}
+	if err := proto.Unmarshal(pResp.Endorsement.Endorser, sid); err == nil {
+		metadata.EndorserMspid = sid.Mspid
+	}
+	if endpoint, err := peer.GetPeerEndpoint(); err == nil {
+		metadata.EndorserEndpoint = endpoint.Address
+	}
+	pResp.EndorsementMetadata = metadata
+}
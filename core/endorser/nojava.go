@@ -8,6 +8,8 @@ SPDX-License-Identifier: Apache-2.0
 
 package endorser
 
+// javaEnabled returns whether Java chaincode can be installed, instantiated
+// and upgraded. It is not in builds without the experimental tag.
 func javaEnabled() bool {
 	return false
 }
@@ -0,0 +1,122 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/core/common/validation"
+	"github.com/hyperledger/fabric/core/ledger"
+	syscc "github.com/hyperledger/fabric/core/scc"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	putils "github.com/hyperledger/fabric/protos/utils"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// StateOverlay maps a namespace (chaincode name) to the key/value pairs that
+// should be seen by a simulation in place of the committed ledger state
+type StateOverlay map[string]map[string][]byte
+
+// overlaySimulator is a TxSimulator whose public state reads see the values
+// of an in-memory overlay instead of the ledger for the overlaid keys.
+// The overlay itself is never written to the underlying simulator.
+type overlaySimulator struct {
+	ledger.TxSimulator
+	overlay StateOverlay
+}
+
+func (s *overlaySimulator) lookup(namespace string, key string) ([]byte, bool) {
+	value, ok := s.overlay[namespace][key]
+	return value, ok
+}
+
+// GetState returns the overlaid value for the key if there is one, or the
+// value in the ledger otherwise
+func (s *overlaySimulator) GetState(namespace string, key string) ([]byte, error) {
+	if value, ok := s.lookup(namespace, key); ok {
+		return value, nil
+	}
+	return s.TxSimulator.GetState(namespace, key)
+}
+
+// GetStateMultipleKeys returns the values of the keys, taking the overlay
+// into account
+func (s *overlaySimulator) GetStateMultipleKeys(namespace string, keys []string) ([][]byte, error) {
+	values, err := s.TxSimulator.GetStateMultipleKeys(namespace, keys)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		if value, ok := s.lookup(namespace, key); ok {
+			values[i] = value
+		}
+	}
+	return values, nil
+}
+
+// SimulateWithOverlay runs the chaincode invoked by the signed proposal as if
+// the ledger state contained the values of the overlay, and returns the
+// chaincode response. Nothing is endorsed: the result describes what the
+// transaction would do, it cannot be submitted.
+func (e *Endorser) SimulateWithOverlay(ctx context.Context, signedProp *pb.SignedProposal, overlay StateOverlay) (*pb.Response, error) {
+	processed, err := e.admit(ctx, signedProp)
+	if err != nil {
+		return nil, err
+	}
+	defer processed()
+
+	prop, hdr, hdrExt, err := validation.ValidateProposalMessage(signedProp)
+	if err != nil {
+		return nil, err
+	}
+
+	chdr, err := putils.UnmarshalChannelHeader(hdr.ChannelHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	chainID := chdr.ChannelId
+	txid := chdr.TxId
+	if chainID == "" {
+		return nil, errors.New("what-if simulation requires a channel")
+	}
+
+	cid := hdrExt.ChaincodeId
+	if !syscc.IsSysCC(cid.Name) {
+		if err = e.checkACL(signedProp, chdr, nil, hdrExt); err != nil {
+			return nil, err
+		}
+	}
+
+	cis, err := putils.GetChaincodeInvocationSpec(prop)
+	if err != nil {
+		return nil, err
+	}
+
+	txsim, err := e.getTxSimulator(chainID, txid)
+	if err != nil {
+		return nil, err
+	}
+	defer txsim.Done()
+
+	version := util.GetSysCCVersion()
+	if !syscc.IsSysCC(cid.Name) {
+		cdLedger, err := e.getCDSFromLSCC(ctx, chainID, txid, signedProp, prop, cid.Name, txsim)
+		if err != nil {
+			return nil, errors.WithMessage(err, fmt.Sprintf("make sure the chaincode %s has been successfully instantiated and try again", cid.Name))
+		}
+		version = cdLedger.CCVersion()
+	}
+
+	res, _, err := e.callChaincode(ctx, chainID, version, txid, signedProp, prop, cis, cid, &overlaySimulator{TxSimulator: txsim, overlay: overlay})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,63 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/common/resourcesconfig"
+	mspmgmt "github.com/hyperledger/fabric/msp/mgmt"
+	"github.com/hyperledger/fabric/protos/common"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// flagOutsideEndorsementPolicy flags the endorsement metadata of the
+// endorsed proposal response when the identity which signed it cannot
+// satisfy any principal of the endorsement policy of the chaincode, so that
+// clients know not to collect endorsements from this peer for it. It is
+// advisory only: the response is returned all the same.
+func (e *Endorser) flagOutsideEndorsementPolicy(chainID string, pResp *pb.ProposalResponse, cd resourcesconfig.ChaincodeDefinition) {
+	if !e.config.EndorsementPolicyCheck || pResp.Endorsement == nil || cd == nil {
+		return
+	}
+	if !outsideEndorsementPolicy(chainID, pResp.Endorsement.Endorser, cd) {
+		return
+	}
+
+	endorserLogger.Debugf("the endorser of chaincode %s on channel %s satisfies no principal of its endorsement policy", cd.CCName(), chainID)
+	if pResp.EndorsementMetadata == nil {
+		pResp.EndorsementMetadata = &pb.EndorsementMetadata{}
+	}
+	pResp.EndorsementMetadata.OutsideEndorsementPolicy = true
+}
+
+// outsideEndorsementPolicy returns whether the serialized endorser satisfies
+// none of the principals of the signature policy the chaincode definition
+// validates its transactions with. It returns false whenever it cannot
+// tell, e.g. when the definition refers to a policy of the channel config
+// rather than carrying a signature policy.
+func outsideEndorsementPolicy(chainID string, endorser []byte, cd resourcesconfig.ChaincodeDefinition) bool {
+	_, policy := cd.Validation()
+	env := &common.SignaturePolicyEnvelope{}
+	if err := proto.Unmarshal(policy, env); err != nil || env.Rule == nil || len(env.Identities) == 0 {
+		return false
+	}
+
+	deserializer := mspmgmt.GetIdentityDeserializer(chainID)
+	if deserializer == nil {
+		return false
+	}
+	id, err := deserializer.DeserializeIdentity(endorser)
+	if err != nil {
+		return false
+	}
+	for _, principal := range env.Identities {
+		if id.SatisfiesPrincipal(principal) == nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,25 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/pkg/errors"
+)
+
+// checkProposalSize returns an error if the signed proposal is larger than
+// MaxProposalSize; only the lengths of its raw bytes are looked at
+func (e *Endorser) checkProposalSize(signedProp *pb.SignedProposal) error {
+	if e.config.MaxProposalSize <= 0 {
+		return nil
+	}
+	size := len(signedProp.GetProposalBytes()) + len(signedProp.GetSignature())
+	if size > e.config.MaxProposalSize {
+		return errors.Errorf("proposal of %d bytes exceeds the maximum proposal size of %d bytes", size, e.config.MaxProposalSize)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"golang.org/x/net/context"
+)
+
+// queryOnlyKey is the context key marking the proposals processed by
+// ProcessQuery
+const queryOnlyKey contextKey = "queryOnly"
+
+// ProcessQuery processes a proposal which will never be submitted as a
+// transaction, such as a query re-run with the same txid. Unlike
+// ProcessProposal, the ledger is not searched for a transaction with the
+// txid of the proposal, and no history query executor is provided to the
+// chaincode, so that the chaincode cannot query the history of keys. The
+// proposal is simulated on a query executor, with empty simulation
+// results; a chaincode attempting to write fails the proposal.
+//
+// The response is endorsed like any other, but it MUST NOT be submitted to
+// the ordering service: its txid may already be committed, or be committed
+// later by another transaction.
+func (e *Endorser) ProcessQuery(ctx context.Context, signedProp *pb.SignedProposal) (*pb.ProposalResponse, error) {
+	return e.ProcessProposal(context.WithValue(ctx, queryOnlyKey, true), signedProp)
+}
+
+// isQueryOnly returns whether the proposal processed by ctx was submitted
+// through ProcessQuery
+func isQueryOnly(ctx context.Context) bool {
+	queryOnly, _ := ctx.Value(queryOnlyKey).(bool)
+	return queryOnly
+}
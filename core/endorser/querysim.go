@@ -0,0 +1,90 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"sync/atomic"
+
+	"github.com/hyperledger/fabric/core/ledger"
+	"github.com/hyperledger/fabric/protos/ledger/rwset"
+	"github.com/pkg/errors"
+)
+
+// errQuerySimulatorWrite is returned to the chaincode of a query that
+// attempts to write
+var errQuerySimulatorWrite = errors.New("query attempted to write")
+
+// querySimulator is the TxSimulator the queries are simulated on. It reads
+// through a query executor, which does not track the reads the way a
+// simulator does; its simulation results are therefore empty. Writes are
+// refused and recorded, so that the endorser can tell that the query was
+// not one after all.
+type querySimulator struct {
+	ledger.QueryExecutor
+	writes int32
+}
+
+// newQuerySimulator returns a query simulator reading the ledger
+func newQuerySimulator(lgr ledger.PeerLedger) (*querySimulator, error) {
+	qe, err := lgr.NewQueryExecutor()
+	if err != nil {
+		return nil, err
+	}
+	return &querySimulator{QueryExecutor: qe}, nil
+}
+
+// attemptedWrite returns whether the query attempted to write
+func (s *querySimulator) attemptedWrite() bool {
+	return atomic.LoadInt32(&s.writes) > 0
+}
+
+func (s *querySimulator) refuseWrite() error {
+	atomic.AddInt32(&s.writes, 1)
+	return errQuerySimulatorWrite
+}
+
+// SetState refuses to write
+func (s *querySimulator) SetState(namespace string, key string, value []byte) error {
+	return s.refuseWrite()
+}
+
+// DeleteState refuses to write
+func (s *querySimulator) DeleteState(namespace string, key string) error {
+	return s.refuseWrite()
+}
+
+// SetStateMultipleKeys refuses to write
+func (s *querySimulator) SetStateMultipleKeys(namespace string, kvs map[string][]byte) error {
+	return s.refuseWrite()
+}
+
+// ExecuteUpdate refuses to write
+func (s *querySimulator) ExecuteUpdate(query string) error {
+	return s.refuseWrite()
+}
+
+// SetPrivateData refuses to write
+func (s *querySimulator) SetPrivateData(namespace, collection, key string, value []byte) error {
+	return s.refuseWrite()
+}
+
+// SetPrivateDataMultipleKeys refuses to write
+func (s *querySimulator) SetPrivateDataMultipleKeys(namespace, collection string, kvs map[string][]byte) error {
+	return s.refuseWrite()
+}
+
+// DeletePrivateData refuses to write
+func (s *querySimulator) DeletePrivateData(namespace, collection, key string) error {
+	return s.refuseWrite()
+}
+
+// GetTxSimulationResults returns empty results, the reads not being tracked
+func (s *querySimulator) GetTxSimulationResults() (*ledger.TxSimulationResults, error) {
+	return &ledger.TxSimulationResults{
+		PubSimulationResults: &rwset.TxReadWriteSet{DataModel: rwset.TxReadWriteSet_KV},
+	}, nil
+}
@@ -0,0 +1,115 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"sync"
+	"time"
+
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// RateLimit is the token bucket limiting the rate of the proposals of a
+// channel
+type RateLimit struct {
+	// Rate is the number of proposals per second allowed in the long run.
+	// Zero means no limit.
+	Rate float64
+	// Burst is the number of proposals allowed at once, above the rate,
+	// after a quiet period; it is at least one
+	Burst int
+}
+
+// tokenBucket holds the tokens left to a channel, as of the last time one
+// was taken
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter limits the rate of the proposals of every channel with a
+// bucket of its own, so that the load on one channel does not throttle the
+// others
+type rateLimiter struct {
+	limits       map[string]RateLimit
+	defaultLimit RateLimit
+
+	sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// newRateLimiter returns a limiter applying the limits of the channels and
+// the default limit to the channels not listed, or nil if no channel is
+// limited
+func newRateLimiter(limits map[string]RateLimit, defaultLimit RateLimit) *rateLimiter {
+	if defaultLimit.Rate <= 0 {
+		limited := false
+		for _, limit := range limits {
+			limited = limited || limit.Rate > 0
+		}
+		if !limited {
+			return nil
+		}
+	}
+	return &rateLimiter{
+		limits:       limits,
+		defaultLimit: defaultLimit,
+		buckets:      make(map[string]*tokenBucket),
+	}
+}
+
+func (l *rateLimiter) limitOf(chainID string) RateLimit {
+	if limit, ok := l.limits[chainID]; ok {
+		return limit
+	}
+	return l.defaultLimit
+}
+
+// take takes a token from the bucket of the channel at the given time. It
+// returns zero if the proposal is allowed, or how long to wait before the
+// bucket holds a token again otherwise.
+func (l *rateLimiter) take(chainID string, now time.Time) time.Duration {
+	if l == nil {
+		return 0
+	}
+	limit := l.limitOf(chainID)
+	if limit.Rate <= 0 {
+		return 0
+	}
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	bucket, ok := l.buckets[chainID]
+	if !ok {
+		bucket = &tokenBucket{tokens: burst, last: now}
+		l.buckets[chainID] = bucket
+	}
+	if elapsed := now.Sub(bucket.last); elapsed > 0 {
+		bucket.tokens += elapsed.Seconds() * limit.Rate
+		if bucket.tokens > burst {
+			bucket.tokens = burst
+		}
+		bucket.last = now
+	}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return 0
+	}
+	return time.Duration((1 - bucket.tokens) / limit.Rate * float64(time.Second))
+}
+
+// rateLimitedResponse is returned to the client when its proposal exceeds
+// the rate limit of the channel; the proposal can be retried after the
+// delay of the message.
+func rateLimitedResponse(err error) *pb.ProposalResponse {
+	endorserLogger.Warningf("%s", err)
+	return &pb.ProposalResponse{Response: &pb.Response{Status: 429, Message: categorizedMessage(rateLimitedError, err.Error())}}
+}
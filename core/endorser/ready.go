@@ -0,0 +1,30 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"github.com/hyperledger/fabric/common/util"
+	"github.com/pkg/errors"
+)
+
+// Ready returns an error if the Endorser cannot service the proposals of the
+// channel, that is if the ledger of the channel is not available or cannot
+// provide tx simulators. It only opens and releases a tx simulator, and is
+// cheap enough to back a health check.
+func (e *Endorser) Ready(channelID string) error {
+	if e.newTxSimulator == nil {
+		if _, err := getLedger(channelID); err != nil {
+			return err
+		}
+	}
+	txsim, err := e.getTxSimulator(channelID, util.GenerateUUID())
+	if err != nil {
+		return errors.WithMessage(err, "failed to create a tx simulator")
+	}
+	txsim.Done()
+	return nil
+}
@@ -0,0 +1,128 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// defaultResponseCacheTTL is how long the responses to proposals are kept
+// for the clients retrying them when no TTL is configured
+const defaultResponseCacheTTL = 30 * time.Second
+
+// responseCache keeps the responses to the proposals recently endorsed, by
+// txid, so that a client retrying a proposal after a timeout gets the same
+// endorsement back rather than having the proposal simulated, and its
+// private data distributed, again. Only the retries of the very same
+// signed proposal are served: another proposal reusing the txid is
+// processed as usual. The responses are kept for the TTL at most, and
+// only as long as the transaction is not committed: the committed ones
+// are rejected as duplicates before the cache is consulted.
+type responseCache struct {
+	size int
+	ttl  time.Duration
+
+	sync.Mutex
+	entries map[string]*cachedResponse
+	// order is the keys of the entries, oldest first
+	order []string
+}
+
+// cachedResponse is the response to a signed proposal, identified by the
+// hash of its bytes
+type cachedResponse struct {
+	proposalHash [sha256.Size]byte
+	pResp        *pb.ProposalResponse
+	expires      time.Time
+}
+
+// newResponseCache returns a cache of size responses kept for ttl, 30s if
+// zero, or nil if size is not positive
+func newResponseCache(size int, ttl time.Duration) *responseCache {
+	if size <= 0 {
+		return nil
+	}
+	if ttl <= 0 {
+		ttl = defaultResponseCacheTTL
+	}
+	return &responseCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*cachedResponse),
+	}
+}
+
+func responseCacheKey(chainID string, txid string) string {
+	return chainID + "/" + txid
+}
+
+// store caches the successful response to the signed proposal of the txid
+func (c *responseCache) store(chainID string, txid string, signedProp *pb.SignedProposal, pResp *pb.ProposalResponse, now time.Time) {
+	if c == nil {
+		return
+	}
+
+	key := responseCacheKey(chainID, txid)
+	entry := &cachedResponse{
+		proposalHash: sha256.Sum256(signedProp.ProposalBytes),
+		pResp:        proto.Clone(pResp).(*pb.ProposalResponse),
+		expires:      now.Add(c.ttl),
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.entries[key]; !ok {
+		if len(c.order) == c.size {
+			delete(c.entries, c.order[0])
+			c.order = c.order[1:]
+		}
+		c.order = append(c.order, key)
+	}
+	c.entries[key] = entry
+}
+
+// get returns the response cached for the txid if it answered the same
+// signed proposal and has not expired, or nil
+func (c *responseCache) get(chainID string, txid string, signedProp *pb.SignedProposal, now time.Time) *pb.ProposalResponse {
+	if c == nil {
+		return nil
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	entry, ok := c.entries[responseCacheKey(chainID, txid)]
+	if !ok || now.After(entry.expires) || entry.proposalHash != sha256.Sum256(signedProp.ProposalBytes) {
+		return nil
+	}
+	return proto.Clone(entry.pResp).(*pb.ProposalResponse)
+}
+
+// evict removes the response cached for the txid, if any
+func (c *responseCache) evict(chainID string, txid string) {
+	if c == nil {
+		return
+	}
+
+	key := responseCacheKey(chainID, txid)
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.entries[key]; !ok {
+		return
+	}
+	delete(c.entries, key)
+	for i, k := range c.order {
+		if k == key {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+}
@@ -0,0 +1,38 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	// minResponseStatus and maxResponseStatus bound the statuses chaincodes
+	// respond with, which follow the HTTP ones
+	minResponseStatus = 100
+	maxResponseStatus = 599
+)
+
+// normalizeStatus returns the response of the chaincode with a status out
+// of the range of the statuses chaincodes respond with turned into
+// shim.ERROR, so that a non-compliant chaincode fails instead of being
+// endorsed or reported with a status clients do not expect. The original
+// status is logged and kept in the message.
+func normalizeStatus(logger proposalLogger, ccName string, res *pb.Response) *pb.Response {
+	if res == nil || (res.Status >= minResponseStatus && res.Status <= maxResponseStatus) {
+		return res
+	}
+	logger.Warningf("Chaincode %s responded with status %d, out of the range [%d, %d], failing the proposal", ccName, res.Status, minResponseStatus, maxResponseStatus)
+	return &pb.Response{
+		Status:  shim.ERROR,
+		Message: fmt.Sprintf("chaincode responded with invalid status %d: %s", res.Status, res.Message),
+		Payload: res.Payload,
+	}
+}
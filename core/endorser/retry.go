@@ -0,0 +1,66 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// transient is implemented by errors reporting a temporary condition, such
+// as a busy simulator or a ledger being snapshotted, after which the same
+// proposal is expected to go through
+type transient interface {
+	Transient() bool
+}
+
+// isTransient returns whether the cause of err is a transient error
+func isTransient(err error) bool {
+	t, ok := errors.Cause(err).(transient)
+	return ok && t.Transient()
+}
+
+// retryTransient decides whether the simulation of a proposal that failed
+// with err on the given attempt (counting from 1) is retried, and waits for
+// the backoff if so. Non-transient errors are never retried.
+func (e *Endorser) retryTransient(ctx context.Context, attempt int, err error) bool {
+	return retry(ctx, "simulation", attempt, e.config.TransientRetries, e.config.TransientRetryBackoff, err)
+}
+
+// retryDistribution decides like retryTransient whether the distribution of
+// the private data of a proposal that failed with err is retried
+func (e *Endorser) retryDistribution(ctx context.Context, attempt int, err error) bool {
+	return retry(ctx, "private data distribution", attempt, e.config.PvtDataDistributionRetries, e.config.PvtDataDistributionRetryBackoff, err)
+}
+
+// retry decides whether the operation of a proposal that failed with err on
+// the given attempt is retried, up to retries times, and waits for the
+// backoff, doubled with every attempt, if so. Retries stop once the next one
+// could not start before the deadline of the proposal.
+func retry(ctx context.Context, operation string, attempt int, retries int, initialBackoff time.Duration, err error) bool {
+	if attempt > retries || !isTransient(err) {
+		return false
+	}
+
+	backoff := initialBackoff << uint(attempt-1)
+	if deadline, ok := ctx.Deadline(); ok && time.Now().Add(backoff).After(deadline) {
+		endorserLogger.Debugf("not retrying the %s, the proposal deadline would pass first: %s", operation, err)
+		return false
+	}
+
+	endorserLogger.Warningf("%s attempt %d failed with a transient error, retrying in %s: %s", operation, attempt, backoff, err)
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,25 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// signingObserved records how long the ESCC took to sign the endorsement of
+// a proposal to the chaincode, in the signing_duration metric of the
+// proposal, and logs a warning when it took longer than SlowSigningThreshold
+func (e *Endorser) signingObserved(ctx context.Context, ccName string, escc string, txid string, elapsed time.Duration) {
+	if scope := proposalMetricsFrom(ctx); scope != nil {
+		scope.Histogram("signing_duration").RecordDuration(elapsed)
+	}
+	if threshold := e.config.SlowSigningThreshold; threshold > 0 && elapsed > threshold {
+		proposalLoggerFrom(ctx).Warningf("%s took %s to sign the endorsement of chaincode %s on transaction %s, above the threshold of %s", escc, elapsed, ccName, txid, threshold)
+	}
+}
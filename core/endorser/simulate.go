@@ -0,0 +1,113 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"github.com/hyperledger/fabric/core/chaincode"
+	"github.com/hyperledger/fabric/core/common/validation"
+	syscc "github.com/hyperledger/fabric/core/scc"
+	"github.com/hyperledger/fabric/protos/ledger/rwset"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	putils "github.com/hyperledger/fabric/protos/utils"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// SimulateProposal simulates the chaincode invoked by the signed proposal
+// and returns the chaincode response along with the public simulation
+// results, without endorsing them. The proposal is validated and checked
+// against the ACLs and the committed transactions as if it were to be
+// endorsed, but the private data written by the simulation is not
+// distributed.
+func (e *Endorser) SimulateProposal(ctx context.Context, signedProp *pb.SignedProposal) (*pb.Response, []byte, error) {
+	res, simResult, _, err := e.simulateWithoutEndorsement(ctx, signedProp)
+	if err != nil {
+		return nil, nil, err
+	}
+	return res, simResult, nil
+}
+
+// simulateWithoutEndorsement validates the signed proposal, checks that its
+// transaction has not been committed yet and simulates it on a simulator of
+// its own, returning the chaincode response, the public simulation results
+// and the chaincode event. The private data written by the simulation is not
+// distributed.
+func (e *Endorser) simulateWithoutEndorsement(ctx context.Context, signedProp *pb.SignedProposal) (*pb.Response, []byte, *pb.ChaincodeEvent, error) {
+	processed, err := e.admit(ctx, signedProp)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer processed()
+
+	prop, hdr, hdrExt, err := validation.ValidateProposalMessage(signedProp)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	chdr, err := putils.UnmarshalChannelHeader(hdr.ChannelHeader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	chainID := chdr.ChannelId
+	txid := chdr.TxId
+	if chainID == "" {
+		return nil, nil, nil, errors.New("simulation without endorsement requires a channel")
+	}
+
+	shdr, err := putils.GetSignatureHeader(hdr.SignatureHeader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	lgr, err := getLedger(chainID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if _, err := lgr.GetTransactionByID(txid); err == nil {
+		return nil, nil, nil, errors.Errorf("duplicate transaction found [%s]. Creator [%x]", txid, shdr.Creator)
+	}
+
+	cid := hdrExt.ChaincodeId
+	// deploys and upgrades launch the chaincode while being simulated
+	if cid.Name == "lscc" {
+		return nil, nil, nil, errors.New("lifecycle proposals cannot be simulated without endorsement")
+	}
+	if e.isSysCCAndNotInvokableExternal(cid.Name) {
+		return nil, nil, nil, errors.Errorf("chaincode %s cannot be invoked through a proposal", cid.Name)
+	}
+	if !syscc.IsSysCC(cid.Name) {
+		if err = e.checkACL(signedProp, chdr, nil, hdrExt); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	historyQueryExecutor, err := e.newHistoryQueryExecutorOn(lgr, chainID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ctx = context.WithValue(ctx, chaincode.HistoryQueryExecutorKey, historyQueryExecutor)
+
+	simulator := *e
+	simulator.distributePrivateData = func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }
+	simulator.config.AckingPrivateDataDistributor = nil
+	for {
+		txsim, err := e.newTxSimulatorOn(lgr, chainID, txid)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		_, res, simResult, ccevent, _, err := simulator.simulateProposal(ctx, chainID, txid, signedProp, prop, cid, txsim)
+		txsim.Done()
+		if err == errStaleSimulation {
+			continue
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return res, simResult, ccevent, nil
+	}
+}
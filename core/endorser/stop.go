@@ -0,0 +1,84 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"sync"
+
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// errStopped is returned for the proposals received once the Endorser is
+// stopped
+var errStopped = errors.New("endorser is stopped")
+
+// proposalTracker tracks the proposals being processed, so that the
+// Endorser can wait for them when it is stopped. A nil tracker tracks
+// nothing.
+type proposalTracker struct {
+	sync.Mutex
+	stopped bool
+	active  sync.WaitGroup
+}
+
+// enter registers a proposal about to be processed, unless the Endorser is
+// stopped. The returned function must be called once it is processed.
+func (t *proposalTracker) enter() (func(), error) {
+	if t == nil {
+		return func() {}, nil
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	if t.stopped {
+		return nil, errStopped
+	}
+	t.active.Add(1)
+	return t.active.Done, nil
+}
+
+// stop rejects the proposals from now on and returns a channel closed once
+// the ones being processed are
+func (t *proposalTracker) stop() <-chan struct{} {
+	drained := make(chan struct{})
+	if t == nil {
+		close(drained)
+		return drained
+	}
+
+	t.Lock()
+	t.stopped = true
+	t.Unlock()
+
+	go func() {
+		t.active.Wait()
+		close(drained)
+	}()
+	return drained
+}
+
+// Stop stops the Endorser: the proposals received from now on, through any
+// entry point, are rejected, by ProcessProposal with a retryable 503, and
+// Stop waits for the ones being processed, so that their tx simulators are
+// released and their private data distributed before the peer shuts down. It returns the error of ctx if it is done
+// before they are processed; the Endorser stays stopped anyway.
+func (e *Endorser) Stop(ctx context.Context) error {
+	select {
+	case <-e.proposalsInFlight.stop():
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "gave up waiting for the proposals being processed")
+	}
+}
+
+// stoppedResponse is returned to the client when the Endorser is stopped;
+// the proposal can be retried on another peer.
+func stoppedResponse(err error) *pb.ProposalResponse {
+	return &pb.ProposalResponse{Response: &pb.Response{Status: 503, Message: categorizedMessage(stoppedError, err.Error())}}
+}
@@ -0,0 +1,21 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	syscc "github.com/hyperledger/fabric/core/scc"
+)
+
+// isSysCCAndNotInvokableExternal returns whether the chaincode is a system
+// chaincode which proposals cannot invoke, as configured for it in
+// ExternallyInvokableSysCCs or else as decided by the scc package
+func (e *Endorser) isSysCCAndNotInvokableExternal(ccName string) bool {
+	if invokable, ok := e.config.ExternallyInvokableSysCCs[ccName]; ok && syscc.IsSysCC(ccName) {
+		return !invokable
+	}
+	return syscc.IsSysCCAndNotInvokableExternal(ccName)
+}
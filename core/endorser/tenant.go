@@ -0,0 +1,122 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric/common/flogging"
+	"github.com/hyperledger/fabric/common/metrics"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	putils "github.com/hyperledger/fabric/protos/utils"
+	"github.com/op/go-logging"
+	"golang.org/x/net/context"
+)
+
+type contextKey string
+
+const (
+	// tenantKey is the context key of the tenant of the proposal being
+	// processed
+	tenantKey contextKey = "tenant"
+	// metricsKey is the context key of the metrics scope of the proposal
+	// being processed
+	metricsKey contextKey = "metrics"
+)
+
+// proposalLog is the endorser logger as seen from proposalLogger, so that
+// log records carry the location of the caller of proposalLogger
+var proposalLog = func() *logging.Logger {
+	l := flogging.MustGetLogger("endorser")
+	l.ExtraCalldepth = 1
+	return l
+}()
+
+// proposalLogger logs the lines about a proposal, prefixed with the tenant
+// of the proposal if it has one
+type proposalLogger struct {
+	prefix string
+}
+
+// proposalLoggerFrom returns the logger of the proposal processed by ctx
+func proposalLoggerFrom(ctx context.Context) proposalLogger {
+	if tenant, ok := ctx.Value(tenantKey).(string); ok && tenant != "" {
+		return proposalLogger{prefix: fmt.Sprintf("[tenant: %s] ", tenant)}
+	}
+	return proposalLogger{}
+}
+
+func (l proposalLogger) Debugf(format string, args ...interface{}) {
+	proposalLog.Debugf(l.prefix+format, args...)
+}
+
+func (l proposalLogger) Infof(format string, args ...interface{}) {
+	proposalLog.Infof(l.prefix+format, args...)
+}
+
+func (l proposalLogger) Warningf(format string, args ...interface{}) {
+	proposalLog.Warningf(l.prefix+format, args...)
+}
+
+func (l proposalLogger) Errorf(format string, args ...interface{}) {
+	proposalLog.Errorf(l.prefix+format, args...)
+}
+
+// resolveTenant returns the tenant owning the chaincode on the channel, or
+// the empty string if there is none
+func (e *Endorser) resolveTenant(chainID string, ccName string) string {
+	tenants := e.config.Tenants[chainID]
+	if tenant, ok := tenants[ccName]; ok {
+		return tenant
+	}
+	return tenants[""]
+}
+
+// proposalTarget returns the channel and the name of the chaincode the
+// signed proposal is addressed to. It is best effort: the parts that cannot
+// be unmarshalled are returned empty, the proposal is validated later on.
+func proposalTarget(signedProp *pb.SignedProposal) (string, string) {
+	prop, err := putils.GetProposal(signedProp.GetProposalBytes())
+	if err != nil {
+		return "", ""
+	}
+	hdr, err := putils.GetHeader(prop.Header)
+	if err != nil {
+		return "", ""
+	}
+	chdr, err := putils.UnmarshalChannelHeader(hdr.ChannelHeader)
+	if err != nil {
+		return "", ""
+	}
+	hdrExt, err := putils.GetChaincodeHeaderExtension(hdr)
+	if err != nil {
+		return chdr.ChannelId, ""
+	}
+	return chdr.ChannelId, hdrExt.GetChaincodeId().GetName()
+}
+
+// proposalMetrics returns the scope of the metrics of a proposal, tagged
+// with its channel, chaincode and tenant, or nil if metrics are disabled
+func (e *Endorser) proposalMetrics(chainID string, ccName string, tenant string) metrics.Scope {
+	if e.config.Metrics == nil {
+		return nil
+	}
+	tags := map[string]string{"channel": chainID, "chaincode": ccName}
+	if tenant != "" {
+		tags["tenant"] = tenant
+	}
+	return e.config.Metrics.Tagged(tags)
+}
+
+// proposalMetricsFrom returns the metrics scope of the proposal processed by
+// ctx, or nil if metrics are disabled
+func proposalMetricsFrom(ctx context.Context) metrics.Scope {
+	if scope, ok := ctx.Value(metricsKey).(metrics.Scope); ok {
+		return scope
+	}
+	return nil
+}
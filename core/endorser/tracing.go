@@ -0,0 +1,98 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	pb "github.com/hyperledger/fabric/protos/peer"
+	putils "github.com/hyperledger/fabric/protos/utils"
+	"golang.org/x/net/context"
+)
+
+// Tracer adapts the tracing system the spans of the proposals are reported
+// to, e.g. OpenTelemetry
+type Tracer interface {
+	// Extract returns ctx carrying the remote span identified by the trace
+	// context the client put in the transient map of the proposal, or ctx
+	// itself if there is none
+	Extract(ctx context.Context, transientMap map[string][]byte) context.Context
+
+	// StartSpan starts a span, child of the span carried by ctx if any,
+	// and returns it along with the context carrying it
+	StartSpan(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer
+type Span interface {
+	// SetAttribute records an attribute of the span
+	SetAttribute(key string, value string)
+
+	// SetStatus records the status of the response to the proposal and
+	// its message
+	SetStatus(status int32, message string)
+
+	// End ends the span
+	End()
+}
+
+// noopSpan is the span of the endorsers without a Tracer, which does nothing
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value string) {}
+
+func (noopSpan) SetStatus(status int32, message string) {}
+
+func (noopSpan) End() {}
+
+// startSpan starts a span, child of the span carried by ctx if any
+func (e *Endorser) startSpan(ctx context.Context, name string) (context.Context, Span) {
+	if e.config.Tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return e.config.Tracer.StartSpan(ctx, name)
+}
+
+// startProposalSpan starts the span of the signed proposal, child of the
+// remote span of its trace context if any, and records the txid, channel
+// and chaincode of the proposal. It is best effort like proposalTarget:
+// the parts that cannot be unmarshalled are not recorded.
+func (e *Endorser) startProposalSpan(ctx context.Context, signedProp *pb.SignedProposal) (context.Context, Span) {
+	if e.config.Tracer == nil {
+		return ctx, noopSpan{}
+	}
+
+	var txid string
+	var transientMap map[string][]byte
+	if prop, err := putils.GetProposal(signedProp.GetProposalBytes()); err == nil {
+		if cpp, err := putils.GetChaincodeProposalPayload(prop.Payload); err == nil {
+			transientMap = cpp.TransientMap
+		}
+		if hdr, err := putils.GetHeader(prop.Header); err == nil {
+			if chdr, err := putils.UnmarshalChannelHeader(hdr.ChannelHeader); err == nil {
+				txid = chdr.TxId
+			}
+		}
+	}
+
+	ctx, span := e.config.Tracer.StartSpan(e.config.Tracer.Extract(ctx, transientMap), "ProcessProposal")
+	chainID, ccName := proposalTarget(signedProp)
+	span.SetAttribute("txid", txid)
+	span.SetAttribute("channel", chainID)
+	span.SetAttribute("chaincode", ccName)
+	return ctx, span
+}
+
+// endProposalSpan records the status of the response to the proposal and
+// ends its span
+func endProposalSpan(span Span, pResp *pb.ProposalResponse, err error) {
+	switch {
+	case pResp.GetResponse() != nil:
+		span.SetStatus(pResp.Response.Status, pResp.Response.Message)
+	case err != nil:
+		span.SetStatus(500, err.Error())
+	}
+	span.End()
+}
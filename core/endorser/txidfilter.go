@@ -0,0 +1,120 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+const (
+	// txIDFilterBitsPerTxID and txIDFilterHashes size the bloom filters for
+	// a false positive rate of about 1% once they hold their capacity
+	txIDFilterBitsPerTxID = 10
+	txIDFilterHashes      = 7
+)
+
+// txIDFilter remembers the txids of the proposals recently received on
+// every channel, so that the response cache is only searched for the txids
+// that may have been received before. It says nothing of the transactions
+// committed, which are always looked up in the ledger. It keeps two generations of bloom filters per channel:
+// the current one is replaced when it holds its capacity or when the
+// rotation interval elapsed, and the previous one is dropped. A filter may
+// claim that a txid was seen when it was not, which only costs a cache
+// lookup, but never the opposite for the txids of the two generations it
+// keeps.
+type txIDFilter struct {
+	capacity int
+	rotation time.Duration
+
+	sync.Mutex
+	channels map[string]*txIDGenerations
+}
+
+type txIDGenerations struct {
+	current  *bloomFilter
+	previous *bloomFilter
+	rotated  time.Time
+}
+
+// newTxIDFilter returns a filter whose generations hold capacity txids and
+// are rotated every rotation, or only when full if rotation is zero. It
+// returns nil if capacity is not positive.
+func newTxIDFilter(capacity int, rotation time.Duration) *txIDFilter {
+	if capacity <= 0 {
+		return nil
+	}
+	return &txIDFilter{
+		capacity: capacity,
+		rotation: rotation,
+		channels: make(map[string]*txIDGenerations),
+	}
+}
+
+// seen records the txid as received on the channel and returns false only
+// if it was certainly not received before, within the generations the
+// filter keeps. A nil filter has seen every txid.
+func (f *txIDFilter) seen(chainID string, txid string) bool {
+	if f == nil {
+		return true
+	}
+
+	digest := sha256.Sum256([]byte(txid))
+	h1 := binary.BigEndian.Uint64(digest[:8])
+	h2 := binary.BigEndian.Uint64(digest[8:16])
+
+	f.Lock()
+	defer f.Unlock()
+	gens, ok := f.channels[chainID]
+	if !ok {
+		gens = &txIDGenerations{current: newBloomFilter(f.capacity), rotated: time.Now()}
+		f.channels[chainID] = gens
+	}
+	if gens.current.count >= f.capacity || (f.rotation > 0 && time.Since(gens.rotated) >= f.rotation) {
+		gens.previous = gens.current
+		gens.current = newBloomFilter(f.capacity)
+		gens.rotated = time.Now()
+	}
+
+	seen := gens.current.contains(h1, h2) || (gens.previous != nil && gens.previous.contains(h1, h2))
+	if !seen {
+		gens.current.add(h1, h2)
+	}
+	return seen
+}
+
+// bloomFilter is a bloom filter indexed by double hashing
+type bloomFilter struct {
+	bits  []uint64
+	count int
+}
+
+func newBloomFilter(capacity int) *bloomFilter {
+	return &bloomFilter{bits: make([]uint64, (capacity*txIDFilterBitsPerTxID+63)/64)}
+}
+
+func (b *bloomFilter) add(h1 uint64, h2 uint64) {
+	size := uint64(len(b.bits)) * 64
+	for i := uint64(0); i < txIDFilterHashes; i++ {
+		bit := (h1 + i*h2) % size
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+	b.count++
+}
+
+func (b *bloomFilter) contains(h1 uint64, h2 uint64) bool {
+	size := uint64(len(b.bits)) * 64
+	for i := uint64(0); i < txIDFilterHashes; i++ {
+		bit := (h1 + i*h2) % size
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,150 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"github.com/hyperledger/fabric/core/chaincode"
+	"github.com/hyperledger/fabric/core/common/validation"
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/rwsetutil"
+	syscc "github.com/hyperledger/fabric/core/scc"
+	"github.com/hyperledger/fabric/protos/ledger/rwset"
+	"github.com/hyperledger/fabric/protos/ledger/rwset/kvrwset"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	putils "github.com/hyperledger/fabric/protos/utils"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// SimulateUnchangedSince simulates the stored signed proposal on the
+// current state and checks that none of the keys it read, range queries
+// included, was updated at or above the given block height, returning the
+// chaincode response along with the public simulation results. It tells
+// whether a simulation at that height would have read the same state; it
+// is not a replay at that height: the ledger only keeps the latest state,
+// and a simulation that read a key updated since, such as the one of a
+// transaction invalidated by a read conflict, is rejected rather than
+// simulated on the state of the past. Keys read as missing are not
+// checked, as the state does not tell when they were deleted.
+//
+// The transaction of the proposal may have been committed already. Nothing
+// is endorsed, the private data written by the simulation is not
+// distributed, and the endorsement cache is neither used nor filled. The
+// simulations are only allowed when UnchangedSinceSimulations is set, since
+// they run the chaincode like any proposal.
+func (e *Endorser) SimulateUnchangedSince(ctx context.Context, signedProp *pb.SignedProposal, height uint64) (*pb.Response, []byte, error) {
+	if !e.config.UnchangedSinceSimulations {
+		return nil, nil, errors.New("simulations checking the reads unchanged since a block height are disabled")
+	}
+
+	processed, err := e.admit(ctx, signedProp)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer processed()
+
+	prop, hdr, hdrExt, err := validation.ValidateProposalMessage(signedProp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	chdr, err := putils.UnmarshalChannelHeader(hdr.ChannelHeader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	chainID := chdr.ChannelId
+	txid := chdr.TxId
+	if chainID == "" {
+		return nil, nil, errors.New("simulation checking the reads unchanged since a block height requires a channel")
+	}
+
+	cid := hdrExt.ChaincodeId
+	// deploys and upgrades launch the chaincode while being simulated
+	if cid.Name == "lscc" {
+		return nil, nil, errors.New("lifecycle proposals cannot be simulated without endorsement")
+	}
+	if e.isSysCCAndNotInvokableExternal(cid.Name) {
+		return nil, nil, errors.Errorf("chaincode %s cannot be invoked through a proposal", cid.Name)
+	}
+	if !syscc.IsSysCC(cid.Name) {
+		if err = e.checkACL(signedProp, chdr, nil, hdrExt); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	lgr, err := getLedger(chainID)
+	if err != nil {
+		return nil, nil, err
+	}
+	historyQueryExecutor, err := e.newHistoryQueryExecutorOn(lgr, chainID)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx = context.WithValue(ctx, chaincode.HistoryQueryExecutorKey, historyQueryExecutor)
+
+	txsim, err := e.newTxSimulatorOn(lgr, chainID, txid)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer txsim.Done()
+
+	// the state cannot change while the simulator is open
+	info, err := lgr.GetBlockchainInfo()
+	if err != nil {
+		return nil, nil, err
+	}
+	if height > info.Height {
+		return nil, nil, errors.Errorf("cannot check the reads unchanged since block height %d, the ledger of channel %s is at height %d", height, chainID, info.Height)
+	}
+
+	simulator := *e
+	simulator.distributePrivateData = func(string, string, *rwset.TxPvtReadWriteSet) error { return nil }
+	simulator.config.AckingPrivateDataDistributor = nil
+	simulator.endorsementCache = nil
+	simulator.events = nil
+	_, res, simResult, _, _, err := simulator.simulateProposal(ctx, chainID, txid, signedProp, prop, cid, txsim)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = checkReadsUnchangedSince(simResult, height); err != nil {
+		return nil, nil, err
+	}
+	return res, simResult, nil
+}
+
+// checkReadsUnchangedSince checks that the keys read by the simulation,
+// range queries included, were last updated below the block height
+func checkReadsUnchangedSince(simResult []byte, height uint64) error {
+	txRWSet := &rwsetutil.TxRwSet{}
+	if err := txRWSet.FromProtoBytes(simResult); err != nil {
+		return errors.Wrap(err, "failed to unmarshal simulation results")
+	}
+
+	for _, nsRWSet := range txRWSet.NsRwSets {
+		kvRWSet := nsRWSet.KvRwSet
+		if kvRWSet == nil {
+			continue
+		}
+		reads := append([]*kvrwset.KVRead{}, kvRWSet.Reads...)
+		for _, rqi := range kvRWSet.RangeQueriesInfo {
+			reads = append(reads, rqi.GetRawReads().GetKvReads()...)
+		}
+		for _, read := range reads {
+			if err := checkReadUnchangedSince(nsRWSet.NameSpace, read, height); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func checkReadUnchangedSince(namespace string, read *kvrwset.KVRead, height uint64) error {
+	if read.Version != nil && read.Version.BlockNum >= height {
+		return errors.Errorf("key %s of namespace %s was updated in block %d, at or above block height %d", read.Key, namespace, read.Version.BlockNum, height)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorser
+
+import (
+	"sync"
+
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/pkg/errors"
+)
+
+// errChaincodeUpgrading is returned for the proposals to a chaincode being
+// upgraded
+var errChaincodeUpgrading = errors.New("chaincode is being upgraded")
+
+// upgradeGuard tracks the chaincodes whose upgrade is being simulated, so
+// that the proposals to them are rejected rather than simulated against the
+// version being replaced, which would fail validation once the upgrade is
+// committed.
+type upgradeGuard struct {
+	sync.Mutex
+	// upgrading counts the upgrades in progress by channel and chaincode
+	upgrading map[string]map[string]int
+}
+
+// newUpgradeGuard returns a guard, or nil (proposals never rejected) if
+// enabled is not set
+func newUpgradeGuard(enabled bool) *upgradeGuard {
+	if !enabled {
+		return nil
+	}
+	return &upgradeGuard{upgrading: make(map[string]map[string]int)}
+}
+
+// begin marks the chaincode as being upgraded on the channel. The returned
+// function must be called once the upgrade is over, whether it succeeded or
+// not.
+func (g *upgradeGuard) begin(chainID string, ccName string) func() {
+	if g == nil {
+		return func() {}
+	}
+
+	g.Lock()
+	defer g.Unlock()
+	if g.upgrading[chainID] == nil {
+		g.upgrading[chainID] = make(map[string]int)
+	}
+	g.upgrading[chainID][ccName]++
+
+	return func() {
+		g.Lock()
+		defer g.Unlock()
+		if g.upgrading[chainID][ccName]--; g.upgrading[chainID][ccName] == 0 {
+			delete(g.upgrading[chainID], ccName)
+		}
+	}
+}
+
+// check returns an error if the chaincode is being upgraded on the channel
+func (g *upgradeGuard) check(chainID string, ccName string) error {
+	if g == nil {
+		return nil
+	}
+
+	g.Lock()
+	defer g.Unlock()
+	if g.upgrading[chainID][ccName] > 0 {
+		return errors.WithMessage(errChaincodeUpgrading, "rejecting proposal to "+ccName+" on channel "+chainID)
+	}
+	return nil
+}
+
+// chaincodeUpgradingResponse is returned to the client when the chaincode
+// of its proposal is being upgraded; the proposal can be retried once the
+// upgrade is over.
+func chaincodeUpgradingResponse(err error) *pb.ProposalResponse {
+	endorserLogger.Warningf("%s", err)
+	return &pb.ProposalResponse{Response: &pb.Response{Status: 503, Message: err.Error()}}
+}
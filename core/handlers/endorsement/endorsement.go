@@ -0,0 +1,27 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorsement
+
+// Selector selects the endorsement plugin (ESCC) endorsing a proposal
+type Selector interface {
+	// SelectEndorsement returns the name of the ESCC endorsing a proposal
+	// to chaincode ccName on channel chainID, given the one the peer would
+	// use otherwise, or "" to leave the selection to the next selectors
+	SelectEndorsement(chainID string, ccName string, escc string) string
+}
+
+// Select returns the ESCC selected by the first of the selectors selecting
+// one, or escc if none does
+func Select(chainID string, ccName string, escc string, selectors ...Selector) string {
+	for _, selector := range selectors {
+		if selected := selector.SelectEndorsement(chainID, ccName, escc); selected != "" {
+			return selected
+		}
+	}
+
+	return escc
+}
@@ -0,0 +1,29 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package endorsement
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type channelSelector map[string]string
+
+func (s channelSelector) SelectEndorsement(chainID string, ccName string, escc string) string {
+	return s[chainID]
+}
+
+func TestSelect(t *testing.T) {
+	assert.Equal(t, "escc", Select("mychannel", "mycc", "escc"))
+
+	first := channelSelector{"mychannel": "myescc"}
+	second := channelSelector{"mychannel": "otherescc", "otherchannel": "otherescc"}
+	assert.Equal(t, "myescc", Select("mychannel", "mycc", "escc", first, second))
+	assert.Equal(t, "otherescc", Select("otherchannel", "mycc", "escc", first, second))
+	assert.Equal(t, "escc", Select("thirdchannel", "mycc", "escc", first, second))
+}
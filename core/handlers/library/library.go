@@ -11,6 +11,8 @@ import (
 	"github.com/hyperledger/fabric/core/handlers/auth/filter"
 	"github.com/hyperledger/fabric/core/handlers/decoration"
 	"github.com/hyperledger/fabric/core/handlers/decoration/decorator"
+	"github.com/hyperledger/fabric/core/handlers/endorsement"
+	"github.com/hyperledger/fabric/core/handlers/endorsement/selector"
 )
 
 // HandlerLibrary is used to assert
@@ -33,3 +35,10 @@ func (r *HandlerLibrary) DefaultAuth() auth.Filter {
 func (r *HandlerLibrary) DefaultDecorator() decoration.Decorator {
 	return decorator.NewDecorator()
 }
+
+// DefaultEndorsement creates a default endorsement selector
+// that doesn't select any ESCC, leaving the peer endorse
+// proposals with the ESCC of their chaincode.
+func (r *HandlerLibrary) DefaultEndorsement() endorsement.Selector {
+	return selector.NewSelector()
+}
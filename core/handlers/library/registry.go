@@ -15,6 +15,7 @@ import (
 
 	"github.com/hyperledger/fabric/core/handlers/auth"
 	"github.com/hyperledger/fabric/core/handlers/decoration"
+	"github.com/hyperledger/fabric/core/handlers/endorsement"
 )
 
 // Registry defines an object that looks up
@@ -35,14 +36,19 @@ const (
 	// Decoration handler - append or mutate the chaincode input
 	// passed to the chaincode
 	Decoration
+	// Endorsement handler - select the endorsement plugin (ESCC)
+	// endorsing a proposal
+	Endorsement
 
-	authPluginFactory      = "NewFilter"
-	decoratorPluginFactory = "NewDecorator"
+	authPluginFactory        = "NewFilter"
+	decoratorPluginFactory   = "NewDecorator"
+	endorsementPluginFactory = "NewEndorsementSelector"
 )
 
 type registry struct {
 	filters    []auth.Filter
 	decorators []decoration.Decorator
+	selectors  []endorsement.Selector
 }
 
 var once sync.Once
@@ -53,6 +59,7 @@ var reg registry
 type Config struct {
 	AuthFilters []*HandlerConfig `mapstructure:"authFilters" yaml:"authFilters"`
 	Decorators  []*HandlerConfig `mapstructure:"decorators" yaml:"decorators"`
+	Endorsers   []*HandlerConfig `mapstructure:"endorsers" yaml:"endorsers"`
 }
 
 // HandlerConfig defines configuration for a plugin or compiled handler
@@ -79,6 +86,9 @@ func (r *registry) loadHandlers(c Config) {
 	for _, config := range c.Decorators {
 		r.evaluateModeAndLoad(config, Decoration)
 	}
+	for _, config := range c.Endorsers {
+		r.evaluateModeAndLoad(config, Endorsement)
+	}
 }
 
 // evaluateModeAndLoad if a library path is provided, load the shared object
@@ -105,6 +115,8 @@ func (r *registry) loadCompiled(handlerFactory string, handlerType HandlerType)
 		r.filters = append(r.filters, inst.(auth.Filter))
 	} else if handlerType == Decoration {
 		r.decorators = append(r.decorators, inst.(decoration.Decorator))
+	} else if handlerType == Endorsement {
+		r.selectors = append(r.selectors, inst.(endorsement.Selector))
 	}
 }
 
@@ -123,6 +135,8 @@ func (r *registry) loadPlugin(pluginPath string, handlerType HandlerType) {
 		r.initAuthPlugin(p)
 	} else if handlerType == Decoration {
 		r.initDecoratorPlugin(p)
+	} else if handlerType == Endorsement {
+		r.initEndorsementPlugin(p)
 	}
 }
 
@@ -159,6 +173,23 @@ func (r *registry) initDecoratorPlugin(p *plugin.Plugin) {
 	}
 }
 
+// initEndorsementPlugin constructs an endorsement selector from the given
+// plugin
+func (r *registry) initEndorsementPlugin(p *plugin.Plugin) {
+	constructorSymbol, err := p.Lookup(endorsementPluginFactory)
+	if err != nil {
+		panicWithLookupError(endorsementPluginFactory, err)
+	}
+	constructor, ok := constructorSymbol.(func() endorsement.Selector)
+	if !ok {
+		panicWithDefinitionError(endorsementPluginFactory)
+	}
+	selector := constructor()
+	if selector != nil {
+		r.selectors = append(r.selectors, selector)
+	}
+}
+
 // panicWithLookupError panics when a handler constructor lookup fails
 func panicWithLookupError(factory string, err error) {
 	panic(fmt.Errorf("Filter must contain constructor with name %s. Error from lookup: %s",
@@ -179,6 +210,8 @@ func (r *registry) Lookup(handlerType HandlerType) interface{} {
 		return r.filters
 	} else if handlerType == Decoration {
 		return r.decorators
+	} else if handlerType == Endorsement {
+		return r.selectors
 	}
 
 	return nil
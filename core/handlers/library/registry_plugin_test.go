@@ -24,8 +24,9 @@ import (
 )
 
 const (
-	authPluginPackage      = "github.com/hyperledger/fabric/core/handlers/auth/plugin"
-	decoratorPluginPackage = "github.com/hyperledger/fabric/core/handlers/decoration/plugin"
+	authPluginPackage        = "github.com/hyperledger/fabric/core/handlers/auth/plugin"
+	decoratorPluginPackage   = "github.com/hyperledger/fabric/core/handlers/decoration/plugin"
+	endorsementPluginPackage = "github.com/hyperledger/fabric/core/handlers/endorsement/plugin"
 )
 
 func TestLoadAuthPlugin(t *testing.T) {
@@ -72,6 +73,25 @@ func TestLoadDecoratorPlugin(t *testing.T) {
 	assert.True(t, proto.Equal(decoratedInput, testInput), "Expected chaincode input to remain unchanged")
 }
 
+func TestLoadEndorsementPlugin(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "")
+	assert.NoError(t, err, "Could not create temp directory for plugins")
+	defer os.Remove(testDir)
+	pluginPath := strings.Join([]string{testDir, "/", "endorsementplugin.so"}, "")
+
+	cmd := exec.Command("go", "build", "-o", pluginPath, "-buildmode=plugin",
+		endorsementPluginPackage)
+	output, err := cmd.CombinedOutput()
+	assert.NoError(t, err, "Could not build plugin: "+string(output))
+
+	testReg := registry{}
+	testReg.loadPlugin(pluginPath, Endorsement)
+	assert.Len(t, testReg.selectors, 1, "Expected endorsement selector to be registered")
+
+	escc := testReg.selectors[0].SelectEndorsement("mychannel", "mycc", "escc")
+	assert.Empty(t, escc, "Expected the selection of the ESCC to be left to the peer")
+}
+
 func TestLoadPluginInvalidPath(t *testing.T) {
 	defer func() {
 		if r := recover(); r == nil {
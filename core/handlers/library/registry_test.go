@@ -11,6 +11,7 @@ import (
 
 	"github.com/hyperledger/fabric/core/handlers/auth"
 	"github.com/hyperledger/fabric/core/handlers/decoration"
+	"github.com/hyperledger/fabric/core/handlers/endorsement"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -18,6 +19,7 @@ func TestInitRegistry(t *testing.T) {
 	r := InitRegistry(Config{
 		AuthFilters: []*HandlerConfig{&HandlerConfig{Name: "DefaultAuth"}},
 		Decorators:  []*HandlerConfig{&HandlerConfig{Name: "DefaultDecorator"}},
+		Endorsers:   []*HandlerConfig{&HandlerConfig{Name: "DefaultEndorsement"}},
 	})
 	assert.NotNil(t, r)
 	authHandlers := r.Lookup(Auth)
@@ -31,6 +33,12 @@ func TestInitRegistry(t *testing.T) {
 	decorators, isDecorators := decorationHandlers.([]decoration.Decorator)
 	assert.True(t, isDecorators)
 	assert.Len(t, decorators, 1)
+
+	endorsementHandlers := r.Lookup(Endorsement)
+	assert.NotNil(t, endorsementHandlers)
+	selectors, isSelectors := endorsementHandlers.([]endorsement.Selector)
+	assert.True(t, isSelectors)
+	assert.Len(t, selectors, 1)
 }
 
 func TestLoadCompiledInvalid(t *testing.T) {
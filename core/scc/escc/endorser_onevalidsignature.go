@@ -18,6 +18,7 @@ package escc
 
 import (
 	"fmt"
+	"strconv"
 
 	"github.com/hyperledger/fabric/common/flogging"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
@@ -48,7 +49,7 @@ func (e *EndorserOneValidSignature) Init(stub shim.ChaincodeStubInterface) pb.Re
 // policy specification to be coded as a transaction of the chaincode and Client
 // could select which policy to use for endorsement using parameter
 // @return a marshalled proposal response
-// Note that Peer calls this function with 4 mandatory arguments (and 2 optional ones):
+// Note that Peer calls this function with 4 mandatory arguments (and 3 optional ones):
 // args[0] - function name (not used now)
 // args[1] - serialized Header object
 // args[2] - serialized ChaincodeProposalPayload object
@@ -57,6 +58,7 @@ func (e *EndorserOneValidSignature) Init(stub shim.ChaincodeStubInterface) pb.Re
 // args[5] - binary blob of simulation results
 // args[6] - serialized events
 // args[7] - payloadVisibility
+// args[8] - status the endorsed responses are below, when the peer endorses chaincode failures
 //
 // NOTE: this chaincode is meant to sign another chaincode's simulation
 // results. It should not manipulate state as any state change will be
@@ -67,8 +69,8 @@ func (e *EndorserOneValidSignature) Invoke(stub shim.ChaincodeStubInterface) pb.
 	args := stub.GetArgs()
 	if len(args) < 6 {
 		return shim.Error(fmt.Sprintf("Incorrect number of arguments (expected a minimum of 5, provided %d)", len(args)))
-	} else if len(args) > 8 {
-		return shim.Error(fmt.Sprintf("Incorrect number of arguments (expected a maximum of 7, provided %d)", len(args)))
+	} else if len(args) > 9 {
+		return shim.Error(fmt.Sprintf("Incorrect number of arguments (expected a maximum of 8, provided %d)", len(args)))
 	}
 
 	logger.Debugf("ESCC starts: %d args", len(args))
@@ -100,7 +102,16 @@ func (e *EndorserOneValidSignature) Invoke(stub shim.ChaincodeStubInterface) pb.
 	}
 
 	// handle executing chaincode result
-	// Status code < shim.ERRORTHRESHOLD can be endorsed
+	// Status code < shim.ERRORTHRESHOLD can be endorsed, unless the peer
+	// raises the threshold to endorse failures
+	threshold := int32(shim.ERRORTHRESHOLD)
+	if len(args) > 8 && args[8] != nil {
+		t, err := strconv.ParseInt(string(args[8]), 10, 32)
+		if err != nil || t < shim.ERRORTHRESHOLD {
+			return shim.Error(fmt.Sprintf("Invalid endorsement threshold %q", args[8]))
+		}
+		threshold = int32(t)
+	}
 	if args[4] == nil {
 		return shim.Error("Response of chaincode executing is null")
 	}
@@ -110,8 +121,8 @@ func (e *EndorserOneValidSignature) Invoke(stub shim.ChaincodeStubInterface) pb.
 		return shim.Error(fmt.Sprintf("Failed to get Response of executing chaincode: %s", err.Error()))
 	}
 
-	if response.Status >= shim.ERRORTHRESHOLD {
-		return shim.Error(fmt.Sprintf("Status code less than %d will be endorsed, received status code: %d", shim.ERRORTHRESHOLD, response.Status))
+	if response.Status >= threshold {
+		return shim.Error(fmt.Sprintf("Status code less than %d will be endorsed, received status code: %d", threshold, response.Status))
 	}
 
 	// handle simulation results
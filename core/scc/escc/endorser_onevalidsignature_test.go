@@ -254,6 +254,22 @@ func TestInvoke(t *testing.T) {
 		t.Fatalf("%s", err)
 		return
 	}
+
+	// success test 4: failure below the endorsement threshold passed by the peer
+	args = [][]byte{[]byte(""), proposal.Header, proposal.Payload, ccidBytes, failRes, simRes, events, nil, []byte("501")}
+	res = stub.MockInvoke("1", args)
+	assert.Equal(t, int32(shim.OK), res.Status, "escc invoke failed with: %s", res.Message)
+
+	// Failed path: failure at the endorsement threshold
+	args = [][]byte{[]byte(""), proposal.Header, proposal.Payload, ccidBytes, failRes, simRes, events, nil, []byte("500")}
+	res = stub.MockInvoke("1", args)
+	assert.Contains(t, res.Message, "Status code less than 500 will be endorsed")
+
+	// Failed path: invalid endorsement threshold
+	args = [][]byte{[]byte(""), proposal.Header, proposal.Payload, ccidBytes, ccFailRes, simRes, events, nil, []byte("300")}
+	res = stub.MockInvoke("1", args)
+	assert.NotEqual(t, int32(shim.OK), res.Status)
+	assert.Contains(t, res.Message, "Invalid endorsement threshold")
 }
 
 func validateProposalResponse(prBytes []byte, proposal *pb.Proposal, ccid *pb.ChaincodeID, visibility []byte, response *pb.Response, simRes []byte, events []byte) error {
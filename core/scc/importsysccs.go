@@ -153,6 +153,18 @@ func IsSysCCAndNotInvokableCC2CC(name string) bool {
 	return false
 }
 
+// IsSysCCAvailable returns true if the chaincode is a system
+// chaincode which is enabled and whitelisted, ie which is
+// deployed on the peer
+func IsSysCCAvailable(name string) bool {
+	for _, sysCC := range systemChaincodes {
+		if sysCC.Name == name {
+			return sysCC.Enabled && isWhitelisted(sysCC)
+		}
+	}
+	return false
+}
+
 // MockRegisterSysCCs is used only for testing
 // This is needed to break import cycle
 func MockRegisterSysCCs(mockSysCCs []*SystemChaincode) []*SystemChaincode {
@@ -125,6 +125,111 @@ type Kafka struct {
 type HoneyBadgerBFT struct {
 	SendSocketPath    string
 	ReceiveSocketPath string
+	// SendAddress and ReceiveAddress, when set, are the TCP addresses of
+	// the send proxy and the one the orderer listens on for the receive
+	// proxy, used instead of SendSocketPath and ReceiveSocketPath
+	SendAddress    string
+	ReceiveAddress string
+	// TLS secures the TCP connections to the proxy, with mutual
+	// authentication: the certificates of the proxy are verified against
+	// RootCAs and ClientRootCAs
+	TLS TLS
+	// MaxInFlightFrameBytes bounds the bytes of the frames being received
+	// from the proxy across all the chains; 0 means no bound
+	MaxInFlightFrameBytes int64
+	// ReconnectInterval is how long to wait before the first attempt to
+	// reconnect to the proxy once a connection to it is broken; the wait
+	// doubles after every failed attempt, up to ReconnectMaxInterval
+	ReconnectInterval    time.Duration
+	ReconnectMaxInterval time.Duration
+	// ReconnectMaxRetries is the number of attempts to reconnect to the
+	// proxy before giving up
+	ReconnectMaxRetries int
+	// MeasurementInterval is the number of envelopes a chain orders
+	// between two measurements of its throughput
+	MeasurementInterval int64
+	// MeasurementPeriod, when set, is how often the throughput of a chain
+	// is measured instead, whatever the number of envelopes ordered
+	MeasurementPeriod time.Duration
+	// MaxPendingEnvelopes is the number of envelopes a chain holds waiting
+	// to be sent to the proxy; beyond it Order waits for one of them to be
+	// sent, for at most SendTimeout. 0 means no bound
+	MaxPendingEnvelopes int
+	// MaxInFlightEnvelopes bounds the envelopes a chain has sent to the
+	// proxy and not yet seen ordered in a block; beyond it Order waits for
+	// a block, for at most SendTimeout, so that a burst does not overwhelm
+	// the BFT network. 0 means no bound
+	MaxInFlightEnvelopes int
+	// SendTimeout bounds the time Order waits for the proxy to accept an
+	// envelope before failing; 0 means it waits indefinitely
+	SendTimeout time.Duration
+	// MaxMessageSize bounds the size of the blocks received from the
+	// proxy; 0 means the largest block of the channel, as configured by
+	// its AbsoluteMaxBytes when the chain is created
+	MaxMessageSize uint64
+	// HeartbeatInterval is how often a heartbeat is sent to the proxy,
+	// which echoes it back over the receive connection; 0 disables the
+	// heartbeats. Once MaxMissedHeartbeats of them are not echoed, the
+	// connection to the send proxy is replaced.
+	HeartbeatInterval   time.Duration
+	MaxMissedHeartbeats int
+	// Replicas are the endpoints of the replicas of the proxy besides the
+	// one above. Envelopes are sent to one of them at a time, failing over
+	// to the next when it cannot be reached, while blocks are received from
+	// all of them; TLS secures the connections to every replica.
+	Replicas []HoneyBadgerBFTProxy
+	// BlockWindow, when set, is the number of blocks the proxy may send
+	// over a receive connection ahead of the ones the orderer is ready to
+	// append: the orderer grants the proxy a block every time it takes
+	// one, so that a slow ledger holds the proxy back. 0 disables the flow
+	// control, for the proxies unaware of it.
+	BlockWindow int
+	// AppendMaxRetries is the number of times the append of a block to the
+	// ledger is retried when it fails with a temporary error, the first
+	// retry waiting for AppendRetryInterval and every following one twice
+	// as long. A chain whose append fails for good is halted, the other
+	// chains keep running. 0 means 5 retries, starting after 100ms
+	AppendMaxRetries    int
+	AppendRetryInterval time.Duration
+	// AckTimeout, when set, asks the proxy to acknowledge the envelopes it
+	// accepts, and is how long Order waits for the acknowledgement before
+	// failing. The proxies which do not confirm they acknowledge envelopes
+	// are not waited for, as if it was not set. 0 disables the
+	// acknowledgements
+	AckTimeout time.Duration
+	// BlockQueueSize is the number of blocks received from the proxy which
+	// may wait to be appended to the ledger, so that the receipt of blocks
+	// keeps ahead of slower ledger writes; beyond it the receipt waits for
+	// the ledger. 0 means 100. It is ignored when BlockWindow is set, the
+	// window bounding the blocks received ahead of the ledger instead.
+	BlockQueueSize int
+	// Resume, when set, tells the proxy where a chain resumes from when it
+	// starts: the number of the next block and the orderer metadata of the
+	// last block committed, so that the proxy does not order the blocks
+	// committed before a restart again. It is disabled for the proxies
+	// unaware of it.
+	Resume bool
+	// LatencyTrackingSize is the number of envelopes sent to the proxy a
+	// chain waits to see in a block to measure their order-to-commit
+	// latency; the oldest ones are no longer waited for beyond it. 0 means
+	// 10000
+	LatencyTrackingSize int
+	// Compression, when set, is the algorithm the envelopes sent to the
+	// proxy are compressed with, gzip or snappy, the proxy then being
+	// allowed to compress the blocks it sends with it too. It is
+	// negotiated over every send connection, the envelopes being sent as
+	// is to the proxies which do not confirm they accept it. Empty
+	// disables the compression.
+	Compression string
+}
+
+// HoneyBadgerBFTProxy contains the endpoints of a replica of the
+// HoneyBadgerBFT proxy, like the ones of HoneyBadgerBFT
+type HoneyBadgerBFTProxy struct {
+	SendSocketPath    string
+	ReceiveSocketPath string
+	SendAddress       string
+	ReceiveAddress    string
 }
 
 // Retry contains configuration related to retries and timeouts when the
@@ -232,8 +337,13 @@ var defaults = TopLevel{
 		},
 	},
 	HoneyBadgerBFT: HoneyBadgerBFT{
-		SendSocketPath:    "/tmp/hyper-ledger-honey-badger-bft-1-send",
-		ReceiveSocketPath: "/tmp/hyper-ledger-honey-badger-bft-1-receive",
+		SendSocketPath:       "/tmp/hyper-ledger-honey-badger-bft-1-send",
+		ReceiveSocketPath:    "/tmp/hyper-ledger-honey-badger-bft-1-receive",
+		ReconnectInterval:    100 * time.Millisecond,
+		ReconnectMaxInterval: 10 * time.Second,
+		ReconnectMaxRetries:  10,
+		MeasurementInterval:  10000,
+		MaxMissedHeartbeats:  3,
 	},
 	Debug: Debug{
 		BroadcastTraceDir: "",
@@ -275,6 +385,10 @@ func (c *TopLevel) completeInitialization(configDir string) {
 		c.General.TLS.ClientRootCAs = translateCAs(configDir, c.General.TLS.ClientRootCAs)
 		cf.TranslatePathInPlace(configDir, &c.General.TLS.PrivateKey)
 		cf.TranslatePathInPlace(configDir, &c.General.TLS.Certificate)
+		c.HoneyBadgerBFT.TLS.RootCAs = translateCAs(configDir, c.HoneyBadgerBFT.TLS.RootCAs)
+		c.HoneyBadgerBFT.TLS.ClientRootCAs = translateCAs(configDir, c.HoneyBadgerBFT.TLS.ClientRootCAs)
+		cf.TranslatePathInPlace(configDir, &c.HoneyBadgerBFT.TLS.PrivateKey)
+		cf.TranslatePathInPlace(configDir, &c.HoneyBadgerBFT.TLS.Certificate)
 		cf.TranslatePathInPlace(configDir, &c.General.GenesisFile)
 		cf.TranslatePathInPlace(configDir, &c.General.LocalMSPDir)
 	}()
@@ -375,6 +489,13 @@ func (c *TopLevel) completeInitialization(configDir string) {
 			logger.Infof("Kafka.Version unset, setting to %v", defaults.Kafka.Version)
 			c.Kafka.Version = defaults.Kafka.Version
 
+		case c.HoneyBadgerBFT.TLS.Enabled && c.HoneyBadgerBFT.TLS.Certificate == "":
+			logger.Panicf("HoneyBadgerBFT.TLS.Certificate must be set if HoneyBadgerBFT.TLS.Enabled is set to true.")
+		case c.HoneyBadgerBFT.TLS.Enabled && c.HoneyBadgerBFT.TLS.PrivateKey == "":
+			logger.Panicf("HoneyBadgerBFT.TLS.PrivateKey must be set if HoneyBadgerBFT.TLS.Enabled is set to true.")
+		case c.HoneyBadgerBFT.TLS.Enabled && c.HoneyBadgerBFT.TLS.RootCAs == nil:
+			logger.Panicf("HoneyBadgerBFT.TLS.RootCAs must be set if HoneyBadgerBFT.TLS.Enabled is set to true.")
+
 		case c.HoneyBadgerBFT.SendSocketPath == "":
 			logger.Infof("Orderer.HoneyBadgerBFT.SendSocketPath unset, setting to %s", defaults.HoneyBadgerBFT.SendSocketPath)
 			c.HoneyBadgerBFT.SendSocketPath = defaults.HoneyBadgerBFT.SendSocketPath
@@ -383,6 +504,22 @@ func (c *TopLevel) completeInitialization(configDir string) {
 			logger.Infof("Orderer.HoneyBadgerBFT.ReceiveSocketPath unset, setting to %s", defaults.HoneyBadgerBFT.ReceiveSocketPath)
 			c.HoneyBadgerBFT.ReceiveSocketPath = defaults.HoneyBadgerBFT.ReceiveSocketPath
 
+		case c.HoneyBadgerBFT.ReconnectInterval == 0*time.Second:
+			logger.Infof("Orderer.HoneyBadgerBFT.ReconnectInterval unset, setting to %v", defaults.HoneyBadgerBFT.ReconnectInterval)
+			c.HoneyBadgerBFT.ReconnectInterval = defaults.HoneyBadgerBFT.ReconnectInterval
+		case c.HoneyBadgerBFT.ReconnectMaxInterval == 0*time.Second:
+			logger.Infof("Orderer.HoneyBadgerBFT.ReconnectMaxInterval unset, setting to %v", defaults.HoneyBadgerBFT.ReconnectMaxInterval)
+			c.HoneyBadgerBFT.ReconnectMaxInterval = defaults.HoneyBadgerBFT.ReconnectMaxInterval
+		case c.HoneyBadgerBFT.ReconnectMaxRetries == 0:
+			logger.Infof("Orderer.HoneyBadgerBFT.ReconnectMaxRetries unset, setting to %v", defaults.HoneyBadgerBFT.ReconnectMaxRetries)
+			c.HoneyBadgerBFT.ReconnectMaxRetries = defaults.HoneyBadgerBFT.ReconnectMaxRetries
+		case c.HoneyBadgerBFT.MeasurementInterval == 0:
+			logger.Infof("Orderer.HoneyBadgerBFT.MeasurementInterval unset, setting to %v", defaults.HoneyBadgerBFT.MeasurementInterval)
+			c.HoneyBadgerBFT.MeasurementInterval = defaults.HoneyBadgerBFT.MeasurementInterval
+		case c.HoneyBadgerBFT.MaxMissedHeartbeats == 0:
+			logger.Infof("Orderer.HoneyBadgerBFT.MaxMissedHeartbeats unset, setting to %v", defaults.HoneyBadgerBFT.MaxMissedHeartbeats)
+			c.HoneyBadgerBFT.MaxMissedHeartbeats = defaults.HoneyBadgerBFT.MaxMissedHeartbeats
+
 		default:
 			return
 		}
@@ -17,6 +17,7 @@ import (
 	"github.com/hyperledger/fabric/common/channelconfig"
 	"github.com/hyperledger/fabric/common/crypto"
 	"github.com/hyperledger/fabric/common/flogging"
+	"github.com/hyperledger/fabric/common/metrics"
 	"github.com/hyperledger/fabric/common/tools/configtxgen/encoder"
 	genesisconfig "github.com/hyperledger/fabric/common/tools/configtxgen/localconfig"
 	"github.com/hyperledger/fabric/core/comm"
@@ -240,7 +241,7 @@ func initializeMultichannelRegistrar(conf *config.TopLevel, signer crypto.LocalS
 	consenters := make(map[string]consensus.Consenter)
 	consenters["solo"] = solo.New()
 	consenters["kafka"] = kafka.New(conf.Kafka)
-	consenters["honeybadgerbft"] = honeybadgerbft.New(conf.HoneyBadgerBFT)
+	consenters["honeybadgerbft"] = honeybadgerbft.New(conf.HoneyBadgerBFT, metrics.RootScope)
 
 	return multichannel.NewRegistrar(lf, consenters, signer, callbacks...)
 }
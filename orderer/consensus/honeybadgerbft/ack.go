@@ -0,0 +1,151 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package honeybadgerbft
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// ackTracker matches the acknowledgements sent by the proxy to the
+// envelopes waiting for them. Acknowledgements are negotiated per send
+// connection: the first envelope sent over a new connection is preceded by
+// an ack request opening a session, and the envelopes are only waited for
+// once the proxy confirmed the session, so that the proxies unaware of the
+// acknowledgements are used as before.
+type ackTracker struct {
+	sync.Mutex
+	// conn is the send connection the session was opened over
+	conn net.Conn
+	// session identifies the current session, confirmed tells whether the
+	// proxy confirmed it
+	session   uint64
+	confirmed bool
+	// sent is the number of envelopes sent in the session, the sequence
+	// the proxy acknowledges the last one with
+	sent    uint64
+	waiters map[uint64]chan error
+}
+
+// pendingAck is the acknowledgement an envelope sent to the proxy waits for
+type pendingAck struct {
+	session  uint64
+	sequence uint64
+	acked    chan error
+}
+
+// expectAck opens a session of acknowledgements over conn unless one is
+// opened already, and registers the envelope about to be sent over it. It
+// returns nil when acknowledgements are disabled, or not confirmed by the
+// proxy. It is called with sendLock held.
+func (ch *chain) expectAck(conn net.Conn) (*pendingAck, error) {
+	if ch.ackTimeout <= 0 {
+		return nil, nil
+	}
+
+	ch.acks.Lock()
+	defer ch.acks.Unlock()
+	if ch.acks.conn != conn {
+		ch.acks.endSession(fmt.Errorf("connection to send proxy replaced"))
+		ch.acks.conn = conn
+		ch.acks.session++
+		var payload [8]byte
+		binary.BigEndian.PutUint64(payload[:], ch.acks.session)
+		if err := ch.sendControlFrame(conn, ackRequestFrame, payload[:]); err != nil {
+			ch.acks.conn = nil
+			return nil, err
+		}
+	}
+
+	ch.acks.sent++
+	if !ch.acks.confirmed {
+		return nil, nil
+	}
+	ack := &pendingAck{session: ch.acks.session, sequence: ch.acks.sent, acked: make(chan error, 1)}
+	ch.acks.waiters[ack.sequence] = ack.acked
+	return ack, nil
+}
+
+// cancelAck forgets the acknowledgement of an envelope which could not be
+// sent after all
+func (ch *chain) cancelAck(ack *pendingAck) {
+	if ack == nil {
+		return
+	}
+	ch.acks.Lock()
+	defer ch.acks.Unlock()
+	if ack.session == ch.acks.session {
+		delete(ch.acks.waiters, ack.sequence)
+	}
+}
+
+// endSession fails the envelopes waiting for an acknowledgement of the
+// current session. It is called with the lock held.
+func (t *ackTracker) endSession(err error) {
+	for sequence, acked := range t.waiters {
+		acked <- err
+		delete(t.waiters, sequence)
+	}
+	t.confirmed = false
+	t.sent = 0
+}
+
+// waitForAck waits for the proxy to acknowledge the envelope, for at most
+// ackTimeout
+func (ch *chain) waitForAck(ack *pendingAck) error {
+	if ack == nil {
+		return nil
+	}
+	timer := time.NewTimer(ch.ackTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-ack.acked:
+		return err
+	case <-timer.C:
+		ch.cancelAck(ack)
+		return fmt.Errorf("proxy did not acknowledge the envelope within %s", ch.ackTimeout)
+	case <-ch.exitChan:
+		return fmt.Errorf("exiting")
+	}
+}
+
+// acked records the acknowledgement received from the proxy in an ack
+// frame. Sequence zero confirms the session, the others acknowledge the
+// envelopes sent in it. The acknowledgements of previous sessions are
+// ignored.
+func (ch *chain) acked(payload []byte) error {
+	if len(payload) != 16 {
+		return fmt.Errorf("acknowledgement of %d bytes received from proxy, expected 16", len(payload))
+	}
+	session := binary.BigEndian.Uint64(payload[:8])
+	sequence := binary.BigEndian.Uint64(payload[8:])
+
+	ch.acks.Lock()
+	defer ch.acks.Unlock()
+	if session != ch.acks.session || ch.acks.conn == nil {
+		ch.logger.Debugf("Ignoring acknowledgement %d of past session %d", sequence, session)
+		return nil
+	}
+	if sequence == 0 {
+		if !ch.acks.confirmed {
+			ch.logger.Infof("Proxy acknowledges the envelopes sent from now on")
+		}
+		ch.acks.confirmed = true
+		return nil
+	}
+	if sequence > ch.acks.sent {
+		return fmt.Errorf("acknowledgement %d received from proxy for an envelope never sent", sequence)
+	}
+	if acked, ok := ch.acks.waiters[sequence]; ok {
+		acked <- nil
+		delete(ch.acks.waiters, sequence)
+	}
+	return nil
+}
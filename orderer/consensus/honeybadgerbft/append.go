@@ -0,0 +1,67 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package honeybadgerbft
+
+import (
+	"fmt"
+	"time"
+
+	cb "github.com/hyperledger/fabric/protos/common"
+)
+
+const (
+	// defaultAppendMaxRetries is the number of times the append of a block
+	// failing with a recoverable error is retried, unless configured
+	defaultAppendMaxRetries = 5
+	// defaultAppendRetryInterval is how long to wait before the first retry
+	// of an append, unless configured
+	defaultAppendRetryInterval = 100 * time.Millisecond
+)
+
+// temporary is implemented by the errors which tell whether they are
+// temporary, such as a ledger locked for a while
+type temporary interface {
+	Temporary() bool
+}
+
+// isRecoverable returns whether the append failing with err may succeed if
+// retried
+func isRecoverable(err error) bool {
+	t, ok := err.(temporary)
+	return ok && t.Temporary()
+}
+
+// appendWithRetries appends the block, retrying up to appendMaxRetries
+// times when it fails with a recoverable error. The wait between two
+// attempts starts at appendRetryInterval and doubles after every one. The
+// last error is returned once the retries are exhausted, the error is fatal
+// or the chain is halted.
+func (ch *chain) appendWithRetries(block *cb.Block) error {
+	interval := ch.appendRetryInterval
+	err := ch.appendBlock(block)
+	for attempt := 1; err != nil && isRecoverable(err) && attempt <= ch.appendMaxRetries; attempt++ {
+		ch.logger.Warningf("Attempt %d of %d to append block %d failed, retrying in %s: %s", attempt, ch.appendMaxRetries, block.Header.Number, interval, err)
+		select {
+		case <-time.After(interval):
+		case <-ch.exitChan:
+			return err
+		}
+		interval *= 2
+		err = ch.appendBlock(block)
+	}
+	return err
+}
+
+// appendFailed halts the chain, the block it could not append leaving a gap
+// in the ledger the following blocks cannot be appended after. The other
+// chains of the orderer keep running, while this one reports the failure
+// through Errored and Err.
+func (ch *chain) appendFailed(block *cb.Block, err error) {
+	ch.logger.Errorf("Could not append block %d, halting: %s", block.Header.Number, err)
+	ch.fail(fmt.Errorf("could not append block %d: %s", block.Header.Number, err))
+	ch.Halt()
+}
@@ -0,0 +1,138 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package honeybadgerbft
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// errSlotTimeout is returned by takeSlot when no slot freed up within
+// sendTimeout
+var errSlotTimeout = errors.New("no slot freed up in time")
+
+// newSendSlots returns the slots bounding the envelopes waiting to be sent
+// to the proxy, or nil if max is not positive; nil slots never block
+func newSendSlots(max int) chan struct{} {
+	if max <= 0 {
+		return nil
+	}
+	return make(chan struct{}, max)
+}
+
+// acquireSendSlot waits for one of the slots bounding the envelopes waiting
+// to be sent to the proxy, for at most sendTimeout, and returns the function
+// releasing it. It fails once the timeout expires, so that the envelopes
+// stop piling up when the proxy cannot keep up.
+func (ch *chain) acquireSendSlot() (func(), error) {
+	if ch.sendSlots == nil {
+		return func() {}, nil
+	}
+	err := ch.takeSlot(ch.sendSlots)
+	if err == errSlotTimeout {
+		return nil, fmt.Errorf("%d envelopes still waiting to be sent to the proxy after %s", cap(ch.sendSlots), ch.sendTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return func() { <-ch.sendSlots }, nil
+}
+
+// takeSlot takes one of the slots, waiting for at most sendTimeout, or
+// indefinitely when it is zero
+func (ch *chain) takeSlot(slots chan struct{}) error {
+	select {
+	case slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	var timeout <-chan time.Time
+	if ch.sendTimeout > 0 {
+		timer := time.NewTimer(ch.sendTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case slots <- struct{}{}:
+		return nil
+	case <-timeout:
+		return errSlotTimeout
+	case <-ch.exitChan:
+		return fmt.Errorf("exiting")
+	}
+}
+
+// acquireInFlightSlot waits for one of the slots bounding the envelopes sent
+// to the proxy and not yet seen in a block, for at most sendTimeout. The
+// slot is released by transactionsObserved, or by the returned function if
+// the envelope could not be sent after all.
+func (ch *chain) acquireInFlightSlot() (func(), error) {
+	if ch.inFlightSlots == nil {
+		return func() {}, nil
+	}
+	err := ch.takeSlot(ch.inFlightSlots)
+	if err == errSlotTimeout {
+		return nil, fmt.Errorf("%d envelopes sent to the proxy still not ordered after %s", cap(ch.inFlightSlots), ch.sendTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return func() { ch.transactionsObserved(1) }, nil
+}
+
+// transactionsObserved releases the in-flight slots of count transactions
+// found in the blocks received. The blocks also order the envelopes sent
+// by the other orderers, so fewer slots than count may be held.
+func (ch *chain) transactionsObserved(count int) {
+	if ch.inFlightSlots == nil {
+		return
+	}
+	for i := 0; i < count; i++ {
+		select {
+		case <-ch.inFlightSlots:
+		default:
+			return
+		}
+	}
+}
+
+// writeFrame writes a whole frame to conn, within sendTimeout. A frame which
+// could not be written entirely is reported as an error; the connection is
+// then left in the middle of a frame and must not be used anymore.
+func (ch *chain) writeFrame(conn net.Conn, frame []byte) error {
+	if ch.sendTimeout > 0 {
+		if err := conn.SetWriteDeadline(time.Now().Add(ch.sendTimeout)); err != nil {
+			return err
+		}
+	}
+	n, err := conn.Write(frame)
+	if err == nil && n < len(frame) {
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
+// dropSendConnection closes the connection to the send proxy, unless it was
+// replaced already, so that the next envelope is sent over a new one
+func (ch *chain) dropSendConnection(conn net.Conn) {
+	ch.connLock.Lock()
+	defer ch.connLock.Unlock()
+	conn.Close()
+	if ch.sendConnection == conn {
+		ch.sendConnection = nil
+	}
+}
+
+// isTimeout returns whether err is a network timeout
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
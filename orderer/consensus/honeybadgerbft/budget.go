@@ -0,0 +1,85 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package honeybadgerbft
+
+import (
+	"fmt"
+	"sync"
+)
+
+// frameBudget is a byte budget for the frames being received, which a chain
+// acquires before allocating a frame and releases once the frame has been
+// decoded. It is shared by the chains of a consenter, so that a burst on
+// one channel holds back the others instead of exhausting the memory.
+// A frame larger than the whole budget is granted the whole budget.
+type frameBudget struct {
+	capacity int64
+
+	lock      sync.Mutex
+	available int64
+	// released is closed, and replaced, whenever some budget is released
+	released chan struct{}
+}
+
+// newFrameBudget returns a budget of capacity bytes, or nil if capacity is
+// not positive; a nil budget never blocks
+func newFrameBudget(capacity int64) *frameBudget {
+	if capacity <= 0 {
+		return nil
+	}
+	return &frameBudget{
+		capacity:  capacity,
+		available: capacity,
+		released:  make(chan struct{}),
+	}
+}
+
+func (b *frameBudget) clamp(size int64) int64 {
+	if size > b.capacity {
+		return b.capacity
+	}
+	return size
+}
+
+// acquire blocks until size bytes of the budget are available and takes
+// them, or returns an error if exit is closed first
+func (b *frameBudget) acquire(size int64, exit <-chan struct{}) error {
+	if b == nil || size <= 0 {
+		return nil
+	}
+	size = b.clamp(size)
+
+	for {
+		b.lock.Lock()
+		if b.available >= size {
+			b.available -= size
+			b.lock.Unlock()
+			return nil
+		}
+		released := b.released
+		b.lock.Unlock()
+
+		select {
+		case <-released:
+		case <-exit:
+			return fmt.Errorf("exiting")
+		}
+	}
+}
+
+// release gives back the budget acquired for a frame of size bytes
+func (b *frameBudget) release(size int64) {
+	if b == nil || size <= 0 {
+		return
+	}
+
+	b.lock.Lock()
+	b.available += b.clamp(size)
+	close(b.released)
+	b.released = make(chan struct{})
+	b.lock.Unlock()
+}
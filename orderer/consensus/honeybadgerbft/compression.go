@@ -0,0 +1,187 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package honeybadgerbft
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+// compressor compresses the data frames exchanged with the proxy with one
+// of the algorithms the proxy may support
+type compressor struct {
+	name string
+	// id identifies the algorithm in the compression frames
+	id         byte
+	compress   func(data []byte) ([]byte, error)
+	decompress func(data []byte, limit uint64) ([]byte, error)
+}
+
+// compressors are the compression algorithms supported, by name
+var compressors = map[string]*compressor{
+	"gzip":   {name: "gzip", id: 1, compress: gzipCompress, decompress: gzipDecompress},
+	"snappy": {name: "snappy", id: 2, compress: snappyCompress, decompress: snappyDecompress},
+}
+
+// newCompressor returns the compressor of the given name, or nil (no
+// compression) if the name is empty
+func newCompressor(name string) (*compressor, error) {
+	if name == "" {
+		return nil, nil
+	}
+	c, ok := compressors[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression algorithm %s, expected gzip or snappy", name)
+	}
+	return c, nil
+}
+
+func gzipCompress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gzipDecompress(data []byte, limit uint64) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	// reading one byte past the limit tells whether it is exceeded
+	out, err := ioutil.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(out)) > limit {
+		return nil, fmt.Errorf("decompressed frame exceeds the maximum of %d bytes", limit)
+	}
+	return out, nil
+}
+
+func snappyCompress(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+func snappyDecompress(data []byte, limit uint64) ([]byte, error) {
+	size, err := snappy.DecodedLen(data)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(size) > limit {
+		return nil, fmt.Errorf("decompressed frame of %d bytes exceeds the maximum of %d bytes", size, limit)
+	}
+	return snappy.Decode(nil, data)
+}
+
+// compressionNegotiation tracks whether the proxy accepts the compressed
+// envelopes sent over the current send connection. Compression is
+// negotiated per send connection, like the acknowledgements: a compression
+// frame naming the algorithm is sent over a new connection before the first
+// envelope, and the proxy echoes it back over the receive connection once
+// it decompresses the envelopes; until then they are sent as is, so that
+// the proxies unaware of compression are used as before.
+type compressionNegotiation struct {
+	sync.Mutex
+	// conn is the send connection the compression was requested over, in
+	// the given session
+	conn      net.Conn
+	session   uint64
+	confirmed bool
+}
+
+// compressEnvelope returns the frame payload of the envelope about to be
+// sent over conn, and whether it is compressed. It requests compression
+// over conn unless it did already, and only compresses the envelope once
+// the proxy confirmed it and if that makes it smaller. It is called with
+// sendLock held.
+func (ch *chain) compressEnvelope(conn net.Conn, data []byte) ([]byte, bool, error) {
+	if ch.compressor == nil {
+		return data, false, nil
+	}
+
+	ch.compression.Lock()
+	if ch.compression.conn != conn {
+		ch.compression.conn = conn
+		ch.compression.session++
+		ch.compression.confirmed = false
+		var payload [9]byte
+		payload[0] = ch.compressor.id
+		binary.BigEndian.PutUint64(payload[1:], ch.compression.session)
+		if err := ch.sendControlFrame(conn, compressionFrame, payload[:]); err != nil {
+			ch.compression.conn = nil
+			ch.compression.Unlock()
+			return nil, false, err
+		}
+	}
+	confirmed := ch.compression.confirmed
+	ch.compression.Unlock()
+	if !confirmed {
+		return data, false, nil
+	}
+
+	compressed, err := ch.compressor.compress(data)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to compress envelope with %s: %s", ch.compressor.name, err)
+	}
+	if len(compressed) >= len(data) {
+		return data, false, nil
+	}
+	return compressed, true, nil
+}
+
+// compressionConfirmed records the compression frame echoed by the proxy,
+// which then accepts compressed envelopes over the current send connection.
+// The confirmations of previous sessions are ignored.
+func (ch *chain) compressionConfirmed(payload []byte) error {
+	if len(payload) != 9 {
+		return fmt.Errorf("compression frame of %d bytes received from proxy, expected 9", len(payload))
+	}
+	if ch.compressor == nil || payload[0] != ch.compressor.id {
+		return fmt.Errorf("proxy confirmed compression algorithm %d, which was never requested", payload[0])
+	}
+	session := binary.BigEndian.Uint64(payload[1:])
+
+	ch.compression.Lock()
+	defer ch.compression.Unlock()
+	if session != ch.compression.session || ch.compression.conn == nil {
+		ch.logger.Debugf("Ignoring compression confirmation of past session %d", session)
+		return nil
+	}
+	if !ch.compression.confirmed {
+		ch.logger.Infof("Proxy accepts envelopes compressed with %s from now on", ch.compressor.name)
+		ch.compression.confirmed = true
+	}
+	return nil
+}
+
+// decompressBlock returns the bytes of a block received compressed from the
+// proxy, bounded by the maximum message size
+func (ch *chain) decompressBlock(data []byte) ([]byte, error) {
+	if ch.compressor == nil {
+		return nil, fmt.Errorf("compressed frame received from proxy while compression is disabled")
+	}
+	out, err := ch.compressor.decompress(data, ch.maxMessageSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress block received from proxy with %s: %s", ch.compressor.name, err)
+	}
+	return out, nil
+}
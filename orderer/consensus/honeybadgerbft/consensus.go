@@ -14,6 +14,7 @@ limitations under the License.
 package honeybadgerbft
 
 import (
+	"crypto/tls"
 	"fmt"
 	"sync"
 	"time"
@@ -25,81 +26,333 @@ import (
 	"io"
 	"net"
 
+	"github.com/hyperledger/fabric/common/metrics"
 	localconfig "github.com/hyperledger/fabric/orderer/common/localconfig"
 	"github.com/hyperledger/fabric/orderer/consensus"
 	"github.com/hyperledger/fabric/protos/utils"
 )
 
 var logger = logging.MustGetLogger("orderer/honeybadgerbft")
-var sendSocketPath = ""
-var receiveSocketPath = ""
 
-//measurements
-var interval = int64(10000)
-var envelopeMeasurementStartTime = int64(-1)
-var countEnvelopes = int64(0)
+// acceptRetryDelay is how long connLoop waits before accepting connections
+// again after a temporary error
+const acceptRetryDelay = 100 * time.Millisecond
+
+const (
+	// defaultSendQueueSize is the number of blocks received from the proxy
+	// which may wait to be appended, unless configured
+	defaultSendQueueSize = 100
+	// defaultDrainTimeout bounds the time a halting chain spends appending
+	// the blocks waiting to be appended
+	defaultDrainTimeout = 10 * time.Second
+	// blockOverhead is the room left for the header and the metadata of a
+	// block on top of the AbsoluteMaxBytes of its data
+	blockOverhead = 1024 * 1024
+)
 
-type consenter struct{}
+type consenter struct {
+	// config is handed over to every chain of the consenter
+	config      localconfig.HoneyBadgerBFT
+	frameBudget *frameBudget
+	// tlsConfig secures the TCP connections to the proxy, it is nil when
+	// TLS is disabled
+	tlsConfig *tls.Config
+	// metrics, when set, is the scope the metrics of the chains are
+	// reported to, tagged with their channel
+	metrics metrics.Scope
+}
 
 type chain struct {
+	// heartbeatsSent and heartbeatsEchoed are the sequence numbers of the
+	// last heartbeat sent to the proxy and of the last one it echoed; they
+	// are accessed atomically, and kept first for their alignment
+	heartbeatsSent   uint64
+	heartbeatsEchoed uint64
+
 	support           consensus.ConsenterSupport
-	sendChan          chan *cb.Envelope
+	logger            chainLogger
+	sendChan          chan *cb.Block
 	exitChan          chan struct{}
+	drainTimeout      time.Duration
 	sendConnection    net.Conn
-	receiveConnection net.Listener
 	sendLock          *sync.Mutex
+	sendSocketPath    string
+	receiveSocketPath string
+	// sendAddress and receiveAddress, when set, are the TCP addresses used
+	// instead of the Unix sockets, secured by tlsConfig unless it is nil
+	sendAddress    string
+	receiveAddress string
+	tlsConfig      *tls.Config
+	// replicas are the endpoints of the replicas of the proxy besides the
+	// one above. The envelopes are sent to one replica at a time, sendReplica,
+	// failing over to the next one when it cannot be reached; sendReplica is
+	// guarded by sendLock. The blocks are received from all of them, over
+	// receiveConnections, the listeners indexed like the replicas, the one
+	// above first.
+	replicas           []localconfig.HoneyBadgerBFTProxy
+	sendReplica        int
+	receiveConnections []net.Listener
+	// connLock guards the replacement of the connections to the proxy,
+	// sendLock is held for the whole sending of a frame instead
+	connLock sync.Mutex
+	// recycle is closed by Reconnect, then replaced, so that connLoop
+	// closes the receive connections and listens again
+	recycle chan struct{}
+
+	// reconnect paces the attempts to reconnect to the proxy
+	reconnect reconnectPolicy
+	// state records the state of the connections reported by Status
+	state *connectionState
+
+	// sendSlots bounds the envelopes waiting to be sent to the proxy, and
+	// sendTimeout the time Order waits for a slot and for the proxy to
+	// accept a frame
+	sendSlots   chan struct{}
+	sendTimeout time.Duration
+	// inFlightSlots bounds the envelopes sent to the proxy and not yet
+	// seen in a block, Order waiting for a slot within sendTimeout too
+	inFlightSlots chan struct{}
+
+	// ackTimeout, when set, is how long Order waits for the proxy to
+	// acknowledge an envelope, acks tracking the acknowledgements
+	ackTimeout time.Duration
+	acks       ackTracker
+
+	// compressor, when set, compresses the envelopes sent to the proxy
+	// once compression tells the proxy accepts them, and decompresses the
+	// blocks the proxy compressed
+	compressor  *compressor
+	compression compressionNegotiation
+
+	// heartbeatInterval is how often a heartbeat is sent to the proxy,
+	// zero disabling them, and maxMissedHeartbeats the number of heartbeats
+	// left unechoed after which the connection is replaced
+	heartbeatInterval   time.Duration
+	maxMissedHeartbeats uint64
+
+	// recvLock serializes the handling of the blocks received from the
+	// replicas of the proxy, and guards the fields below up to lastHash.
+	recvLock sync.Mutex
+	// nextBlock is the number of the next block connLoop hands over to
+	// appendToChain; blocks received ahead of it are held in pendingBlocks
+	// until the gap has been pulled from the proxy.
+	nextBlock     uint64
+	pendingBlocks map[uint64]*cb.Block
+	// pulledUpTo is the number following the last block requested from
+	// the proxy, so that a gap is only pulled once.
+	pulledUpTo uint64
+	// lastHash is the header hash of the last block handed over to
+	// appendToChain, which the previous hash of the next one must match,
+	// starting with the last block of the ledger: the blocks are cut by the
+	// proxy, and the first one received must extend the local chain too.
+	lastHash []byte
+
+	// resume tells whether the proxy is told where the chain resumes from
+	// when it starts, resumeState being the value of the orderer metadata
+	// of the last block committed
+	resume      bool
+	resumeState []byte
+
+	// appendedHeight is the number following the last block appended to
+	// the ledger, only used by appendToChain: a block resent by the proxy
+	// after a reconnect is not appended again.
+	appendedHeight uint64
+	// appendMaxRetries is the number of times the append of a block failing
+	// with a recoverable error is retried, the first retry waiting for
+	// appendRetryInterval and the following ones twice as long as the last
+	appendMaxRetries    int
+	appendRetryInterval time.Duration
+
+	throughput *throughputMeter
+	// latency measures the order-to-commit latency of the envelopes, it is
+	// nil when the metrics are not reported
+	latency *latencyTracker
+	// sizes accumulates the envelopes sent since the last block delivered
+	sizes *sizeAccumulator
+
+	// frameBudget bounds the memory held by received frames, it is shared
+	// by all the chains of the consenter
+	frameBudget *frameBudget
+	// maxMessageSize bounds the length of the frames received, it is
+	// checked before they are allocated
+	maxMessageSize uint64
+	// blockWindow is the number of blocks the proxy may send over a receive
+	// connection ahead of the ones handed over to appendToChain; zero
+	// disables the flow control
+	blockWindow uint64
+
+	// protocolErrors receives the errors about the blocks sent by the
+	// proxy which were dropped instead of being appended
+	protocolErrors chan *ProtocolError
+
+	// errorChan is closed once the chain is halted or has failed for good,
+	// failure is the reason of the latter
+	errorChan chan struct{}
+	errorOnce sync.Once
+	failure   error
 }
 
 // New creates a new consenter for the HoneyBadgerBFT consensus scheme.
 // It communicates with a HoneyBadgerBFT node via Unix websockets and simply marshals/sends and receives/unmarshals
-// messages.
-func New(config localconfig.HoneyBadgerBFT) consensus.Consenter {
-	sendSocketPath = config.SendSocketPath
-	receiveSocketPath = config.ReceiveSocketPath
-	return &consenter{}
+// messages. The metrics of the chains are reported to scope unless it is nil.
+func New(config localconfig.HoneyBadgerBFT, scope metrics.Scope) consensus.Consenter {
+	if config.MeasurementInterval <= 0 {
+		config.MeasurementInterval = defaultMeasurementInterval
+	}
+	var tlsConfig *tls.Config
+	if config.TLS.Enabled {
+		var err error
+		if tlsConfig, err = newTLSConfig(config.TLS); err != nil {
+			logger.Panicf("Could not set up TLS for HoneyBadgerBFT proxy connections: %s", err)
+		}
+	}
+	if _, err := newCompressor(config.Compression); err != nil {
+		logger.Panicf("Could not set up compression of HoneyBadgerBFT proxy connections: %s", err)
+	}
+	return &consenter{
+		config:      config,
+		frameBudget: newFrameBudget(config.MaxInFlightFrameBytes),
+		tlsConfig:   tlsConfig,
+		metrics:     scope,
+	}
 }
 
 func (consenter *consenter) HandleChain(support consensus.ConsenterSupport, metadata *cb.Metadata) (consensus.Chain, error) {
-	return newChain(support), nil
+	var scope metrics.Scope
+	if consenter.metrics != nil {
+		scope = consenter.metrics.Tagged(map[string]string{"channel": support.ChainID()})
+	}
+	throughput := newThroughputMeter(consenter.config.MeasurementInterval, consenter.config.MeasurementPeriod, defaultThroughputHistorySize, scope)
+	ch := newChain(support, consenter.config, consenter.frameBudget, throughput)
+	ch.tlsConfig = consenter.tlsConfig
+	ch.latency = newLatencyTracker(consenter.config.LatencyTrackingSize, scope)
+	ch.sizes = newSizeAccumulator(scope)
+	ch.resumeState = metadata.GetValue()
+	if consenter.config.MaxMessageSize == 0 {
+		ch.maxMessageSize = boundMessageSize(uint64(support.SharedConfig().BatchSize().AbsoluteMaxBytes) + blockOverhead)
+	}
+	return ch, nil
 }
 
-func newChain(support consensus.ConsenterSupport) *chain {
+func newChain(support consensus.ConsenterSupport, config localconfig.HoneyBadgerBFT, budget *frameBudget, throughput *throughputMeter) *chain {
+	maxMissedHeartbeats := config.MaxMissedHeartbeats
+	if maxMissedHeartbeats <= 0 {
+		maxMissedHeartbeats = defaultMaxMissedHeartbeats
+	}
+	appendMaxRetries := config.AppendMaxRetries
+	if appendMaxRetries <= 0 {
+		appendMaxRetries = defaultAppendMaxRetries
+	}
+	appendRetryInterval := config.AppendRetryInterval
+	if appendRetryInterval <= 0 {
+		appendRetryInterval = defaultAppendRetryInterval
+	}
+	sendQueueSize := config.BlockQueueSize
+	if sendQueueSize <= 0 {
+		sendQueueSize = defaultSendQueueSize
+	}
+	if config.BlockWindow > 0 {
+		// the window bounds the blocks received ahead of the ledger: a
+		// block is only granted back once appendToChain takes it, which a
+		// queue would hide
+		sendQueueSize = 0
+	}
+	chLogger := newChainLogger(support.ChainID())
+	throughput.logger = chLogger
 	return &chain{
-		support:  support,
-		sendChan: make(chan *cb.Envelope),
-		exitChan: make(chan struct{}),
-		sendLock: &sync.Mutex{},
+		support:             support,
+		logger:              chLogger,
+		sendChan:            make(chan *cb.Block, sendQueueSize),
+		exitChan:            make(chan struct{}),
+		errorChan:           make(chan struct{}),
+		drainTimeout:        defaultDrainTimeout,
+		sendLock:            &sync.Mutex{},
+		sendSocketPath:      config.SendSocketPath,
+		receiveSocketPath:   config.ReceiveSocketPath,
+		sendAddress:         config.SendAddress,
+		receiveAddress:      config.ReceiveAddress,
+		replicas:            config.Replicas,
+		receiveConnections:  make([]net.Listener, 1+len(config.Replicas)),
+		recycle:             make(chan struct{}),
+		state:               newConnectionState(1 + len(config.Replicas)),
+		reconnect:           newReconnectPolicy(config, chLogger),
+		sendSlots:           newSendSlots(config.MaxPendingEnvelopes),
+		inFlightSlots:       newSendSlots(config.MaxInFlightEnvelopes),
+		sendTimeout:         config.SendTimeout,
+		ackTimeout:          config.AckTimeout,
+		acks:                ackTracker{waiters: make(map[uint64]chan error)},
+		compressor:          compressors[config.Compression],
+		heartbeatInterval:   config.HeartbeatInterval,
+		nextBlock:           support.Height(),
+		lastHash:            support.CreateNextBlock(nil).Header.PreviousHash,
+		appendedHeight:      support.Height(),
+		appendMaxRetries:    appendMaxRetries,
+		appendRetryInterval: appendRetryInterval,
+		pendingBlocks:       make(map[uint64]*cb.Block),
+		throughput:          throughput,
+		sizes:               newSizeAccumulator(nil),
+		frameBudget:         budget,
+		maxMessageSize:      boundMessageSize(config.MaxMessageSize),
+		maxMissedHeartbeats: uint64(maxMissedHeartbeats),
+		blockWindow:         uint64(config.BlockWindow),
+		resume:              config.Resume,
+		protocolErrors:      make(chan *ProtocolError, protocolErrorQueueSize),
 	}
 }
 
 func (ch *chain) Start() {
-	conn, err := net.Dial("unix", sendSocketPath)
+	conn, err := ch.dialAnySend()
 
 	if err != nil {
-		logger.Errorf("Could not connect to send proxy on path %s!", sendSocketPath)
-		logger.Error(err)
+		_, address := ch.sendEndpoint()
+		ch.logger.Errorf("Could not connect to send proxy on %s!", address)
+		ch.logger.Error(err)
+		ch.fail(err)
 		return
 	} else {
-		logger.Infof("Connected to send proxy!")
+		ch.logger.Infof("Connected to send proxy!")
+	}
+
+	if err = ch.sendResume(conn); err != nil {
+		ch.logger.Errorf("Could not send resume frame to send proxy: %s", err)
+		conn.Close()
+		ch.fail(err)
+		return
 	}
 
+	ch.connLock.Lock()
 	ch.sendConnection = conn
+	ch.connLock.Unlock()
 
-	listen, err := net.Listen("unix", receiveSocketPath)
+	for replica := 0; replica < ch.proxyCount(); replica++ {
+		listen, err := ch.listenReceive(replica)
 
-	if err != nil {
-		logger.Errorf("Could not connect to receive proxy on path %s!", receiveSocketPath)
-		logger.Error(err)
-		return
-	} else {
-		logger.Infof("Connected to receive proxy!")
-	}
+		if err != nil {
+			_, address := ch.receiveEndpoint(replica)
+			ch.logger.Errorf("Could not connect to receive proxy on %s!", address)
+			ch.logger.Error(err)
+			ch.fail(err)
+			return
+		} else {
+			ch.logger.Infof("Connected to receive proxy!")
+		}
 
-	ch.receiveConnection = listen
+		ch.connLock.Lock()
+		ch.receiveConnections[replica] = listen
+		ch.connLock.Unlock()
+	}
 
-	go ch.connLoop()
+	for replica := 0; replica < ch.proxyCount(); replica++ {
+		go ch.connLoop(replica)
+	}
 
 	go ch.appendToChain()
+
+	go ch.throughput.run(ch.exitChan)
+
+	if ch.heartbeatInterval > 0 {
+		go ch.heartbeatLoop()
+	}
 }
 
 func (ch *chain) Halt() {
@@ -109,140 +362,336 @@ func (ch *chain) Halt() {
 		// Allow multiple halts without panic
 	default:
 		close(ch.exitChan)
+		ch.fail(nil)
+		// unblock connLoop and the reads and writes in progress
+		ch.connLock.Lock()
+		defer ch.connLock.Unlock()
+		for _, listener := range ch.receiveConnections {
+			if listener != nil {
+				listener.Close()
+			}
+		}
+		if ch.sendConnection != nil {
+			ch.sendConnection.Close()
+		}
 	}
 }
 
-// Configure accepts configuration update messages for ordering
-// TODO
+// Configure accepts configuration update messages for ordering. A config
+// update validated against an older config sequence is revalidated first, as
+// the config it applies to may have changed since. Like Order, it waits for
+// the proxy to acknowledge the update if it acknowledges envelopes. Once the
+// config of the channel terminates the chain, the chain halts and rejects the
+// config updates.
 func (ch *chain) Configure(config *cb.Envelope, configSeq uint64) error {
-	//select {
-	//case ch.sendChan <- &message{
-	//	configSeq: configSeq,
-	//	configMsg: config,
-	//}:
-	//	return nil
-	//case <-ch.exitChan:
-	//	return fmt.Errorf("Exiting")
-	//}
-
-	return nil;
+	if ch.haltIfTerminated() {
+		return errTerminated
+	}
+
+	if configSeq < ch.support.Sequence() {
+		var err error
+		if config, _, err = ch.support.ProcessConfigMsg(config); err != nil {
+			ch.logger.Warningf("Discarding bad config message: %s", err)
+			return err
+		}
+	}
+
+	_, ack, err := ch.sendEnvToBFTProxy(config, ch.support.Sequence(), true)
+	if err != nil {
+		return err
+	}
+	if err = ch.waitForAck(ack); err != nil {
+		return err
+	}
+
+	select {
+	case <-ch.exitChan:
+		return fmt.Errorf("exiting")
+	default:
+		return nil
+	}
 }
 
-// Errored only closes on exit
+// Errored closes on exit, or when the connections to the proxy failed and
+// could not be reestablished, in which case Err returns why
 func (ch *chain) Errored() <-chan struct{} {
-	return ch.exitChan
+	return ch.errorChan
 }
 
-func (ch *chain) sendLength(length int, conn net.Conn) (int, error) {
-	var buf [8]byte
-
-	logger.Infof("Sending length to proxy: %s", length)
-
-	binary.BigEndian.PutUint64(buf[:], uint64(length))
+// Err returns the failure the chain errored because of, or nil if it has not
+// errored or was halted
+func (ch *chain) Err() error {
+	select {
+	case <-ch.errorChan:
+		return ch.failure
+	default:
+		return nil
+	}
+}
 
-	return conn.Write(buf[:])
+// fail marks the chain as errored because of err, nil meaning it was
+// halted, unless it already is
+func (ch *chain) fail(err error) {
+	select {
+	case <-ch.exitChan:
+		// failing because of the halt is no failure
+		err = nil
+	default:
+	}
+	ch.errorOnce.Do(func() {
+		ch.failure = err
+		close(ch.errorChan)
+	})
 }
 
-func (ch *chain) sendEnvToBFTProxy(env *cb.Envelope) (int, error) {
+// sendEnvToBFTProxy sends an envelope to be ordered to the proxy. Config
+// envelopes are sent in config frames, so that the proxy orders each of them
+// in a block of its own. When the connection to the proxy is broken, the
+// envelope is sent again once reconnected; the other envelopes wait for the
+// reconnection meanwhile. An envelope the proxy does not accept within the
+// send timeout is not sent again, and the connection is replaced. A normal
+// envelope validated against the config of sequence configSeq is validated
+// anew before it is sent, should the config have been updated since.
+func (ch *chain) sendEnvToBFTProxy(env *cb.Envelope, configSeq uint64, isConfig bool) (int, *pendingAck, error) {
 	ch.sendLock.Lock()
+	defer ch.sendLock.Unlock()
+	if err := ch.Err(); err != nil {
+		return -1, nil, fmt.Errorf("chain errored: %s", err)
+	}
+	if !isConfig {
+		if err := ch.revalidate(env, configSeq); err != nil {
+			return -1, nil, err
+		}
+	}
 	bytes, err := utils.Marshal(env)
 
 	if err != nil {
-		return -1, err
+		return -1, nil, err
+	}
+	// recorded before the envelope is sent, as the block containing it may
+	// be received before the proxy acknowledges it
+	ch.latency.envelopeSent(bytes, time.Now())
+
+	ch.connLock.Lock()
+	conn := ch.sendConnection
+	ch.connLock.Unlock()
+
+	if conn != nil {
+		status, ack, err := ch.sendAckedFrame(conn, bytes, isConfig)
+		if err == nil {
+			ch.state.envelopeSent(time.Now())
+			ch.sizes.envelopeSent(len(bytes))
+			return status, ack, nil
+		}
+		select {
+		case <-ch.exitChan:
+			return status, nil, err
+		default:
+		}
+		if isTimeout(err) {
+			ch.dropSendConnection(conn)
+			return status, nil, fmt.Errorf("proxy did not accept the envelope within %s: %s", ch.sendTimeout, err)
+		}
+		ch.logger.Warningf("Connection to send proxy broken, reconnecting: %s", err)
 	}
 
-	status, err := ch.sendLength(len(bytes), ch.sendConnection)
+	conn, err = ch.reconnectSend()
+	if err != nil {
+		ch.fail(err)
+		return -1, nil, err
+	}
+	// the config may have been updated while reconnecting
+	if !isConfig {
+		if err := ch.revalidate(env, configSeq); err != nil {
+			return -1, nil, err
+		}
+	}
+	status, ack, err := ch.sendAckedFrame(conn, bytes, isConfig)
+	if err != nil {
+		ch.dropSendConnection(conn)
+		return status, nil, err
+	}
+	ch.state.envelopeSent(time.Now())
+	ch.sizes.envelopeSent(len(bytes))
+	return status, ack, nil
+}
 
+// sendAckedFrame sends the frame of an envelope over conn, along with the
+// acknowledgement it waits for, if any
+func (ch *chain) sendAckedFrame(conn net.Conn, bytes []byte, isConfig bool) (int, *pendingAck, error) {
+	ack, err := ch.expectAck(conn)
 	if err != nil {
-		return status, err
+		return 0, nil, err
 	}
+	status, err := ch.sendFrame(conn, bytes, isConfig)
+	if err != nil {
+		ch.cancelAck(ack)
+		return status, nil, err
+	}
+	return status, ack, nil
+}
 
-	logger.Infof("Sending bytes to proxy: %s", bytes)
+func (ch *chain) sendFrame(conn net.Conn, bytes []byte, isConfig bool) (int, error) {
+	if isConfig {
+		ch.logger.Infof("Sending config bytes to proxy: %s", bytes)
+		return len(bytes), ch.sendControlFrame(conn, configFrame, bytes)
+	}
 
-	i, err := ch.sendConnection.Write(bytes)
+	ch.logger.Infof("Sending bytes to proxy: %s", bytes)
 
-	ch.sendLock.Unlock()
+	payload, compressed, err := ch.compressEnvelope(conn, bytes)
+	if err != nil {
+		return 0, err
+	}
+	prefix := uint64(len(payload))
+	if compressed {
+		prefix |= compressedFrameFlag
+	}
 
-	return i, err
+	// the length and the bytes are written at once, so that a frame is
+	// either sent entirely or reported as failed
+	frame := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint64(frame[:8], prefix)
+	copy(frame[8:], payload)
+	if err := ch.writeFrame(conn, frame); err != nil {
+		return 0, err
+	}
+	return len(bytes), nil
 }
 
-func (ch *chain) recvLength(conn net.Conn) (int64, error) {
-	var size int64
-	err := binary.Read(conn, binary.BigEndian, &size)
+// recvLength reads the length prefix of a frame, a big-endian uint64 like
+// the one sendFrame writes, and checks it against the maximum message size,
+// or the maximum control frame size for a control frame. It also returns
+// whether the frame is a control frame, and whether it is compressed. It
+// returns io.EOF if the connection ends before the prefix, and a framing
+// error if it ends within the prefix or the length is invalid.
+func (ch *chain) recvLength(conn net.Conn) (uint64, bool, bool, error) {
+	var buf [8]byte
+	// a connection may return the prefix over several reads
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+		if err == io.EOF {
+			return 0, false, false, err
+		}
+		return 0, false, false, &framingError{err}
+	}
+	size := binary.BigEndian.Uint64(buf[:])
 
-	logger.Infof("Receiving length to proxy: %s", size)
+	ch.logger.Infof("Receiving length from proxy: %d", size)
 
-	return size, err
+	if size&controlFrameFlag != 0 {
+		size &^= controlFrameFlag
+		if size == 0 || size > maxControlFrameSize {
+			return 0, false, false, &framingError{fmt.Errorf("control frame of %d bytes received from proxy, expected between 1 and %d bytes", size, maxControlFrameSize)}
+		}
+		return size, true, false, nil
+	}
+	compressed := size&compressedFrameFlag != 0
+	size &^= compressedFrameFlag
+	if size > ch.maxMessageSize {
+		return 0, false, false, &framingError{fmt.Errorf("frame of %d bytes received from proxy exceeds the maximum of %d bytes", size, ch.maxMessageSize)}
+	}
+	return size, false, compressed, nil
 }
 
+// recvBytes returns the payload of the next data frame received from the
+// proxy, decompressed if need be, handling the control frames received
+// before it
 func (ch *chain) recvBytes(conn net.Conn) ([]byte, error) {
-	size, err := ch.recvLength(conn)
+	size, control, compressed, err := ch.recvLength(conn)
+	for err == nil && control {
+		if err = ch.recvControlFrame(conn, size); err == nil {
+			size, control, compressed, err = ch.recvLength(conn)
+		}
+	}
 
 	if err != nil {
 		return nil, err
 	}
 
-	buf := make([]byte, size)
+	// wait for the other chains to release enough of the budget before
+	// allocating the frame; recvBlockFromBFTProxy releases it
+	if err := ch.frameBudget.acquire(int64(size), ch.exitChan); err != nil {
+		return nil, err
+	}
 
-	_, err = io.ReadFull(conn, buf)
+	buf := make([]byte, size)
 
-	if err != nil {
+	if err = readFrame(conn, buf); err != nil {
+		ch.frameBudget.release(int64(size))
 		return nil, err
 	}
 
-	logger.Infof("Receiving bytes from proxy: %s", buf)
+	if compressed {
+		// the budget then accounts for the decompressed frame, which
+		// recvBlockFromBFTProxy releases
+		data, err := ch.decompressBlock(buf)
+		ch.frameBudget.release(int64(size))
+		if err != nil {
+			return nil, err
+		}
+		if err = ch.frameBudget.acquire(int64(len(data)), ch.exitChan); err != nil {
+			return nil, err
+		}
+		buf = data
+	}
+
+	ch.logger.Infof("Receiving bytes from proxy: %s", buf)
 
 	return buf, nil
 }
 
-func (ch *chain) recvEnvFromBFTProxy(conn net.Conn) (*cb.Envelope, error) {
-	size, err := ch.recvLength(conn)
+func (ch *chain) recvBlockFromBFTProxy(conn net.Conn) (*cb.Block, error) {
+	buf, err := ch.recvBytes(conn)
 
 	if err != nil {
 		return nil, err
 	}
 
-	buf := make([]byte, size)
-
-	_, err = io.ReadFull(conn, buf)
-
-	logger.Infof("Receiving env bytes from proxy: %s", buf)
+	block, err := utils.GetBlockFromBlockBytes(buf)
+	ch.frameBudget.release(int64(len(buf)))
 
 	if err != nil {
 		return nil, err
 	}
 
-	env, err := utils.UnmarshalEnvelope(buf)
-
-	if err != nil {
-		return nil, err
+	if block.Header == nil {
+		return nil, fmt.Errorf("received block without header")
 	}
 
-	return env, nil
+	return block, nil
 }
 
-// Order accepts a message and returns true on acceptance, or false on shutdown
-func (ch *chain) Order(env *cb.Envelope, _ uint64) error {
-
-	_, err := ch.sendEnvToBFTProxy(env)
-
+// Order accepts a message and returns true on acceptance, or false on shutdown.
+// It waits while too many envelopes are waiting to be sent to the proxy or
+// have been sent but not ordered yet, and fails when the proxy does not keep
+// up within the send timeout. The message is validated anew before it is
+// sent if the config was updated since it was validated against configSeq.
+// Once the proxy confirmed it acknowledges envelopes, Order also waits for
+// the envelope to be acknowledged, for at most the ack timeout.
+func (ch *chain) Order(env *cb.Envelope, configSeq uint64) error {
+	releaseInFlight, err := ch.acquireInFlightSlot()
 	if err != nil {
 		return err
 	}
-
-	if envelopeMeasurementStartTime == -1 {
-		envelopeMeasurementStartTime = time.Now().UnixNano()
+	release, err := ch.acquireSendSlot()
+	if err != nil {
+		releaseInFlight()
+		return err
 	}
+	_, ack, err := ch.sendEnvToBFTProxy(env, configSeq, false)
+	release()
 
-	countEnvelopes++
-	if countEnvelopes%interval == 0 {
-
-		tp := float64(interval*1000000000) / float64(time.Now().UnixNano()-envelopeMeasurementStartTime)
-		fmt.Printf("Throughput = %v envelopes/sec\n", tp)
-		envelopeMeasurementStartTime = time.Now().UnixNano()
-
+	if err != nil {
+		releaseInFlight()
+		return err
+	}
+	// the envelope is in flight once sent, acknowledged or not
+	if err = ch.waitForAck(ack); err != nil {
+		return err
 	}
 
+	ch.throughput.envelopeOrdered(time.Now())
+
 	select {
 	case <-ch.exitChan:
 		return fmt.Errorf("exiting")
@@ -251,65 +700,292 @@ func (ch *chain) Order(env *cb.Envelope, _ uint64) error {
 	}
 }
 
-func (ch *chain) connLoop() {
+// connLoop accepts the connections of the given replica of the proxy and
+// receives the blocks it pushes over them, until the chain is halted or the
+// receive connection cannot be reopened. When the connection of the proxy is
+// broken, the next one it makes is accepted.
+func (ch *chain) connLoop(replica int) {
+	ch.connLock.Lock()
+	listener := ch.receiveConnections[replica]
+	ch.connLock.Unlock()
+
 	for {
-		conn, err := ch.receiveConnection.Accept()
-		if err != nil {
-			logger.Errorf("[recv] Error while accepting connection from HoneyBadgerBFT proxy: %v\n", err)
-			continue
-		}
+		ch.connLock.Lock()
+		recycle := ch.recycle
+		ch.connLock.Unlock()
 
-		block, err := ch.recvEnvFromBFTProxy(conn)
+		conn, err := listener.Accept()
 		if err != nil {
-			logger.Errorf("[recv] Error while receiving envelope from HoneyBadgerBFT proxy: %v\n", err)
+			select {
+			case <-ch.exitChan:
+				ch.logger.Debugf("[recv] Exiting")
+				return
+			case <-recycle:
+				ch.logger.Infof("[recv] Listening again for HoneyBadgerBFT proxy on demand")
+				if listener, err = ch.relisten(replica); err != nil {
+					ch.logger.Errorf("[recv] %v\n", err)
+					ch.fail(err)
+					return
+				}
+				continue
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				ch.logger.Warningf("[recv] Error while accepting connection from HoneyBadgerBFT proxy, retrying: %v\n", err)
+				time.Sleep(acceptRetryDelay)
+				continue
+			}
+			ch.logger.Errorf("[recv] Error while accepting connection from HoneyBadgerBFT proxy, listening again: %v\n", err)
+			if listener, err = ch.relisten(replica); err != nil {
+				ch.logger.Errorf("[recv] %v\n", err)
+				ch.fail(err)
+				return
+			}
 			continue
 		}
 
-		ch.sendChan <- block
+		// the connection is closed on halt and on Reconnect, so that
+		// recvBlocks does not stay blocked on it
+		received := make(chan struct{})
+		go func() {
+			select {
+			case <-ch.exitChan:
+				conn.Close()
+			case <-recycle:
+				conn.Close()
+			case <-received:
+			}
+		}()
+		ch.state.receiveConnectionChanged(replica, true)
+		ch.recvBlocks(conn)
+		ch.state.receiveConnectionChanged(replica, false)
+		close(received)
+
+		select {
+		case <-ch.exitChan:
+			ch.logger.Debugf("[recv] Exiting")
+			return
+		default:
+		}
 	}
 }
 
-func (ch *chain) appendToChain() {
-	var timer <-chan time.Time
-	var err error
+// recvBlocks reads the blocks pushed by the proxy over conn until the proxy
+// closes it, and hands them to handleBlock. With flow control, the proxy is
+// granted the window of blocks first, then another block every time one is
+// handled, which waits for appendToChain to take it. The connection is
+// dropped on the first error, a framing error leaving no way to find the
+// next frame, and the blocks pulled over it are pulled again over the next.
+func (ch *chain) recvBlocks(conn net.Conn) {
+	defer ch.resync()
+	defer conn.Close()
+
+	if ch.blockWindow > 0 {
+		if err := ch.sendCredit(conn, ch.blockWindow); err != nil {
+			ch.logger.Errorf("[recv] Error while granting blocks to HoneyBadgerBFT proxy: %v\n", err)
+			return
+		}
+	}
 
 	for {
-		err = nil
-		select {
-		case msg := <-ch.sendChan:
-			// NormalMsg
-			_, err = ch.support.ProcessNormalMsg(msg)
-			if err != nil {
-				logger.Warningf("Discarding bad normal message: %s", err)
-				continue
+		block, err := ch.recvBlockFromBFTProxy(conn)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			select {
+			case <-ch.exitChan:
+				// the connection was closed by Halt
+				return
+			default:
 			}
-			batches, _ := ch.support.BlockCutter().Ordered(msg)
-			if len(batches) == 0 && timer == nil {
-				timer = time.After(ch.support.SharedConfig().BatchTimeout())
-				continue
+			if _, ok := err.(*framingError); ok {
+				ch.logger.Errorf("[recv] Frames from HoneyBadgerBFT proxy out of sync, dropping the connection: %v\n", err)
+				return
 			}
-			for _, batch := range batches {
-				block := ch.support.CreateNextBlock(batch)
-				ch.support.WriteBlock(block, nil)
+			ch.logger.Errorf("[recv] Error while receiving block from HoneyBadgerBFT proxy: %v\n", err)
+			return
+		}
+
+		ch.state.blockReceivedAt(block.Header.Number)
+
+		ch.recvLock.Lock()
+		ok := ch.handleBlock(conn, block)
+		ch.recvLock.Unlock()
+		if !ok {
+			return
+		}
+
+		if ch.blockWindow > 0 {
+			if err := ch.sendCredit(conn, 1); err != nil {
+				ch.logger.Errorf("[recv] Error while granting blocks to HoneyBadgerBFT proxy: %v\n", err)
+				return
 			}
-			if len(batches) > 0 {
-				timer = nil
+		}
+	}
+}
+
+// resync forgets the blocks requested from the proxy over a connection which
+// ended, so that those not received yet are requested again over the next
+func (ch *chain) resync() {
+	ch.recvLock.Lock()
+	ch.pulledUpTo = ch.nextBlock
+	ch.recvLock.Unlock()
+}
+
+// handleBlock handles a block received over conn, and returns whether the
+// next ones should be received. Blocks are handed over to appendToChain
+// strictly in order, so that a block received from several replicas of the
+// proxy is only appended once; when a block arrives ahead of the expected
+// one, the missing range is pulled from the proxy over the same
+// connection. Blocks which are not intact or do not follow the last block
+// handed over are dropped.
+func (ch *chain) handleBlock(conn net.Conn, block *cb.Block) bool {
+	if perr := ch.validateBlock(block); perr != nil {
+		ch.reportProtocolError(perr)
+		return true
+	}
+
+	number := block.Header.Number
+	switch {
+	case number < ch.nextBlock:
+		ch.logger.Debugf("[recv] Ignoring block %d, already received", number)
+		return true
+	case number > ch.nextBlock:
+		ch.pendingBlocks[number] = block
+		start := ch.nextBlock
+		if ch.pulledUpTo > start {
+			start = ch.pulledUpTo
+		}
+		if start < number {
+			if err := ch.sendPullRequest(conn, start, number-start); err != nil {
+				ch.logger.Errorf("[recv] Error while pulling blocks from HoneyBadgerBFT proxy: %v\n", err)
+				return false
 			}
-		case <-timer:
-			//clear the timer
-			timer = nil
+		}
+		if number+1 > ch.pulledUpTo {
+			ch.pulledUpTo = number + 1
+		}
+		return true
+	}
 
-			batch := ch.support.BlockCutter().Cut()
-			if len(batch) == 0 {
-				logger.Warningf("Batch timer expired with no pending requests, this might indicate a bug")
-				continue
+	delivered, ok := ch.deliver(block)
+	if !ok {
+		return false
+	}
+
+	for delivered {
+		next, pending := ch.pendingBlocks[ch.nextBlock]
+		if !pending {
+			break
+		}
+		delete(ch.pendingBlocks, ch.nextBlock)
+		if delivered, ok = ch.deliver(next); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// deliver hands the next block over to appendToChain unless it does not
+// follow the last one, and returns whether it did. It also returns false if
+// the chain was halted instead.
+func (ch *chain) deliver(block *cb.Block) (delivered bool, ok bool) {
+	if perr := ch.validateChaining(block); perr != nil {
+		ch.reportProtocolError(perr)
+		// the block is expected anew, and pulled again along with the
+		// blocks following it when one of those is received
+		ch.pulledUpTo = ch.nextBlock
+		return false, true
+	}
+
+	select {
+	case ch.sendChan <- block:
+		ch.nextBlock++
+		ch.lastHash = block.Header.Hash()
+		ch.transactionsObserved(len(block.GetData().GetData()))
+		ch.latency.blockReceived(block.GetData().GetData(), time.Now())
+		ch.sizes.blockDelivered()
+		return true, true
+	case <-ch.exitChan:
+		return false, false
+	}
+}
+
+func (ch *chain) appendToChain() {
+	for {
+		select {
+		case block := <-ch.sendChan:
+			if err := ch.appendWithRetries(block); err != nil {
+				ch.appendFailed(block, err)
+				return
 			}
-			logger.Debugf("Batch timer expired, creating block")
-			block := ch.support.CreateNextBlock(batch)
-			ch.support.WriteBlock(block, nil)
 		case <-ch.exitChan:
-			logger.Debugf("Exiting")
+			ch.drain()
+			ch.logger.Debugf("Exiting")
+			return
+		}
+	}
+}
+
+// drain appends the blocks already received when the chain is halted, so
+// that the ledger does not miss them, for at most drainTimeout. It stops at
+// the first block which cannot be appended.
+func (ch *chain) drain() {
+	timeout := time.After(ch.drainTimeout)
+	for {
+		select {
+		case <-timeout:
+			ch.logger.Warningf("Halting before all the blocks received were appended")
+			return
+		default:
+		}
+
+		select {
+		case block := <-ch.sendChan:
+			if err := ch.appendBlock(block); err != nil {
+				ch.logger.Errorf("Could not append block %d while halting: %s", block.Header.Number, err)
+				return
+			}
+		default:
 			return
 		}
 	}
 }
+
+// appendBlock appends the block following the last one appended. A block
+// already appended is skipped, while a block further ahead is an error, the
+// blocks in between being missing. The config of a config block is
+// validated before it is written: the proxy orders config updates but does
+// not validate them, and an invalid one must halt the chain rather than
+// make WriteConfigBlock panic.
+func (ch *chain) appendBlock(block *cb.Block) error {
+	number := block.Header.Number
+	switch {
+	case number < ch.appendedHeight:
+		ch.logger.Warningf("Skipping block %d, already appended", number)
+		return nil
+	case number > ch.appendedHeight:
+		return fmt.Errorf("blocks %d to %d are missing", ch.appendedHeight, number-1)
+	}
+
+	// config blocks are applied to the channel as they are written
+	if utils.IsConfigBlock(block) {
+		env, err := utils.ExtractEnvelope(block, 0)
+		if err != nil {
+			return fmt.Errorf("config block %d carries no config: %s", number, err)
+		}
+		if _, _, err = ch.support.ProcessConfigMsg(env); err != nil {
+			return fmt.Errorf("config block %d carries an invalid config: %s", number, err)
+		}
+		ch.support.WriteConfigBlock(block, nil)
+		ch.appendedHeight++
+		ch.haltIfTerminated()
+		return nil
+	}
+	if err := ch.support.AppendBlock(block); err != nil {
+		return err
+	}
+	ch.appendedHeight++
+	return nil
+}
@@ -0,0 +1,2005 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package honeybadgerbft
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/common/metrics"
+	mockconfig "github.com/hyperledger/fabric/common/mocks/config"
+	localconfig "github.com/hyperledger/fabric/orderer/common/localconfig"
+	"github.com/hyperledger/fabric/orderer/consensus"
+	mockmultichannel "github.com/hyperledger/fabric/orderer/mocks/common/multichannel"
+	cb "github.com/hyperledger/fabric/protos/common"
+	ab "github.com/hyperledger/fabric/protos/orderer"
+	"github.com/hyperledger/fabric/protos/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// testSharedConfig is the config of the channels whose chains are created
+// by HandleChain
+var testSharedConfig = &mockconfig.Orderer{ConsensusTypeVal: consensusType, BatchSizeVal: &ab.BatchSize{AbsoluteMaxBytes: 1024 * 1024}}
+
+// newTestBlock returns a block carrying data and following previous, if any
+func newTestBlock(number uint64, previous *cb.Block, data ...[]byte) *cb.Block {
+	var previousHash []byte
+	if previous != nil {
+		previousHash = previous.Header.Hash()
+	}
+	block := cb.NewBlock(number, previousHash)
+	block.Data.Data = data
+	block.Header.DataHash = block.Data.Hash()
+	return block
+}
+
+// emptyTestBlock returns the block with the given number of a chain of
+// empty blocks
+func emptyTestBlock(number uint64) *cb.Block {
+	var previous *cb.Block
+	for i := uint64(0); i < number; i++ {
+		previous = newTestBlock(i, previous)
+	}
+	return newTestBlock(number, previous)
+}
+
+// writeBlock plays the proxy side of the receive connection, writing a
+// length-prefixed block to conn
+func writeBlock(t *testing.T, conn net.Conn, block *cb.Block) {
+	var length [8]byte
+	blockBytes := utils.MarshalOrPanic(block)
+	binary.BigEndian.PutUint64(length[:], uint64(len(blockBytes)))
+	_, err := conn.Write(append(length[:], blockBytes...))
+	assert.NoError(t, err)
+}
+
+// sendBlock writes the block with the given number of a chain of empty
+// blocks to conn
+func sendBlock(t *testing.T, conn net.Conn, number uint64) {
+	writeBlock(t, conn, emptyTestBlock(number))
+}
+
+// recvPullRequest plays the proxy side of the receive connection, reading a
+// pull request frame from conn and returning the requested range
+func recvPullRequest(t *testing.T, conn net.Conn) (uint64, uint64) {
+	var frame [8 + 1 + 16]byte
+	_, err := io.ReadFull(conn, frame[:])
+	assert.NoError(t, err)
+	assert.Equal(t, controlFrameFlag|17, binary.BigEndian.Uint64(frame[:8]))
+	assert.Equal(t, pullFrame, frame[8])
+	return binary.BigEndian.Uint64(frame[9:17]), binary.BigEndian.Uint64(frame[17:])
+}
+
+// recvCredit plays the proxy side of the receive connection, reading a
+// credit frame from conn and returning the number of blocks granted
+func recvCredit(t *testing.T, conn net.Conn) uint64 {
+	var frame [8 + 1 + 8]byte
+	_, err := io.ReadFull(conn, frame[:])
+	assert.NoError(t, err)
+	assert.Equal(t, controlFrameFlag|9, binary.BigEndian.Uint64(frame[:8]))
+	assert.Equal(t, creditFrame, frame[8])
+	return binary.BigEndian.Uint64(frame[9:])
+}
+
+func expectBlock(t *testing.T, support *mockmultichannel.ConsenterSupport, number uint64) {
+	select {
+	case block := <-support.Blocks:
+		assert.Equal(t, number, block.Header.Number)
+	case <-time.After(time.Second):
+		t.Fatalf("Expected block %d to be appended", number)
+	}
+}
+
+func TestPullMissingBlocks(t *testing.T) {
+	support := &mockmultichannel.ConsenterSupport{
+		Blocks:    make(chan *cb.Block),
+		HeightVal: 1,
+	}
+	ch := newChain(support, localconfig.HoneyBadgerBFT{}, nil, newTestThroughputMeter())
+	go ch.appendToChain()
+	defer ch.Halt()
+
+	proxy, conn := net.Pipe()
+	defer proxy.Close()
+	done := make(chan struct{})
+	go func() {
+		ch.recvBlocks(conn)
+		close(done)
+	}()
+
+	sendBlock(t, proxy, 1)
+	expectBlock(t, support, 1)
+
+	// block 2 is lost, so receiving block 3 should trigger a pull for it
+	sendBlock(t, proxy, 3)
+	start, count := recvPullRequest(t, proxy)
+	assert.Equal(t, uint64(2), start)
+	assert.Equal(t, uint64(1), count)
+
+	sendBlock(t, proxy, 2)
+	expectBlock(t, support, 2)
+	expectBlock(t, support, 3)
+
+	// a block resent by the proxy is not appended twice
+	sendBlock(t, proxy, 3)
+	sendBlock(t, proxy, 4)
+	expectBlock(t, support, 4)
+
+	proxy.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected recvBlocks to return once the proxy closed the connection")
+	}
+}
+
+func TestThroughputHistory(t *testing.T) {
+	meter := newThroughputMeter(2, 0, 3, nil)
+	assert.Empty(t, meter.history())
+
+	// envelopes are ordered at 0, 1, 3, 6, 10, ... seconds, so the
+	// intervals closed by every other envelope get longer and longer
+	start := time.Unix(1000, 0)
+	orderAt := func(i int) {
+		meter.envelopeOrdered(start.Add(time.Duration(i*(i+1)/2) * time.Second))
+	}
+	for i := 0; i < 4; i++ {
+		orderAt(i)
+	}
+
+	history := meter.history()
+	if assert.Len(t, history, 2) {
+		assert.Equal(t, ThroughputSample{Value: 2, Timestamp: start.Add(1 * time.Second)}, history[0])
+		assert.Equal(t, ThroughputSample{Value: 0.4, Timestamp: start.Add(6 * time.Second)}, history[1])
+	}
+
+	for i := 4; i < 9; i++ {
+		orderAt(i)
+	}
+
+	// 4 samples were taken, only the 3 most recent are retained, oldest first
+	history = meter.history()
+	if assert.Len(t, history, 3) {
+		assert.Equal(t, start.Add(6*time.Second), history[0].Timestamp)
+		assert.Equal(t, start.Add(15*time.Second), history[1].Timestamp)
+		assert.Equal(t, ThroughputSample{Value: 2.0 / 13, Timestamp: start.Add(28 * time.Second)}, history[2])
+	}
+}
+
+func TestPeriodicThroughput(t *testing.T) {
+	meter := newThroughputMeter(1, 20*time.Millisecond, 10, nil)
+	exit := make(chan struct{})
+	defer close(exit)
+	go meter.run(exit)
+
+	// envelopes do not trigger samples of their own
+	for i := 0; i < 5; i++ {
+		meter.envelopeOrdered(time.Now())
+	}
+
+	// samples are taken every period, even without envelopes
+	deadline := time.After(5 * time.Second)
+	for len(meter.history()) < 3 {
+		select {
+		case <-deadline:
+			t.Fatal("Expected throughput to be sampled periodically")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	history := meter.history()
+	assert.True(t, history[0].Value > 0, "the envelopes ordered should be measured")
+	assert.Zero(t, history[len(history)-1].Value, "no envelope was ordered since")
+}
+
+func TestSharedFrameBudget(t *testing.T) {
+	blockBytes := utils.MarshalOrPanic(emptyTestBlock(1))
+	// the budget fits a single frame at a time
+	budget := newFrameBudget(int64(len(blockBytes)))
+
+	newReceivingChain := func() (*mockmultichannel.ConsenterSupport, net.Conn, *chain) {
+		support := &mockmultichannel.ConsenterSupport{
+			Blocks:    make(chan *cb.Block),
+			HeightVal: 1,
+		}
+		ch := newChain(support, localconfig.HoneyBadgerBFT{}, budget, newTestThroughputMeter())
+		go ch.appendToChain()
+		proxy, conn := net.Pipe()
+		go ch.recvBlocks(conn)
+		return support, proxy, ch
+	}
+	supportA, proxyA, chainA := newReceivingChain()
+	defer chainA.Halt()
+	defer proxyA.Close()
+	supportB, proxyB, chainB := newReceivingChain()
+	defer chainB.Halt()
+	defer proxyB.Close()
+
+	// chain A is in the middle of receiving a frame, and holds the budget
+	var length [8]byte
+	binary.BigEndian.PutUint64(length[:], uint64(len(blockBytes)))
+	_, err := proxyA.Write(length[:])
+	assert.NoError(t, err)
+	_, err = proxyA.Write(blockBytes[:1])
+	assert.NoError(t, err)
+
+	// so chain B cannot receive its own until chain A is done with it
+	go sendBlock(t, proxyB, 1)
+	select {
+	case <-supportB.Blocks:
+		t.Fatal("Expected chain B to wait for budget")
+	case <-time.After(100 * time.Millisecond):
+	}
+	budget.lock.Lock()
+	assert.Zero(t, budget.available)
+	budget.lock.Unlock()
+
+	_, err = proxyA.Write(blockBytes[1:])
+	assert.NoError(t, err)
+	expectBlock(t, supportA, 1)
+	expectBlock(t, supportB, 1)
+
+	budget.lock.Lock()
+	assert.Equal(t, budget.capacity, budget.available)
+	budget.lock.Unlock()
+}
+
+func TestRejectWrongChannelBlock(t *testing.T) {
+	support := &mockmultichannel.ConsenterSupport{
+		Blocks:     make(chan *cb.Block),
+		HeightVal:  1,
+		ChainIDVal: "mychannel",
+	}
+	ch := newChain(support, localconfig.HoneyBadgerBFT{}, nil, newTestThroughputMeter())
+	go ch.appendToChain()
+	defer ch.Halt()
+
+	proxy, conn := net.Pipe()
+	defer proxy.Close()
+	go ch.recvBlocks(conn)
+
+	sendChannelBlock := func(number uint64, chainID string) {
+		env := &cb.Envelope{Payload: utils.MarshalOrPanic(&cb.Payload{
+			Header: utils.MakePayloadHeader(utils.MakeChannelHeader(cb.HeaderType_MESSAGE, 0, chainID, 0), &cb.SignatureHeader{}),
+		})}
+		writeBlock(t, proxy, newTestBlock(number, nil, utils.MarshalOrPanic(env)))
+	}
+
+	sendChannelBlock(1, "otherchannel")
+	select {
+	case perr := <-ch.ProtocolErrors():
+		assert.Equal(t, uint64(1), perr.BlockNumber)
+		assert.Contains(t, perr.Error(), "block belongs to channel otherchannel instead of mychannel")
+	case <-time.After(time.Second):
+		t.Fatal("Expected the wrong channel block to be reported")
+	}
+
+	// the rejected block is not appended, the one of the chain's channel is
+	sendChannelBlock(1, "mychannel")
+	expectBlock(t, support, 1)
+	select {
+	case perr := <-ch.ProtocolErrors():
+		t.Fatalf("Unexpected protocol error: %s", perr)
+	default:
+	}
+}
+
+// configBlockSupport records the blocks written as config blocks apart from
+// the ones appended as is
+type configBlockSupport struct {
+	*mockmultichannel.ConsenterSupport
+	configBlocks chan *cb.Block
+}
+
+func (cs *configBlockSupport) WriteConfigBlock(block *cb.Block, encodedMetadataValue []byte) {
+	cs.configBlocks <- block
+}
+
+func TestConfigure(t *testing.T) {
+	makeEnv := func(typ cb.HeaderType) *cb.Envelope {
+		return &cb.Envelope{Payload: utils.MarshalOrPanic(&cb.Payload{
+			Header: utils.MakePayloadHeader(utils.MakeChannelHeader(typ, 0, "mychannel", 0), &cb.SignatureHeader{}),
+		})}
+	}
+	configEnv := makeEnv(cb.HeaderType_CONFIG)
+	revalidatedEnv := makeEnv(cb.HeaderType_CONFIG)
+	revalidatedEnv.Signature = []byte("revalidated")
+
+	support := &configBlockSupport{
+		ConsenterSupport: &mockmultichannel.ConsenterSupport{
+			Blocks:              make(chan *cb.Block),
+			HeightVal:           1,
+			ChainIDVal:          "mychannel",
+			SequenceVal:         1,
+			ProcessConfigMsgVal: revalidatedEnv,
+			SharedConfigVal:     testSharedConfig,
+		},
+		configBlocks: make(chan *cb.Block),
+	}
+	ch := newChain(support, localconfig.HoneyBadgerBFT{}, nil, newTestThroughputMeter())
+	go ch.appendToChain()
+	defer ch.Halt()
+
+	sendProxy, sendConn := net.Pipe()
+	defer sendProxy.Close()
+	ch.sendConnection = sendConn
+
+	// recvConfigFrame plays the proxy side of the send connection
+	recvConfigFrame := func() *cb.Envelope {
+		var length [8]byte
+		_, err := io.ReadFull(sendProxy, length[:])
+		assert.NoError(t, err)
+		size := binary.BigEndian.Uint64(length[:])
+		assert.NotZero(t, size&controlFrameFlag)
+		frame := make([]byte, size&^controlFrameFlag)
+		_, err = io.ReadFull(sendProxy, frame)
+		assert.NoError(t, err)
+		assert.Equal(t, configFrame, frame[0])
+		env, err := utils.UnmarshalEnvelope(frame[1:])
+		assert.NoError(t, err)
+		return env
+	}
+
+	// a config update validated against the current config is sent as is
+	errs := make(chan error, 1)
+	go func() { errs <- ch.Configure(configEnv, 1) }()
+	assert.Equal(t, configEnv.Payload, recvConfigFrame().Payload)
+	assert.NoError(t, <-errs)
+
+	// a stale one is revalidated first
+	go func() { errs <- ch.Configure(configEnv, 0) }()
+	assert.Equal(t, revalidatedEnv.Signature, recvConfigFrame().Signature)
+	assert.NoError(t, <-errs)
+
+	// and is not sent if it became invalid
+	support.ProcessConfigMsgErr = fmt.Errorf("invalid config")
+	assert.EqualError(t, ch.Configure(configEnv, 0), "invalid config")
+
+	// the config block ordered by the proxy is validated and written as a
+	// config block, the following blocks are appended as is
+	support.ProcessConfigMsgErr = nil
+	recvProxy, recvConn := net.Pipe()
+	defer recvProxy.Close()
+	go ch.recvBlocks(recvConn)
+
+	var last *cb.Block
+	sendEnvBlock := func(number uint64, env *cb.Envelope) {
+		last = newTestBlock(number, last, utils.MarshalOrPanic(env))
+		writeBlock(t, recvProxy, last)
+	}
+
+	sendEnvBlock(1, configEnv)
+	select {
+	case block := <-support.configBlocks:
+		assert.Equal(t, uint64(1), block.Header.Number)
+	case <-time.After(time.Second):
+		t.Fatal("Expected config block 1 to be written")
+	}
+	sendEnvBlock(2, makeEnv(cb.HeaderType_MESSAGE))
+	expectBlock(t, support.ConsenterSupport, 2)
+}
+
+func TestInvalidConfigBlockHaltsChain(t *testing.T) {
+	configEnv := &cb.Envelope{Payload: utils.MarshalOrPanic(&cb.Payload{
+		Header: utils.MakePayloadHeader(utils.MakeChannelHeader(cb.HeaderType_CONFIG, 0, "mychannel", 0), &cb.SignatureHeader{}),
+	})}
+	support := &configBlockSupport{
+		ConsenterSupport: &mockmultichannel.ConsenterSupport{
+			Blocks:              make(chan *cb.Block),
+			HeightVal:           1,
+			ChainIDVal:          "mychannel",
+			ProcessConfigMsgErr: fmt.Errorf("invalid config"),
+			SharedConfigVal:     testSharedConfig,
+		},
+		configBlocks: make(chan *cb.Block, 1),
+	}
+	ch := newChain(support, localconfig.HoneyBadgerBFT{}, nil, newTestThroughputMeter())
+	go ch.appendToChain()
+	defer ch.Halt()
+
+	recvProxy, recvConn := net.Pipe()
+	defer recvProxy.Close()
+	go ch.recvBlocks(recvConn)
+	writeBlock(t, recvProxy, newTestBlock(1, nil, utils.MarshalOrPanic(configEnv)))
+
+	// the invalid config is not written, the chain fails instead
+	select {
+	case <-ch.Errored():
+		assert.EqualError(t, ch.Err(), "could not append block 1: config block 1 carries an invalid config: invalid config")
+	case <-time.After(time.Second):
+		t.Fatal("Expected the chain to fail on the invalid config block")
+	}
+	assert.Empty(t, support.configBlocks)
+}
+
+func TestConfigureHaltsTerminatedChain(t *testing.T) {
+	support := &mockmultichannel.ConsenterSupport{
+		Blocks:          make(chan *cb.Block),
+		ChainIDVal:      "mychannel",
+		SharedConfigVal: &mockconfig.Orderer{ConsensusTypeVal: "solo"},
+	}
+	ch := newChain(support, localconfig.HoneyBadgerBFT{}, nil, newTestThroughputMeter())
+	sendProxy, sendConn := net.Pipe()
+	defer sendProxy.Close()
+	ch.sendConnection = sendConn
+
+	env := &cb.Envelope{Payload: []byte("config")}
+	assert.Equal(t, errTerminated, ch.Configure(env, 0))
+	select {
+	case <-ch.Errored():
+	default:
+		t.Fatal("Expected the terminated chain to be halted")
+	}
+	assert.NoError(t, ch.Err())
+
+	// the send connection to the proxy is closed
+	_, err := sendProxy.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	// and configuring it again is harmless
+	assert.Equal(t, errTerminated, ch.Configure(env, 0))
+}
+
+func TestHaltStopsConnLoop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "honeybadgerbft")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	support := &mockmultichannel.ConsenterSupport{
+		Blocks:    make(chan *cb.Block),
+		HeightVal: 1,
+	}
+	ch := newChain(support, localconfig.HoneyBadgerBFT{}, nil, newTestThroughputMeter())
+	go ch.appendToChain()
+
+	listener, err := net.Listen("unix", filepath.Join(dir, "receive.sock"))
+	assert.NoError(t, err)
+	ch.receiveConnections = []net.Listener{listener}
+	sendProxy, sendConn := net.Pipe()
+	defer sendProxy.Close()
+	ch.sendConnection = sendConn
+
+	done := make(chan struct{})
+	go func() {
+		ch.connLoop(0)
+		close(done)
+	}()
+
+	proxy, err := net.Dial("unix", listener.Addr().String())
+	assert.NoError(t, err)
+	defer proxy.Close()
+	sendBlock(t, proxy, 1)
+	expectBlock(t, support, 1)
+
+	ch.Halt()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected connLoop to return once the chain is halted")
+	}
+
+	// a halted chain is errored without failure
+	select {
+	case <-ch.Errored():
+	default:
+		t.Fatal("Expected the halted chain to be errored")
+	}
+	assert.NoError(t, ch.Err())
+
+	// both connections to the proxy are closed
+	_, err = proxy.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	_, err = sendConn.Write([]byte{0})
+	assert.Error(t, err)
+
+	// halting again is harmless
+	ch.Halt()
+}
+
+func TestReconnectSendProxy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "honeybadgerbft")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := localconfig.HoneyBadgerBFT{
+		SendSocketPath:       filepath.Join(dir, "send.sock"),
+		ReconnectInterval:    time.Millisecond,
+		ReconnectMaxInterval: 4 * time.Millisecond,
+		ReconnectMaxRetries:  3,
+	}
+	ch := newChain(&mockmultichannel.ConsenterSupport{}, config, nil, newTestThroughputMeter())
+	defer ch.Halt()
+
+	// the proxy restarted: the connection is broken, a new proxy listens
+	deadConnection := func() net.Conn {
+		deadProxy, deadConn := net.Pipe()
+		deadProxy.Close()
+		return deadConn
+	}
+	ch.sendConnection = deadConnection()
+	listener, err := net.Listen("unix", config.SendSocketPath)
+	assert.NoError(t, err)
+
+	// the envelope is sent over a new connection
+	env := &cb.Envelope{Payload: []byte("payload")}
+	errs := make(chan error, 1)
+	go func() { errs <- ch.Order(env, 0) }()
+
+	proxy, err := listener.Accept()
+	assert.NoError(t, err)
+	defer proxy.Close()
+	var length [8]byte
+	_, err = io.ReadFull(proxy, length[:])
+	assert.NoError(t, err)
+	envBytes := make([]byte, binary.BigEndian.Uint64(length[:]))
+	_, err = io.ReadFull(proxy, envBytes)
+	assert.NoError(t, err)
+	assert.Equal(t, utils.MarshalOrPanic(env), envBytes)
+	assert.NoError(t, <-errs)
+
+	// the proxy went away for good: nobody listens anymore
+	listener.Close()
+	ch.sendConnection = deadConnection()
+	err = ch.Order(env, 0)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "could not reconnect to send proxy")
+
+	// the chain has errored, and rejects the envelopes from now on
+	select {
+	case <-ch.Errored():
+	default:
+		t.Fatal("Expected the chain to have errored")
+	}
+	assert.Contains(t, ch.Err().Error(), "could not reconnect to send proxy")
+	err = ch.Order(env, 0)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "chain errored")
+
+	// halting the errored chain keeps its failure
+	ch.Halt()
+	assert.Contains(t, ch.Err().Error(), "could not reconnect to send proxy")
+}
+
+func TestReconnectPolicy(t *testing.T) {
+	policy := reconnectPolicy{interval: time.Millisecond, maxInterval: 2 * time.Millisecond, maxRetries: 4}
+
+	attempts := 0
+	err := policy.retry("proxy", nil, func() error {
+		attempts++
+		return fmt.Errorf("attempt %d failed", attempts)
+	})
+	assert.EqualError(t, err, "attempt 4 failed")
+	assert.Equal(t, 4, attempts)
+
+	attempts = 0
+	err = policy.retry("proxy", nil, func() error {
+		attempts++
+		if attempts < 2 {
+			return fmt.Errorf("attempt %d failed", attempts)
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+
+	// no attempt is made once exiting
+	exit := make(chan struct{})
+	close(exit)
+	policy.interval = time.Hour
+	err = policy.retry("proxy", exit, func() error {
+		t.Fatal("Unexpected attempt to reconnect")
+		return nil
+	})
+	assert.EqualError(t, err, "exiting")
+
+	// without a bound, the attempts go on until exiting, and without an
+	// interval, they are paced all the same
+	policy = reconnectPolicy{}
+	exit = make(chan struct{})
+	attempts = 0
+	start := time.Now()
+	err = policy.retry("proxy", exit, func() error {
+		attempts++
+		if attempts == 5 {
+			close(exit)
+		}
+		return fmt.Errorf("attempt %d failed", attempts)
+	})
+	assert.EqualError(t, err, "exiting")
+	assert.Equal(t, 5, attempts)
+	assert.True(t, time.Since(start) >= 5*minReconnectInterval, "Expected the attempts to be paced")
+}
+
+func newTestThroughputMeter() *throughputMeter {
+	return newThroughputMeter(defaultMeasurementInterval, 0, defaultThroughputHistorySize, nil)
+}
+
+// fakeScope records the metrics reported by the chains
+type fakeScope struct {
+	metrics.Scope
+	tags       map[string]string
+	counters   map[string]int64
+	gauges     map[string]float64
+	histograms map[string][]time.Duration
+}
+
+func (s *fakeScope) Counter(name string) metrics.Counter     { return fakeCounter{s, name} }
+func (s *fakeScope) Gauge(name string) metrics.Gauge         { return fakeGauge{s, name} }
+func (s *fakeScope) Histogram(name string) metrics.Histogram { return fakeHistogram{s, name} }
+func (s *fakeScope) Tagged(tags map[string]string) metrics.Scope {
+	s.tags = tags
+	return s
+}
+
+type fakeCounter struct {
+	scope *fakeScope
+	name  string
+}
+
+func (c fakeCounter) Inc(delta int64) { c.scope.counters[c.name] += delta }
+
+type fakeGauge struct {
+	scope *fakeScope
+	name  string
+}
+
+func (g fakeGauge) Update(value float64) { g.scope.gauges[g.name] = value }
+
+type fakeHistogram struct {
+	scope *fakeScope
+	name  string
+}
+
+func (h fakeHistogram) RecordDuration(value time.Duration) {
+	h.scope.histograms[h.name] = append(h.scope.histograms[h.name], value)
+}
+
+func TestThroughputMetrics(t *testing.T) {
+	scope := &fakeScope{counters: map[string]int64{}, gauges: map[string]float64{}}
+	consenter := New(localconfig.HoneyBadgerBFT{MeasurementInterval: 2}, scope)
+	c, err := consenter.HandleChain(&mockmultichannel.ConsenterSupport{ChainIDVal: "mychannel", SharedConfigVal: testSharedConfig}, nil)
+	assert.NoError(t, err)
+	meter := c.(*chain).throughput
+	assert.Equal(t, map[string]string{"channel": "mychannel"}, scope.tags)
+
+	start := time.Unix(1000, 0)
+	meter.envelopeOrdered(start)
+	assert.Equal(t, int64(1), scope.counters["envelopes_ordered"])
+	assert.Empty(t, scope.gauges)
+
+	meter.envelopeOrdered(start.Add(4 * time.Second))
+	assert.Equal(t, int64(2), scope.counters["envelopes_ordered"])
+	assert.Equal(t, 0.5, scope.gauges["throughput"])
+
+	// without metrics, the chain only keeps its own history
+	c, err = New(localconfig.HoneyBadgerBFT{}, nil).HandleChain(&mockmultichannel.ConsenterSupport{SharedConfigVal: testSharedConfig}, nil)
+	assert.NoError(t, err)
+	meter = c.(*chain).throughput
+	assert.Equal(t, int64(defaultMeasurementInterval), meter.interval)
+	meter.envelopeOrdered(start)
+	assert.Empty(t, meter.history())
+}
+
+func TestCommitLatency(t *testing.T) {
+	scope := &fakeScope{histograms: map[string][]time.Duration{}}
+	c, err := New(localconfig.HoneyBadgerBFT{LatencyTrackingSize: 2}, scope).
+		HandleChain(&mockmultichannel.ConsenterSupport{ChainIDVal: "mychannel", SharedConfigVal: testSharedConfig}, nil)
+	assert.NoError(t, err)
+	latency := c.(*chain).latency
+
+	start := time.Unix(1000, 0)
+	latency.envelopeSent([]byte("first"), start)
+	latency.envelopeSent([]byte("second"), start.Add(time.Second))
+	// sent again, still measured from its first sending
+	latency.envelopeSent([]byte("first"), start.Add(2*time.Second))
+	latency.blockReceived([][]byte{[]byte("second"), []byte("unknown")}, start.Add(3*time.Second))
+	assert.Equal(t, []time.Duration{2 * time.Second}, scope.histograms["commit_latency"])
+
+	// beyond the size, the oldest envelope is no longer waited for
+	latency.envelopeSent([]byte("third"), start.Add(4*time.Second))
+	latency.envelopeSent([]byte("fourth"), start.Add(5*time.Second))
+	latency.blockReceived([][]byte{[]byte("first"), []byte("third"), []byte("fourth")}, start.Add(6*time.Second))
+	assert.Equal(t, []time.Duration{2 * time.Second, 2 * time.Second, time.Second}, scope.histograms["commit_latency"])
+	assert.Empty(t, latency.pending)
+	assert.Equal(t, 0, latency.sent.Len())
+
+	// a block received again does not record the latency twice
+	latency.blockReceived([][]byte{[]byte("fourth")}, start.Add(7*time.Second))
+	assert.Len(t, scope.histograms["commit_latency"], 3)
+
+	// without metrics, the envelopes are not tracked
+	c, err = New(localconfig.HoneyBadgerBFT{}, nil).HandleChain(&mockmultichannel.ConsenterSupport{SharedConfigVal: testSharedConfig}, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, c.(*chain).latency)
+	c.(*chain).latency.envelopeSent([]byte("first"), start)
+}
+
+func TestEnvelopeSizes(t *testing.T) {
+	scope := &fakeScope{counters: map[string]int64{}, gauges: map[string]float64{}, histograms: map[string][]time.Duration{}}
+	c, err := New(localconfig.HoneyBadgerBFT{}, scope).
+		HandleChain(&mockmultichannel.ConsenterSupport{HeightVal: 1, SharedConfigVal: testSharedConfig}, nil)
+	assert.NoError(t, err)
+	ch := c.(*chain)
+	defer ch.Halt()
+
+	proxy, conn := net.Pipe()
+	defer proxy.Close()
+	go io.Copy(ioutil.Discard, proxy)
+	ch.sendConnection = conn
+	small := &cb.Envelope{Payload: []byte("p")}
+	large := &cb.Envelope{Payload: bytes.Repeat([]byte("payload"), 100)}
+	assert.NoError(t, ch.Order(small, 0))
+	assert.NoError(t, ch.Order(large, 0))
+	sent := len(utils.MarshalOrPanic(small)) + len(utils.MarshalOrPanic(large))
+	envelopes, size := ch.SentSinceLastBlock()
+	assert.Equal(t, 2, envelopes)
+	assert.Equal(t, int64(sent), size)
+
+	// a block reports the average size and starts accumulating anew
+	block1 := newTestBlock(1, nil, []byte("tx"))
+	delivered, ok := ch.deliver(block1)
+	assert.True(t, delivered)
+	assert.True(t, ok)
+	assert.Equal(t, float64(sent)/2, scope.gauges["average_envelope_size"])
+	envelopes, size = ch.SentSinceLastBlock()
+	assert.Equal(t, 0, envelopes)
+	assert.Equal(t, int64(0), size)
+
+	// blocks without envelopes sent in between leave the average as is
+	delivered, ok = ch.deliver(newTestBlock(2, block1))
+	assert.True(t, delivered)
+	assert.True(t, ok)
+	assert.Equal(t, float64(sent)/2, scope.gauges["average_envelope_size"])
+}
+
+func TestChainsKeepTheirConsenterConfig(t *testing.T) {
+	first, err := New(localconfig.HoneyBadgerBFT{SendSocketPath: "/tmp/first-send", ReceiveSocketPath: "/tmp/first-receive"}, nil).
+		HandleChain(&mockmultichannel.ConsenterSupport{SharedConfigVal: testSharedConfig}, nil)
+	assert.NoError(t, err)
+	second, err := New(localconfig.HoneyBadgerBFT{SendSocketPath: "/tmp/second-send", ReceiveSocketPath: "/tmp/second-receive"}, nil).
+		HandleChain(&mockmultichannel.ConsenterSupport{SharedConfigVal: testSharedConfig}, nil)
+	assert.NoError(t, err)
+
+	// creating the second consenter does not change the paths of the
+	// chains of the first one
+	assert.Equal(t, "/tmp/first-send", first.(*chain).sendSocketPath)
+	assert.Equal(t, "/tmp/first-receive", first.(*chain).receiveSocketPath)
+	assert.Equal(t, "/tmp/second-send", second.(*chain).sendSocketPath)
+	assert.Equal(t, "/tmp/second-receive", second.(*chain).receiveSocketPath)
+	assert.True(t, first.(*chain).throughput != second.(*chain).throughput)
+}
+
+// newTestCA returns a CA certificate along with a function issuing
+// certificates signed by it, valid for both TLS clients and servers
+func newTestCA(t *testing.T) (*x509.Certificate, func(dir string, name string) (string, string)) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	assert.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	assert.NoError(t, err)
+
+	serial := int64(1)
+	issue := func(dir string, name string) (string, string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.NoError(t, err)
+		serial++
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		assert.NoError(t, err)
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		assert.NoError(t, err)
+
+		certPath := filepath.Join(dir, name+"-cert.pem")
+		keyPath := filepath.Join(dir, name+"-key.pem")
+		assert.NoError(t, ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+		assert.NoError(t, ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+		return certPath, keyPath
+	}
+	return ca, issue
+}
+
+func TestTLSProxyConnections(t *testing.T) {
+	dir, err := ioutil.TempDir("", "honeybadgerbft")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca, issue := newTestCA(t)
+	caPath := filepath.Join(dir, "ca-cert.pem")
+	assert.NoError(t, ioutil.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0600))
+	ordererCert, ordererKey := issue(dir, "orderer")
+	proxyCert, proxyKey := issue(dir, "proxy")
+
+	// the proxy trusts the same CA, and authenticates the orderer too
+	proxyKeyPair, err := tls.LoadX509KeyPair(proxyCert, proxyKey)
+	assert.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	proxyTLS := &tls.Config{
+		Certificates: []tls.Certificate{proxyKeyPair},
+		RootCAs:      roots,
+		ClientCAs:    roots,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	sendProxy, err := tls.Listen("tcp", "127.0.0.1:0", proxyTLS)
+	assert.NoError(t, err)
+	defer sendProxy.Close()
+
+	c, err := New(localconfig.HoneyBadgerBFT{
+		SendAddress:    sendProxy.Addr().String(),
+		ReceiveAddress: "127.0.0.1:0",
+		TLS: localconfig.TLS{
+			Enabled:     true,
+			Certificate: ordererCert,
+			PrivateKey:  ordererKey,
+			RootCAs:     []string{caPath},
+		},
+	}, nil).HandleChain(&mockmultichannel.ConsenterSupport{SharedConfigVal: testSharedConfig}, nil)
+	assert.NoError(t, err)
+	ch := c.(*chain)
+
+	// the orderer dials the send proxy, each verifying the other
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := sendProxy.Accept()
+		assert.NoError(t, err)
+		assert.NoError(t, conn.(*tls.Conn).Handshake())
+		accepted <- conn
+	}()
+	conn, err := ch.dialSend()
+	assert.NoError(t, err)
+	defer conn.Close()
+	proxyConn := <-accepted
+	defer proxyConn.Close()
+	peers := proxyConn.(*tls.Conn).ConnectionState().PeerCertificates
+	if assert.NotEmpty(t, peers) {
+		assert.Equal(t, "orderer", peers[0].Subject.CommonName)
+	}
+
+	// and the receive proxy connects to the orderer the same way
+	listener, err := ch.listenReceive(0)
+	assert.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	recvConn, err := tls.Dial("tcp", listener.Addr().String(), proxyTLS)
+	assert.NoError(t, err)
+	assert.Equal(t, "orderer", recvConn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+	recvConn.Close()
+
+	// a proxy whose certificate is not issued by the CA is rejected
+	_, rogueIssue := newTestCA(t)
+	rogueCert, rogueKey := rogueIssue(dir, "rogue")
+	rogueKeyPair, err := tls.LoadX509KeyPair(rogueCert, rogueKey)
+	assert.NoError(t, err)
+	rogueProxy, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{rogueKeyPair}})
+	assert.NoError(t, err)
+	defer rogueProxy.Close()
+	go func() {
+		conn, err := rogueProxy.Accept()
+		if err == nil {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	ch.sendAddress = rogueProxy.Addr().String()
+	_, err = ch.dialSend()
+	assert.Error(t, err)
+}
+
+func TestRejectTamperedBlocks(t *testing.T) {
+	support := &mockmultichannel.ConsenterSupport{
+		Blocks:     make(chan *cb.Block),
+		HeightVal:  1,
+		ChainIDVal: "mychannel",
+	}
+	ch := newChain(support, localconfig.HoneyBadgerBFT{}, nil, newTestThroughputMeter())
+	go ch.appendToChain()
+	defer ch.Halt()
+
+	proxy, conn := net.Pipe()
+	defer proxy.Close()
+	go ch.recvBlocks(conn)
+
+	expectProtocolError := func(number uint64, reason string) {
+		select {
+		case perr := <-ch.ProtocolErrors():
+			assert.Equal(t, number, perr.BlockNumber)
+			assert.Contains(t, perr.Error(), reason)
+		case <-time.After(time.Second):
+			t.Fatalf("Expected block %d to be rejected", number)
+		}
+	}
+
+	tx := func(txID string) []byte {
+		return utils.MarshalOrPanic(&cb.Envelope{Payload: utils.MarshalOrPanic(&cb.Payload{
+			Header: utils.MakePayloadHeader(utils.MakeChannelHeader(cb.HeaderType_MESSAGE, 0, "mychannel", 0), &cb.SignatureHeader{}),
+			Data:   []byte(txID),
+		})})
+	}
+
+	block1 := newTestBlock(1, nil, tx("tx1"))
+	writeBlock(t, proxy, block1)
+	expectBlock(t, support, 1)
+
+	// the data of the block was altered
+	tampered := newTestBlock(2, block1, tx("tx2"))
+	tampered.Data.Data[0] = tx("forged")
+	writeBlock(t, proxy, tampered)
+	expectProtocolError(2, "data hash does not match the data of the block")
+
+	// the block does not follow block 1
+	writeBlock(t, proxy, newTestBlock(2, newTestBlock(1, nil, tx("other")), tx("tx2")))
+	expectProtocolError(2, "previous hash does not match the hash of block 1")
+
+	// so the block is pulled again when the next one comes
+	block2 := newTestBlock(2, block1, tx("tx2"))
+	writeBlock(t, proxy, newTestBlock(3, block2, tx("tx3")))
+	start, count := recvPullRequest(t, proxy)
+	assert.Equal(t, uint64(2), start)
+	assert.Equal(t, uint64(1), count)
+
+	writeBlock(t, proxy, block2)
+	expectBlock(t, support, 2)
+	expectBlock(t, support, 3)
+	select {
+	case perr := <-ch.ProtocolErrors():
+		t.Fatalf("Unexpected protocol error: %s", perr)
+	default:
+	}
+}
+
+// tipSupport is a ConsenterSupport whose ledger ends with the block of hash
+// lastHash
+type tipSupport struct {
+	*mockmultichannel.ConsenterSupport
+	lastHash []byte
+}
+
+func (ts *tipSupport) CreateNextBlock(messages []*cb.Envelope) *cb.Block {
+	return cb.NewBlock(ts.HeightVal, ts.lastHash)
+}
+
+func TestFirstBlockExtendsLedger(t *testing.T) {
+	support := &tipSupport{
+		ConsenterSupport: &mockmultichannel.ConsenterSupport{
+			Blocks:     make(chan *cb.Block),
+			HeightVal:  1,
+			ChainIDVal: "mychannel",
+		},
+		lastHash: emptyTestBlock(0).Header.Hash(),
+	}
+	ch := newChain(support, localconfig.HoneyBadgerBFT{}, nil, newTestThroughputMeter())
+	go ch.appendToChain()
+	defer ch.Halt()
+
+	proxy, conn := net.Pipe()
+	defer proxy.Close()
+	go ch.recvBlocks(conn)
+
+	// the first block received does not follow the last block of the ledger
+	writeBlock(t, proxy, newTestBlock(1, newTestBlock(0, nil, []byte("other"))))
+	select {
+	case perr := <-ch.ProtocolErrors():
+		assert.Equal(t, uint64(1), perr.BlockNumber)
+		assert.Contains(t, perr.Error(), "previous hash does not match the hash of block 0")
+	case <-time.After(time.Second):
+		t.Fatal("Expected block 1 to be rejected")
+	}
+
+	writeBlock(t, proxy, emptyTestBlock(1))
+	expectBlock(t, support.ConsenterSupport, 1)
+}
+
+// failingSupport fails to append the block numbered failAt, and those
+// following it
+type failingSupport struct {
+	*mockmultichannel.ConsenterSupport
+	failAt uint64
+}
+
+func (fs *failingSupport) AppendBlock(block *cb.Block) error {
+	if block.Header.Number >= fs.failAt {
+		return fmt.Errorf("ledger unavailable")
+	}
+	return fs.ConsenterSupport.AppendBlock(block)
+}
+
+func TestDrainOnHalt(t *testing.T) {
+	newHaltedChain := func(support consensus.ConsenterSupport) *chain {
+		ch := newChain(support, localconfig.HoneyBadgerBFT{}, nil, newTestThroughputMeter())
+		for i := uint64(1); i <= 3; i++ {
+			ch.sendChan <- emptyTestBlock(i)
+		}
+		ch.Halt()
+		return ch
+	}
+
+	// the blocks received before the halt are all appended
+	support := &mockmultichannel.ConsenterSupport{Blocks: make(chan *cb.Block, 3), HeightVal: 1}
+	newHaltedChain(support).appendToChain()
+	for i := uint64(1); i <= 3; i++ {
+		expectBlock(t, support, i)
+	}
+
+	// up to the first one which cannot be
+	support = &mockmultichannel.ConsenterSupport{Blocks: make(chan *cb.Block, 3), HeightVal: 1}
+	newHaltedChain(&failingSupport{ConsenterSupport: support, failAt: 2}).drain()
+	expectBlock(t, support, 1)
+	assert.Empty(t, support.Blocks)
+
+	// and for a bounded time
+	ch := newHaltedChain(&slowSupport{ConsenterSupport: &mockmultichannel.ConsenterSupport{HeightVal: 1}, delay: 50 * time.Millisecond})
+	ch.drainTimeout = 75 * time.Millisecond
+	ch.drain()
+	assert.Len(t, ch.sendChan, 1)
+}
+
+func TestAppendBlockSequence(t *testing.T) {
+	support := &mockmultichannel.ConsenterSupport{Blocks: make(chan *cb.Block, 3), HeightVal: 1}
+	ch := newChain(support, localconfig.HoneyBadgerBFT{}, nil, newTestThroughputMeter())
+
+	assert.NoError(t, ch.appendBlock(emptyTestBlock(1)))
+	expectBlock(t, support, 1)
+
+	// a block replayed by the proxy after a reconnect is skipped
+	assert.NoError(t, ch.appendBlock(emptyTestBlock(1)))
+	assert.NoError(t, ch.appendBlock(emptyTestBlock(0)))
+	assert.Empty(t, support.Blocks)
+
+	// a gap is an error, and leaves the ledger untouched
+	assert.EqualError(t, ch.appendBlock(emptyTestBlock(4)), "blocks 2 to 3 are missing")
+	assert.Empty(t, support.Blocks)
+
+	assert.NoError(t, ch.appendBlock(emptyTestBlock(2)))
+	expectBlock(t, support, 2)
+}
+
+// temporaryError is an append error which may not happen again
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "ledger locked" }
+func (temporaryError) Temporary() bool { return true }
+
+// flakySupport fails to append the next failures blocks with a temporary
+// error
+type flakySupport struct {
+	*mockmultichannel.ConsenterSupport
+	failures int
+}
+
+func (fs *flakySupport) AppendBlock(block *cb.Block) error {
+	if fs.failures > 0 {
+		fs.failures--
+		return temporaryError{}
+	}
+	return fs.ConsenterSupport.AppendBlock(block)
+}
+
+func TestAppendRetries(t *testing.T) {
+	config := localconfig.HoneyBadgerBFT{AppendMaxRetries: 2, AppendRetryInterval: time.Millisecond}
+
+	// temporary errors are retried
+	support := &mockmultichannel.ConsenterSupport{Blocks: make(chan *cb.Block, 1), HeightVal: 1}
+	ch := newChain(&flakySupport{ConsenterSupport: support, failures: 2}, config, nil, newTestThroughputMeter())
+	go ch.appendToChain()
+	defer ch.Halt()
+	ch.sendChan <- emptyTestBlock(1)
+	expectBlock(t, support, 1)
+	assert.NoError(t, ch.Err())
+
+	// up to the configured number of times, after which the chain is
+	// halted instead of the orderer
+	support = &mockmultichannel.ConsenterSupport{Blocks: make(chan *cb.Block, 1), HeightVal: 1}
+	ch = newChain(&flakySupport{ConsenterSupport: support, failures: 3}, config, nil, newTestThroughputMeter())
+	ch.sendChan <- emptyTestBlock(1)
+	ch.appendToChain()
+	assert.EqualError(t, ch.Err(), "could not append block 1: ledger locked")
+	assert.Empty(t, support.Blocks)
+	select {
+	case <-ch.exitChan:
+	default:
+		t.Fatal("The chain should have been halted")
+	}
+
+	// while fatal errors are not retried
+	support = &mockmultichannel.ConsenterSupport{Blocks: make(chan *cb.Block, 1), HeightVal: 1}
+	ch = newChain(&failingSupport{ConsenterSupport: support, failAt: 1}, config, nil, newTestThroughputMeter())
+	ch.sendChan <- emptyTestBlock(1)
+	ch.appendToChain()
+	assert.EqualError(t, ch.Err(), "could not append block 1: ledger unavailable")
+}
+
+// slowSupport takes delay to append every block
+type slowSupport struct {
+	*mockmultichannel.ConsenterSupport
+	delay time.Duration
+}
+
+func (ss *slowSupport) AppendBlock(block *cb.Block) error {
+	time.Sleep(ss.delay)
+	ss.HeightVal++
+	return nil
+}
+
+func TestOrderBackpressure(t *testing.T) {
+	config := localconfig.HoneyBadgerBFT{MaxPendingEnvelopes: 1, SendTimeout: 20 * time.Millisecond}
+	ch := newChain(&mockmultichannel.ConsenterSupport{}, config, nil, newTestThroughputMeter())
+	defer ch.Halt()
+
+	// a proxy which does not read: the envelope is not sent again, and the
+	// connection, left in the middle of a frame, is dropped
+	proxy, conn := net.Pipe()
+	defer proxy.Close()
+	ch.sendConnection = conn
+	env := &cb.Envelope{Payload: []byte("payload")}
+	err := ch.Order(env, 0)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "proxy did not accept the envelope within 20ms")
+	assert.Nil(t, ch.sendConnection)
+	assert.NoError(t, ch.Err(), "a slow proxy should not fail the chain")
+
+	// too many envelopes waiting to be sent already
+	ch.sendSlots <- struct{}{}
+	err = ch.Order(env, 0)
+	assert.EqualError(t, err, "1 envelopes still waiting to be sent to the proxy after 20ms")
+	<-ch.sendSlots
+
+	// once the proxy keeps up again, the envelopes go through
+	ch.sendTimeout = time.Second
+	proxy, conn = net.Pipe()
+	defer proxy.Close()
+	ch.sendConnection = conn
+	errs := make(chan error, 1)
+	go func() { errs <- ch.Order(env, 0) }()
+	var length [8]byte
+	_, err = io.ReadFull(proxy, length[:])
+	assert.NoError(t, err)
+	envBytes := make([]byte, binary.BigEndian.Uint64(length[:]))
+	_, err = io.ReadFull(proxy, envBytes)
+	assert.NoError(t, err)
+	assert.Equal(t, utils.MarshalOrPanic(env), envBytes)
+	assert.NoError(t, <-errs)
+}
+
+func TestInFlightWindow(t *testing.T) {
+	config := localconfig.HoneyBadgerBFT{MaxInFlightEnvelopes: 2, SendTimeout: 20 * time.Millisecond}
+	ch := newChain(&mockmultichannel.ConsenterSupport{HeightVal: 1}, config, nil, newTestThroughputMeter())
+	defer ch.Halt()
+
+	// a proxy reading the envelopes, but not ordering them
+	proxy, conn := net.Pipe()
+	defer proxy.Close()
+	go io.Copy(ioutil.Discard, proxy)
+	ch.sendConnection = conn
+	env := &cb.Envelope{Payload: []byte("payload")}
+	assert.NoError(t, ch.Order(env, 0))
+	assert.NoError(t, ch.Order(env, 0))
+
+	// the window is full
+	err := ch.Order(env, 0)
+	assert.EqualError(t, err, "2 envelopes sent to the proxy still not ordered after 20ms")
+
+	// until a block orders some of the envelopes sent
+	block1 := newTestBlock(1, nil, []byte("tx"))
+	delivered, ok := ch.deliver(block1)
+	assert.True(t, delivered)
+	assert.True(t, ok)
+	assert.NoError(t, ch.Order(env, 0))
+	assert.Error(t, ch.Order(env, 0))
+
+	// the envelopes ordered by other orderers do not open the window further
+	delivered, ok = ch.deliver(newTestBlock(2, block1, []byte("tx"), []byte("tx"), []byte("tx")))
+	assert.True(t, delivered)
+	assert.True(t, ok)
+	assert.Len(t, ch.inFlightSlots, 0)
+
+	// and an envelope which could not be sent does not hold a slot
+	proxy.Close()
+	ch.reconnect.maxRetries = 1
+	assert.Error(t, ch.Order(env, 0))
+	assert.Len(t, ch.inFlightSlots, 0)
+}
+
+func TestRecvFrameLength(t *testing.T) {
+	ch := newChain(&mockmultichannel.ConsenterSupport{}, localconfig.HoneyBadgerBFT{}, nil, newTestThroughputMeter())
+	defer ch.Halt()
+
+	proxy, conn := net.Pipe()
+	defer proxy.Close()
+
+	recv := func(length uint64, split int, payload []byte) ([]byte, error) {
+		var prefix [8]byte
+		binary.BigEndian.PutUint64(prefix[:], length)
+		go func() {
+			// the prefix comes over several writes
+			proxy.Write(prefix[:split])
+			proxy.Write(prefix[split:])
+			if len(payload) > 0 {
+				proxy.Write(payload)
+			}
+		}()
+		return ch.recvBytes(conn)
+	}
+
+	buf, err := recv(7, 3, []byte("payload"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("payload"), buf)
+
+	_, err = recv(maxFrameSize+1, 4, nil)
+	assert.EqualError(t, err, fmt.Sprintf("frame of %d bytes received from proxy exceeds the maximum of %d bytes", maxFrameSize+1, maxFrameSize))
+
+	_, err = recv(controlFrameFlag|(maxControlFrameSize+1), 1, nil)
+	assert.EqualError(t, err, fmt.Sprintf("control frame of %d bytes received from proxy, expected between 1 and %d bytes", maxControlFrameSize+1, maxControlFrameSize))
+
+	_, err = recv(controlFrameFlag|7, 1, []byte("payload"))
+	assert.EqualError(t, err, "unexpected control frame of type 112 received from proxy")
+}
+
+// shortReadConn is a connection returning at most one byte per read
+type shortReadConn struct {
+	net.Conn
+}
+
+func (c shortReadConn) Read(b []byte) (int, error) {
+	if len(b) > 1 {
+		b = b[:1]
+	}
+	return c.Conn.Read(b)
+}
+
+func TestRecvLengthShortReads(t *testing.T) {
+	ch := newChain(&mockmultichannel.ConsenterSupport{}, localconfig.HoneyBadgerBFT{MaxMessageSize: 16}, nil, newTestThroughputMeter())
+	defer ch.Halt()
+
+	proxy, conn := net.Pipe()
+	defer proxy.Close()
+	send := func(length uint64, payload []byte) {
+		var prefix [8]byte
+		binary.BigEndian.PutUint64(prefix[:], length)
+		go proxy.Write(append(prefix[:], payload...))
+	}
+
+	// the frame is read whole, however few bytes every read returns
+	send(7, []byte("payload"))
+	buf, err := ch.recvBytes(shortReadConn{conn})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("payload"), buf)
+
+	// the length is unsigned, like the one sent, and bounded by the
+	// maximum message size
+	send(1<<62-1, nil)
+	_, err = ch.recvBytes(shortReadConn{conn})
+	assert.EqualError(t, err, fmt.Sprintf("frame of %d bytes received from proxy exceeds the maximum of 16 bytes", uint64(1<<62-1)))
+	send(17, nil)
+	_, err = ch.recvBytes(shortReadConn{conn})
+	assert.EqualError(t, err, "frame of 17 bytes received from proxy exceeds the maximum of 16 bytes")
+
+	// a connection ending within the prefix is a framing error
+	go func() {
+		proxy.Write([]byte{0, 0, 0})
+		proxy.Close()
+	}()
+	_, err = ch.recvBytes(shortReadConn{conn})
+	assert.IsType(t, &framingError{}, err)
+	assert.Equal(t, io.ErrUnexpectedEOF, err.(*framingError).err)
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	// by default, the largest block of the channel
+	c, err := New(localconfig.HoneyBadgerBFT{}, nil).HandleChain(&mockmultichannel.ConsenterSupport{SharedConfigVal: testSharedConfig}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1024*1024+blockOverhead), c.(*chain).maxMessageSize)
+
+	// never beyond maxFrameSize
+	c, err = New(localconfig.HoneyBadgerBFT{MaxMessageSize: maxFrameSize + 1}, nil).HandleChain(&mockmultichannel.ConsenterSupport{}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, maxFrameSize, c.(*chain).maxMessageSize)
+
+	// a frame larger than the configured size is rejected before being
+	// allocated
+	ch := newChain(&mockmultichannel.ConsenterSupport{}, localconfig.HoneyBadgerBFT{MaxMessageSize: 16}, nil, newTestThroughputMeter())
+	defer ch.Halt()
+	proxy, conn := net.Pipe()
+	defer proxy.Close()
+	go func() {
+		var length [8]byte
+		binary.BigEndian.PutUint64(length[:], 17)
+		proxy.Write(length[:])
+	}()
+	_, err = ch.recvBlockFromBFTProxy(conn)
+	assert.Error(t, err)
+	assert.EqualError(t, err, "frame of 17 bytes received from proxy exceeds the maximum of 16 bytes")
+}
+
+// writeHeartbeat plays the proxy side of the receive connection, echoing the
+// heartbeat with the given sequence number
+func writeHeartbeat(t *testing.T, conn net.Conn, seq uint64) {
+	var frame [8 + 1 + 8]byte
+	binary.BigEndian.PutUint64(frame[:8], controlFrameFlag|9)
+	frame[8] = heartbeatFrame
+	binary.BigEndian.PutUint64(frame[9:], seq)
+	_, err := conn.Write(frame[:])
+	assert.NoError(t, err)
+}
+
+func TestHeartbeats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "honeybadgerbft")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := localconfig.HoneyBadgerBFT{
+		SendSocketPath:       filepath.Join(dir, "send.sock"),
+		ReconnectInterval:    time.Millisecond,
+		ReconnectMaxInterval: 4 * time.Millisecond,
+		ReconnectMaxRetries:  3,
+		HeartbeatInterval:    10 * time.Millisecond,
+		MaxMissedHeartbeats:  2,
+	}
+	listener, err := net.Listen("unix", config.SendSocketPath)
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	ch := newChain(&mockmultichannel.ConsenterSupport{}, config, nil, newTestThroughputMeter())
+	defer ch.Halt()
+	ch.sendConnection, err = ch.dialSend()
+	assert.NoError(t, err)
+	proxy, err := listener.Accept()
+	assert.NoError(t, err)
+	defer proxy.Close()
+
+	go ch.heartbeatLoop()
+
+	// heartbeats are control frames, never mistaken for envelopes
+	var frame [8 + 1 + 8]byte
+	_, err = io.ReadFull(proxy, frame[:])
+	assert.NoError(t, err)
+	assert.Equal(t, controlFrameFlag|9, binary.BigEndian.Uint64(frame[:8]))
+	assert.Equal(t, heartbeatFrame, frame[8])
+	assert.Equal(t, uint64(1), binary.BigEndian.Uint64(frame[9:]))
+
+	// the echoes received along with the blocks are not mistaken for blocks
+	recvProxy, recvConn := net.Pipe()
+	defer recvProxy.Close()
+	go func() {
+		writeHeartbeat(t, recvProxy, 1)
+		sendBlock(t, recvProxy, 0)
+	}()
+	block, err := ch.recvBlockFromBFTProxy(recvConn)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), block.Header.Number)
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&ch.heartbeatsEchoed))
+
+	// an echo of a heartbeat never sent is an error
+	go writeHeartbeat(t, recvProxy, 1000)
+	_, err = ch.recvBlockFromBFTProxy(recvConn)
+	assert.EqualError(t, err, "heartbeat 1000 received from proxy was never sent")
+
+	// once the proxy stops echoing, the connection is replaced
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the connection to the send proxy to be replaced")
+	}
+	assert.NoError(t, ch.Err())
+}
+
+func TestProxyReplicas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "honeybadgerbft")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := localconfig.HoneyBadgerBFT{
+		SendSocketPath:    filepath.Join(dir, "send0.sock"),
+		ReceiveSocketPath: filepath.Join(dir, "receive0.sock"),
+		Replicas: []localconfig.HoneyBadgerBFTProxy{{
+			SendSocketPath:    filepath.Join(dir, "send1.sock"),
+			ReceiveSocketPath: filepath.Join(dir, "receive1.sock"),
+		}},
+		ReconnectInterval:    time.Millisecond,
+		ReconnectMaxInterval: 4 * time.Millisecond,
+		ReconnectMaxRetries:  3,
+	}
+	// the first replica of the proxy is down, the second one is up
+	listener, err := net.Listen("unix", config.Replicas[0].SendSocketPath)
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	support := &mockmultichannel.ConsenterSupport{
+		Blocks:    make(chan *cb.Block),
+		HeightVal: 1,
+	}
+	ch := newChain(support, config, nil, newTestThroughputMeter())
+	ch.Start()
+	defer ch.Halt()
+	assert.NoError(t, ch.Err())
+
+	// the envelopes are sent to the replica which is up
+	proxy, err := listener.Accept()
+	assert.NoError(t, err)
+	defer proxy.Close()
+	env := &cb.Envelope{Payload: []byte("payload")}
+	errs := make(chan error, 1)
+	go func() { errs <- ch.Order(env, 0) }()
+	var length [8]byte
+	_, err = io.ReadFull(proxy, length[:])
+	assert.NoError(t, err)
+	envBytes := make([]byte, binary.BigEndian.Uint64(length[:]))
+	_, err = io.ReadFull(proxy, envBytes)
+	assert.NoError(t, err)
+	assert.Equal(t, utils.MarshalOrPanic(env), envBytes)
+	assert.NoError(t, <-errs)
+
+	// the blocks are received from every replica, and appended once
+	recv0, err := net.Dial("unix", config.ReceiveSocketPath)
+	assert.NoError(t, err)
+	defer recv0.Close()
+	recv1, err := net.Dial("unix", config.Replicas[0].ReceiveSocketPath)
+	assert.NoError(t, err)
+	defer recv1.Close()
+
+	sendBlock(t, recv0, 1)
+	expectBlock(t, support, 1)
+	sendBlock(t, recv1, 1)
+	sendBlock(t, recv1, 2)
+	expectBlock(t, support, 2)
+}
+
+func TestBlockWindow(t *testing.T) {
+	support := &mockmultichannel.ConsenterSupport{
+		Blocks:    make(chan *cb.Block),
+		HeightVal: 1,
+	}
+	ch := newChain(support, localconfig.HoneyBadgerBFT{BlockWindow: 2, BlockQueueSize: 10}, nil, newTestThroughputMeter())
+	go ch.appendToChain()
+	defer ch.Halt()
+
+	// the window bounds the blocks ahead of the ledger instead of the queue
+	assert.Equal(t, 0, cap(ch.sendChan))
+
+	proxy, conn := net.Pipe()
+	defer proxy.Close()
+	go ch.recvBlocks(conn)
+
+	// the proxy is granted the window first
+	assert.Equal(t, uint64(2), recvCredit(t, proxy))
+
+	// then a block once appendToChain took the previous one
+	sendBlock(t, proxy, 1)
+	assert.Equal(t, uint64(1), recvCredit(t, proxy))
+
+	// the ledger is slow: block 1 is still being appended, so block 2 is
+	// not granted back
+	sendBlock(t, proxy, 2)
+	credits := make(chan uint64, 1)
+	go func() { credits <- recvCredit(t, proxy) }()
+	select {
+	case <-credits:
+		t.Fatal("Expected no block to be granted while the ledger is busy")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// until the ledger catches up
+	expectBlock(t, support, 1)
+	select {
+	case count := <-credits:
+		assert.Equal(t, uint64(1), count)
+	case <-time.After(time.Second):
+		t.Fatal("Expected a block to be granted once the ledger caught up")
+	}
+	expectBlock(t, support, 2)
+}
+
+func TestChainLogger(t *testing.T) {
+	throughput := newTestThroughputMeter()
+	ch := newChain(&mockmultichannel.ConsenterSupport{ChainIDVal: "mychannel"}, localconfig.HoneyBadgerBFT{}, nil, throughput)
+
+	// every line logged about the chain is tagged with its channel
+	assert.Equal(t, "[channel: mychannel] ", ch.logger.prefix)
+	assert.Equal(t, ch.logger, ch.reconnect.logger)
+	assert.Equal(t, ch.logger, throughput.logger)
+}
+
+func TestConnectionStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "honeybadgerbft")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := localconfig.HoneyBadgerBFT{
+		SendSocketPath:       filepath.Join(dir, "send.sock"),
+		ReceiveSocketPath:    filepath.Join(dir, "receive.sock"),
+		ReconnectInterval:    time.Millisecond,
+		ReconnectMaxInterval: 4 * time.Millisecond,
+		ReconnectMaxRetries:  3,
+	}
+	listener, err := net.Listen("unix", config.SendSocketPath)
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	support := &mockmultichannel.ConsenterSupport{
+		Blocks:    make(chan *cb.Block),
+		HeightVal: 1,
+	}
+	ch := newChain(support, config, nil, newTestThroughputMeter())
+	assert.Equal(t, ConnectionStatus{ReceiveConnected: []bool{false}}, ch.Status())
+	ch.Start()
+	defer ch.Halt()
+	proxy, err := listener.Accept()
+	assert.NoError(t, err)
+	go io.Copy(ioutil.Discard, proxy)
+
+	status := ch.Status()
+	assert.True(t, status.SendConnected)
+	assert.Equal(t, []bool{false}, status.ReceiveConnected)
+	assert.True(t, status.LastSend.IsZero())
+	assert.False(t, status.BlockReceived)
+
+	// the envelopes sent and the blocks received are recorded
+	assert.NoError(t, ch.Order(&cb.Envelope{Payload: []byte("payload")}, 0))
+	recv, err := net.Dial("unix", config.ReceiveSocketPath)
+	assert.NoError(t, err)
+	defer recv.Close()
+	sendBlock(t, recv, 1)
+	expectBlock(t, support, 1)
+
+	status = ch.Status()
+	assert.False(t, status.LastSend.IsZero())
+	assert.Equal(t, []bool{true}, status.ReceiveConnected)
+	assert.True(t, status.BlockReceived)
+	assert.Equal(t, uint64(1), status.LastBlock)
+	assert.Zero(t, status.ReconnectAttempts)
+
+	// and so are the attempts to reconnect to the proxy once it is gone
+	listener.Close()
+	proxy.Close()
+	assert.Error(t, ch.Order(&cb.Envelope{Payload: []byte("payload")}, 0))
+	assert.Equal(t, uint64(3), ch.Status().ReconnectAttempts)
+}
+
+func TestOrderRevalidation(t *testing.T) {
+	support := &mockmultichannel.ConsenterSupport{HeightVal: 1, SequenceVal: 1, ProcessNormalMsgErr: fmt.Errorf("rejected by new config")}
+	ch := newChain(support, localconfig.HoneyBadgerBFT{MaxInFlightEnvelopes: 1}, nil, newTestThroughputMeter())
+	defer ch.Halt()
+
+	proxy, conn := net.Pipe()
+	defer proxy.Close()
+	sent := make(chan []byte, 2)
+	go func() {
+		for {
+			var length [8]byte
+			if _, err := io.ReadFull(proxy, length[:]); err != nil {
+				return
+			}
+			envBytes := make([]byte, binary.BigEndian.Uint64(length[:]))
+			if _, err := io.ReadFull(proxy, envBytes); err != nil {
+				return
+			}
+			sent <- envBytes
+		}
+	}()
+	ch.sendConnection = conn
+	env := &cb.Envelope{Payload: []byte("payload")}
+
+	// an envelope validated against the current config is sent as is
+	assert.NoError(t, ch.Order(env, 1))
+	assert.Equal(t, utils.MarshalOrPanic(env), <-sent)
+	ch.transactionsObserved(1)
+
+	// one validated against an older config is dropped if no longer valid,
+	// without holding a slot
+	assert.EqualError(t, ch.Order(env, 0), "message invalidated by config update: rejected by new config")
+	assert.Len(t, ch.inFlightSlots, 0)
+	assert.Empty(t, sent)
+
+	// and sent if still valid
+	support.ProcessNormalMsgErr = nil
+	assert.NoError(t, ch.Order(env, 0))
+	assert.Equal(t, utils.MarshalOrPanic(env), <-sent)
+}
+
+func TestAcknowledgements(t *testing.T) {
+	ch := newChain(&mockmultichannel.ConsenterSupport{HeightVal: 1}, localconfig.HoneyBadgerBFT{AckTimeout: 50 * time.Millisecond}, nil, newTestThroughputMeter())
+	defer ch.Halt()
+
+	// a proxy reading the frames sent to it
+	proxy, conn := net.Pipe()
+	defer proxy.Close()
+	frames := make(chan []byte, 10)
+	go func() {
+		for {
+			var length [8]byte
+			if _, err := io.ReadFull(proxy, length[:]); err != nil {
+				return
+			}
+			frame := make([]byte, binary.BigEndian.Uint64(length[:])&^controlFrameFlag)
+			if _, err := io.ReadFull(proxy, frame); err != nil {
+				return
+			}
+			frames <- frame
+		}
+	}()
+	ch.sendConnection = conn
+	env := &cb.Envelope{Payload: []byte("payload")}
+	ack := func(session uint64, sequence uint64) error {
+		var payload [16]byte
+		binary.BigEndian.PutUint64(payload[:8], session)
+		binary.BigEndian.PutUint64(payload[8:], sequence)
+		return ch.acked(payload[:])
+	}
+
+	// the first envelope is preceded by the ack request, and not waited for
+	// until the proxy confirms the session
+	assert.NoError(t, ch.Order(env, 0))
+	assert.Equal(t, []byte{ackRequestFrame, 0, 0, 0, 0, 0, 0, 0, 1}, <-frames)
+	assert.Equal(t, utils.MarshalOrPanic(env), <-frames)
+
+	// once confirmed, Order waits for the acknowledgement of the envelope
+	assert.NoError(t, ack(1, 0))
+	errs := make(chan error, 1)
+	go func() { errs <- ch.Order(env, 0) }()
+	assert.Equal(t, utils.MarshalOrPanic(env), <-frames)
+	select {
+	case err := <-errs:
+		t.Fatalf("Order returned before the envelope was acknowledged: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	assert.NoError(t, ack(1, 2))
+	assert.NoError(t, <-errs)
+
+	// for at most the ack timeout
+	assert.EqualError(t, ch.Order(env, 0), "proxy did not acknowledge the envelope within 50ms")
+	<-frames
+
+	// the acknowledgements of other sessions are ignored, while those of
+	// envelopes never sent are errors
+	assert.NoError(t, ack(2, 1))
+	assert.EqualError(t, ack(1, 4), "acknowledgement 4 received from proxy for an envelope never sent")
+	assert.Error(t, ch.acked([]byte{1}))
+
+	// a new connection opens a new session
+	proxy2, conn2 := net.Pipe()
+	defer proxy2.Close()
+	ch.sendConnection = conn2
+	go func() { errs <- ch.Order(env, 0) }()
+	var frame [8 + 1 + 8]byte
+	_, err := io.ReadFull(proxy2, frame[:])
+	assert.NoError(t, err)
+	assert.Equal(t, ackRequestFrame, frame[8])
+	assert.Equal(t, uint64(2), binary.BigEndian.Uint64(frame[9:]))
+	go io.Copy(ioutil.Discard, proxy2)
+	assert.NoError(t, <-errs)
+}
+
+func TestCompression(t *testing.T) {
+	ch := newChain(&mockmultichannel.ConsenterSupport{HeightVal: 1}, localconfig.HoneyBadgerBFT{Compression: "gzip"}, nil, newTestThroughputMeter())
+	defer ch.Halt()
+
+	// a proxy reading the frames sent to it, along with their length prefix
+	proxy, conn := net.Pipe()
+	defer proxy.Close()
+	type frame struct {
+		prefix  uint64
+		payload []byte
+	}
+	frames := make(chan frame, 10)
+	go func() {
+		for {
+			var length [8]byte
+			if _, err := io.ReadFull(proxy, length[:]); err != nil {
+				return
+			}
+			prefix := binary.BigEndian.Uint64(length[:])
+			payload := make([]byte, prefix&^(controlFrameFlag|compressedFrameFlag))
+			if _, err := io.ReadFull(proxy, payload); err != nil {
+				return
+			}
+			frames <- frame{prefix, payload}
+		}
+	}()
+	ch.sendConnection = conn
+	env := &cb.Envelope{Payload: bytes.Repeat([]byte("payload"), 100)}
+	confirm := func(algorithm byte, session uint64) error {
+		var payload [9]byte
+		payload[0] = algorithm
+		binary.BigEndian.PutUint64(payload[1:], session)
+		return ch.compressionConfirmed(payload[:])
+	}
+
+	// the first envelope is preceded by the compression request, and sent
+	// as is until the proxy confirms it
+	assert.NoError(t, ch.Order(env, 0))
+	request := <-frames
+	assert.NotZero(t, request.prefix&controlFrameFlag)
+	assert.Equal(t, []byte{compressionFrame, 1, 0, 0, 0, 0, 0, 0, 0, 1}, request.payload)
+	sent := <-frames
+	assert.Equal(t, uint64(len(sent.payload)), sent.prefix)
+	assert.Equal(t, utils.MarshalOrPanic(env), sent.payload)
+
+	// the confirmations of other algorithms and sessions are not taken
+	// into account
+	assert.EqualError(t, confirm(2, 1), "proxy confirmed compression algorithm 2, which was never requested")
+	assert.NoError(t, confirm(1, 2))
+	assert.Error(t, ch.compressionConfirmed([]byte{1}))
+	assert.NoError(t, ch.Order(env, 0))
+	assert.Equal(t, utils.MarshalOrPanic(env), (<-frames).payload)
+
+	// once confirmed, the envelopes are compressed
+	assert.NoError(t, confirm(1, 1))
+	assert.NoError(t, ch.Order(env, 0))
+	sent = <-frames
+	assert.Equal(t, compressedFrameFlag|uint64(len(sent.payload)), sent.prefix)
+	assert.True(t, len(sent.payload) < len(utils.MarshalOrPanic(env)))
+	decompressed, err := gzipDecompress(sent.payload, maxFrameSize)
+	assert.NoError(t, err)
+	assert.Equal(t, utils.MarshalOrPanic(env), decompressed)
+
+	// unless that does not make them smaller
+	small := &cb.Envelope{Payload: []byte("p")}
+	assert.NoError(t, ch.Order(small, 0))
+	assert.Equal(t, utils.MarshalOrPanic(small), (<-frames).payload)
+
+	// the blocks compressed by the proxy are decompressed, within the
+	// maximum message size
+	recvProxy, recvConn := net.Pipe()
+	defer recvProxy.Close()
+	recv := func(data []byte) ([]byte, error) {
+		compressed, err := gzipCompress(data)
+		assert.NoError(t, err)
+		go func() {
+			var prefix [8]byte
+			binary.BigEndian.PutUint64(prefix[:], compressedFrameFlag|uint64(len(compressed)))
+			recvProxy.Write(append(prefix[:], compressed...))
+		}()
+		return ch.recvBytes(recvConn)
+	}
+	block := bytes.Repeat([]byte("block"), 100)
+	buf, err := recv(block)
+	assert.NoError(t, err)
+	assert.Equal(t, block, buf)
+	ch.maxMessageSize = 100
+	_, err = recv(block)
+	assert.EqualError(t, err, "failed to decompress block received from proxy with gzip: decompressed frame exceeds the maximum of 100 bytes")
+
+	// but not when compression is disabled
+	ch.compressor = nil
+	ch.maxMessageSize = maxFrameSize
+	_, err = recv(block)
+	assert.EqualError(t, err, "compressed frame received from proxy while compression is disabled")
+
+	for _, name := range []string{"gzip", "snappy"} {
+		c, err := newCompressor(name)
+		assert.NoError(t, err)
+		compressed, err := c.compress(block)
+		assert.NoError(t, err)
+		decompressed, err := c.decompress(compressed, uint64(len(block)))
+		assert.NoError(t, err)
+		assert.Equal(t, block, decompressed)
+		_, err = c.decompress(compressed, uint64(len(block))-1)
+		assert.Error(t, err)
+	}
+	assert.Panics(t, func() { New(localconfig.HoneyBadgerBFT{Compression: "zip"}, nil) })
+}
+
+func TestReconnectOnDemand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "honeybadgerbft")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := localconfig.HoneyBadgerBFT{
+		SendSocketPath:       filepath.Join(dir, "send.sock"),
+		ReceiveSocketPath:    filepath.Join(dir, "receive.sock"),
+		ReconnectInterval:    time.Millisecond,
+		ReconnectMaxInterval: 4 * time.Millisecond,
+		ReconnectMaxRetries:  3,
+	}
+	listener, err := net.Listen("unix", config.SendSocketPath)
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	support := &mockmultichannel.ConsenterSupport{
+		Blocks:    make(chan *cb.Block),
+		HeightVal: 1,
+	}
+	ch := newChain(support, config, nil, newTestThroughputMeter())
+	ch.Start()
+	defer ch.Halt()
+	proxy, err := listener.Accept()
+	assert.NoError(t, err)
+	defer proxy.Close()
+	recv, err := net.Dial("unix", config.ReceiveSocketPath)
+	assert.NoError(t, err)
+	defer recv.Close()
+	sendBlock(t, recv, 1)
+	expectBlock(t, support, 1)
+
+	errs := make(chan error, 1)
+	go func() { errs <- ch.Reconnect() }()
+	newProxy, err := listener.Accept()
+	assert.NoError(t, err)
+	defer newProxy.Close()
+	assert.NoError(t, <-errs)
+
+	// both previous connections are closed
+	_, err = proxy.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	_, err = recv.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	// the envelopes are sent over the new connection
+	env := &cb.Envelope{Payload: []byte("payload")}
+	go func() { errs <- ch.Order(env, 0) }()
+	var length [8]byte
+	_, err = io.ReadFull(newProxy, length[:])
+	assert.NoError(t, err)
+	envBytes := make([]byte, binary.BigEndian.Uint64(length[:]))
+	_, err = io.ReadFull(newProxy, envBytes)
+	assert.NoError(t, err)
+	assert.Equal(t, utils.MarshalOrPanic(env), envBytes)
+	assert.NoError(t, <-errs)
+
+	// and the chain keeps receiving blocks once the receive proxy is back
+	var newRecv net.Conn
+	for i := 0; i < 100; i++ {
+		if newRecv, err = net.Dial("unix", config.ReceiveSocketPath); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if assert.NoError(t, err) {
+		defer newRecv.Close()
+		sendBlock(t, newRecv, 2)
+		expectBlock(t, support, 2)
+	}
+	assert.NoError(t, ch.Err())
+}
+
+func TestBlockQueueSize(t *testing.T) {
+	ch := newChain(&mockmultichannel.ConsenterSupport{}, localconfig.HoneyBadgerBFT{}, nil, newTestThroughputMeter())
+	assert.Equal(t, defaultSendQueueSize, cap(ch.sendChan))
+
+	// the blocks received keep ahead of the ledger up to the queue size
+	ch = newChain(&mockmultichannel.ConsenterSupport{HeightVal: 1}, localconfig.HoneyBadgerBFT{BlockQueueSize: 2}, nil, newTestThroughputMeter())
+	defer ch.Halt()
+	assert.Equal(t, 2, cap(ch.sendChan))
+	for i := uint64(1); i <= 2; i++ {
+		delivered, ok := ch.deliver(emptyTestBlock(i))
+		assert.True(t, delivered)
+		assert.True(t, ok)
+	}
+	blocked := make(chan struct{})
+	go func() {
+		ch.deliver(emptyTestBlock(3))
+		close(blocked)
+	}()
+	select {
+	case <-blocked:
+		t.Fatal("The third block should wait for the ledger")
+	case <-time.After(20 * time.Millisecond):
+	}
+	ch.Halt()
+	<-blocked
+}
+
+func TestResume(t *testing.T) {
+	support := &mockmultichannel.ConsenterSupport{HeightVal: 5, SharedConfigVal: testSharedConfig}
+	c, err := New(localconfig.HoneyBadgerBFT{Resume: true}, nil).HandleChain(support, &cb.Metadata{Value: []byte("state")})
+	assert.NoError(t, err)
+	ch := c.(*chain)
+	assert.Equal(t, []byte("state"), ch.resumeState)
+
+	// the proxy is told the next block and the state of the last one
+	proxy, conn := net.Pipe()
+	defer proxy.Close()
+	frames := make(chan []byte, 1)
+	go func() {
+		var length [8]byte
+		if _, err := io.ReadFull(proxy, length[:]); err != nil {
+			return
+		}
+		frame := make([]byte, binary.BigEndian.Uint64(length[:])&^controlFrameFlag)
+		if _, err := io.ReadFull(proxy, frame); err != nil {
+			return
+		}
+		frames <- frame
+	}()
+	assert.NoError(t, ch.sendResume(conn))
+	assert.Equal(t, append([]byte{resumeFrame, 0, 0, 0, 0, 0, 0, 0, 5}, "state"...), <-frames)
+
+	// nothing is sent to the proxies unaware of resuming
+	ch.resume = false
+	assert.NoError(t, ch.sendResume(nil))
+}
+
+func TestFramingErrors(t *testing.T) {
+	ch := newChain(&mockmultichannel.ConsenterSupport{HeightVal: 1}, localconfig.HoneyBadgerBFT{}, nil, newTestThroughputMeter())
+	defer ch.Halt()
+
+	recv := func(data []byte) error {
+		proxy, conn := net.Pipe()
+		go func() {
+			proxy.Write(data)
+			proxy.Close()
+		}()
+		_, err := ch.recvBytes(conn)
+		return err
+	}
+	prefix := func(length uint64) []byte {
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], length)
+		return buf[:]
+	}
+
+	// the connection may only end between frames
+	assert.Equal(t, io.EOF, recv(nil))
+	err := recv(prefix(7)[:5])
+	assert.IsType(t, &framingError{}, err)
+	assert.EqualError(t, err, io.ErrUnexpectedEOF.Error())
+	err = recv(prefix(7))
+	assert.IsType(t, &framingError{}, err)
+	assert.EqualError(t, err, io.ErrUnexpectedEOF.Error())
+	err = recv(append(prefix(7), "pay"...))
+	assert.IsType(t, &framingError{}, err)
+	err = recv(append(prefix(controlFrameFlag|9), heartbeatFrame))
+	assert.IsType(t, &framingError{}, err)
+
+	// once the connection is dropped, the blocks pulled over it are pulled
+	// again over the next one
+	ch.pulledUpTo = 5
+	proxy, conn := net.Pipe()
+	go func() {
+		proxy.Write(append(prefix(7), "pay"...))
+		proxy.Close()
+	}()
+	ch.recvBlocks(conn)
+	assert.Equal(t, ch.nextBlock, ch.pulledUpTo)
+}
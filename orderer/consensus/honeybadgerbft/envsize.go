@@ -0,0 +1,63 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package honeybadgerbft
+
+import (
+	"sync"
+
+	"github.com/hyperledger/fabric/common/metrics"
+)
+
+// sizeAccumulator accumulates the envelopes sent to the proxy and their
+// bytes since the last block delivered, so that the batches of the proxy
+// can be tuned by size rather than by count alone. When it has a metrics
+// scope, the average size of the envelopes sent between two blocks is
+// reported to the average_envelope_size gauge every time a block is
+// delivered.
+type sizeAccumulator struct {
+	sync.Mutex
+	envelopes int
+	bytes     int64
+
+	average metrics.Gauge
+}
+
+func newSizeAccumulator(scope metrics.Scope) *sizeAccumulator {
+	a := &sizeAccumulator{}
+	if scope != nil {
+		a.average = scope.Gauge("average_envelope_size")
+	}
+	return a
+}
+
+// envelopeSent accumulates an envelope of size bytes sent to the proxy
+func (a *sizeAccumulator) envelopeSent(size int) {
+	a.Lock()
+	defer a.Unlock()
+	a.envelopes++
+	a.bytes += int64(size)
+}
+
+// blockDelivered reports the average size of the envelopes accumulated,
+// if any, and starts accumulating anew
+func (a *sizeAccumulator) blockDelivered() {
+	a.Lock()
+	defer a.Unlock()
+	if a.average != nil && a.envelopes > 0 {
+		a.average.Update(float64(a.bytes) / float64(a.envelopes))
+	}
+	a.envelopes = 0
+	a.bytes = 0
+}
+
+// SentSinceLastBlock returns the number of envelopes sent to the proxy since
+// the chain last delivered a block, and their cumulative size in bytes
+func (ch *chain) SentSinceLastBlock() (envelopes int, bytes int64) {
+	ch.sizes.Lock()
+	defer ch.sizes.Unlock()
+	return ch.sizes.envelopes, ch.sizes.bytes
+}
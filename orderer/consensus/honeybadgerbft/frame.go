@@ -0,0 +1,166 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package honeybadgerbft
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Frames exchanged with the HoneyBadgerBFT proxy are prefixed with their
+// length, encoded as a big-endian uint64. Data frames (envelopes sent to the
+// proxy, blocks received from it) carry the marshalled message as is.
+// Control frames set the most significant bit of the length prefix and
+// start with a single byte identifying the frame type. Data frames whose
+// payload is compressed, with the algorithm negotiated with the proxy, set
+// the next bit of the length prefix.
+const (
+	controlFrameFlag    = uint64(1) << 63
+	compressedFrameFlag = uint64(1) << 62
+)
+
+// maxControlFrameSize bounds the length of the control frames received from
+// the proxy, which only echoes heartbeats and acknowledges envelopes
+const maxControlFrameSize = 64
+
+// maxFrameSize bounds the length of the frames received from the proxy, so
+// that a corrupted length prefix fails the connection instead of the
+// allocation of the frame, whatever the maximum message size configured
+const maxFrameSize = uint64(1) << 30
+
+// boundMessageSize returns the maximum message size configured, bounded by
+// maxFrameSize; 0 means maxFrameSize
+func boundMessageSize(size uint64) uint64 {
+	if size == 0 || size > maxFrameSize {
+		return maxFrameSize
+	}
+	return size
+}
+
+const (
+	// pullFrame asks the proxy to resend a range of blocks. Its payload is
+	// the number of the first block followed by the number of blocks
+	// requested, both encoded as big-endian uint64.
+	pullFrame byte = iota + 1
+	// configFrame carries a marshalled config envelope to be ordered in a
+	// block of its own.
+	configFrame
+	// heartbeatFrame carries the sequence number of a heartbeat, encoded as
+	// a big-endian uint64. The proxy sends it back unchanged over the
+	// receive connection.
+	heartbeatFrame
+	// creditFrame grants the proxy more blocks to send over the receive
+	// connection it is sent over. Its payload is the number of blocks
+	// granted, encoded as a big-endian uint64. It is only sent when flow
+	// control is enabled, the proxy then waiting for the blocks it sends
+	// to be granted.
+	creditFrame
+	// ackRequestFrame asks the proxy to acknowledge the envelopes it
+	// receives next over the send connection. Its payload is the session
+	// of the acknowledgements, encoded as a big-endian uint64. It is only
+	// sent when acknowledgements are enabled.
+	ackRequestFrame
+	// ackFrame is sent by the proxy over the receive connection to
+	// acknowledge an envelope. Its payload is the session followed by the
+	// sequence the proxy assigned to the envelope within the session, both
+	// encoded as big-endian uint64; sequence zero confirms the session
+	// itself, the first envelope being acknowledged with sequence one.
+	ackFrame
+	// resumeFrame tells the proxy where the chain resumes from when it
+	// starts, so that the blocks already committed are not ordered again
+	// after a restart. Its payload is the number of the next block the
+	// chain expects, encoded as a big-endian uint64, followed by the value
+	// of the orderer metadata of the last block committed, which holds the
+	// state the proxy wrote there, if any. It is the first frame sent over
+	// the send connection, and only sent when resuming is enabled.
+	resumeFrame
+	// compressionFrame asks the proxy to accept the envelopes compressed
+	// with an algorithm, and allows it to compress the blocks it sends.
+	// Its payload is the algorithm, 1 for gzip and 2 for snappy, followed
+	// by the session of the compression, encoded as a big-endian uint64.
+	// The proxy sends it back unchanged over the receive connection once
+	// it accepts compressed envelopes over the send connection it was
+	// received over. It is only sent when compression is enabled.
+	compressionFrame
+)
+
+// framingError means the frames received from the proxy cannot be told
+// apart anymore: a frame was cut short or its length prefix is invalid, so
+// that the bytes following it would be read as the wrong frames. The
+// connection it was received over must be dropped rather than read further.
+type framingError struct {
+	err error
+}
+
+func (e *framingError) Error() string {
+	return e.err.Error()
+}
+
+// readFrame reads the bytes of a frame whose length prefix was read; the
+// connection ending before all of them are read is a framing error
+func readFrame(conn net.Conn, buf []byte) error {
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return &framingError{err}
+	}
+	return nil
+}
+
+func (ch *chain) sendControlFrame(conn net.Conn, frameType byte, payload []byte) error {
+	buf := make([]byte, 8+1+len(payload))
+
+	binary.BigEndian.PutUint64(buf[:8], controlFrameFlag|uint64(1+len(payload)))
+	buf[8] = frameType
+	copy(buf[9:], payload)
+
+	return ch.writeFrame(conn, buf)
+}
+
+// sendPullRequest asks the proxy for count blocks starting at block start;
+// the proxy answers with the requested blocks on the same connection.
+func (ch *chain) sendPullRequest(conn net.Conn, start uint64, count uint64) error {
+	var payload [16]byte
+
+	ch.logger.Infof("Pulling %d block(s) starting at block %d from proxy", count, start)
+
+	binary.BigEndian.PutUint64(payload[:8], start)
+	binary.BigEndian.PutUint64(payload[8:], count)
+
+	return ch.sendControlFrame(conn, pullFrame, payload[:])
+}
+
+// sendCredit grants the proxy count more blocks to send over conn
+func (ch *chain) sendCredit(conn net.Conn, count uint64) error {
+	var payload [8]byte
+	binary.BigEndian.PutUint64(payload[:], count)
+	return ch.sendControlFrame(conn, creditFrame, payload[:])
+}
+
+// recvControlFrame reads the payload of a control frame of the given length
+// sent by the proxy and handles it. The proxy only sends heartbeat frames,
+// echoing the ones sent to it, and acknowledgements and compression frames
+// when asked to.
+func (ch *chain) recvControlFrame(conn net.Conn, size uint64) error {
+	buf := make([]byte, size)
+	if err := readFrame(conn, buf); err != nil {
+		return err
+	}
+	switch buf[0] {
+	case heartbeatFrame:
+		return ch.heartbeatEchoed(buf[1:])
+	case ackFrame:
+		return ch.acked(buf[1:])
+	case compressionFrame:
+		return ch.compressionConfirmed(buf[1:])
+	default:
+		return fmt.Errorf("unexpected control frame of type %d received from proxy", buf[0])
+	}
+}
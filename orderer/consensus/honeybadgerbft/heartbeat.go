@@ -0,0 +1,106 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package honeybadgerbft
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// defaultMaxMissedHeartbeats is the number of heartbeats the proxy may
+// leave unechoed before the connection to it is replaced
+const defaultMaxMissedHeartbeats = 3
+
+// heartbeatLoop sends a heartbeat to the proxy every heartbeatInterval until
+// the chain is halted. The proxy echoes the heartbeats back on the receive
+// connection; once maxMissedHeartbeats of them are left unechoed, the
+// connection to the send proxy is replaced.
+func (ch *chain) heartbeatLoop() {
+	ticker := time.NewTicker(ch.heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ch.exitChan:
+			return
+		}
+
+		if missed := ch.missedHeartbeats(); missed >= ch.maxMissedHeartbeats {
+			ch.logger.Warningf("%d heartbeat(s) not echoed by proxy, reconnecting", missed)
+			if err := ch.replaceSendConnection(); err != nil {
+				ch.logger.Errorf("%s", err)
+				ch.fail(err)
+				return
+			}
+			continue
+		}
+		ch.sendHeartbeat()
+	}
+}
+
+// missedHeartbeats returns the number of heartbeats sent to the proxy since
+// the last one it echoed
+func (ch *chain) missedHeartbeats() uint64 {
+	return atomic.LoadUint64(&ch.heartbeatsSent) - atomic.LoadUint64(&ch.heartbeatsEchoed)
+}
+
+// sendHeartbeat sends the next heartbeat over the connection to the send
+// proxy, unless the connection is being replaced. The heartbeat carries its
+// sequence number, which the proxy echoes.
+func (ch *chain) sendHeartbeat() {
+	ch.sendLock.Lock()
+	defer ch.sendLock.Unlock()
+
+	ch.connLock.Lock()
+	conn := ch.sendConnection
+	ch.connLock.Unlock()
+	if conn == nil {
+		return
+	}
+
+	var payload [8]byte
+	binary.BigEndian.PutUint64(payload[:], atomic.AddUint64(&ch.heartbeatsSent, 1))
+	if err := ch.sendControlFrame(conn, heartbeatFrame, payload[:]); err != nil {
+		ch.logger.Warningf("Could not send heartbeat to proxy: %s", err)
+		ch.dropSendConnection(conn)
+	}
+}
+
+// replaceSendConnection replaces the connection to the send proxy by a new
+// one, the heartbeats being missed over the current one
+func (ch *chain) replaceSendConnection() error {
+	ch.sendLock.Lock()
+	defer ch.sendLock.Unlock()
+
+	if _, err := ch.reconnectSend(); err != nil {
+		return err
+	}
+	// the heartbeats sent over the previous connection are not waited for
+	atomic.StoreUint64(&ch.heartbeatsEchoed, atomic.LoadUint64(&ch.heartbeatsSent))
+	return nil
+}
+
+// heartbeatEchoed records the heartbeat echoed by the proxy, as received in
+// a heartbeat frame
+func (ch *chain) heartbeatEchoed(payload []byte) error {
+	if len(payload) != 8 {
+		return fmt.Errorf("heartbeat of %d bytes received from proxy, expected 8", len(payload))
+	}
+	seq := binary.BigEndian.Uint64(payload)
+	if seq > atomic.LoadUint64(&ch.heartbeatsSent) {
+		return fmt.Errorf("heartbeat %d received from proxy was never sent", seq)
+	}
+	for {
+		echoed := atomic.LoadUint64(&ch.heartbeatsEchoed)
+		if seq <= echoed || atomic.CompareAndSwapUint64(&ch.heartbeatsEchoed, echoed, seq) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,100 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package honeybadgerbft
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/hyperledger/fabric/common/metrics"
+)
+
+// defaultLatencyTrackingSize is the number of envelopes sent to the proxy
+// a chain waits to see in a block, unless configured otherwise
+const defaultLatencyTrackingSize = 10000
+
+// sentEnvelope is an envelope sent to the proxy and not seen in a block yet
+type sentEnvelope struct {
+	hash   [sha256.Size]byte
+	sentAt time.Time
+}
+
+// latencyTracker measures how long the envelopes sent to the proxy take to
+// come back in a block, and reports it to the commit_latency histogram.
+// The envelopes are identified by the hash of their bytes, which the proxy
+// orders as is. At most size envelopes are waited for, the oldest being
+// forgotten beyond it, so that the envelopes the proxy drops, or which are
+// sent again, do not pile up.
+type latencyTracker struct {
+	size      int
+	histogram metrics.Histogram
+
+	sync.Mutex
+	// sent lists the envelopes waited for from the oldest to the most
+	// recent, which pending indexes by hash
+	sent    *list.List
+	pending map[[sha256.Size]byte]*list.Element
+}
+
+// newLatencyTracker returns a tracker waiting for at most size envelopes,
+// or nil (no tracking) if there is no metrics scope to report to
+func newLatencyTracker(size int, scope metrics.Scope) *latencyTracker {
+	if scope == nil {
+		return nil
+	}
+	if size <= 0 {
+		size = defaultLatencyTrackingSize
+	}
+	return &latencyTracker{
+		size:      size,
+		histogram: scope.Histogram("commit_latency"),
+		sent:      list.New(),
+		pending:   make(map[[sha256.Size]byte]*list.Element),
+	}
+}
+
+// envelopeSent records the envelope sent to the proxy at now
+func (t *latencyTracker) envelopeSent(bytes []byte, now time.Time) {
+	if t == nil {
+		return
+	}
+	hash := sha256.Sum256(bytes)
+
+	t.Lock()
+	defer t.Unlock()
+	// an envelope sent again is measured from its first sending
+	if _, ok := t.pending[hash]; ok {
+		return
+	}
+	if t.sent.Len() == t.size {
+		oldest := t.sent.Remove(t.sent.Front()).(*sentEnvelope)
+		delete(t.pending, oldest.hash)
+	}
+	t.pending[hash] = t.sent.PushBack(&sentEnvelope{hash: hash, sentAt: now})
+}
+
+// blockReceived records the latency of the envelopes sent to the proxy
+// found in the data of a block received at now
+func (t *latencyTracker) blockReceived(data [][]byte, now time.Time) {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	for _, bytes := range data {
+		element, ok := t.pending[sha256.Sum256(bytes)]
+		if !ok {
+			continue
+		}
+		sent := t.sent.Remove(element).(*sentEnvelope)
+		delete(t.pending, sent.hash)
+		t.histogram.RecordDuration(now.Sub(sent.sentAt))
+	}
+}
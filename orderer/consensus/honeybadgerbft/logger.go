@@ -0,0 +1,55 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package honeybadgerbft
+
+import (
+	"fmt"
+
+	"github.com/op/go-logging"
+)
+
+// chainLog is the package logger as seen from chainLogger, so that log
+// records carry the location of the caller of chainLogger
+var chainLog = func() *logging.Logger {
+	l := logging.MustGetLogger("orderer/honeybadgerbft")
+	l.ExtraCalldepth = 1
+	return l
+}()
+
+// chainLogger logs the lines about a chain, prefixed with its channel so
+// that the chains of a multi-channel orderer can be told apart
+type chainLogger struct {
+	prefix string
+}
+
+func newChainLogger(chainID string) chainLogger {
+	return chainLogger{prefix: fmt.Sprintf("[channel: %s] ", chainID)}
+}
+
+func (l chainLogger) Debugf(format string, args ...interface{}) {
+	chainLog.Debugf(l.prefix+format, args...)
+}
+
+func (l chainLogger) Infof(format string, args ...interface{}) {
+	chainLog.Infof(l.prefix+format, args...)
+}
+
+func (l chainLogger) Warningf(format string, args ...interface{}) {
+	chainLog.Warningf(l.prefix+format, args...)
+}
+
+func (l chainLogger) Errorf(format string, args ...interface{}) {
+	chainLog.Errorf(l.prefix+format, args...)
+}
+
+func (l chainLogger) Error(err error) {
+	chainLog.Error(l.prefix + err.Error())
+}
+
+func (l chainLogger) Panicf(format string, args ...interface{}) {
+	chainLog.Panicf(l.prefix+format, args...)
+}
@@ -0,0 +1,92 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package honeybadgerbft
+
+import (
+	"bytes"
+	"fmt"
+
+	cb "github.com/hyperledger/fabric/protos/common"
+	"github.com/hyperledger/fabric/protos/utils"
+)
+
+// protocolErrorQueueSize is the number of protocol errors waiting to be
+// consumed beyond which new ones are only logged
+const protocolErrorQueueSize = 100
+
+// ProtocolError reports a block sent by the proxy which is well formed but
+// cannot be appended to the chain, and has been dropped
+type ProtocolError struct {
+	// BlockNumber is the number in the header of the block
+	BlockNumber uint64
+	// Reason describes what is wrong with the block
+	Reason string
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("block %d received from HoneyBadgerBFT proxy rejected: %s", e.BlockNumber, e.Reason)
+}
+
+// validateBlock checks that a block received from the proxy is intact and
+// belongs to the chain. Blocks without data carry no channel, only their
+// data hash is checked.
+func (ch *chain) validateBlock(block *cb.Block) *ProtocolError {
+	data := block.Data
+	if data == nil {
+		data = &cb.BlockData{}
+	}
+	if !bytes.Equal(block.Header.DataHash, data.Hash()) {
+		return &ProtocolError{BlockNumber: block.Header.Number, Reason: "data hash does not match the data of the block"}
+	}
+	if len(data.Data) == 0 {
+		return nil
+	}
+
+	chainID, err := utils.GetChainIDFromBlock(block)
+	if err != nil {
+		return &ProtocolError{BlockNumber: block.Header.Number, Reason: err.Error()}
+	}
+	if chainID != ch.support.ChainID() {
+		return &ProtocolError{
+			BlockNumber: block.Header.Number,
+			Reason:      fmt.Sprintf("block belongs to channel %s instead of %s", chainID, ch.support.ChainID()),
+		}
+	}
+	return nil
+}
+
+// validateChaining checks that the block about to be appended follows the
+// last block appended, the first block received after the chain started
+// following the last block of the ledger. Nothing is checked if the hash of
+// that block is not known.
+func (ch *chain) validateChaining(block *cb.Block) *ProtocolError {
+	if ch.lastHash == nil || bytes.Equal(block.Header.PreviousHash, ch.lastHash) {
+		return nil
+	}
+	return &ProtocolError{
+		BlockNumber: block.Header.Number,
+		Reason:      fmt.Sprintf("previous hash does not match the hash of block %d", block.Header.Number-1),
+	}
+}
+
+// reportProtocolError hands the error over to the consumer of
+// ProtocolErrors, never blocking the receipt of blocks
+func (ch *chain) reportProtocolError(err *ProtocolError) {
+	ch.logger.Warningf("[recv] %s", err)
+
+	select {
+	case ch.protocolErrors <- err:
+	default:
+		ch.logger.Warningf("[recv] Protocol error queue is full, dropping error about block %d", err.BlockNumber)
+	}
+}
+
+// ProtocolErrors returns the channel the errors about the blocks sent by the
+// proxy and dropped by the chain are reported to
+func (ch *chain) ProtocolErrors() <-chan *ProtocolError {
+	return ch.protocolErrors
+}
@@ -0,0 +1,176 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package honeybadgerbft
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	localconfig "github.com/hyperledger/fabric/orderer/common/localconfig"
+)
+
+// minReconnectInterval is the shortest wait before an attempt to reconnect,
+// so that a policy without an interval does not retry in a busy loop
+const minReconnectInterval = 10 * time.Millisecond
+
+// reconnectPolicy paces the attempts to reestablish a connection to the
+// proxy, waiting exponentially longer between consecutive attempts
+type reconnectPolicy struct {
+	interval    time.Duration
+	maxInterval time.Duration
+	// maxRetries bounds the attempts to reconnect; 0 means they go on until
+	// the chain exits
+	maxRetries int
+	logger     chainLogger
+}
+
+func newReconnectPolicy(config localconfig.HoneyBadgerBFT, logger chainLogger) reconnectPolicy {
+	return reconnectPolicy{
+		interval:    config.ReconnectInterval,
+		maxInterval: config.ReconnectMaxInterval,
+		maxRetries:  config.ReconnectMaxRetries,
+		logger:      logger,
+	}
+}
+
+// retry calls connect until it succeeds, it failed maxRetries times or exit
+// is closed, and returns the last error in the latter cases
+func (p reconnectPolicy) retry(what string, exit <-chan struct{}, connect func() error) error {
+	interval := p.interval
+	if interval < minReconnectInterval {
+		interval = minReconnectInterval
+	}
+	maxInterval := p.maxInterval
+	if maxInterval < interval {
+		maxInterval = interval
+	}
+
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-time.After(interval):
+		case <-exit:
+			return fmt.Errorf("exiting")
+		}
+
+		err := connect()
+		if err == nil {
+			p.logger.Infof("Reconnected to %s after %d attempt(s)", what, attempt)
+			return nil
+		}
+		if p.maxRetries <= 0 {
+			p.logger.Warningf("Attempt %d to reconnect to %s failed: %s", attempt, what, err)
+		} else {
+			p.logger.Warningf("Attempt %d of %d to reconnect to %s failed: %s", attempt, p.maxRetries, what, err)
+			if attempt == p.maxRetries {
+				return err
+			}
+		}
+
+		interval *= 2
+		if interval > maxInterval {
+			interval = maxInterval
+		}
+	}
+}
+
+// reconnectSend replaces the connection to the send proxy by a new one, to
+// the first replica of the proxy accepting it
+func (ch *chain) reconnectSend() (net.Conn, error) {
+	var conn net.Conn
+	err := ch.reconnect.retry("send proxy", ch.exitChan, func() error {
+		ch.state.reconnectAttempted()
+		var err error
+		conn, err = ch.dialAnySend()
+		return err
+	})
+	if err != nil {
+		_, address := ch.sendEndpoint()
+		return nil, fmt.Errorf("could not reconnect to send proxy on %s: %s", address, err)
+	}
+
+	ch.connLock.Lock()
+	defer ch.connLock.Unlock()
+	select {
+	case <-ch.exitChan:
+		conn.Close()
+		return nil, fmt.Errorf("exiting")
+	default:
+	}
+	if ch.sendConnection != nil {
+		ch.sendConnection.Close()
+	}
+	ch.sendConnection = conn
+	return conn, nil
+}
+
+// relisten replaces the listener the receive proxy of the given replica
+// connects to by a new one
+func (ch *chain) relisten(replica int) (net.Listener, error) {
+	ch.connLock.Lock()
+	if ch.receiveConnections[replica] != nil {
+		// closing the listener removes its socket, which is created anew
+		ch.receiveConnections[replica].Close()
+	}
+	ch.connLock.Unlock()
+
+	var listener net.Listener
+	err := ch.reconnect.retry("receive proxy", ch.exitChan, func() error {
+		ch.state.reconnectAttempted()
+		var err error
+		listener, err = ch.listenReceive(replica)
+		return err
+	})
+	if err != nil {
+		_, address := ch.receiveEndpoint(replica)
+		return nil, fmt.Errorf("could not listen again for receive proxy on %s: %s", address, err)
+	}
+
+	ch.connLock.Lock()
+	defer ch.connLock.Unlock()
+	select {
+	case <-ch.exitChan:
+		listener.Close()
+		return nil, fmt.Errorf("exiting")
+	default:
+	}
+	ch.receiveConnections[replica] = listener
+	return listener, nil
+}
+
+// Reconnect replaces the connections to the proxy by new ones on demand,
+// e.g. during the maintenance of the proxy, without halting the chain. The
+// envelopes being ordered wait for the new connection to the send proxy,
+// while the receive proxies are expected to connect again to the sockets
+// listened on anew. The chain fails, like on a broken connection, if the
+// send proxy cannot be reached again.
+func (ch *chain) Reconnect() error {
+	select {
+	case <-ch.exitChan:
+		return fmt.Errorf("exiting")
+	default:
+	}
+	ch.logger.Infof("Reconnecting to proxy on demand")
+
+	// connLoop closes the receive connections and listens again
+	ch.connLock.Lock()
+	close(ch.recycle)
+	ch.recycle = make(chan struct{})
+	for _, listener := range ch.receiveConnections {
+		if listener != nil {
+			listener.Close()
+		}
+	}
+	ch.connLock.Unlock()
+
+	if err := ch.replaceSendConnection(); err != nil {
+		ch.logger.Errorf("%s", err)
+		ch.fail(err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package honeybadgerbft
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// sendResume tells the proxy over conn which block the chain expects next
+// and the state of the proxy recorded in the metadata of the last block
+// committed, unless resuming is disabled
+func (ch *chain) sendResume(conn net.Conn) error {
+	if !ch.resume {
+		return nil
+	}
+	height := ch.support.Height()
+	payload := make([]byte, 8+len(ch.resumeState))
+	binary.BigEndian.PutUint64(payload[:8], height)
+	copy(payload[8:], ch.resumeState)
+
+	ch.logger.Infof("Resuming from block %d with %d byte(s) of proxy state", height, len(ch.resumeState))
+	return ch.sendControlFrame(conn, resumeFrame, payload)
+}
@@ -0,0 +1,29 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package honeybadgerbft
+
+import (
+	"fmt"
+
+	cb "github.com/hyperledger/fabric/protos/common"
+)
+
+// revalidate validates the normal envelope anew when the config of the
+// channel was updated since it was validated against the config of sequence
+// configSeq. An envelope which is no longer valid is dropped, and the error
+// returned.
+func (ch *chain) revalidate(env *cb.Envelope, configSeq uint64) error {
+	seq := ch.support.Sequence()
+	if configSeq >= seq {
+		return nil
+	}
+	if _, err := ch.support.ProcessNormalMsg(env); err != nil {
+		ch.logger.Warningf("Discarding normal message no longer valid at config sequence %d: %s", seq, err)
+		return fmt.Errorf("message invalidated by config update: %s", err)
+	}
+	return nil
+}
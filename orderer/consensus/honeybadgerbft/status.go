@@ -0,0 +1,91 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package honeybadgerbft
+
+import (
+	"sync"
+	"time"
+)
+
+// ConnectionStatus is the state of the connections of a chain to the proxy,
+// as reported to the health checks of the orderer
+type ConnectionStatus struct {
+	// SendConnected tells whether the chain holds a connection to the send
+	// proxy
+	SendConnected bool
+	// ReceiveConnected tells, for the proxy then each of its replicas,
+	// whether its receive proxy is connected to the chain
+	ReceiveConnected []bool
+	// LastSend is the time an envelope was last sent to the proxy, zero if
+	// none was
+	LastSend time.Time
+	// LastBlock is the number of the last block received from the proxy,
+	// valid only when BlockReceived is set
+	LastBlock     uint64
+	BlockReceived bool
+	// ReconnectAttempts is the number of attempts to reconnect to the
+	// proxy since the chain started, successful or not
+	ReconnectAttempts uint64
+}
+
+// connectionState records the state of the connections of a chain as they
+// are used, for Status
+type connectionState struct {
+	sync.Mutex
+	receiveConnected  []bool
+	lastSend          time.Time
+	lastBlock         uint64
+	blockReceived     bool
+	reconnectAttempts uint64
+}
+
+func newConnectionState(proxyCount int) *connectionState {
+	return &connectionState{receiveConnected: make([]bool, proxyCount)}
+}
+
+func (s *connectionState) receiveConnectionChanged(replica int, connected bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.receiveConnected[replica] = connected
+}
+
+func (s *connectionState) envelopeSent(now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	s.lastSend = now
+}
+
+func (s *connectionState) blockReceivedAt(number uint64) {
+	s.Lock()
+	defer s.Unlock()
+	s.lastBlock = number
+	s.blockReceived = true
+}
+
+func (s *connectionState) reconnectAttempted() {
+	s.Lock()
+	defer s.Unlock()
+	s.reconnectAttempts++
+}
+
+// Status returns the state of the connections of the chain to the proxy
+func (ch *chain) Status() ConnectionStatus {
+	ch.connLock.Lock()
+	sendConnected := ch.sendConnection != nil
+	ch.connLock.Unlock()
+
+	ch.state.Lock()
+	defer ch.state.Unlock()
+	return ConnectionStatus{
+		SendConnected:     sendConnected,
+		ReceiveConnected:  append([]bool(nil), ch.state.receiveConnected...),
+		LastSend:          ch.state.lastSend,
+		LastBlock:         ch.state.lastBlock,
+		BlockReceived:     ch.state.blockReceived,
+		ReconnectAttempts: ch.state.reconnectAttempts,
+	}
+}
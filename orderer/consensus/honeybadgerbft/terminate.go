@@ -0,0 +1,35 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package honeybadgerbft
+
+import "fmt"
+
+// consensusType is the consensus type of the channels ordered by this
+// consenter in the orderer config
+const consensusType = "honeybadgerbft"
+
+// errTerminated is returned for the config updates of a terminated channel
+var errTerminated = fmt.Errorf("channel terminated")
+
+// terminated returns whether the current config of the channel terminates
+// the chain, i.e. no longer has it ordered by honeybadgerbft, in which case
+// the chain is to be halted.
+func (ch *chain) terminated() bool {
+	return ch.support.SharedConfig().ConsensusType() != consensusType
+}
+
+// haltIfTerminated halts the chain if the current config of the channel
+// terminates it, and returns whether it did. Halting a chain already halted
+// is harmless, so that it may be called any number of times.
+func (ch *chain) haltIfTerminated() bool {
+	if !ch.terminated() {
+		return false
+	}
+	ch.logger.Infof("Channel config no longer has the channel ordered by %s, halting", consensusType)
+	ch.Halt()
+	return true
+}
@@ -0,0 +1,154 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package honeybadgerbft
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hyperledger/fabric/common/metrics"
+)
+
+const (
+	// defaultMeasurementInterval is the number of envelopes ordered between
+	// two throughput samples, unless they are taken periodically
+	defaultMeasurementInterval = 10000
+	// defaultThroughputHistorySize is the number of most recent throughput
+	// samples a chain retains
+	defaultThroughputHistorySize = 100
+)
+
+// ThroughputSample is the ordering throughput measured over an interval,
+// in envelopes per second, along with the time the interval ended
+type ThroughputSample struct {
+	Value     float64
+	Timestamp time.Time
+}
+
+// throughputMeter samples the rate at which envelopes are ordered, keeping
+// the most recent samples in a ring buffer. It samples the rate every
+// interval envelopes or, when period is set, every period whatever the
+// number of envelopes ordered meanwhile. When it has a metrics scope, the
+// envelopes ordered are counted in envelopes_ordered and every sample is
+// reported to the throughput gauge.
+type throughputMeter struct {
+	sync.Mutex
+	interval int64
+	period   time.Duration
+	// count is the number of envelopes ordered since startTime, the start
+	// of the current measurement
+	count     int64
+	startTime time.Time
+
+	envelopes  metrics.Counter
+	throughput metrics.Gauge
+	// logger is the logger of the chain the meter measures
+	logger chainLogger
+
+	samples []ThroughputSample
+	next    int
+	full    bool
+}
+
+func newThroughputMeter(interval int64, period time.Duration, historySize int, scope metrics.Scope) *throughputMeter {
+	m := &throughputMeter{
+		interval: interval,
+		period:   period,
+		samples:  make([]ThroughputSample, historySize),
+	}
+	if scope != nil {
+		m.envelopes = scope.Counter("envelopes_ordered")
+		m.throughput = scope.Gauge("throughput")
+	}
+	return m
+}
+
+// envelopeOrdered counts an envelope ordered at now, recording a sample
+// every interval envelopes unless the meter samples every period
+func (m *throughputMeter) envelopeOrdered(now time.Time) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.startTime.IsZero() {
+		m.startTime = now
+	}
+
+	if m.envelopes != nil {
+		m.envelopes.Inc(1)
+	}
+
+	m.count++
+	if m.period > 0 || m.count < m.interval {
+		return
+	}
+	m.record(now)
+}
+
+// run records a sample every period until exit is closed, when the meter
+// samples every period
+func (m *throughputMeter) run(exit <-chan struct{}) {
+	if m.period <= 0 {
+		return
+	}
+	m.Lock()
+	m.startTime = time.Now()
+	m.Unlock()
+
+	ticker := time.NewTicker(m.period)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			m.Lock()
+			m.record(now)
+			m.Unlock()
+		case <-exit:
+			return
+		}
+	}
+}
+
+// record records the throughput measured since startTime and starts the
+// next measurement at now; it must be called with the lock held
+func (m *throughputMeter) record(now time.Time) {
+	sample := ThroughputSample{
+		Value:     float64(m.count) / now.Sub(m.startTime).Seconds(),
+		Timestamp: now,
+	}
+	m.logger.Debugf("Throughput = %v envelopes/sec", sample.Value)
+	if m.throughput != nil {
+		m.throughput.Update(sample.Value)
+	}
+	m.count = 0
+	m.startTime = now
+
+	if len(m.samples) == 0 {
+		return
+	}
+	m.samples[m.next] = sample
+	m.next = (m.next + 1) % len(m.samples)
+	if m.next == 0 {
+		m.full = true
+	}
+}
+
+// history returns the retained samples, oldest first
+func (m *throughputMeter) history() []ThroughputSample {
+	m.Lock()
+	defer m.Unlock()
+
+	if !m.full {
+		return append([]ThroughputSample(nil), m.samples[:m.next]...)
+	}
+	return append(append([]ThroughputSample(nil), m.samples[m.next:]...), m.samples[:m.next]...)
+}
+
+// ThroughputHistory returns the most recent throughput samples of the
+// chain, oldest first
+func (ch *chain) ThroughputHistory() []ThroughputSample {
+	return ch.throughput.history()
+}
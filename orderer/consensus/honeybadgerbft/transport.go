@@ -0,0 +1,133 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package honeybadgerbft
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+
+	localconfig "github.com/hyperledger/fabric/orderer/common/localconfig"
+)
+
+// newTLSConfig loads the certificate the orderer authenticates with to the
+// proxy, and the CAs the certificates of the proxy are verified against,
+// both when the orderer dials the send proxy and when the receive proxy
+// connects to the orderer
+func newTLSConfig(config localconfig.TLS) (*tls.Config, error) {
+	certificate, err := ioutil.ReadFile(config.Certificate)
+	if err != nil {
+		return nil, fmt.Errorf("could not read TLS certificate %s: %s", config.Certificate, err)
+	}
+	key, err := ioutil.ReadFile(config.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not read TLS private key %s: %s", config.PrivateKey, err)
+	}
+	keyPair, err := tls.X509KeyPair(certificate, key)
+	if err != nil {
+		return nil, fmt.Errorf("could not load TLS key pair: %s", err)
+	}
+
+	roots := x509.NewCertPool()
+	for _, ca := range append(append([]string(nil), config.RootCAs...), config.ClientRootCAs...) {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("could not read TLS CA %s: %s", ca, err)
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in TLS CA %s", ca)
+		}
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{keyPair},
+		RootCAs:      roots,
+		ClientCAs:    roots,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// proxyCount returns the number of replicas of the proxy the chain talks
+// to: the one configured by the endpoints of the chain, then its replicas
+func (ch *chain) proxyCount() int {
+	return 1 + len(ch.replicas)
+}
+
+// sendEndpointOf returns where the send proxy of the given replica listens:
+// its TCP address when one is configured, its Unix socket otherwise
+func (ch *chain) sendEndpointOf(replica int) (string, string) {
+	address, socketPath := ch.sendAddress, ch.sendSocketPath
+	if replica > 0 {
+		address, socketPath = ch.replicas[replica-1].SendAddress, ch.replicas[replica-1].SendSocketPath
+	}
+	if address != "" {
+		return "tcp", address
+	}
+	return "unix", socketPath
+}
+
+// sendEndpoint returns where the send proxy the envelopes are sent to
+// listens
+func (ch *chain) sendEndpoint() (string, string) {
+	return ch.sendEndpointOf(ch.sendReplica)
+}
+
+// receiveEndpoint returns where the orderer listens for the receive proxy
+// of the given replica: the TCP address when one is configured, the Unix
+// socket otherwise
+func (ch *chain) receiveEndpoint(replica int) (string, string) {
+	address, socketPath := ch.receiveAddress, ch.receiveSocketPath
+	if replica > 0 {
+		address, socketPath = ch.replicas[replica-1].ReceiveAddress, ch.replicas[replica-1].ReceiveSocketPath
+	}
+	if address != "" {
+		return "tcp", address
+	}
+	return "unix", socketPath
+}
+
+// dialSend connects to the send proxy the envelopes are sent to, with TLS
+// over TCP when configured
+func (ch *chain) dialSend() (net.Conn, error) {
+	network, address := ch.sendEndpoint()
+	if network == "tcp" && ch.tlsConfig != nil {
+		return tls.Dial(network, address, ch.tlsConfig)
+	}
+	return net.Dial(network, address)
+}
+
+// dialAnySend connects to the first send proxy that accepts the connection,
+// starting with the one the envelopes are sent to and failing over to the
+// next replicas in turn. The envelopes are then sent to that replica.
+func (ch *chain) dialAnySend() (net.Conn, error) {
+	var err error
+	for i := 0; i < ch.proxyCount(); i++ {
+		var conn net.Conn
+		if conn, err = ch.dialSend(); err == nil {
+			return conn, nil
+		}
+		if ch.proxyCount() > 1 {
+			_, address := ch.sendEndpoint()
+			ch.logger.Warningf("Could not connect to send proxy on %s, failing over: %s", address, err)
+		}
+		ch.sendReplica = (ch.sendReplica + 1) % ch.proxyCount()
+	}
+	return nil, err
+}
+
+// listenReceive listens for the receive proxy of the given replica, with TLS
+// over TCP when configured
+func (ch *chain) listenReceive(replica int) (net.Listener, error) {
+	network, address := ch.receiveEndpoint(replica)
+	if network == "tcp" && ch.tlsConfig != nil {
+		return tls.Listen(network, address, ch.tlsConfig)
+	}
+	return net.Listen(network, address)
+}
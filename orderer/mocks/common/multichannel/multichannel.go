@@ -93,6 +93,13 @@ func (mcs *ConsenterSupport) WriteBlock(block *cb.Block, encodedMetadataValue []
 	mcs.Blocks <- block
 }
 
+// AppendBlock appends the block as is, writing it to the Blocks channel
+func (mcs *ConsenterSupport) AppendBlock(block *cb.Block) error {
+	mcs.HeightVal++
+	mcs.Blocks <- block
+	return nil
+}
+
 // WriteConfigBlock calls WriteBlock
 func (mcs *ConsenterSupport) WriteConfigBlock(block *cb.Block, encodedMetadataValue []byte) {
 	mcs.WriteBlock(block, encodedMetadataValue)
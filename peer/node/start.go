@@ -176,11 +176,14 @@ func serve(args []string) error {
 		return service.GetGossipService().DistributePrivateData(channel, txID, privateData)
 	}
 
-	serverEndorser := endorser.NewEndorserServer(privDataDist)
 	libConf := library.Config{}
 	if err = viperutil.EnhancedExactUnmarshalKey("peer.handlers", &libConf); err != nil {
 		return errors.WithMessage(err, "could not load YAML config")
 	}
+	serverEndorser := endorser.NewEndorserServer(privDataDist, endorser.Config{
+		Handlers:    libConf,
+		ACLCacheTTL: viper.GetDuration("peer.aclCacheTTL"),
+	})
 	authFilters := library.InitRegistry(libConf).Lookup(library.Auth).([]authHandler.Filter)
 	auth := authHandler.ChainFilters(serverEndorser, authFilters...)
 	// Register the Endorser server
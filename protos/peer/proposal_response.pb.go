@@ -35,6 +35,21 @@ type ProposalResponse struct {
 	// The endorsement of the proposal, basically
 	// the endorser's signature over the payload
 	Endorsement *Endorsement `protobuf:"bytes,6,opt,name=endorsement" json:"endorsement,omitempty"`
+	// The endorsements of the writes to private data collections, each
+	// produced by the identity endorsing its collection
+	CollectionEndorsements []*CollectionEndorsement `protobuf:"bytes,7,rep,name=collection_endorsements,json=collectionEndorsements" json:"collection_endorsements,omitempty"`
+	// The epoch of the key the endorsement was signed with, empty
+	// if the endorser does not rotate its keys
+	EndorsementEpoch string `protobuf:"bytes,8,opt,name=endorsement_epoch,json=endorsementEpoch" json:"endorsement_epoch,omitempty"`
+	// Warnings about the proposal for the client, which are not part of
+	// the endorsement
+	Warnings []string `protobuf:"bytes,9,rep,name=warnings" json:"warnings,omitempty"`
+	// The endpoints of the peers which acknowledged the private data
+	// written by the proposal, when the endorser reports them
+	PrivateDataRecipients []string `protobuf:"bytes,10,rep,name=private_data_recipients,json=privateDataRecipients" json:"private_data_recipients,omitempty"`
+	// Who endorsed the proposal and when, for the client, which is not
+	// part of the endorsement
+	EndorsementMetadata *EndorsementMetadata `protobuf:"bytes,11,opt,name=endorsement_metadata,json=endorsementMetadata" json:"endorsement_metadata,omitempty"`
 }
 
 func (m *ProposalResponse) Reset()                    { *m = ProposalResponse{} }
@@ -77,6 +92,41 @@ func (m *ProposalResponse) GetEndorsement() *Endorsement {
 	return nil
 }
 
+func (m *ProposalResponse) GetCollectionEndorsements() []*CollectionEndorsement {
+	if m != nil {
+		return m.CollectionEndorsements
+	}
+	return nil
+}
+
+func (m *ProposalResponse) GetEndorsementEpoch() string {
+	if m != nil {
+		return m.EndorsementEpoch
+	}
+	return ""
+}
+
+func (m *ProposalResponse) GetWarnings() []string {
+	if m != nil {
+		return m.Warnings
+	}
+	return nil
+}
+
+func (m *ProposalResponse) GetPrivateDataRecipients() []string {
+	if m != nil {
+		return m.PrivateDataRecipients
+	}
+	return nil
+}
+
+func (m *ProposalResponse) GetEndorsementMetadata() *EndorsementMetadata {
+	if m != nil {
+		return m.EndorsementMetadata
+	}
+	return nil
+}
+
 // A response with a representation similar to an HTTP response that can
 // be used within another message.
 type Response struct {
@@ -199,38 +249,145 @@ func (m *Endorsement) GetSignature() []byte {
 	return nil
 }
 
+// A CollectionEndorsement is the endorsement of the writes of a proposal
+// response to a private data collection, by an identity entitled to endorse
+// that collection.
+type CollectionEndorsement struct {
+	// Namespace (chaincode) the collection belongs to
+	Namespace string `protobuf:"bytes,1,opt,name=namespace" json:"namespace,omitempty"`
+	// Name of the collection
+	Collection string `protobuf:"bytes,2,opt,name=collection" json:"collection,omitempty"`
+	// Signature of the payload included in ProposalResponse concatenated with
+	// the namespace, the collection name and the endorser's certificate
+	Endorsement *Endorsement `protobuf:"bytes,3,opt,name=endorsement" json:"endorsement,omitempty"`
+}
+
+func (m *CollectionEndorsement) Reset()                    { *m = CollectionEndorsement{} }
+func (m *CollectionEndorsement) String() string            { return proto.CompactTextString(m) }
+func (*CollectionEndorsement) ProtoMessage()               {}
+func (*CollectionEndorsement) Descriptor() ([]byte, []int) { return fileDescriptor8, []int{4} }
+
+func (m *CollectionEndorsement) GetNamespace() string {
+	if m != nil {
+		return m.Namespace
+	}
+	return ""
+}
+
+func (m *CollectionEndorsement) GetCollection() string {
+	if m != nil {
+		return m.Collection
+	}
+	return ""
+}
+
+func (m *CollectionEndorsement) GetEndorsement() *Endorsement {
+	if m != nil {
+		return m.Endorsement
+	}
+	return nil
+}
+
+// EndorsementMetadata describes the endorsement of a proposal response for
+// the client collecting it, e.g. to evaluate the endorsement policy. It is
+// set by the endorser outside of the signed payload, so it is neither
+// validated nor part of the transaction.
+type EndorsementMetadata struct {
+	// MSP ID of the identity which signed the endorsement
+	EndorserMspid string `protobuf:"bytes,1,opt,name=endorser_mspid,json=endorserMspid" json:"endorser_mspid,omitempty"`
+	// Endpoint of the peer which endorsed the proposal
+	EndorserEndpoint string `protobuf:"bytes,2,opt,name=endorser_endpoint,json=endorserEndpoint" json:"endorser_endpoint,omitempty"`
+	// Time the peer endorsed the proposal
+	EndorsedAt *google_protobuf1.Timestamp `protobuf:"bytes,3,opt,name=endorsed_at,json=endorsedAt" json:"endorsed_at,omitempty"`
+	// Whether the identity which signed the endorsement cannot satisfy
+	// any principal of the endorsement policy of the chaincode, so that
+	// the endorsement does not count towards it
+	OutsideEndorsementPolicy bool `protobuf:"varint,4,opt,name=outside_endorsement_policy,json=outsideEndorsementPolicy" json:"outside_endorsement_policy,omitempty"`
+}
+
+func (m *EndorsementMetadata) Reset()                    { *m = EndorsementMetadata{} }
+func (m *EndorsementMetadata) String() string            { return proto.CompactTextString(m) }
+func (*EndorsementMetadata) ProtoMessage()               {}
+func (*EndorsementMetadata) Descriptor() ([]byte, []int) { return fileDescriptor8, []int{5} }
+
+func (m *EndorsementMetadata) GetEndorserMspid() string {
+	if m != nil {
+		return m.EndorserMspid
+	}
+	return ""
+}
+
+func (m *EndorsementMetadata) GetEndorserEndpoint() string {
+	if m != nil {
+		return m.EndorserEndpoint
+	}
+	return ""
+}
+
+func (m *EndorsementMetadata) GetEndorsedAt() *google_protobuf1.Timestamp {
+	if m != nil {
+		return m.EndorsedAt
+	}
+	return nil
+}
+
+func (m *EndorsementMetadata) GetOutsideEndorsementPolicy() bool {
+	if m != nil {
+		return m.OutsideEndorsementPolicy
+	}
+	return false
+}
+
 func init() {
 	proto.RegisterType((*ProposalResponse)(nil), "protos.ProposalResponse")
 	proto.RegisterType((*Response)(nil), "protos.Response")
 	proto.RegisterType((*ProposalResponsePayload)(nil), "protos.ProposalResponsePayload")
 	proto.RegisterType((*Endorsement)(nil), "protos.Endorsement")
+	proto.RegisterType((*CollectionEndorsement)(nil), "protos.CollectionEndorsement")
+	proto.RegisterType((*EndorsementMetadata)(nil), "protos.EndorsementMetadata")
 }
 
 func init() { proto.RegisterFile("peer/proposal_response.proto", fileDescriptor8) }
 
 var fileDescriptor8 = []byte{
-	// 367 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x6c, 0x92, 0x51, 0x4b, 0xfb, 0x30,
-	0x14, 0xc5, 0xe9, 0xfe, 0xff, 0xcd, 0x2d, 0x9b, 0x30, 0x2a, 0x68, 0x19, 0x03, 0x47, 0x7d, 0x99,
-	0x20, 0x29, 0x28, 0x82, 0xcf, 0x03, 0xd1, 0xc7, 0x11, 0xc4, 0x07, 0x11, 0x24, 0xdd, 0xee, 0xd2,
-	0x62, 0xdb, 0x84, 0xdc, 0x54, 0xdc, 0x07, 0xf6, 0x7b, 0x48, 0xd3, 0xa6, 0xab, 0xe2, 0xd3, 0x38,
-	0x77, 0x27, 0xbf, 0x7b, 0xcf, 0xed, 0x25, 0x73, 0x05, 0xa0, 0x23, 0xa5, 0xa5, 0x92, 0xc8, 0xb3,
-	0x37, 0x0d, 0xa8, 0x64, 0x81, 0x40, 0x95, 0x96, 0x46, 0xfa, 0x03, 0xfb, 0x83, 0xb3, 0x73, 0x21,
-	0xa5, 0xc8, 0x20, 0xb2, 0x32, 0x2e, 0x77, 0x91, 0x49, 0x73, 0x40, 0xc3, 0x73, 0x55, 0x1b, 0xc3,
-	0x2f, 0x8f, 0x4c, 0xd7, 0x0d, 0x84, 0x35, 0x0c, 0x3f, 0x20, 0x47, 0x1f, 0xa0, 0x31, 0x95, 0x45,
-	0xe0, 0x2d, 0xbc, 0x65, 0x9f, 0x39, 0xe9, 0xdf, 0x91, 0x51, 0x4b, 0x08, 0x7a, 0x0b, 0x6f, 0x39,
-	0xbe, 0x9e, 0xd1, 0xba, 0x07, 0x75, 0x3d, 0xe8, 0x93, 0x73, 0xb0, 0x83, 0xd9, 0xbf, 0x22, 0x43,
-	0x37, 0x63, 0xf0, 0xdf, 0x3e, 0x9c, 0xd6, 0x2f, 0x90, 0xba, 0xbe, 0xac, 0x75, 0x54, 0x13, 0x28,
-	0xbe, 0xcf, 0x24, 0xdf, 0x06, 0xfd, 0x85, 0xb7, 0x9c, 0x30, 0x27, 0xfd, 0x5b, 0x32, 0x86, 0x62,
-	0x2b, 0x35, 0x42, 0x0e, 0x85, 0x09, 0x06, 0x16, 0x75, 0xe2, 0x50, 0xf7, 0x87, 0xbf, 0x58, 0xd7,
-	0x17, 0x3e, 0x93, 0x61, 0x1b, 0xef, 0x94, 0x0c, 0xd0, 0x70, 0x53, 0x62, 0x93, 0xae, 0x51, 0x55,
-	0xd3, 0x1c, 0x10, 0xb9, 0x00, 0x1b, 0x6d, 0xc4, 0x9c, 0xec, 0x8e, 0xf3, 0xef, 0xc7, 0x38, 0xe1,
-	0x2b, 0x39, 0xfb, 0xbd, 0xbe, 0x75, 0x33, 0xe9, 0x05, 0x39, 0x6e, 0x3f, 0x4f, 0xc2, 0x31, 0xb1,
-	0xdd, 0x26, 0x6c, 0xe2, 0x8a, 0x8f, 0x1c, 0x13, 0x7f, 0x4e, 0x46, 0xf0, 0x69, 0xa0, 0xb0, 0xcb,
-	0xee, 0x59, 0xc3, 0xa1, 0x10, 0x3e, 0x90, 0x71, 0x27, 0x91, 0x3f, 0x23, 0xc3, 0x26, 0x93, 0x6e,
-	0x60, 0xad, 0xae, 0x40, 0x98, 0x8a, 0x82, 0x9b, 0x52, 0x83, 0x03, 0xb5, 0x85, 0x55, 0x42, 0x42,
-	0xa9, 0x05, 0x4d, 0xf6, 0x0a, 0x74, 0x06, 0x5b, 0x01, 0x9a, 0xee, 0x78, 0xac, 0xd3, 0x8d, 0x5b,
-	0x5c, 0x75, 0x4d, 0xab, 0x3f, 0xa2, 0x6c, 0xde, 0xb9, 0x80, 0x97, 0x4b, 0x91, 0x9a, 0xa4, 0x8c,
-	0xe9, 0x46, 0xe6, 0x51, 0x87, 0x11, 0xd5, 0x8c, 0xfa, 0xba, 0x30, 0xaa, 0x18, 0x71, 0x7d, 0x79,
-	0x37, 0xdf, 0x01, 0x00, 0x00, 0xff, 0xff, 0x0e, 0x52, 0x0b, 0x35, 0xa0, 0x02, 0x00, 0x00,
+	// 614 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x54, 0x5f, 0x6b, 0xd4, 0x4e,
+	0x14, 0x65, 0xbb, 0xfd, 0xb3, 0xb9, 0xdb, 0xfe, 0xe8, 0x6f, 0x6a, 0xdb, 0xb0, 0x56, 0x5d, 0x22,
+	0xc2, 0x8a, 0x92, 0x85, 0x8a, 0x22, 0xe8, 0x8b, 0xd5, 0xa2, 0x2f, 0x95, 0x32, 0x48, 0x1f, 0x44,
+	0x08, 0xb3, 0xc9, 0x6d, 0x32, 0x98, 0x64, 0x86, 0x99, 0xd9, 0x6a, 0xbf, 0x83, 0xf8, 0x29, 0xfd,
+	0x20, 0x92, 0xd9, 0x4c, 0x76, 0x5a, 0x17, 0xf1, 0x29, 0xdc, 0x73, 0xcf, 0x9c, 0xb9, 0x7f, 0xce,
+	0x04, 0x8e, 0x24, 0xa2, 0x9a, 0x4a, 0x25, 0xa4, 0xd0, 0xac, 0x4c, 0x14, 0x6a, 0x29, 0x6a, 0x8d,
+	0xb1, 0x54, 0xc2, 0x08, 0xb2, 0x69, 0x3f, 0x7a, 0xf4, 0x20, 0x17, 0x22, 0x2f, 0x71, 0x6a, 0xc3,
+	0xd9, 0xfc, 0x72, 0x6a, 0x78, 0x85, 0xda, 0xb0, 0x4a, 0x2e, 0x88, 0xd1, 0xcf, 0x75, 0xd8, 0x3d,
+	0x6f, 0x45, 0x68, 0xab, 0x41, 0x42, 0xd8, 0xba, 0x42, 0xa5, 0xb9, 0xa8, 0xc3, 0xde, 0xb8, 0x37,
+	0xd9, 0xa0, 0x2e, 0x24, 0x2f, 0x21, 0xe8, 0x14, 0xc2, 0xb5, 0x71, 0x6f, 0x32, 0x3c, 0x1e, 0xc5,
+	0x8b, 0x3b, 0x62, 0x77, 0x47, 0xfc, 0xc9, 0x31, 0xe8, 0x92, 0x4c, 0x9e, 0xc2, 0xc0, 0xd5, 0x18,
+	0xae, 0xdb, 0x83, 0xbb, 0x8b, 0x13, 0x3a, 0x76, 0xf7, 0xd2, 0x81, 0xf2, 0x2a, 0x90, 0xec, 0xba,
+	0x14, 0x2c, 0x0b, 0x37, 0xc6, 0xbd, 0xc9, 0x36, 0x75, 0x21, 0x79, 0x0e, 0x43, 0xac, 0x33, 0xa1,
+	0x34, 0x56, 0x58, 0x9b, 0x70, 0xd3, 0x4a, 0xed, 0x39, 0xa9, 0xd3, 0x65, 0x8a, 0xfa, 0x3c, 0x72,
+	0x01, 0x87, 0xa9, 0x28, 0x4b, 0x4c, 0x0d, 0x17, 0x75, 0xe2, 0x65, 0x74, 0xb8, 0x35, 0xee, 0x4f,
+	0x86, 0xc7, 0xf7, 0x9c, 0xc4, 0xdb, 0x8e, 0xe6, 0x8b, 0x1d, 0xa4, 0xab, 0x60, 0x4d, 0x9e, 0xc0,
+	0xff, 0x9e, 0x58, 0x82, 0x52, 0xa4, 0x45, 0x38, 0x18, 0xf7, 0x26, 0x01, 0xdd, 0xf5, 0x12, 0xa7,
+	0x0d, 0x4e, 0x46, 0x30, 0xf8, 0xc6, 0x54, 0xcd, 0xeb, 0x5c, 0x87, 0xc1, 0xb8, 0x3f, 0x09, 0x68,
+	0x17, 0x93, 0x17, 0x70, 0x28, 0x15, 0xbf, 0x62, 0x06, 0x93, 0x8c, 0x19, 0x96, 0x28, 0x4c, 0xb9,
+	0xe4, 0xb6, 0x40, 0xb0, 0xd4, 0xfd, 0x36, 0xfd, 0x8e, 0x19, 0x46, 0xbb, 0x24, 0xf9, 0x08, 0x77,
+	0xfc, 0x02, 0x2a, 0x34, 0xac, 0x39, 0x1f, 0x0e, 0xed, 0x60, 0xee, 0xae, 0x18, 0xcc, 0x59, 0x4b,
+	0xa1, 0x7b, 0xf8, 0x27, 0x18, 0x5d, 0xc0, 0xa0, 0xf3, 0xc1, 0x01, 0x6c, 0x6a, 0xc3, 0xcc, 0x5c,
+	0xb7, 0x36, 0x68, 0xa3, 0x66, 0x3b, 0x15, 0x6a, 0xcd, 0x72, 0xb4, 0x1e, 0x08, 0xa8, 0x0b, 0xfd,
+	0xbd, 0xf5, 0x6f, 0xec, 0x2d, 0xfa, 0x02, 0x87, 0xb7, 0x7d, 0x76, 0xde, 0xae, 0xf4, 0x21, 0xec,
+	0x74, 0x3e, 0x2e, 0x98, 0x2e, 0xec, 0x6d, 0xdb, 0x74, 0xdb, 0x81, 0x1f, 0x98, 0x2e, 0xc8, 0x11,
+	0x04, 0xf8, 0xdd, 0x60, 0x6d, 0x5d, 0xb9, 0x66, 0x09, 0x4b, 0x20, 0x7a, 0x0f, 0x43, 0xaf, 0xc3,
+	0x66, 0xd0, 0x6d, 0x6f, 0xaa, 0x15, 0xeb, 0xe2, 0x46, 0x48, 0xf3, 0xbc, 0x66, 0x66, 0xae, 0xd0,
+	0x09, 0x75, 0x40, 0xf4, 0xa3, 0x07, 0xfb, 0x2b, 0x1d, 0xd0, 0x9c, 0xab, 0x59, 0x85, 0x5a, 0xb2,
+	0x14, 0xad, 0x68, 0x40, 0x97, 0x00, 0xb9, 0x0f, 0xb0, 0x74, 0x48, 0x3b, 0x15, 0x0f, 0xb9, 0x6d,
+	0xdb, 0xfe, 0xbf, 0xd9, 0x36, 0xfa, 0xd5, 0x83, 0xbd, 0x15, 0xab, 0x23, 0x8f, 0xe0, 0x3f, 0xd7,
+	0x50, 0x52, 0x69, 0xc9, 0xb3, 0xb6, 0xa2, 0x1d, 0x87, 0x9e, 0x35, 0xa0, 0xe7, 0x4e, 0xd5, 0x78,
+	0x5e, 0x0a, 0x5e, 0x9b, 0x70, 0xed, 0x86, 0x3b, 0xd5, 0x69, 0x8b, 0x93, 0x57, 0x5d, 0x89, 0x59,
+	0xc2, 0x5c, 0x89, 0x7f, 0x7b, 0xdd, 0xe0, 0xe8, 0x6f, 0x0c, 0x79, 0x0d, 0x23, 0x31, 0x37, 0x9a,
+	0x67, 0xe8, 0x3f, 0xae, 0x44, 0x8a, 0x92, 0xa7, 0xd7, 0xf6, 0xc1, 0x0f, 0x68, 0xd8, 0x32, 0xbc,
+	0x86, 0xce, 0x6d, 0xfe, 0xa4, 0x80, 0x48, 0xa8, 0x3c, 0x2e, 0xae, 0x25, 0xaa, 0x12, 0xb3, 0x1c,
+	0x55, 0x7c, 0xc9, 0x66, 0x8a, 0xa7, 0x6e, 0x40, 0x12, 0x51, 0x9d, 0xac, 0x30, 0x50, 0xfa, 0x95,
+	0xe5, 0xf8, 0xf9, 0x71, 0xce, 0x4d, 0x31, 0x9f, 0xc5, 0xa9, 0xa8, 0xa6, 0x9e, 0xc6, 0x74, 0xa1,
+	0xb1, 0xf8, 0xf9, 0xe9, 0x69, 0xa3, 0x31, 0x5b, 0xfc, 0x18, 0x9f, 0xfd, 0x1e, 0x00, 0x45, 0xcf,
+	0x6b, 0xa0, 0x3f, 0x05, 0x00, 0x00,
 }